@@ -0,0 +1,79 @@
+package stream
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// queryInt parses an integer query parameter, returning def when absent or invalid.
+func queryInt(r *http.Request, key string, def int) int {
+	i, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || i < 1 {
+		return def
+	}
+
+	return i
+}
+
+type searchResponse struct {
+	Query string  `json:"query"`
+	Files []Entry `json:"files"`
+	Shows []Entry `json:"shows"`
+}
+
+// apiSearch searches the names of all exposed files and TV shows.
+//
+// Query parameters: `q` (required) and `limit` (defaults to 50).
+func (h Stream) apiSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing query parameter `q`")
+		return
+	}
+
+	files, shows, err := h.Search(r.Context(), query, queryInt(r, "limit", 50))
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "search failed")
+		return
+	}
+
+	res := searchResponse{Query: query, Files: []Entry{}, Shows: []Entry{}}
+	res.Files = append(res.Files, files...)
+	res.Shows = append(res.Shows, shows...)
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// apiMedia returns the metadata parsed from the name of a file or folder.
+func (h Stream) apiMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	m, err := h.storage.Media(r.Context(), ps.ByName("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "no file or folder with this ID")
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not retrieve the metadata")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m)
+}
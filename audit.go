@@ -0,0 +1,258 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Audit configures the log of streaming sessions.
+type Audit struct {
+	Disabled bool
+	// Retention is how long sessions are kept, defaults to 90 days.
+	Retention time.Duration
+}
+
+// The reasons a streaming session ended.
+const (
+	ReasonComplete = "complete"
+	ReasonEPIPE    = "epipe"
+	ReasonReset    = "reset"
+	ReasonCancel   = "cancel"
+	ReasonError    = "error"
+)
+
+// A Session is a single streaming request of a file.
+type Session struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Client  string    `json:"client"`
+	Address string    `json:"address"`
+	FileID  string    `json:"file"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+
+	// RangeStart and RangeEnd are the requested bytes, of which Sent were served to the client.
+	RangeStart uint64 `json:"range_start"`
+	RangeEnd   uint64 `json:"range_end"`
+	Sent       int64  `json:"sent"`
+	// Upstream is the number of bytes read from Google Drive.
+	Upstream int64 `json:"upstream"`
+
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+
+	// size of the file, used to estimate the progress.
+	size int64
+}
+
+// The session table is the audit log of all streams, with times in milliseconds since the Unix epoch.
+const sqlSessionSchema = `
+CREATE TABLE IF NOT EXISTS session (
+	"id" text NOT NULL PRIMARY KEY,
+	"user" text NOT NULL,
+	"client" text NOT NULL,
+	"address" text NOT NULL,
+	"file" text NOT NULL,
+	"started" integer NOT NULL,
+	"ended" integer NOT NULL,
+	"range_start" integer NOT NULL,
+	"range_end" integer NOT NULL,
+	"sent" integer NOT NULL,
+	"upstream" integer NOT NULL,
+	"reason" text NOT NULL,
+	"error" text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS session_started ON session(started);
+CREATE INDEX IF NOT EXISTS session_file ON session(file);
+CREATE INDEX IF NOT EXISTS session_user ON session(user);
+`
+
+// sessionStore keeps the sessions of the audit log.
+type sessionStore interface {
+	RecordSession(ctx context.Context, ss Session, cutoff time.Time) error
+	Sessions(ctx context.Context, q SessionQuery) ([]Session, error)
+}
+
+func (s Store) createSessionTable() error {
+	_, err := s.DB.Exec(sqlSessionSchema)
+	return err
+}
+
+const sqlInsertSession = `
+INSERT INTO session (id, user, client, address, file, started, ended, range_start, range_end, sent, upstream, reason, error)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// RecordSession stores the session and removes the sessions which started before the retention cutoff.
+func (s Store) RecordSession(ctx context.Context, ss Session, cutoff time.Time) error {
+	_, err := s.DB.ExecContext(ctx, sqlInsertSession, ss.ID, ss.User, ss.Client, ss.Address, ss.FileID,
+		ss.Started.UnixNano()/int64(time.Millisecond), ss.Ended.UnixNano()/int64(time.Millisecond),
+		ss.RangeStart, ss.RangeEnd, ss.Sent, ss.Upstream, ss.Reason, ss.Error)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx, `DELETE FROM session WHERE started < ?`, cutoff.UnixNano()/int64(time.Millisecond))
+	return err
+}
+
+// A SessionQuery filters the sessions, empty fields match all sessions.
+type SessionQuery struct {
+	User   string
+	FileID string
+	Reason string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of sessions, all sessions are retrieved when zero.
+	Limit int
+}
+
+// Sessions retrieves the sessions matching the query, newest first.
+func (s Store) Sessions(ctx context.Context, q SessionQuery) (sessions []Session, err error) {
+	var where []string
+	var args []interface{}
+
+	for column, value := range map[string]string{"user": q.User, "file": q.FileID, "reason": q.Reason} {
+		if value != "" {
+			where = append(where, column+" = ?")
+			args = append(args, value)
+		}
+	}
+
+	if !q.Since.IsZero() {
+		where = append(where, "started >= ?")
+		args = append(args, q.Since.UnixNano()/int64(time.Millisecond))
+	}
+
+	if !q.Until.IsZero() {
+		where = append(where, "started < ?")
+		args = append(args, q.Until.UnixNano()/int64(time.Millisecond))
+	}
+
+	query := `SELECT id, user, client, address, file, started, ended, range_start, range_end, sent, upstream, reason, error FROM session`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	query += " ORDER BY started DESC, id DESC"
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		ss := Session{}
+		var started, ended int64
+
+		err := rows.Scan(&ss.ID, &ss.User, &ss.Client, &ss.Address, &ss.FileID, &started, &ended,
+			&ss.RangeStart, &ss.RangeEnd, &ss.Sent, &ss.Upstream, &ss.Reason, &ss.Error)
+		if err != nil {
+			return nil, err
+		}
+
+		ss.Started = time.Unix(0, started*int64(time.Millisecond))
+		ss.Ended = time.Unix(0, ended*int64(time.Millisecond))
+		sessions = append(sessions, ss)
+	}
+
+	return sessions, rows.Err()
+}
+
+// newSession starts the session of a streaming request.
+func newSession(r *http.Request, f ds.File, start, end uint64) Session {
+	return Session{
+		ID:         getRequestID(r.Context()),
+		User:       getUser(r.Context()),
+		Client:     r.UserAgent(),
+		Address:    r.RemoteAddr,
+		FileID:     f.ID,
+		size:       int64(f.Size),
+		Started:    time.Now(),
+		RangeStart: start,
+		RangeEnd:   end,
+		Reason:     ReasonComplete,
+	}
+}
+
+// endSession records the session in the audit log and updates the progress of the user.
+func (h Stream) endSession(ss Session) {
+	ss.Ended = time.Now()
+	h.updateProgress(ss)
+	h.live.remove(ss.ID)
+	h.events.Publish(EventSessionEnded, ss)
+
+	o := h.options()
+	if o.audit.Disabled {
+		return
+	}
+
+	// The request has ended, so its context can no longer be used.
+	err := h.store.RecordSession(context.Background(), ss, ss.Ended.Add(-o.audit.Retention))
+	if err != nil {
+		fmt.Printf("%s - could not record session: %v\n", ss.ID, err)
+	}
+}
+
+// countingWriter counts the bytes written to the client.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// apiSessions returns the streaming sessions, newest first.
+//
+// Query parameters: `user`, `file`, `reason`, `since` and `until` (RFC 3339) and `limit` (defaults to 100).
+func (h Stream) apiSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	query := SessionQuery{
+		User:   q.Get("user"),
+		FileID: q.Get("file"),
+		Reason: q.Get("reason"),
+		Limit:  queryInt(r, "limit", 100),
+	}
+
+	for param, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if q.Get(param) == "" {
+			continue
+		}
+
+		var err error
+		if *t, err = time.Parse(time.RFC3339, q.Get(param)); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("`%s` must be an RFC 3339 time", param))
+			return
+		}
+	}
+
+	sessions, err := h.store.Sessions(r.Context(), query)
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not retrieve the sessions")
+		return
+	}
+
+	if sessions == nil {
+		sessions = []Session{}
+	}
+
+	writeJSON(w, http.StatusOK, sessions)
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newAuditStream(t *testing.T, audit Audit) (Stream, Store) {
+	store := newSyncedStore(t, nil, nil)
+	return NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Audit: audit}), store
+}
+
+// Sessions which started before the retention are removed whenever a session is recorded.
+func TestAuditRetention(t *testing.T) {
+	ctx := context.Background()
+	s, store := newAuditStream(t, Audit{Retention: 24 * time.Hour})
+
+	now := time.Now()
+	for i, started := range []time.Time{now.Add(-48 * time.Hour), now.Add(-25 * time.Hour), now.Add(-time.Hour)} {
+		ss := Session{ID: fmt.Sprintf("old%d", i), FileID: "f1", Started: started, Ended: started, Reason: ReasonComplete}
+		if err := store.RecordSession(ctx, ss, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.endSession(Session{ID: "new", FileID: "f1", Started: now, Reason: ReasonCancel})
+
+	sessions, err := store.Sessions(ctx, SessionQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 2 || sessions[0].ID != "new" || sessions[1].ID != "old2" {
+		t.Errorf("sessions after the retention = %+v, want new and old2", sessions)
+	}
+
+	// Nothing is recorded or removed while the audit log is disabled.
+	s.Reload(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Audit: Audit{Disabled: true, Retention: time.Nanosecond}})
+	s.endSession(Session{ID: "disabled", FileID: "f1", Started: now})
+
+	if sessions, err := store.Sessions(ctx, SessionQuery{}); err != nil || len(sessions) != 2 {
+		t.Errorf("sessions with a disabled audit log = %+v, %v", sessions, err)
+	}
+}
+
+// The API returns the newest sessions up to the limit, 100 when the limit is missing or invalid.
+func TestAuditLimit(t *testing.T) {
+	ctx := context.Background()
+	s, store := newAuditStream(t, Audit{})
+	h := s.Handler()
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 120; i++ {
+		user := "kodi"
+		if i%2 == 1 {
+			user = "plex"
+		}
+
+		started := start.Add(time.Duration(i) * time.Second)
+		ss := Session{ID: fmt.Sprintf("s%03d", i), User: user, FileID: "f1", Started: started, Ended: started, Reason: ReasonComplete}
+		if err := store.RecordSession(ctx, ss, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sessions, err := store.Sessions(ctx, SessionQuery{}); err != nil || len(sessions) != 120 {
+		t.Errorf("Sessions without a limit returned %d sessions, %v, want all 120", len(sessions), err)
+	}
+
+	tests := []struct {
+		query string
+		count int
+		first string
+	}{
+		{"", 100, "s119"},
+		{"?limit=3", 3, "s119"},
+		{"?limit=0", 100, "s119"},
+		{"?limit=-1", 100, "s119"},
+		{"?limit=many", 100, "s119"},
+		{"?limit=500", 120, "s119"},
+		{"?user=kodi&limit=5", 5, "s118"},
+		{"?user=kodi", 60, "s118"},
+		{"?until=" + start.Add(10*time.Second).Format(time.RFC3339), 10, "s009"},
+	}
+
+	for _, tt := range tests {
+		res := serve(h, "GET", "/api/sessions"+tt.query, nil)
+
+		var sessions []Session
+		if err := json.NewDecoder(res.Body).Decode(&sessions); err != nil {
+			t.Fatalf("GET /api/sessions%s: %v", tt.query, err)
+		}
+
+		if len(sessions) != tt.count || len(sessions) > 0 && sessions[0].ID != tt.first {
+			t.Errorf("GET /api/sessions%s returned %d sessions, want %d starting with %s", tt.query, len(sessions), tt.count, tt.first)
+		}
+	}
+
+	if res := serve(h, "GET", "/api/sessions?since=yesterday", nil); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /api/sessions?since=yesterday: status %d, want 400", res.StatusCode)
+	}
+}
@@ -0,0 +1,173 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+)
+
+// The folder closure materialises every ancestor of every folder,
+// so the files within a library are found without walking the folders on every request.
+//
+// Hidden is set when the descendant or a folder in between is trashed,
+// in which case the descendant is not exposed within the ancestor.
+const sqlClosureSchema = `
+CREATE TABLE IF NOT EXISTS folder_closure (
+	"ancestor" text NOT NULL,
+	"descendant" text NOT NULL,
+	"depth" integer NOT NULL,
+	"hidden" boolean NOT NULL,
+	PRIMARY KEY(ancestor, descendant)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS folder_closure_descendant ON folder_closure(descendant);
+`
+
+func (s Store) createClosureTable() error {
+	if _, err := s.DB.Exec(sqlClosureSchema); err != nil {
+		return err
+	}
+
+	// Databases created before the closure existed are materialised right away.
+	var rows int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM folder_closure`).Scan(&rows); err != nil {
+		return err
+	}
+
+	if rows > 0 {
+		return nil
+	}
+
+	return s.RebuildClosure(context.Background())
+}
+
+// sqlInsertClosure walks from the selected folders up to the root of their drive.
+const sqlInsertClosure = `
+WITH RECURSIVE up(ancestor, descendant, depth, hidden) AS (
+	SELECT id, id, 0, 0 FROM folder WHERE %s
+	UNION ALL
+	SELECT folder.parent, up.descendant, up.depth + 1, up.hidden OR folder.trashed
+	FROM up JOIN folder ON folder.id = up.ancestor
+	WHERE folder.parent IS NOT NULL
+)
+INSERT OR REPLACE INTO folder_closure (ancestor, descendant, depth, hidden)
+SELECT ancestor, descendant, depth, hidden FROM up
+`
+
+// RebuildClosure replaces the folder closure with the current folders.
+func (s Store) RebuildClosure(ctx context.Context) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		`DELETE FROM folder_closure`,
+		fmt.Sprintf(sqlInsertClosure, "1"),
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateClosure updates the folder closure after the given folders were changed or removed.
+//
+// The ancestors of the folders and of everything within them are determined again,
+// as moving or trashing a folder affects all of its descendants.
+func (s Store) UpdateClosure(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Temporary tables belong to the connection of the transaction.
+	setup := []string{
+		`CREATE TEMP TABLE IF NOT EXISTS closure_changed (id text PRIMARY KEY)`,
+		`DELETE FROM closure_changed`,
+	}
+
+	for _, statement := range setup {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO closure_changed (id) VALUES (?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer insert.Close()
+	for _, id := range ids {
+		if _, err := insert.ExecContext(ctx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	statements := []string{
+		`INSERT OR IGNORE INTO closure_changed (id)
+			SELECT descendant FROM folder_closure WHERE ancestor IN (SELECT id FROM closure_changed)`,
+		`DELETE FROM folder_closure WHERE descendant IN (SELECT id FROM closure_changed)`,
+		fmt.Sprintf(sqlInsertClosure, "id IN (SELECT id FROM closure_changed)"),
+		`DELETE FROM closure_changed`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Ancestors retrieves the IDs of the folder and all of its parents, nearest folder first.
+func (s Store) Ancestors(ctx context.Context, id string) (ids []string, err error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT ancestor FROM folder_closure WHERE descendant = ? ORDER BY depth`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var ancestor string
+		if err := rows.Scan(&ancestor); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, ancestor)
+	}
+
+	return ids, rows.Err()
+}
+
+// removedChange describes a removed file or folder as it is before the removal is saved.
+// Unknown items are returned without a name or ancestors.
+func (s Store) removedChange(ctx context.Context, id string) Change {
+	c := Change{ID: id, Removed: true}
+
+	if f, err := s.FileByID(ctx, id); err == nil {
+		c.Name, c.parent = f.Name, f.Parent
+	} else if folders, err := s.Parents(ctx, id); err == nil && len(folders) > 0 {
+		c.Name, c.Folder, c.parent = folders[0].Name, true, folders[0].Parent
+	}
+
+	if c.parent != "" {
+		c.Ancestors, _ = s.Ancestors(ctx, c.parent)
+	}
+
+	return c
+}
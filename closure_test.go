@@ -0,0 +1,141 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// closureRows returns all rows of the folder closure, ordered by ancestor and descendant.
+func closureRows(t *testing.T, store Store) []string {
+	rows, err := store.DB.Query(`SELECT ancestor, descendant, depth, hidden FROM folder_closure ORDER BY ancestor, descendant`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	var closure []string
+	for rows.Next() {
+		var ancestor, descendant string
+		var depth int
+		var hidden bool
+
+		if err := rows.Scan(&ancestor, &descendant, &depth, &hidden); err != nil {
+			t.Fatal(err)
+		}
+
+		closure = append(closure, fmt.Sprintf("%s>%s %d %t", ancestor, descendant, depth, hidden))
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return closure
+}
+
+// Updating the closure after partial syncs gives the same rows as rebuilding it.
+func TestUpdateClosure(t *testing.T) {
+	ctx := context.Background()
+	drive := ds.Drive{ID: "drive", Name: "Drive"}
+
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "a", Name: "A", Parent: "films"},
+		{ID: "a1", Name: "A1", Parent: "a"},
+		{ID: "a2", Name: "A2", Parent: "a1"},
+		{ID: "b", Name: "B", Parent: "films"},
+		{ID: "x", Name: "X", Parent: "films"},
+		{ID: "x1", Name: "X1", Parent: "x"},
+		{ID: "s", Name: "S", Parent: "shows"},
+		{ID: "s1", Name: "S1", Parent: "s"},
+	}, []ds.File{
+		{ID: "f1", Name: "F1.mkv", Parent: "a2"},
+	})
+
+	changes := []struct {
+		name    string
+		folders []ds.Folder
+		removed []string
+		want    map[string]string
+	}{
+		{"move, trash, remove and add", []ds.Folder{
+			{ID: "a1", Name: "A1", Parent: "b"},
+			{ID: "s", Name: "S", Parent: "shows", Trashed: true},
+			{ID: "n", Name: "N", Parent: "a2"},
+		}, []string{"x1", "x"}, map[string]string{
+			"a2": "a2 a1 b films drive",
+			"n":  "n a2 a1 b films drive",
+			"x1": "",
+		}},
+		{"restore and move into the trash", []ds.Folder{
+			{ID: "s", Name: "S", Parent: "shows"},
+			{ID: "b", Name: "B", Parent: "s1"},
+		}, nil, map[string]string{
+			"n": "n a2 a1 b s1 s shows drive",
+		}},
+		{"trash within a trashed folder", []ds.Folder{
+			{ID: "s", Name: "S", Parent: "shows", Trashed: true},
+			{ID: "a1", Name: "A1", Parent: "b", Trashed: true},
+		}, nil, map[string]string{
+			"a2": "a2 a1 b s1 s shows drive",
+		}},
+	}
+
+	for _, c := range changes {
+		if err := store.PartialSync(drive, c.folders, nil, c.removed); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		ids := append([]string(nil), c.removed...)
+		for _, f := range c.folders {
+			ids = append(ids, f.ID)
+		}
+
+		if err := store.UpdateClosure(ctx, ids); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		for id, want := range c.want {
+			ancestors, err := store.Ancestors(ctx, id)
+			if err != nil || strings.Join(ancestors, " ") != want {
+				t.Errorf("%s: Ancestors(%s) = %v, %v, want %q", c.name, id, ancestors, err, want)
+			}
+		}
+
+		updated := closureRows(t, store)
+		if err := store.RebuildClosure(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		rebuilt := closureRows(t, store)
+		if strings.Join(updated, "\n") != strings.Join(rebuilt, "\n") {
+			t.Errorf("%s: updated closure\n%s\nwant the rebuilt closure\n%s", c.name, strings.Join(updated, "\n"), strings.Join(rebuilt, "\n"))
+		}
+	}
+
+	// Everything within a trashed folder is hidden from the ancestors of the trashed folder only.
+	hidden := map[string]bool{}
+	for _, row := range closureRows(t, store) {
+		if strings.HasSuffix(row, "true") {
+			hidden[strings.Fields(row)[0]] = true
+		}
+	}
+
+	for _, row := range []string{"shows>s1", "drive>n", "b>a2", "s1>n"} {
+		if !hidden[row] {
+			t.Errorf("%s is not hidden", row)
+		}
+	}
+
+	for _, row := range []string{"s>s1", "a1>n", "s1>b"} {
+		if hidden[row] {
+			t.Errorf("%s is hidden", row)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream"
+	"github.com/m-rots/stream/parse"
+)
+
+// browser answers questions about the local index with the same queries as the WebDAV server.
+type browser struct {
+	ctx     context.Context
+	stream  stream.Stream
+	store   stream.Store
+	baseURL string
+	json    bool
+	out     io.Writer
+}
+
+func newBrowser(configPath *string, name string, args []string) (*browser, []string) {
+	fs := newFlagSet(name, configPath)
+	asJSON := fs.Bool("json", false, "print the output as JSON")
+	baseURL := fs.String("url", "", "base URL of the server (defaults to http://localhost:<port>)")
+	args = parseInterspersed(fs, args)
+
+	c := mustLoadConfig(*configPath)
+	if *baseURL == "" {
+		*baseURL = fmt.Sprintf("http://localhost:%d", c.Port)
+	}
+
+	store := mustOpenStore(c)
+
+	streamConf := c.streamConfig()
+	streamConf.Store = store
+
+	return &browser{
+		ctx:     context.Background(),
+		stream:  stream.NewStream(streamConf),
+		store:   store,
+		baseURL: strings.TrimSuffix(*baseURL, "/"),
+		json:    *asJSON,
+		out:     os.Stdout,
+	}, args
+}
+
+func (b *browser) close() {
+	b.store.Close()
+}
+
+// exitOnError reports the problem and exits, closing the store first as exiting skips the deferred close.
+func (b *browser) exitOnError(err error) {
+	if err == nil {
+		return
+	}
+
+	b.close()
+	if p, ok := err.(problem); ok {
+		ifErrorThenExit(p.err, p.msg, p.help)
+	}
+
+	ifErrorThenExit(err, "could not read the database", nil)
+}
+
+func (b *browser) printJSON(v interface{}) {
+	fprintJSON(b.out, v)
+}
+
+func printJSON(v interface{}) {
+	fprintJSON(os.Stdout, v)
+}
+
+func fprintJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (b *browser) printEntries(entries []stream.Entry) {
+	if b.json {
+		if entries == nil {
+			entries = []stream.Entry{}
+		}
+
+		b.printJSON(entries)
+		return
+	}
+
+	w := tabwriter.NewWriter(b.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tID")
+
+	for _, e := range entries {
+		size := "-"
+		if !e.Folder {
+			size = humanize.Bytes(uint64(e.Size))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Name, size, e.ID)
+	}
+
+	w.Flush()
+}
+
+func lsCommand(configPath *string, args []string) {
+	b, args := newBrowser(configPath, "ls", args)
+	defer b.close()
+
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Println("usage: stream ls <films|shows> [show]")
+		os.Exit(2)
+	}
+
+	entries, err := b.ls(args)
+	b.exitOnError(err)
+	b.printEntries(entries)
+}
+
+// ls lists a library, or the episodes of a TV show.
+func (b *browser) ls(args []string) (entries []stream.Entry, err error) {
+	library := strings.Trim(args[0], "/")
+
+	switch {
+	case library == "films" && len(args) == 1:
+		entries, err = b.stream.Films(b.ctx)
+	case library == "shows" && len(args) == 1:
+		entries, err = b.stream.Shows(b.ctx)
+	case library == "shows":
+		var show ds.Folder
+		show, err = b.findShow(args[1])
+		if err == nil {
+			entries, err = b.stream.Episodes(b.ctx, show)
+		}
+	default:
+		return nil, problem{
+			err:  fmt.Errorf("unknown path `%s`", strings.Join(args, "/")),
+			msg:  "the films library does not contain folders",
+			help: []string{"run `stream ls films` to list the films"},
+		}
+	}
+
+	if err != nil {
+		return nil, problem{err, "could not list the library", []string{
+			"run `stream ls shows` to list the available TV shows",
+		}}
+	}
+
+	return entries, nil
+}
+
+// findShow matches a TV show by its WebDAV name, name or ID.
+func (b *browser) findShow(name string) (ds.Folder, error) {
+	name = strings.Trim(name, "/")
+
+	shows, err := b.stream.Shows(b.ctx)
+	if err != nil {
+		return ds.Folder{}, err
+	}
+
+	for _, show := range shows {
+		if strings.HasSuffix(show.Href, "/"+name) || show.Name == name || show.ID == name {
+			return ds.Folder{ID: show.ID, Name: show.Name}, nil
+		}
+	}
+
+	return ds.Folder{}, fmt.Errorf("no TV show named `%s`", name)
+}
+
+type treeNode struct {
+	stream.Entry
+	Children []treeNode `json:"children,omitempty"`
+}
+
+func treeCommand(configPath *string, args []string) {
+	b, _ := newBrowser(configPath, "tree", args)
+	defer b.close()
+
+	root, err := b.tree()
+	b.exitOnError(err)
+
+	if b.json {
+		b.printJSON(root)
+		return
+	}
+
+	printTree(b.out, root, "")
+}
+
+// tree lists both libraries with the files of every renamed film and the episodes of every TV show.
+func (b *browser) tree() ([]treeNode, error) {
+	films, err := b.stream.Films(b.ctx)
+	if err != nil {
+		return nil, problem{err, "could not list the films", nil}
+	}
+
+	shows, err := b.stream.Shows(b.ctx)
+	if err != nil {
+		return nil, problem{err, "could not list the TV shows", nil}
+	}
+
+	root := []treeNode{
+		{Entry: stream.Entry{Href: "/films/", Name: "films", Folder: true}},
+		{Entry: stream.Entry{Href: "/shows/", Name: "shows", Folder: true}},
+	}
+
+	for _, f := range films {
+		node := treeNode{Entry: f}
+
+		// Renamed films are placed in a folder of their own.
+		if f.Folder {
+			p, _ := url.PathUnescape(f.Href)
+			files, err := b.store.AliasFiles(b.ctx, p)
+			if err != nil {
+				return nil, problem{err, fmt.Sprintf("could not list the files of `%s`", f.Name), nil}
+			}
+
+			for _, file := range files {
+				node.Children = append(node.Children, treeNode{Entry: file})
+			}
+		}
+
+		root[0].Children = append(root[0].Children, node)
+	}
+
+	for _, show := range shows {
+		episodes, err := b.stream.Episodes(b.ctx, ds.Folder{ID: show.ID, Name: show.Name})
+		if err != nil {
+			return nil, problem{err, fmt.Sprintf("could not list the episodes of `%s`", show.Name), nil}
+		}
+
+		node := treeNode{Entry: show}
+		for _, e := range episodes {
+			node.Children = append(node.Children, treeNode{Entry: e})
+		}
+
+		root[1].Children = append(root[1].Children, node)
+	}
+
+	return root, nil
+}
+
+func printTree(w io.Writer, nodes []treeNode, indent string) {
+	for i, n := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+
+		if n.Folder {
+			fmt.Fprintf(w, "%s%s%s/\n", indent, branch, n.Name)
+		} else {
+			fmt.Fprintf(w, "%s%s%s (%s)\n", indent, branch, n.Name, humanize.Bytes(uint64(n.Size)))
+		}
+
+		printTree(w, n.Children, indent+next)
+	}
+}
+
+type findResult struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	Size int    `json:"size,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+func findCommand(configPath *string, args []string) {
+	b, args := newBrowser(configPath, "find", args)
+	defer b.close()
+
+	if len(args) != 1 {
+		fmt.Println("usage: stream find <pattern>")
+		os.Exit(2)
+	}
+
+	results, err := b.find(args[0])
+	b.exitOnError(err)
+
+	if b.json {
+		b.printJSON(results)
+		return
+	}
+
+	w := tabwriter.NewWriter(b.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tSIZE\tID\tURL")
+
+	for _, r := range results {
+		size, url := "-", "not exposed"
+		if r.Kind == "file" {
+			size = humanize.Bytes(uint64(r.Size))
+		}
+
+		if r.URL != "" {
+			url = r.URL
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Kind, r.Name, size, r.ID, url)
+	}
+
+	w.Flush()
+}
+
+// find searches the files and folders by name, with the URLs of those which are exposed.
+func (b *browser) find(pattern string) ([]findResult, error) {
+	files, folders, err := b.store.Find(b.ctx, pattern)
+	if err != nil {
+		return nil, problem{err, "could not search the database", nil}
+	}
+
+	results := []findResult{}
+	for _, f := range folders {
+		parents, err := b.store.Parents(b.ctx, f.Parent)
+		if err != nil {
+			return nil, problem{err, fmt.Sprintf("could not retrieve the parents of `%s`", f.ID), nil}
+		}
+
+		r := findResult{Kind: "folder", Name: f.Name, ID: f.ID}
+		if href, ok := b.stream.FolderHref(b.ctx, f, parents); ok {
+			r.URL = b.baseURL + href
+		}
+
+		results = append(results, r)
+	}
+
+	for _, f := range files {
+		parents, err := b.store.Parents(b.ctx, f.Parent)
+		if err != nil {
+			return nil, problem{err, fmt.Sprintf("could not retrieve the parents of `%s`", f.ID), nil}
+		}
+
+		r := findResult{Kind: "file", Name: f.Name, ID: f.ID, Size: f.Size}
+		if href, ok := b.stream.Href(b.ctx, f, parents); ok {
+			r.URL = b.baseURL + href
+		}
+
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+type fileInfo struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Size    int          `json:"size"`
+	MD5     string       `json:"md5"`
+	Trashed bool         `json:"trashed"`
+	Parents []folderInfo `json:"parents"`
+	URL     string       `json:"url,omitempty"`
+	Media   *parse.Media `json:"media,omitempty"`
+}
+
+type folderInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Trashed bool   `json:"trashed"`
+}
+
+func infoCommand(configPath *string, args []string) {
+	b, args := newBrowser(configPath, "info", args)
+	defer b.close()
+
+	if len(args) != 1 {
+		fmt.Println("usage: stream info <file-id>")
+		os.Exit(2)
+	}
+
+	info, parents, err := b.info(args[0])
+	b.exitOnError(err)
+
+	if b.json {
+		b.printJSON(info)
+		return
+	}
+
+	// print the parents from the root of the drive to the file
+	chain := make([]string, len(parents))
+	for i, p := range parents {
+		name := fmt.Sprintf("%s [%s]", p.Name, p.ID)
+		if p.Trashed {
+			name += " (trashed)"
+		}
+
+		chain[len(parents)-1-i] = name
+	}
+
+	url := info.URL
+	if url == "" {
+		url = "not exposed"
+	}
+
+	w := tabwriter.NewWriter(b.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "ID:\t%s\n", info.ID)
+	fmt.Fprintf(w, "Size:\t%s (%d bytes)\n", humanize.Bytes(uint64(info.Size)), info.Size)
+	fmt.Fprintf(w, "MD5:\t%s\n", info.MD5)
+	fmt.Fprintf(w, "Trashed:\t%t\n", info.Trashed)
+	fmt.Fprintf(w, "Path:\t%s\n", strings.Join(append(chain, info.Name), " / "))
+	fmt.Fprintf(w, "WebDAV:\t%s\n", url)
+
+	if m := info.Media; m != nil {
+		fmt.Fprintf(w, "Title:\t%s\n", m.Title)
+
+		fields := []struct {
+			name  string
+			value interface{}
+			empty bool
+		}{
+			{"Year", m.Year, m.Year == 0},
+			{"Season", m.Season, m.Season == 0},
+			{"Episode", episodeRange(*m), !m.IsEpisode()},
+			{"Resolution", m.Resolution, m.Resolution == ""},
+			{"Source", m.Source, m.Source == ""},
+			{"Codec", m.Codec, m.Codec == ""},
+			{"Edition", m.Edition, m.Edition == ""},
+			{"Group", m.Group, m.Group == ""},
+		}
+
+		for _, field := range fields {
+			if !field.empty {
+				fmt.Fprintf(w, "%s:\t%v\n", field.name, field.value)
+			}
+		}
+	}
+
+	w.Flush()
+}
+
+// info retrieves the details of a file and its parents, closest first.
+func (b *browser) info(id string) (info fileInfo, parents []ds.Folder, err error) {
+	f, err := b.store.FileByID(b.ctx, id)
+	if err != nil {
+		return info, nil, problem{err, fmt.Sprintf("could not find file `%s`", id), []string{
+			"use `stream find <pattern>` to look up the ID of a file",
+		}}
+	}
+
+	parents, err = b.store.Parents(b.ctx, f.Parent)
+	if err != nil {
+		return info, nil, problem{err, fmt.Sprintf("could not retrieve the parents of `%s`", f.ID), nil}
+	}
+
+	info = fileInfo{
+		ID:      f.ID,
+		Name:    f.Name,
+		Size:    f.Size,
+		MD5:     f.MD5,
+		Trashed: f.Trashed,
+		Parents: make([]folderInfo, len(parents)),
+	}
+
+	for i, p := range parents {
+		info.Parents[i] = folderInfo{ID: p.ID, Name: p.Name, Trashed: p.Trashed}
+	}
+
+	if href, ok := b.stream.Href(b.ctx, f, parents); ok {
+		info.URL = b.baseURL + href
+	}
+
+	if m, err := b.store.Media(b.ctx, f.ID); err == nil {
+		info.Media = &m
+	}
+
+	return info, parents, nil
+}
+
+func episodeRange(m parse.Media) string {
+	if m.EpisodeEnd > m.Episode {
+		return fmt.Sprintf("%d-%d", m.Episode, m.EpisodeEnd)
+	}
+
+	return fmt.Sprint(m.Episode)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream"
+)
+
+// newTestBrowser creates a browser of a database with two films and a TV show, which writes to the buffer.
+func newTestBrowser(t *testing.T) (*browser, *bytes.Buffer) {
+	store, err := stream.NewStore(filepath.Join(tempDir(t), "stream.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+
+	folders := []ds.Folder{
+		{ID: "drive", Name: "Drive"},
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+		{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+		{ID: "dark", Name: "Dark (2017)", Parent: "shows"},
+		{ID: "dark1", Name: "Season 1", Parent: "dark"},
+		{ID: "extras", Name: "Extras", Parent: "drive"},
+	}
+
+	files := []ds.File{
+		{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 4000, MD5: "a"},
+		{ID: "f2", Name: "Inception (2010).mkv", Parent: "inception", Size: 2000, MD5: "b"},
+		{ID: "e1", Name: "Dark S01E01.mkv", Parent: "dark1", Size: 300, MD5: "c"},
+		{ID: "x1", Name: "Heat Trailer.mkv", Parent: "extras", Size: 10, MD5: "d"},
+	}
+
+	if err := store.FullSync(ds.Drive{ID: "drive", Name: "Drive"}, folders, files); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables derived from the files are updated after every sync.
+	ctx := context.Background()
+	for _, update := range []func(context.Context) error{store.RebuildClosure, store.RebuildSearchIndex, store.UpdateMedia} {
+		if err := update(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := stream.NewStream(stream.Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	return &browser{
+		ctx:     ctx,
+		stream:  s,
+		store:   store,
+		baseURL: "http://localhost:3000",
+		out:     out,
+	}, out
+}
+
+func TestBrowseList(t *testing.T) {
+	b, out := newTestBrowser(t)
+
+	films, err := b.ls([]string{"films"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(films) != 2 || films[0].Name != "Heat (1995).mkv" || films[1].Name != "Inception (2010).mkv" {
+		t.Errorf("ls films = %+v", films)
+	}
+
+	b.printEntries(films)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[0], "NAME") || !strings.Contains(lines[1], "4.0 kB") {
+		t.Errorf("printed films:\n%s", out)
+	}
+
+	// A TV show is found by its name or ID.
+	for _, name := range []string{"Dark (2017)", "dark"} {
+		episodes, err := b.ls([]string{"shows", name})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(episodes) != 1 || episodes[0].ID != "e1" {
+			t.Errorf("ls shows %s = %+v", name, episodes)
+		}
+	}
+
+	if _, err := b.ls([]string{"shows", "Lost"}); err == nil {
+		t.Error("ls of an unknown TV show did not fail")
+	}
+
+	if _, err := b.ls([]string{"films", "Heat"}); err == nil {
+		t.Error("ls of a folder in the films library did not fail")
+	}
+}
+
+func TestBrowseTree(t *testing.T) {
+	b, out := newTestBrowser(t)
+	b.json = true
+
+	root, err := b.tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.printJSON(root)
+
+	var decoded []treeNode
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 2 || len(decoded[0].Children) != 2 || len(decoded[1].Children) != 1 {
+		t.Fatalf("tree = %+v", decoded)
+	}
+
+	if show := decoded[1].Children[0]; show.Name != "Dark (2017)" || len(show.Children) != 1 || show.Children[0].ID != "e1" {
+		t.Errorf("TV show in the tree = %+v", show)
+	}
+
+	out.Reset()
+	printTree(out, root, "")
+	if want := "└── shows/\n    └── Dark (2017)/\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("printed tree does not contain %q:\n%s", want, out)
+	}
+}
+
+func TestBrowseFind(t *testing.T) {
+	b, _ := newTestBrowser(t)
+
+	results, err := b.find("heat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := map[string]string{}
+	for _, r := range results {
+		urls[r.ID] = r.URL
+	}
+
+	if len(results) != 3 {
+		t.Errorf("find heat = %+v, want the folder, the film and the trailer", results)
+	}
+
+	if !strings.HasPrefix(urls["f1"], "http://localhost:3000/films/") {
+		t.Errorf("URL of the film = %q", urls["f1"])
+	}
+
+	// Files outside the libraries are found, but not exposed.
+	if url, ok := urls["x1"]; !ok || url != "" {
+		t.Errorf("URL of the trailer = %q (found %v), want it found without a URL", url, ok)
+	}
+}
+
+func TestBrowseInfo(t *testing.T) {
+	b, _ := newTestBrowser(t)
+
+	info, parents, err := b.info("e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Name != "Dark S01E01.mkv" || info.Size != 300 || len(parents) != 4 || parents[0].ID != "dark1" {
+		t.Errorf("info e1 = %+v with parents %+v", info, parents)
+	}
+
+	if !strings.HasPrefix(info.URL, "http://localhost:3000/shows/") {
+		t.Errorf("URL of the episode = %q", info.URL)
+	}
+
+	if info.Media == nil || info.Media.Season != 1 || !info.Media.IsEpisode() {
+		t.Errorf("media of the episode = %+v", info.Media)
+	}
+
+	if _, _, err := b.info("missing"); err == nil {
+		t.Error("info of a missing file did not fail")
+	}
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/m-rots/stream"
+	"github.com/m-rots/stubbs"
+	"gopkg.in/yaml.v2"
+)
+
+type config struct {
+	AuthPath     string `yaml:"auth"`
+	DatabasePath string `yaml:"database"`
+	Storage      string `yaml:"storage"`
+	Port         int    `yaml:"port"`
+	DriveID      string `yaml:"drive"`
+	Depth        int    `yaml:"depth"`
+	FilmsID      string `yaml:"films"`
+	ShowsID      string `yaml:"shows"`
+
+	Extensions []string          `yaml:"extensions"`
+	Users      map[string]string `yaml:"users"`
+	Limits     limits            `yaml:"limits"`
+	Recent     int               `yaml:"recent"`
+	Continue   int               `yaml:"continue"`
+	Proxies    []string          `yaml:"trusted_proxies"`
+	Rename     rename            `yaml:"rename"`
+	Versions   versions          `yaml:"versions"`
+	NFO        nfo               `yaml:"nfo"`
+	Dedupe     dedupe            `yaml:"dedupe"`
+	Audit      audit             `yaml:"audit"`
+	Webhooks   []webhook         `yaml:"webhooks"`
+	Sources    []source          `yaml:"sources"`
+	Server     server            `yaml:"server"`
+
+	// SyncInterval is the time between partial syncs while serving.
+	// Periodic syncs are disabled when zero.
+	SyncInterval time.Duration `yaml:"sync_interval"`
+}
+
+// server configures the timeouts of the HTTP server.
+// Reading the request headers and idle keep-alive connections are limited,
+// but responses are not as streams can take hours to complete.
+type server struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+}
+
+type rename struct {
+	Enabled bool   `yaml:"enabled"`
+	Film    string `yaml:"film"`
+	Episode string `yaml:"episode"`
+}
+
+type versions struct {
+	Group       bool     `yaml:"group"`
+	Best        bool     `yaml:"best"`
+	Resolutions []string `yaml:"resolutions"`
+	Codecs      []string `yaml:"codecs"`
+	Smallest    bool     `yaml:"smallest"`
+}
+
+type nfo struct {
+	Enabled bool   `yaml:"enabled"`
+	Artwork string `yaml:"artwork"`
+}
+
+type dedupe struct {
+	Films bool `yaml:"films"`
+	Shows bool `yaml:"shows"`
+}
+
+type audit struct {
+	Disabled  bool          `yaml:"disabled"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type webhook struct {
+	URL       string   `yaml:"url"`
+	Libraries []string `yaml:"libraries"`
+	Secret    string   `yaml:"secret"`
+	Preset    string   `yaml:"preset"`
+	Path      string   `yaml:"path"`
+	// Retries defaults to 3 when omitted.
+	Retries *int `yaml:"retries"`
+}
+
+// source mounts directories, or the prefixes of a bucket, into the films and shows folders.
+type source struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Films string `yaml:"films"`
+	Shows string `yaml:"shows"`
+
+	// The remaining fields only apply to the `s3` type.
+	Endpoint    string `yaml:"endpoint"`
+	Region      string `yaml:"region"`
+	Bucket      string `yaml:"bucket"`
+	AccessKey   string `yaml:"access_key"`
+	SecretKey   string `yaml:"secret_key"`
+	VirtualHost bool   `yaml:"virtual_host"`
+}
+
+type limits struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// defaultConfigPath is used when neither the `--config` flag nor `STREAM_CONFIG` is set.
+const defaultConfigPath = "./config.yml"
+
+// loadConfig decodes the YAML config file and applies the environment variable overrides.
+func loadConfig(path string) (c config, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return c, err
+	}
+
+	defer file.Close()
+
+	c.Server = server{
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+	}
+
+	decoder := yaml.NewDecoder(file)
+	decoder.SetStrict(true)
+	if err = decoder.Decode(&c); err != nil {
+		return c, err
+	}
+
+	err = c.applyEnv()
+	return c, err
+}
+
+// applyEnv overrides config values with their `STREAM_*` environment variables.
+func (c *config) applyEnv() error {
+	texts := map[string]*string{
+		"STREAM_AUTH":     &c.AuthPath,
+		"STREAM_DATABASE": &c.DatabasePath,
+		"STREAM_DRIVE":    &c.DriveID,
+		"STREAM_FILMS":    &c.FilmsID,
+		"STREAM_SHOWS":    &c.ShowsID,
+	}
+
+	for key, field := range texts {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	ints := map[string]*int{
+		"STREAM_PORT":  &c.Port,
+		"STREAM_DEPTH": &c.Depth,
+	}
+
+	for key, field := range ints {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		*field = i
+	}
+
+	return nil
+}
+
+// streamConfig converts the config into a Stream config.
+func (c config) streamConfig() stream.Config {
+	webhooks := make([]stream.Webhook, len(c.Webhooks))
+	for i, wh := range c.Webhooks {
+		webhooks[i] = stream.Webhook{
+			URL:       wh.URL,
+			Libraries: wh.Libraries,
+			Secret:    wh.Secret,
+			Preset:    wh.Preset,
+			Path:      wh.Path,
+			Retries:   3,
+		}
+
+		if wh.Retries != nil {
+			webhooks[i].Retries = *wh.Retries
+		}
+	}
+
+	return stream.Config{
+		DriveID:    c.DriveID,
+		Sources:    c.sources(),
+		Depth:      c.Depth,
+		FilmsID:    c.FilmsID,
+		ShowsID:    c.ShowsID,
+		Extensions: c.Extensions,
+		Users:      c.Users,
+		Limits: stream.Limits{
+			Rate:  c.Limits.Rate,
+			Burst: c.Limits.Burst,
+		},
+		Recent:         c.Recent,
+		Continue:       c.Continue,
+		TrustedProxies: c.Proxies,
+		Rename: stream.Rename{
+			Enabled: c.Rename.Enabled,
+			Film:    c.Rename.Film,
+			Episode: c.Rename.Episode,
+		},
+		Versions: stream.Versions{
+			Group:       c.Versions.Group,
+			Best:        c.Versions.Best,
+			Resolutions: c.Versions.Resolutions,
+			Codecs:      c.Versions.Codecs,
+			Smallest:    c.Versions.Smallest,
+		},
+		NFO: stream.NFO{
+			Enabled: c.NFO.Enabled,
+			Artwork: c.NFO.Artwork,
+		},
+		Dedupe: stream.Dedupe{
+			Films: c.Dedupe.Films,
+			Shows: c.Dedupe.Shows,
+		},
+		Audit: stream.Audit{
+			Disabled:  c.Audit.Disabled,
+			Retention: c.Audit.Retention,
+		},
+		Webhooks: webhooks,
+	}
+}
+
+// sources creates the sources next to the Shared Drive.
+func (c config) sources() (sources []stream.Source) {
+	for _, src := range c.Sources {
+		var mounts []stream.Mount
+		if src.Films != "" {
+			mounts = append(mounts, stream.Mount{Folder: c.FilmsID, Path: src.Films})
+		}
+
+		if src.Shows != "" {
+			mounts = append(mounts, stream.Mount{Folder: c.ShowsID, Path: src.Shows})
+		}
+
+		if src.Type == "s3" {
+			sources = append(sources, stream.NewS3Source(src.Name, stream.S3Config{
+				Endpoint:    src.Endpoint,
+				Region:      src.Region,
+				Bucket:      src.Bucket,
+				AccessKey:   src.AccessKey,
+				SecretKey:   src.SecretKey,
+				VirtualHost: src.VirtualHost,
+			}, mounts...))
+
+			continue
+		}
+
+		sources = append(sources, stream.NewLocalSource(src.Name, mounts...))
+	}
+
+	return sources
+}
+
+// hasSource reports whether a source with the name is configured.
+func (c config) hasSource(name string) bool {
+	for _, src := range c.Sources {
+		if src.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A problem is a single validation error together with some help on how to resolve it.
+type problem struct {
+	err  error
+	msg  string
+	help []string
+}
+
+var driveIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validate checks the config and returns every problem it finds.
+func (c config) validate() (problems []problem) {
+	ids := []struct {
+		field string
+		value string
+	}{
+		{"films", c.FilmsID},
+		{"shows", c.ShowsID},
+	}
+
+	// The Shared Drive is optional when the libraries are served from other sources.
+	if c.DriveID != "" || len(c.Sources) == 0 {
+		if _, _, err := loadServiceAccount(c.AuthPath); err != nil {
+			problems = append(problems, err.(problem))
+		}
+
+		ids = append([]struct {
+			field string
+			value string
+		}{{"drive", c.DriveID}}, ids...)
+	}
+
+	for _, id := range ids {
+		if !driveIDPattern.MatchString(id.value) {
+			problems = append(problems, problem{
+				err: fmt.Errorf("invalid ID %q", id.value),
+				msg: fmt.Sprintf("the `%s` field does not contain a valid Google Drive ID", id.field),
+				help: []string{
+					"copy the last part of the URL of the folder in the Google Drive WebUI",
+					"https://drive.google.com/drive/u/0/folders/<here is the ID>",
+				},
+			})
+		}
+	}
+
+	if c.FilmsID != "" && c.FilmsID == c.ShowsID {
+		problems = append(problems, problem{
+			err: fmt.Errorf("both are set to %q", c.FilmsID),
+			msg: "the `films` and `shows` fields point to the same folder",
+			help: []string{
+				"make sure the `films` and `shows` fields contain the IDs of different folders",
+			},
+		})
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("port %d is out of range", c.Port),
+			msg: "the `port` field does not contain a valid port",
+			help: []string{
+				"choose a port between 1 and 65535, such as 3000",
+			},
+		})
+	}
+
+	if c.Depth < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("depth %d is negative", c.Depth),
+			msg: "the `depth` field cannot be negative",
+			help: []string{
+				"set `depth` to 1 if your TV Show folders are direct children of the `shows` folder, 0 also defaults to 1",
+				"add 1 for each additional folder in between",
+			},
+		})
+	}
+
+	if c.Limits.Rate < 0 || c.Limits.Burst < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("rate %v and burst %d", c.Limits.Rate, c.Limits.Burst),
+			msg: "the `limits` field cannot contain negative values",
+			help: []string{
+				"remove the `limits` field to use the default rate of 10 requests per second",
+			},
+		})
+	}
+
+	if _, err := stream.ParseProxies(c.Proxies); err != nil {
+		problems = append(problems, problem{
+			err: err,
+			msg: "the `trusted_proxies` field contains an invalid proxy",
+			help: []string{
+				"list the IP addresses or CIDR ranges of your reverse proxies, such as `127.0.0.1` or `10.0.0.0/8`",
+			},
+		})
+	}
+
+	if c.Server.ReadHeaderTimeout < 0 || c.Server.IdleTimeout < 0 || c.Server.ShutdownTimeout < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("read_header_timeout %v, idle_timeout %v and shutdown_timeout %v", c.Server.ReadHeaderTimeout, c.Server.IdleTimeout, c.Server.ShutdownTimeout),
+			msg: "the `server` field cannot contain negative timeouts",
+			help: []string{
+				"use durations such as `10s`, `2m` or `1h`",
+			},
+		})
+	}
+
+	if err := c.streamConfig().Rename.Validate(); err != nil {
+		problems = append(problems, problem{
+			err: err,
+			msg: "the `rename` field contains an invalid template",
+			help: []string{
+				"templates use the Go template syntax, such as `{{.Title}} ({{.Year}})`",
+				"a `/` creates a folder, at most one folder can be created",
+			},
+		})
+	}
+
+	if c.NFO.Artwork != "" {
+		if info, err := os.Stat(c.NFO.Artwork); err != nil || !info.IsDir() {
+			problems = append(problems, problem{
+				err: fmt.Errorf("artwork %q is not a directory", c.NFO.Artwork),
+				msg: "the `artwork` field of `nfo` must point to an existing directory",
+				help: []string{
+					"create the directory or remove the field to disable artwork",
+				},
+			})
+		}
+	}
+
+	if c.Audit.Retention < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("retention %v is negative", c.Audit.Retention),
+			msg: "the `retention` field of `audit` cannot be negative",
+			help: []string{
+				"use a duration such as `720h` for 30 days, sessions are kept for 90 days by default",
+			},
+		})
+	}
+
+	if c.Storage != "" && c.Storage != "sqlite" && c.Storage != "memory" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("unknown storage %q", c.Storage),
+			msg: "the `storage` field must be either `sqlite` or `memory`",
+			help: []string{
+				"remove the field to serve the libraries from the database",
+			},
+		})
+	}
+
+	for i, wh := range c.Webhooks {
+		problems = append(problems, wh.validate(i)...)
+	}
+
+	names := map[string]bool{c.DriveID: true}
+	for i, src := range c.Sources {
+		problems = append(problems, src.validate(i, names)...)
+		names[src.Name] = true
+	}
+
+	if c.SyncInterval < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("sync_interval %v is negative", c.SyncInterval),
+			msg: "the `sync_interval` field cannot be negative",
+			help: []string{
+				"use a duration such as `5m`, or remove the field to disable periodic syncs",
+			},
+		})
+	}
+
+	return problems
+}
+
+// validate checks the source at the given index of the `sources` field.
+// The names of the drive and the preceding sources are taken.
+func (src source) validate(i int, taken map[string]bool) (problems []problem) {
+	if !driveIDPattern.MatchString(src.Name) || taken[src.Name] {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has an invalid name %q", i+1, src.Name),
+			msg: "the `name` field of every source must be unique and only contain letters, digits, `-` and `_`",
+			help: []string{
+				"the name identifies the files of the source in the database, such as `nas`",
+			},
+		})
+	}
+
+	if src.Type != "local" && src.Type != "s3" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has an unknown type %q", i+1, src.Type),
+			msg: "the `type` field of a source must be `local` or `s3`",
+			help: []string{
+				"use `local` to serve the files of directories on this server",
+				"use `s3` to serve the objects of a bucket, such as on MinIO, Backblaze B2 or Wasabi",
+			},
+		})
+	}
+
+	if src.Films == "" && src.Shows == "" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has no directories", i+1),
+			msg: "a source needs a `films` or `shows` directory",
+			help: []string{
+				"set `films` or `shows` to the directory placed in that library",
+				"for buckets, use the prefix of the objects, such as `media/films`",
+			},
+		})
+	}
+
+	if src.Type == "s3" {
+		return append(problems, src.validateS3(i)...)
+	}
+
+	for field, dir := range map[string]string{"films": src.Films, "shows": src.Shows} {
+		if dir == "" {
+			continue
+		}
+
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problems = append(problems, problem{
+				err: fmt.Errorf("source %d: %q is not a directory", i+1, dir),
+				msg: fmt.Sprintf("the `%s` field of a source must point to an existing directory", field),
+				help: []string{
+					"make sure the directory exists and is readable by Stream",
+				},
+			})
+		}
+	}
+
+	return problems
+}
+
+// validateS3 checks the bucket of the source at the given index.
+func (src source) validateS3(i int) (problems []problem) {
+	if u, err := url.Parse(src.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has an invalid endpoint %q", i+1, src.Endpoint),
+			msg: "the `endpoint` field of an s3 source must be an absolute HTTP or HTTPS URL",
+			help: []string{
+				"use the URL of the service, such as `http://minio:9000` or `https://s3.eu-central-003.backblazeb2.com`",
+			},
+		})
+	}
+
+	if src.Bucket == "" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has no bucket", i+1),
+			msg: "the `bucket` field of an s3 source is required",
+		})
+	}
+
+	if src.AccessKey == "" || src.SecretKey == "" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("source %d has no credentials", i+1),
+			msg: "the `access_key` and `secret_key` fields of an s3 source are required",
+			help: []string{
+				"create a read-only key for the bucket, as Stream only lists and reads objects",
+			},
+		})
+	}
+
+	return problems
+}
+
+// validate checks the webhook at the given index of the `webhooks` field.
+func (wh webhook) validate(i int) (problems []problem) {
+	if u, err := url.Parse(wh.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, problem{
+			err: fmt.Errorf("webhook %d has an invalid url %q", i+1, wh.URL),
+			msg: "the `url` field of every webhook must be an absolute HTTP or HTTPS URL",
+			help: []string{
+				"use a URL such as `http://kodi:8080/jsonrpc`",
+			},
+		})
+	}
+
+	if wh.Preset != "" && wh.Preset != stream.PresetKodi && wh.Preset != stream.PresetPlex {
+		problems = append(problems, problem{
+			err: fmt.Errorf("webhook %d has an unknown preset %q", i+1, wh.Preset),
+			msg: "the `preset` field of a webhook must be either `kodi` or `plex`",
+			help: []string{
+				"remove the field to receive the changes as JSON",
+			},
+		})
+	}
+
+	for _, library := range wh.Libraries {
+		if library != "films" && library != "shows" {
+			problems = append(problems, problem{
+				err: fmt.Errorf("webhook %d has an unknown library %q", i+1, library),
+				msg: "the `libraries` field of a webhook can only contain `films` and `shows`",
+				help: []string{
+					"remove the field to receive the changes of both libraries",
+				},
+			})
+		}
+	}
+
+	if wh.Retries != nil && *wh.Retries < 0 {
+		problems = append(problems, problem{
+			err: fmt.Errorf("webhook %d has %d retries", i+1, *wh.Retries),
+			msg: "the `retries` field of a webhook cannot be negative",
+			help: []string{
+				"use 0 to disable retries, failed requests are retried 3 times by default",
+			},
+		})
+	}
+
+	return problems
+}
+
+func (p problem) Error() string {
+	return p.err.Error()
+}
+
+type serviceAccount struct {
+	Email      string `json:"client_email"`
+	PrivateKey string `json:"private_key"`
+}
+
+var authHelp = []string{
+	"make sure the `auth` field in your config file",
+	"points to an existing JSON service account key file",
+}
+
+// loadServiceAccount reads the service account key file and returns its authenticator and email address.
+// Any error returned is a problem.
+func loadServiceAccount(path string) (*stubbs.Stubbs, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", problem{err, fmt.Sprintf("could not open `%s`", path), authHelp}
+	}
+
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	sa := new(serviceAccount)
+
+	err = decoder.Decode(sa)
+	if err != nil {
+		return nil, "", problem{err, fmt.Sprintf("invalid JSON syntax in `%s`", path), authHelp}
+	}
+
+	priv, err := stubbs.ParseKey(sa.PrivateKey)
+	if err != nil {
+		return nil, "", problem{err, fmt.Sprintf("invalid private key in `%s`", path), authHelp}
+	}
+
+	scopes := []string{"https://www.googleapis.com/auth/drive.readonly"}
+	return stubbs.New(sa.Email, &priv, scopes, 3600), sa.Email, nil
+}
+
+// configPollInterval is how often watchConfig checks whether the config file was modified.
+var configPollInterval = 5 * time.Second
+
+// watchConfig reloads the config file whenever it is modified or a signal is received on reload,
+// until the context is cancelled.
+//
+// Only valid configs are passed to apply.
+// The file is polled as the file system notifications differ too much between platforms.
+func watchConfig(ctx context.Context, path string, reload <-chan os.Signal, apply func(config)) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+
+		return info.ModTime()
+	}
+
+	last := modTime()
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := modTime()
+			if current.Equal(last) {
+				continue
+			}
+
+			last = current
+		case <-reload:
+			last = modTime()
+		}
+
+		c, err := loadConfig(path)
+		if err != nil {
+			printError(err, "could not reload the config file, keeping the current config", []string{
+				fmt.Sprintf("make sure `%s` contains valid YAML syntax", path),
+			})
+			continue
+		}
+
+		if problems := c.validate(); len(problems) > 0 {
+			for _, p := range problems {
+				printError(p.err, p.msg, p.help)
+			}
+
+			fmt.Println("Keeping the current config until the problems above are resolved.")
+			continue
+		}
+
+		apply(c)
+	}
+}
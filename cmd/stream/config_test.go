@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tempDir creates a temporary directory, which is removed after the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeFile writes the file in the directory and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// writeServiceAccount writes a service account key file with a new private key.
+func writeServiceAccount(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := json.Marshal(serviceAccount{
+		Email:      "stream@example.iam.gserviceaccount.com",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeFile(t, dir, "account.json", string(sa))
+}
+
+// setEnv sets the environment variable until the end of the test.
+func setEnv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+const testConfig = `
+auth: %s
+database: stream.db
+port: 3000
+drive: drive
+depth: 1
+films: films
+shows: shows
+extensions: [mkv, .MP4]
+users:
+  kodi: change-me
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir := tempDir(t)
+	path := writeFile(t, dir, "config.yml", strings.Replace(testConfig, "%s", "account.json", 1))
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 3000 || c.DriveID != "drive" || c.FilmsID != "films" || c.Users["kodi"] != "change-me" || len(c.Extensions) != 2 {
+		t.Errorf("loadConfig = %+v", c)
+	}
+
+	if c.Server.ShutdownTimeout != 30*time.Second {
+		t.Errorf("shutdown timeout %v, want the default of 30s", c.Server.ShutdownTimeout)
+	}
+
+	if _, err := loadConfig(writeFile(t, dir, "unknown.yml", "port: 3000\nunknown: true\n")); err == nil {
+		t.Error("loadConfig accepted an unknown field")
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.yml")); !os.IsNotExist(err) {
+		t.Errorf("loadConfig of a missing file = %v, want a not exist error", err)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	dir := tempDir(t)
+	path := writeFile(t, dir, "config.yml", strings.Replace(testConfig, "%s", "account.json", 1))
+
+	setEnv(t, "STREAM_PORT", "8080")
+	setEnv(t, "STREAM_SHOWS", "tv")
+	setEnv(t, "STREAM_DATABASE", "")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 8080 || c.ShowsID != "tv" || c.DatabasePath != "" {
+		t.Errorf("environment overrides not applied: port %d, shows %q, database %q", c.Port, c.ShowsID, c.DatabasePath)
+	}
+
+	// Fields without an environment variable keep their value.
+	if c.FilmsID != "films" || c.Depth != 1 {
+		t.Errorf("films %q and depth %d changed without an override", c.FilmsID, c.Depth)
+	}
+
+	setEnv(t, "STREAM_DEPTH", "deep")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "STREAM_DEPTH") {
+		t.Errorf("loadConfig with an invalid STREAM_DEPTH = %v, want an error naming it", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := tempDir(t)
+	auth := writeServiceAccount(t, dir)
+
+	c, err := loadConfig(writeFile(t, dir, "config.yml", strings.Replace(testConfig, "%s", auth, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := c.validate(); len(problems) > 0 {
+		t.Fatalf("valid config has problems: %v", problems)
+	}
+
+	// Depth 0 defaults to 1.
+	c.Depth = 0
+	if problems := c.validate(); len(problems) > 0 {
+		t.Errorf("depth 0 has problems: %v", problems)
+	}
+
+	c.AuthPath = filepath.Join(dir, "missing.json")
+	c.DriveID = "not a drive"
+	c.ShowsID = c.FilmsID
+	c.Port = 70000
+	c.Depth = -1
+	c.Limits.Rate = -1
+
+	problems := c.validate()
+	for _, msg := range []string{"could not open", "`drive`", "same folder", "`port`", "`depth`", "`limits`"} {
+		found := false
+		for _, p := range problems {
+			found = found || strings.Contains(p.msg, msg)
+		}
+
+		if !found {
+			t.Errorf("no problem about %s in %v", msg, problems)
+		}
+	}
+
+	if len(problems) != 6 {
+		t.Errorf("validate found %d problems, want all 6 at once: %v", len(problems), problems)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	interval := configPollInterval
+	configPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { configPollInterval = interval })
+
+	dir := tempDir(t)
+	auth := writeServiceAccount(t, dir)
+	path := writeFile(t, dir, "config.yml", strings.Replace(testConfig, "%s", auth, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan os.Signal, 1)
+	applied := make(chan config, 1)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		watchConfig(ctx, path, reload, func(c config) { applied <- c })
+	}()
+
+	// The watcher starts from the modification time of the file as it is now.
+	time.Sleep(5 * configPollInterval)
+
+	// The modification time of the file is checked, so it is moved forward explicitly.
+	modify := func(content string) {
+		writeFile(t, dir, "config.yml", content)
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := func() (config, bool) {
+		select {
+		case c := <-applied:
+			return c, true
+		case <-time.After(500 * time.Millisecond):
+			return config{}, false
+		}
+	}
+
+	modify(strings.Replace(strings.Replace(testConfig, "%s", auth, 1), "depth: 1", "depth: 2", 1))
+	if c, ok := next(); !ok || c.Depth != 2 {
+		t.Fatalf("modified config applied = %v with depth %d, want depth 2", ok, c.Depth)
+	}
+
+	// Invalid configs are never applied.
+	modify(strings.Replace(strings.Replace(testConfig, "%s", auth, 1), "port: 3000", "port: 0", 1))
+	if c, ok := next(); ok {
+		t.Errorf("invalid config applied: %+v", c)
+	}
+
+	reload <- syscall.SIGHUP
+	if _, ok := next(); ok {
+		t.Error("invalid config applied on SIGHUP")
+	}
+
+	writeFile(t, dir, "config.yml", strings.Replace(testConfig, "%s", auth, 1))
+	reload <- syscall.SIGHUP
+	if c, ok := next(); !ok || c.Depth != 1 {
+		t.Errorf("config applied on SIGHUP = %v with depth %d, want depth 1", ok, c.Depth)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("watchConfig did not stop after the context was cancelled")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/m-rots/stream"
+)
+
+func duplicatesCommand(configPath *string, args []string) {
+	b, args := newBrowser(configPath, "duplicates", args)
+	defer b.close()
+
+	libraries := []string{"films", "shows"}
+	if len(args) > 0 {
+		libraries = args
+	}
+
+	var reports []stream.DuplicateReport
+	for _, library := range libraries {
+		if library != "films" && library != "shows" {
+			fmt.Println("usage: stream duplicates [films|shows]")
+			os.Exit(2)
+		}
+
+		report, err := b.stream.Duplicates(b.ctx, library)
+		ifErrorThenExit(err, fmt.Sprintf("could not find the duplicates of the %s", library), nil)
+
+		reports = append(reports, report)
+	}
+
+	if b.json {
+		b.printJSON(reports)
+		return
+	}
+
+	for i, report := range reports {
+		if i > 0 {
+			fmt.Println()
+		}
+
+		fmt.Printf("%s: %d duplicate group(s), %s wasted\n", report.Library, len(report.Groups), humanize.Bytes(uint64(report.Wasted)))
+		if len(report.Groups) == 0 {
+			continue
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MD5\tSIZE\tCOPY\tNAME\tID")
+
+		for _, g := range report.Groups {
+			for j, f := range g.Files {
+				// The first file is the preferred copy.
+				copy := "keep"
+				if j > 0 {
+					copy = "duplicate"
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", g.MD5, humanize.Bytes(uint64(g.Size)), copy, f.Name, f.ID)
+			}
+		}
+
+		w.Flush()
+	}
+}
@@ -1,146 +1,177 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"net/http"
 	"os"
-	"time"
 
 	"github.com/logrusorgru/aurora/v3"
 	lowe "github.com/m-rots/bernard"
-	ds "github.com/m-rots/bernard/datastore"
-	"github.com/m-rots/stream"
-	"github.com/m-rots/stubbs"
-	"gopkg.in/yaml.v2"
 )
 
-type config struct {
-	AuthPath     string `yaml:"auth"`
-	DatabasePath string `yaml:"database"`
-	Port         int    `yaml:"port"`
-	DriveID      string `yaml:"drive"`
-	Depth        int    `yaml:"depth"`
-	FilmsID      string `yaml:"films"`
-	ShowsID      string `yaml:"shows"`
-}
+const usage = `Usage: stream [--config path] <command> [flags]
+
+Commands:
+  serve [--no-sync]                       synchronise and start the server (default)
+  sync [--full|--partial] [--drive id]    synchronise and exit
+  reset [--drive id]                      remove a drive from the database
+  status                                  print the synchronisation state of each drive
+  ls <films|shows> [show] [--json]        list the contents of a library
+  tree [--json]                           print all libraries as a tree
+  find <pattern> [--json]                 search files and folders by name
+  info <file-id> [--json]                 print the details of a file
+  duplicates [films|shows] [--json]       report files with the same MD5 and the space they waste
+  share <file-id> [--expires 24h]         create a signed link to a file without credentials
+  share list | share revoke <share-id>    list or revoke the signed links
+  metadata import [--replace] <file>      import a JSON or CSV metadata dataset for NFO files
+  config validate                         check the config file and report all problems
+
+The config path defaults to $STREAM_CONFIG or ./config.yml.
+`
 
 func main() {
-	file, err := os.Open("./config.yml")
-	ifErrorThenExit(err,
-		"could not open `config.yml`",
-		[]string{
-			"you can create a `config.yml` file in the current directory",
-		},
-	)
-
-	c := config{}
-	decoder := yaml.NewDecoder(file)
-	decoder.SetStrict(true)
-	err = decoder.Decode(&c)
-	ifErrorThenExit(err,
-		"invalid config file / missing values",
-		[]string{
-			"make sure your `config.yml` file contains valid YAML syntax",
-			"and provides all required fields",
-		},
-	)
-
-	auth := newAuth(c.AuthPath, []string{"https://www.googleapis.com/auth/drive.readonly"})
-
-	store, err := stream.NewStore(c.DatabasePath)
-	if err != nil {
-		panic(err)
+	configPath := flag.String("config", configPathFromEnv(), "path to the config file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
 	}
+	flag.Parse()
 
-	streamConf := stream.Config{
-		Depth:   c.Depth,
-		FilmsID: c.FilmsID,
-		ShowsID: c.ShowsID,
+	command, args := "serve", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
-		Auth:  auth,
-		Store: store,
+	switch command {
+	case "serve":
+		serveCommand(configPath, args)
+	case "sync":
+		syncCommand(configPath, args)
+	case "reset":
+		resetCommand(configPath, args)
+	case "status":
+		statusCommand(configPath, args)
+	case "ls":
+		lsCommand(configPath, args)
+	case "tree":
+		treeCommand(configPath, args)
+	case "find":
+		findCommand(configPath, args)
+	case "info":
+		infoCommand(configPath, args)
+	case "duplicates":
+		duplicatesCommand(configPath, args)
+	case "share":
+		shareCommand(configPath, args)
+	case "metadata":
+		metadataCommand(configPath, args)
+	case "config":
+		configCommand(configPath, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
+}
 
-	s := stream.NewStream(streamConf)
-	bernard := lowe.New(auth, store, lowe.WithSafeSleep(0*time.Minute))
+// newFlagSet creates the flags of a command.
+// The `--config` flag can be given before as well as after the command.
+func newFlagSet(name string, configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("stream "+name, flag.ExitOnError)
+	fs.StringVar(configPath, "config", *configPath, "path to the config file")
+	return fs
+}
 
-	_, err = store.PageToken(c.DriveID)
-	if err != nil {
-		if !errors.Is(err, ds.ErrFullSync) {
-			ifErrorThenExit(err,
-				"unexpected error while fetching pageToken from Bernard",
-				[]string{
-					"please open an issue in the github repo",
-					"something went terribly wrong :(",
-				},
-			)
+// parseInterspersed parses the flags of a command, which may be given before or after its arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) (positional []string) {
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
 		}
 
-		// print info on 2 minute safe sync
-		fmt.Printf("%s not synchronised yet, starting synchronisation...\n", c.DriveID)
-		err = bernard.FullSync(c.DriveID)
-		handleSyncError(c, err)
-	} else {
-		fmt.Println("Performing partial sync...")
-		err = bernard.PartialSync(c.DriveID)
-		handleSyncError(c, err)
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
 	}
+}
 
-	fmt.Println("Finished synchronisation!")
-	fmt.Printf("Stream listening on port %d\n", c.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", c.Port), s.Handler())
+func configCommand(configPath *string, args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fs := newFlagSet("config validate", configPath)
+	fs.Parse(args[1:])
+
+	mustValidConfig(*configPath)
+	fmt.Printf("%s `%s` is valid\n", aurora.BrightGreen("ok:"), *configPath)
 }
 
-type serviceAccount struct {
-	Email      string `json:"client_email"`
-	PrivateKey string `json:"private_key"`
+func configPathFromEnv() string {
+	if path, ok := os.LookupEnv("STREAM_CONFIG"); ok {
+		return path
+	}
+
+	return defaultConfigPath
 }
 
-func newAuth(path string, scopes []string) *stubbs.Stubbs {
-	file, err := os.Open(path)
+// mustLoadConfig loads the config file and exits when it cannot be parsed.
+func mustLoadConfig(path string) config {
+	c, err := loadConfig(path)
+	if os.IsNotExist(err) {
+		ifErrorThenExit(err,
+			fmt.Sprintf("could not open `%s`", path),
+			[]string{
+				"you can create a `config.yml` file in the current directory",
+				"or point to another file with `--config` or `STREAM_CONFIG`",
+			},
+		)
+	}
+
 	ifErrorThenExit(err,
-		fmt.Sprintf("could not open `%s`", path),
+		"invalid config file / missing values",
 		[]string{
-			"make sure the `auth` field in your config file",
-			"points to an existing JSON service account key file",
+			fmt.Sprintf("make sure your `%s` file contains valid YAML syntax", path),
+			"and provides all required fields",
 		},
 	)
 
-	decoder := json.NewDecoder(file)
-	sa := new(serviceAccount)
+	return c
+}
 
-	err = decoder.Decode(sa)
-	ifErrorThenExit(err,
-		fmt.Sprintf("invalid JSON syntax in `%s`", path),
-		[]string{
-			"make sure the `auth` field in your config file",
-			"points to an existing JSON service account key file",
-		},
-	)
+// mustValidConfig loads the config file and exits after reporting all of its problems.
+func mustValidConfig(path string) config {
+	c := mustLoadConfig(path)
 
-	priv, err := stubbs.ParseKey(sa.PrivateKey)
-	ifErrorThenExit(err,
-		fmt.Sprintf("invalid private key in `%s`", path),
-		[]string{
-			"make sure the `auth` field in your config file",
-			"points to an existing JSON service account key file",
-		},
-	)
+	problems := c.validate()
+	for _, p := range problems {
+		printError(p.err, p.msg, p.help)
+	}
 
-	return stubbs.New(sa.Email, &priv, scopes, 3600)
+	if len(problems) > 0 {
+		fmt.Printf("%s\n", aurora.Bold(fmt.Sprintf("found %d problem(s) in `%s`", len(problems), path)))
+		os.Exit(1)
+	}
+
+	return c
 }
 
-func ifErrorThenExit(err error, msg string, help []string) {
-	if err != nil {
-		fmt.Printf("%s%s\n", aurora.BrightRed("error"), aurora.Bold(": "+msg))
-		fmt.Printf("  ---> %s\n", err.Error())
+func printError(err error, msg string, help []string) {
+	fmt.Printf("%s%s\n", aurora.BrightRed("error"), aurora.Bold(": "+msg))
+	fmt.Printf("  ---> %s\n", err.Error())
 
+	if len(help) > 0 {
 		fmt.Printf("\n  %s\n", aurora.Bold("help:"))
 		for _, h := range help {
 			fmt.Printf("  %s\n", h)
 		}
+	}
+	fmt.Println()
+}
+
+func ifErrorThenExit(err error, msg string, help []string) {
+	if err != nil {
+		printError(err, msg, help)
 		os.Exit(1)
 	}
 }
@@ -169,7 +200,7 @@ func handleSyncError(c config, err error) {
 	}
 
 	ifErrorThenExit(err,
-		"unexpected error while performing full-sync",
+		"unexpected error while performing synchronisation",
 		[]string{
 			"¯\\_(ツ)_/¯",
 		},
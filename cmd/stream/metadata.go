@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/m-rots/stream"
+)
+
+func metadataCommand(configPath *string, args []string) {
+	if len(args) == 0 || args[0] != "import" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fs := newFlagSet("metadata import", configPath)
+	replace := fs.Bool("replace", false, "remove all previously imported metadata first")
+	positional := parseInterspersed(fs, args[1:])
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: stream metadata import [--replace] <file.json|file.csv>")
+		os.Exit(2)
+	}
+
+	path := positional[0]
+	c := mustLoadConfig(*configPath)
+
+	file, err := os.Open(path)
+	ifErrorThenExit(err,
+		fmt.Sprintf("could not open `%s`", path),
+		nil,
+	)
+	defer file.Close()
+
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	items, err := stream.ReadDataset(file, format)
+	ifErrorThenExit(err,
+		fmt.Sprintf("could not read the dataset `%s`", path),
+		[]string{
+			"datasets are JSON arrays or CSV files with a header row",
+			"every item needs a `type` of `film` or `show` and a `title`",
+		},
+	)
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	err = store.ImportMetadata(context.Background(), items, *replace)
+	ifErrorThenExit(err,
+		"could not import the dataset into the database",
+		[]string{
+			"make sure no other Stream process is using the database",
+		},
+	)
+
+	fmt.Printf("Imported %d items from %s.\n", len(items), path)
+}
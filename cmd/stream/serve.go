@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/m-rots/stream"
+)
+
+func serveCommand(configPath *string, args []string) {
+	fs := newFlagSet("serve", configPath)
+	noSync := fs.Bool("no-sync", false, "start the server without synchronising first")
+	fs.Parse(args)
+
+	path := *configPath
+	c := mustValidConfig(path)
+
+	streamConf := c.streamConfig()
+	if c.DriveID != "" {
+		auth, account, err := loadServiceAccount(c.AuthPath)
+		if err != nil {
+			p := err.(problem)
+			ifErrorThenExit(p.err, p.msg, p.help)
+		}
+
+		streamConf.Auth = auth
+		streamConf.Account = account
+	}
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	// Exiting skips the deferred Close, so the store is closed before.
+	exitOnError := func(err error, msg string, help []string) {
+		if err != nil {
+			store.Close()
+			ifErrorThenExit(err, msg, help)
+		}
+	}
+
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	streamConf.Store = store
+
+	// The memory storage is reloaded before the libraries are refreshed.
+	var after []func(context.Context) error
+	if c.Storage == "memory" {
+		memory := stream.NewMemoryStorage()
+		load := func(ctx context.Context) error {
+			return memory.Load(ctx, store)
+		}
+
+		err := load(ctx)
+		exitOnError(err, "could not load the files and folders into memory", nil)
+
+		streamConf.Storage = memory
+		after = append(after, load)
+	}
+
+	s := stream.NewStream(streamConf)
+	syncer := stream.NewSyncer(store, append(after, s.Refresh)...).WithNotify(s.Notify).WithEvents(s.Events())
+	sources := s.Sources()
+
+	if !*noSync {
+		synced := make(chan error, 1)
+		go func() {
+			synced <- syncer.SyncAll(ctx, stream.SyncAuto, sources...)
+		}()
+
+		select {
+		case err := <-synced:
+			if err != nil {
+				store.Close()
+				handleSyncError(c, err)
+			}
+
+			fmt.Println("Finished synchronisation!")
+		case <-ctx.Done():
+			// A source stops right away unless it is committing its changes, after which
+			// the sync is finished so the changes are never saved without their derived tables.
+			fmt.Println("Waiting for the synchronisation to stop, press Ctrl+C again to exit right away...")
+
+			if err := <-synced; err == nil {
+				fmt.Println("Finished synchronisation!")
+			}
+
+			flushWebhooks(s, c.Server.ShutdownTimeout)
+			return
+		}
+	} else {
+		err := s.Refresh(ctx)
+		exitOnError(err, "could not prepare the libraries", []string{
+			"check the `rename` templates in your config file",
+		})
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// current is the last applied config, which the next reload is compared with.
+	current := c
+	go watchConfig(ctx, path, reload, func(next config) {
+		if next.AuthPath != current.AuthPath || next.DatabasePath != current.DatabasePath || next.Storage != current.Storage ||
+			next.Port != current.Port || next.DriveID != current.DriveID || next.Server != current.Server ||
+			next.SyncInterval != current.SyncInterval || !reflect.DeepEqual(next.Sources, current.Sources) {
+			fmt.Println("Changes to `auth`, `database`, `storage`, `port`, `drive`, `sources`, `server` and `sync_interval` require a restart.")
+		}
+
+		s.Reload(next.streamConfig())
+		current = next
+
+		if err := s.Refresh(ctx); err != nil {
+			fmt.Printf("could not prepare the libraries: %v\n", err)
+			return
+		}
+
+		fmt.Println("Reloaded config!")
+	})
+
+	syncing := make(chan struct{})
+	go func() {
+		defer close(syncing)
+		if c.SyncInterval > 0 {
+			syncer.Run(ctx, c.SyncInterval, sources...)
+		}
+	}()
+
+	srv := newServer(c, s)
+	listening := make(chan error, 1)
+	go func() {
+		listening <- srv.ListenAndServe()
+	}()
+
+	fmt.Printf("Stream listening on port %d\n", c.Port)
+
+	select {
+	case err := <-listening:
+		exitOnError(err,
+			fmt.Sprintf("could not listen on port %d", c.Port),
+			[]string{
+				"make sure no other programme is using this port",
+				"or choose another port in your config file",
+			},
+		)
+	case <-ctx.Done():
+	}
+
+	fmt.Printf("Shutting down, waiting up to %v for active streams to finish...\n", c.Server.ShutdownTimeout)
+	shutdown(srv, c.Server.ShutdownTimeout)
+
+	// The store is only closed once the running sync has finished.
+	select {
+	case <-syncing:
+	default:
+		fmt.Println("Waiting for the synchronisation to finish, press Ctrl+C again to exit right away...")
+		<-syncing
+	}
+
+	flushWebhooks(s, c.Server.ShutdownTimeout)
+	fmt.Println("Stream has shut down.")
+}
+
+// newServer creates the HTTP server of Stream.
+// Event streams never end by themselves, so they are closed when shutting down.
+func newServer(c config, s stream.Stream) *http.Server {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", c.Port),
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+		IdleTimeout:       c.Server.IdleTimeout,
+	}
+
+	srv.RegisterOnShutdown(s.Events().Close)
+	return srv
+}
+
+// shutdown stops accepting new connections and waits up to the timeout for the active ones to finish.
+// Once the timeout passes, the remaining streams are closed.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(deadline); err != nil {
+		fmt.Println("Closing the remaining streams.")
+		srv.Close()
+	}
+}
+
+// flushWebhooks waits up to the timeout for the queued webhooks to be delivered.
+func flushWebhooks(s stream.Stream, timeout time.Duration) {
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.FlushWebhooks(deadline); err != nil {
+		fmt.Println("Cancelling the remaining webhooks.")
+	}
+}
+
+// shutdownContext returns a context which is cancelled on SIGINT or SIGTERM.
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+
+		signal.Stop(shutdown)
+	}()
+
+	return ctx, cancel
+}
+
+func mustOpenStore(c config) stream.Store {
+	store, err := stream.NewStore(c.DatabasePath)
+	ifErrorThenExit(err,
+		fmt.Sprintf("could not open the database `%s`", c.DatabasePath),
+		[]string{
+			"make sure the `database` field in your config file",
+			"points to a writable location",
+		},
+	)
+
+	return store
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream"
+)
+
+// slowSource writes the first half of a file, and the second half once it is released.
+type slowSource struct {
+	content []byte
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s slowSource) ID() string {
+	return "slow"
+}
+
+func (s slowSource) Sync(context.Context, stream.Store, bool) ([]stream.Change, error) {
+	return nil, nil
+}
+
+func (s slowSource) Range(_ context.Context, w io.Writer, _ string, start, end uint64) (int64, error) {
+	half := start + (end-start+1)/2
+	n, err := w.Write(s.content[start:half])
+	if err != nil {
+		return int64(n), err
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	close(s.reading)
+	<-s.release
+
+	m, err := w.Write(s.content[half : end+1])
+	return int64(n + m), err
+}
+
+// Shutting down lets the active streams finish, and closes the event streams which never end by themselves.
+func TestShutdown(t *testing.T) {
+	store, err := stream.NewStore(filepath.Join(tempDir(t), "stream.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	memory := stream.NewMemoryStorage()
+	memory.Replace(stream.Items{
+		Folders: []ds.Folder{{ID: "films", Name: "Films"}, {ID: "heat", Name: "Heat (1995)", Parent: "films"}},
+		Files:   []ds.File{{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 10, MD5: "a"}},
+		Drives:  map[string]string{"f1": "slow"},
+	})
+
+	src := slowSource{content: []byte("0123456789"), reading: make(chan struct{}), release: make(chan struct{})}
+	s := stream.NewStream(stream.Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   store,
+		Storage: memory,
+		Sources: []stream.Source{src},
+	})
+
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newServer(config{Server: server{ReadHeaderTimeout: time.Second}}, s)
+	go srv.Serve(l)
+
+	base := "http://" + l.Addr().String()
+	events, err := http.Get(base + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer events.Body.Close()
+
+	streamed := make(chan string, 1)
+	go func() {
+		res, err := http.Get(base + "/films/Heat%20%281995%29.f1.mkv")
+		if err != nil {
+			streamed <- err.Error()
+			return
+		}
+
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		streamed <- string(b)
+	}()
+
+	select {
+	case <-src.reading:
+	case got := <-streamed:
+		t.Fatalf("stream ended before shutting down: %q", got)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdown(srv, 5*time.Second)
+	}()
+
+	// The event stream is closed, while the stream is still being served.
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, bufio.NewReader(events.Body))
+		closed <- err
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("event stream ended with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the event stream was not closed when shutting down")
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned before the active stream finished")
+	default:
+	}
+
+	close(src.release)
+	if got := <-streamed; got != "0123456789" {
+		t.Errorf("stream during shutdown = %q, want the whole file", got)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return after the active stream finished")
+	}
+
+	if _, err := http.Get(base + "/films"); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("request after shutting down = %v, want a refused connection", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/m-rots/stream"
+)
+
+const shareUsage = `usage: stream share <file-id> [--expires 24h] [--rate 2MB] [--uses n] [--url base]
+       stream share list [--json]
+       stream share revoke <share-id>`
+
+func shareCommand(configPath *string, args []string) {
+	if len(args) == 0 {
+		fmt.Println(shareUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		shareListCommand(configPath, args[1:])
+	case "revoke":
+		shareRevokeCommand(configPath, args[1:])
+	default:
+		shareCreateCommand(configPath, args)
+	}
+}
+
+func shareCreateCommand(configPath *string, args []string) {
+	fs := newFlagSet("share", configPath)
+	expires := fs.Duration("expires", 24*time.Hour, "time until the link expires")
+	rate := fs.String("rate", "", "maximum bandwidth per stream, such as `2MB` per second (unlimited by default)")
+	uses := fs.Int("uses", 0, "maximum number of times the file can be opened (unlimited by default)")
+	baseURL := fs.String("url", "", "base URL of the server (defaults to http://localhost:<port>)")
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		fmt.Println(shareUsage)
+		os.Exit(2)
+	}
+
+	var bytesPerSecond uint64
+	if *rate != "" {
+		var err error
+		bytesPerSecond, err = humanize.ParseBytes(*rate)
+		ifErrorThenExit(err, fmt.Sprintf("invalid rate `%s`", *rate), []string{
+			"use a size such as `500KB` or `2MB`",
+		})
+	}
+
+	c := mustLoadConfig(*configPath)
+	if *baseURL == "" {
+		*baseURL = fmt.Sprintf("http://localhost:%d", c.Port)
+	}
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	streamConf := c.streamConfig()
+	streamConf.Store = store
+	s := stream.NewStream(streamConf)
+
+	sh, token, err := s.NewShare(context.Background(), positional[0], *expires, int(bytesPerSecond), *uses)
+	if errors.Is(err, sql.ErrNoRows) {
+		ifErrorThenExit(err, fmt.Sprintf("no file with ID `%s`", positional[0]), []string{
+			"run `stream find <pattern>` to find the ID of a file",
+		})
+	}
+
+	ifErrorThenExit(err, "could not create the share link", nil)
+
+	fmt.Println(stream.ShareURL(*baseURL, token))
+	fmt.Fprintf(os.Stderr, "Share %s expires %s.\n", sh.ID, sh.Expires.Format(time.RFC1123))
+}
+
+func shareListCommand(configPath *string, args []string) {
+	fs := newFlagSet("share list", configPath)
+	asJSON := fs.Bool("json", false, "print the output as JSON")
+	fs.Parse(args)
+
+	c := mustLoadConfig(*configPath)
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	shares, err := store.Shares(context.Background())
+	ifErrorThenExit(err, "could not read the share links from the database", nil)
+
+	if *asJSON {
+		if shares == nil {
+			shares = []stream.Share{}
+		}
+
+		printJSON(shares)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILE\tEXPIRES\tRATE\tUSES\tSTATE")
+
+	for _, sh := range shares {
+		rate := "-"
+		if sh.Rate > 0 {
+			rate = humanize.Bytes(uint64(sh.Rate)) + "/s"
+		}
+
+		uses := fmt.Sprint(sh.Uses)
+		if sh.MaxUses > 0 {
+			uses += fmt.Sprintf("/%d", sh.MaxUses)
+		}
+
+		var state []string
+		if sh.Revoked {
+			state = append(state, "revoked")
+		}
+
+		if time.Now().After(sh.Expires) {
+			state = append(state, "expired")
+		}
+
+		if sh.MaxUses > 0 && sh.Uses >= sh.MaxUses {
+			state = append(state, "used up")
+		}
+
+		if len(state) == 0 {
+			state = append(state, "active")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", sh.ID, sh.FileID, humanize.Time(sh.Expires), rate, uses, strings.Join(state, ", "))
+	}
+
+	w.Flush()
+}
+
+func shareRevokeCommand(configPath *string, args []string) {
+	fs := newFlagSet("share revoke", configPath)
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		fmt.Println(shareUsage)
+		os.Exit(2)
+	}
+
+	c := mustLoadConfig(*configPath)
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	err := store.RevokeShare(context.Background(), positional[0])
+	if errors.Is(err, sql.ErrNoRows) {
+		ifErrorThenExit(err, fmt.Sprintf("no share link with ID `%s`", positional[0]), []string{
+			"run `stream share list` to list all share links",
+		})
+	}
+
+	ifErrorThenExit(err, "could not revoke the share link", nil)
+	fmt.Printf("Revoked %s.\n", positional[0])
+}
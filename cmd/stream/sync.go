@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/m-rots/stream"
+)
+
+func syncCommand(configPath *string, args []string) {
+	fs := newFlagSet("sync", configPath)
+	full := fs.Bool("full", false, "replace the drive in the database with a full sync")
+	partial := fs.Bool("partial", false, "only perform a partial sync")
+	driveID := fs.String("drive", "", "ID of the drive or name of the source to synchronise (defaults to all of them)")
+	fs.Parse(args)
+
+	if *full && *partial {
+		fmt.Println("the `--full` and `--partial` flags cannot be combined")
+		os.Exit(2)
+	}
+
+	c := mustValidConfig(*configPath)
+
+	// The flag selects a source by its name, or another Shared Drive.
+	only := *driveID
+	if only != "" && !c.hasSource(only) {
+		c.DriveID = only
+	}
+
+	mode := stream.SyncAuto
+	switch {
+	case *full:
+		mode = stream.SyncFull
+	case *partial:
+		mode = stream.SyncPartial
+	}
+
+	streamConf := c.streamConfig()
+	if c.DriveID != "" {
+		auth, _, err := loadServiceAccount(c.AuthPath)
+		if err != nil {
+			p := err.(problem)
+			ifErrorThenExit(p.err, p.msg, p.help)
+		}
+
+		streamConf.Auth = auth
+	}
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	streamConf.Store = store
+	s := stream.NewStream(streamConf)
+
+	var sources []stream.Source
+	for _, src := range s.Sources() {
+		if only == "" || src.ID() == only {
+			sources = append(sources, src)
+		}
+	}
+
+	err := stream.NewSyncer(store, s.Refresh).WithNotify(s.Notify).SyncAll(context.Background(), mode, sources...)
+
+	// The webhooks are delivered before the process exits.
+	s.FlushWebhooks(context.Background())
+	handleSyncError(c, err)
+
+	fmt.Println("Finished synchronisation!")
+}
+
+func resetCommand(configPath *string, args []string) {
+	fs := newFlagSet("reset", configPath)
+	driveID := fs.String("drive", "", "ID of the drive or name of the source to remove (defaults to `drive` in the config)")
+	fs.Parse(args)
+
+	c := mustLoadConfig(*configPath)
+	if *driveID != "" {
+		c.DriveID = *driveID
+	}
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	err := store.Reset(context.Background(), c.DriveID)
+	ifErrorThenExit(err,
+		fmt.Sprintf("could not reset drive `%s`", c.DriveID),
+		[]string{
+			"make sure no other Stream process is using the database",
+		},
+	)
+
+	fmt.Printf("Reset %s, the next sync will be a full sync.\n", c.DriveID)
+}
+
+func statusCommand(configPath *string, args []string) {
+	fs := newFlagSet("status", configPath)
+	fs.Parse(args)
+
+	c := mustLoadConfig(*configPath)
+
+	store := mustOpenStore(c)
+	defer store.Close()
+
+	drives, err := store.Status(context.Background())
+	ifErrorThenExit(err,
+		"could not read the synchronisation state from the database",
+		[]string{
+			fmt.Sprintf("make sure `%s` is a database created by Stream", c.DatabasePath),
+		},
+	)
+
+	if len(drives) == 0 {
+		fmt.Println("No drives have been synchronised yet.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DRIVE\tNAME\tPAGE TOKEN\tFILES\tFOLDERS\tLAST SYNC")
+
+	for _, d := range drives {
+		lastSync := "unknown"
+		if !d.LastSync.IsZero() {
+			lastSync = fmt.Sprintf("%s (%s)", humanize.Time(d.LastSync), d.LastSync.Format(time.RFC3339))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", d.ID, d.Name, d.PageToken, d.Files, d.Folders, lastSync)
+	}
+
+	w.Flush()
+}
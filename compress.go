@@ -0,0 +1,175 @@
+package stream
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressible lists the content types worth compressing.
+// Video is already compressed and is requested in ranges, so it is always sent as is.
+// Event streams are left out as well, as every event must reach the client right away.
+var compressible = []string{
+	"text/xml",
+	"text/html",
+	"text/plain",
+	"application/json",
+	"application/xspf+xml",
+	"application/vnd.apple.mpegurl",
+}
+
+var (
+	gzipPool = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+
+	flatePool = sync.Pool{New: func() interface{} {
+		fw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return fw
+	}}
+)
+
+// compress encodes listings, indexes and API responses with gzip or deflate when the client accepts it.
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptedEncoding picks gzip over deflate, ignoring encodings with a quality of zero.
+func acceptedEncoding(header string) string {
+	accepted := make(map[string]bool)
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[name] = true
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				accepted[name] = false
+			}
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// compressWriter decides whether to compress once the status and headers are known.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	wroteHeader bool
+	encoder     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	cw.wroteHeader = true
+	header := cw.Header()
+
+	if cw.shouldCompress(status) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+
+		if cw.encoding == "gzip" {
+			gw := gzipPool.Get().(*gzip.Writer)
+			gw.Reset(cw.ResponseWriter)
+			cw.encoder = gw
+		} else {
+			fw := flatePool.Get().(*flate.Writer)
+			fw.Reset(cw.ResponseWriter)
+			cw.encoder = fw
+		}
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) shouldCompress(status int) bool {
+	header := cw.Header()
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		status == http.StatusPartialContent || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, t := range compressible {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends the data compressed so far to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if fw, ok := cw.encoder.(interface{ Flush() error }); ok {
+		fw.Flush()
+	}
+
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Close()
+		gzipPool.Put(encoder)
+	case *flate.Writer:
+		encoder.Close()
+		flatePool.Put(encoder)
+	}
+}
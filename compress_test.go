@@ -0,0 +1,163 @@
+package stream
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate, gzip":           "gzip",
+		"GZIP;q=0.5":              "gzip",
+		"gzip;q=0, deflate":       "deflate",
+		"gzip;q=0, deflate;q=0.0": "",
+		"br, identity":            "",
+	}
+
+	for header, want := range tests {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("Heat (1995)\n", 100)
+
+	h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/partial":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Range", "bytes 0-9/1200")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, text[:10])
+		case "/video":
+			w.Header().Set("Content-Type", "video/x-matroska")
+			io.WriteString(w, text)
+		default:
+			// The content type is detected from the body.
+			io.WriteString(w, text)
+		}
+	}))
+
+	tests := []struct {
+		method, target, accept string
+		encoding               string
+	}{
+		{"GET", "/text", "gzip", "gzip"},
+		{"GET", "/text", "deflate", "deflate"},
+		{"GET", "/text", "", ""},
+		{"HEAD", "/text", "gzip", ""},
+		{"GET", "/partial", "gzip", ""},
+		{"GET", "/video", "gzip", ""},
+	}
+
+	for _, tt := range tests {
+		res := serve(h, tt.method, tt.target, map[string]string{"Accept-Encoding": tt.accept})
+		if got := res.Header.Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s %s with %q: Content-Encoding %q, want %q", tt.method, tt.target, tt.accept, got, tt.encoding)
+		}
+
+		if tt.accept != "" && tt.method == "GET" && res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s %s with %q: Vary %q", tt.method, tt.target, tt.accept, res.Header.Get("Vary"))
+		}
+
+		var r io.Reader = res.Body
+		switch tt.encoding {
+		case "gzip":
+			gr, err := gzip.NewReader(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r = gr
+		case "deflate":
+			r = flate.NewReader(res.Body)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The recorder keeps the body of HEAD requests, which must not be encoded either.
+		want := text
+		if tt.target == "/partial" {
+			want = text[:10]
+		}
+
+		if string(b) != want {
+			t.Errorf("%s %s with %q: body of %d bytes, want %d", tt.method, tt.target, tt.accept, len(b), len(want))
+		}
+	}
+}
+
+// Files are never compressed, neither in full nor in ranges.
+func TestCompressFiles(t *testing.T) {
+	s, _ := newMemoryStream(t)
+	h := s.Handler()
+
+	target := "/films/Inception%20%282010%29.f1.mkv"
+	for _, header := range []map[string]string{
+		{"Accept-Encoding": "gzip"},
+		{"Accept-Encoding": "gzip", "Range": "bytes=2-5"},
+	} {
+		for _, method := range []string{"GET", "HEAD"} {
+			res := serve(h, method, target, header)
+			if res.Header.Get("Content-Encoding") != "" || res.StatusCode >= 300 {
+				t.Errorf("%s %s with %v: status %d, Content-Encoding %q", method, target, header, res.StatusCode, res.Header.Get("Content-Encoding"))
+			}
+		}
+	}
+
+	res := serve(h, "GET", target, map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=2-5"})
+	if res.StatusCode != http.StatusPartialContent || body(t, res) != "2345" {
+		t.Errorf("GET %s of a range: status %d", target, res.StatusCode)
+	}
+}
+
+// Listings are streamed, but are the same as a buffered multistatus.
+func TestMultistatus(t *testing.T) {
+	f := ds.File{ID: "f1", Name: "Heat (1995).mkv", Size: 30, MD5: "a"}
+	responses := []Response{
+		createDavFolder("/films/", "films"),
+		createDavFolder("/films/Heat%20%281995%29/", "Heat (1995) & <Friends>"),
+		createDavFile("/films/Heat%20%281995%29.f1.mkv", f),
+	}
+
+	b, err := xml.Marshal(MultiStatus{Namespace: "DAV:", Responses: responses})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	ms := newMultistatus(w)
+	for _, res := range responses {
+		if !ms.write(res) {
+			t.Fatal("write failed")
+		}
+	}
+
+	if err := ms.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := xml.Header + string(b); w.Body.String() != want {
+		t.Errorf("streamed multistatus\n%s\nwant the buffered multistatus\n%s", w.Body.String(), want)
+	}
+
+	if w.Code != http.StatusMultiStatus || w.Header().Get("Content-Type") != "text/xml; charset=utf-8" {
+		t.Errorf("streamed multistatus: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
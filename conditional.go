@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+const sqlVersionSchema = `
+CREATE TABLE IF NOT EXISTS library_version (
+	"library" text NOT NULL,
+	"version" integer NOT NULL,
+	"fingerprint" text NOT NULL,
+	PRIMARY KEY(library)
+)
+`
+
+// versionStore keeps the change counters of the libraries.
+type versionStore interface {
+	LibraryVersion(ctx context.Context, library, fingerprint string) (int64, error)
+}
+
+func (s Store) createVersionTable() error {
+	_, err := s.DB.Exec(sqlVersionSchema)
+	return err
+}
+
+// LibraryVersion returns the change counter of the library,
+// which is incremented whenever the fingerprint of its listing differs from the last one.
+func (s Store) LibraryVersion(ctx context.Context, library, fingerprint string) (version int64, err error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var previous string
+	row := tx.QueryRowContext(ctx, `SELECT version, fingerprint FROM library_version WHERE library = ?`, library)
+	err = row.Scan(&version, &previous)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		version = 1
+		_, err = tx.ExecContext(ctx, `INSERT INTO library_version (library, version, fingerprint) VALUES (?, ?, ?)`,
+			library, version, fingerprint)
+	case err == nil && previous != fingerprint:
+		version++
+		_, err = tx.ExecContext(ctx, `UPDATE library_version SET version = ?, fingerprint = ? WHERE library = ?`,
+			version, fingerprint, library)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return version, tx.Commit()
+}
+
+// fingerprint hashes everything the listings of the snapshot contain,
+// including the NFO files and the settings which add entries to the listings.
+func (snap *snapshot) fingerprint(o options) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "nfo %t\n", o.nfo.Enabled)
+
+	ids := make([]string, 0, len(snap.nfos))
+	for id := range snap.nfos {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		n := snap.nfos[id]
+		fmt.Fprintf(hash, "%s\t%d\t%d\t%s\n", id, n.size, n.relative, n.hash)
+	}
+
+	write := func(key string, entries []Entry) {
+		fmt.Fprintf(hash, "%s\n", key)
+		for _, e := range entries {
+			fmt.Fprintf(hash, "%s\t%s\t%t\t%d\t%s\n", e.Href, e.ID, e.Folder, e.Size, e.MD5)
+		}
+	}
+
+	write("", snap.entries)
+	writeSorted(snap.episodes, write)
+	writeSorted(snap.children, write)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func writeSorted(listings map[string][]Entry, write func(string, []Entry)) {
+	keys := make([]string, 0, len(listings))
+	for key := range listings {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		write(key, listings[key])
+	}
+}
+
+// collectionETag returns the weak ETag of a collection within the library,
+// which differs between the PROPFIND, HTML and JSON representations.
+func (snap *snapshot) collectionETag(root string, r *http.Request) string {
+	variant := ""
+	switch {
+	case r.Method == "PROPFIND":
+	case wantsJSON(r):
+		variant = "-json"
+	default:
+		variant = "-html"
+	}
+
+	return fmt.Sprintf(`W/"%s-%d%s"`, strings.TrimPrefix(root, "/"), snap.version, variant)
+}
+
+// collectionNotModified sets the ETag of a collection within the library in `/films` or `/shows`,
+// and responds with 304 Not Modified when the client already has the current listing.
+func (h Stream) collectionNotModified(w http.ResponseWriter, r *http.Request, root string) bool {
+	snap := h.snapshot(root)
+	if snap == nil {
+		return false
+	}
+
+	etag := snap.collectionETag(root, r)
+	w.Header().Set("ETag", etag)
+
+	if !matchETag(r.Header.Get("If-None-Match"), etag, false) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// fileETag returns the strong ETag of a file, or nothing when Google Drive has no MD5 of it.
+func fileETag(f ds.File) string {
+	if f.MD5 == "" {
+		return ""
+	}
+
+	return `"` + f.MD5 + `"`
+}
+
+// checkPreconditions sets the validators of the file and evaluates `If-Match`, `If-None-Match`
+// and `If-Modified-Since`. The response is written when a precondition decides it, in which case true is returned.
+func (h Stream) checkPreconditions(w http.ResponseWriter, r *http.Request, f ds.File) bool {
+	etag := fileETag(f)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	modified := h.modifiedTime(r.Context(), f.ID)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if match := r.Header.Get("If-Match"); match != "" && !matchETag(match, etag, true) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+
+	// If-Modified-Since is ignored when If-None-Match is present.
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" {
+		if matchETag(noneMatch, etag, false) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+
+	// HTTP dates have a precision of seconds.
+	if !modified.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// modifiedTime returns the modification time of the file from the snapshots of the libraries,
+// or from the Storage when the file is not within them.
+func (h Stream) modifiedTime(ctx context.Context, id string) time.Time {
+	for _, root := range []string{"/films", "/shows"} {
+		if snap := h.snapshot(root); snap != nil {
+			if t, ok := snap.modified[id]; ok {
+				return t
+			}
+		}
+	}
+
+	times, err := h.storage.ItemTimes(ctx, []string{id})
+	if err != nil {
+		return time.Time{}
+	}
+
+	return times[id].Modified
+}
+
+// matchETag reports whether the list of entity tags of a conditional header matches the ETag.
+// Weak ETags never match with strong comparison, as used by `If-Match`.
+func matchETag(header, etag string, strong bool) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		if etag == "" {
+			continue
+		}
+
+		if strong {
+			if tag == etag && !strings.HasPrefix(etag, "W/") {
+				return true
+			}
+
+			continue
+		}
+
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
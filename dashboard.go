@@ -0,0 +1,459 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// rateLimitCooldown is how long an account is shown as rate limited after its last rate limit.
+const rateLimitCooldown = time.Minute
+
+// liveSessions holds the streaming sessions which have not ended yet.
+type liveSessions struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newLiveSessions() *liveSessions {
+	return &liveSessions{sessions: make(map[string]Session)}
+}
+
+func (l *liveSessions) add(ss Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sessions[ss.ID] = ss
+}
+
+func (l *liveSessions) update(id string, sent int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ss, ok := l.sessions[id]; ok {
+		ss.Sent = sent
+		l.sessions[id] = ss
+	}
+}
+
+func (l *liveSessions) remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.sessions, id)
+}
+
+// list returns the live sessions, newest first.
+func (l *liveSessions) list() []Session {
+	l.mu.Lock()
+	sessions := make([]Session, 0, len(l.sessions))
+	for _, ss := range l.sessions {
+		sessions = append(sessions, ss)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.After(sessions[j].Started)
+	})
+
+	return sessions
+}
+
+// Status is the state of Stream as shown on the dashboard.
+type Status struct {
+	Drives    []DriveState    `json:"drives"`
+	Libraries []LibraryStatus `json:"libraries"`
+	Accounts  []AccountStatus `json:"accounts"`
+	Sessions  []Session       `json:"sessions"`
+	// Errors holds the most recent failed syncs, failed sessions and Drive errors, newest first.
+	Errors []Event `json:"errors"`
+}
+
+// DriveState is the synchronisation state of a Shared Drive.
+type DriveState struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Files    int       `json:"files"`
+	Folders  int       `json:"folders"`
+	LastSync time.Time `json:"last_sync"`
+	Syncing  bool      `json:"syncing"`
+	// LastError is the error of the most recent finished sync, if it failed.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// LibraryStatus describes a library as it is currently served.
+type LibraryStatus struct {
+	Library string `json:"library"`
+	ID      string `json:"id"`
+	// Entries is the number of films or TV shows, and Version the change counter of the library.
+	Entries int   `json:"entries"`
+	Version int64 `json:"version"`
+}
+
+// AccountStatus is the quota and rate limit state of a service account.
+type AccountStatus struct {
+	Email string  `json:"email"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// Requests and RateLimits count the requests of all streams to Google Drive since Stream started,
+	// whichever account made them. The requests of syncs are not counted.
+	Requests      int64      `json:"requests"`
+	RateLimits    int64      `json:"rate_limits"`
+	LastRateLimit *time.Time `json:"last_rate_limit,omitempty"`
+	RateLimited   bool       `json:"rate_limited"`
+}
+
+// Status collects the state of the drives, libraries, service account, live sessions and recent errors.
+func (h Stream) Status(ctx context.Context) (status Status, err error) {
+	drives, err := h.store.Status(ctx)
+	if err != nil {
+		return status, err
+	}
+
+	status.Drives = []DriveState{}
+	for _, d := range drives {
+		state := DriveState{
+			ID:       d.ID,
+			Name:     d.Name,
+			Files:    d.Files,
+			Folders:  d.Folders,
+			LastSync: d.LastSync,
+		}
+
+		state.Syncing, state.LastError = h.syncState(d.ID)
+		status.Drives = append(status.Drives, state)
+	}
+
+	o := h.options()
+	for _, lib := range []struct{ root, id string }{{"/films", o.filmsID}, {"/shows", o.showsID}} {
+		ls := LibraryStatus{Library: lib.root[1:], ID: lib.id}
+		if snap := h.snapshot(lib.root); snap != nil {
+			ls.Entries, ls.Version = len(snap.entries), snap.version
+		}
+
+		status.Libraries = append(status.Libraries, ls)
+	}
+
+	account := AccountStatus{
+		Email:      h.account,
+		Rate:       float64(h.fetch.limiter.Limit()),
+		Burst:      h.fetch.limiter.Burst(),
+		Requests:   atomic.LoadInt64(&h.fetch.stats.requests),
+		RateLimits: atomic.LoadInt64(&h.fetch.stats.rateLimits),
+	}
+
+	if last := atomic.LoadInt64(&h.fetch.stats.lastRateLimit); last > 0 {
+		t := time.Unix(0, last)
+		account.LastRateLimit = &t
+		account.RateLimited = time.Since(t) < rateLimitCooldown
+	}
+
+	status.Accounts = []AccountStatus{account}
+	status.Sessions = h.live.list()
+
+	// Errors are kept oldest first.
+	errs := h.events.Errors()
+	status.Errors = make([]Event, len(errs))
+	for i, e := range errs {
+		status.Errors[len(errs)-1-i] = e
+	}
+
+	return status, nil
+}
+
+// syncState reports whether a sync of the drive is running, and the error of its last sync if it failed.
+func (h Stream) syncState(driveID string) (syncing bool, lastError string) {
+	started, ok := h.events.LatestSync(EventSyncStarted, driveID)
+	if !ok {
+		return false, ""
+	}
+
+	finished, ok := h.events.LatestSync(EventSyncFinished, driveID)
+	if !ok {
+		return true, ""
+	}
+
+	return finished.ID < started.ID, finished.Data.(SyncEvent).Error
+}
+
+// apiStatus returns the state of Stream as shown on the dashboard.
+func (h Stream) apiStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status, err := h.Status(r.Context())
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not retrieve the status")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// apiLiveSessions returns the sessions which are still streaming, newest first.
+func (h Stream) apiLiveSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, h.live.list())
+}
+
+// dashboard serves the single-page dashboard, which is built on the API.
+func (h Stream) dashboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Stream</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; margin: 2rem auto; max-width: 72rem; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.4rem; font-weight: 600; }
+h2 { font-size: 1.1rem; font-weight: 600; margin-top: 2rem; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: .4rem .6rem; text-align: left; border-bottom: 1px solid #eee; vertical-align: top; }
+td.num, th.num { text-align: right; white-space: nowrap; }
+a { color: #0b62d6; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.muted { color: #888; }
+.badge { display: inline-block; padding: 0 .4rem; border-radius: .2rem; font-size: .8rem; background: #eee; }
+.ok { background: #dff3e4; color: #1c6b33; }
+.busy { background: #e3edfb; color: #0b62d6; }
+.bad { background: #fbe3e3; color: #a31b1b; }
+.bar { background: #eee; height: .4rem; border-radius: .2rem; min-width: 6rem; }
+.bar div { background: #0b62d6; height: 100%; border-radius: .2rem; }
+#browser form { display: flex; gap: .5rem; margin-bottom: .5rem; }
+#browser input { flex: 1; padding: .3rem .5rem; }
+#crumbs a { margin-right: .3rem; }
+</style>
+</head>
+<body>
+<h1>Stream <span id="live" class="badge">connecting</span></h1>
+
+<h2>Drives</h2>
+<table id="drives"><thead><tr><th>Drive</th><th class="num">Files</th><th class="num">Folders</th><th>Last sync</th><th>State</th></tr></thead><tbody></tbody></table>
+
+<h2>Libraries</h2>
+<table id="libraries"><thead><tr><th>Library</th><th>Folder</th><th class="num">Entries</th><th class="num">Version</th></tr></thead><tbody></tbody></table>
+
+<h2>Service accounts</h2>
+<table id="accounts"><thead><tr><th>Account</th><th class="num">Rate</th><th class="num">Burst</th><th class="num">Stream requests</th><th class="num">Rate limits</th><th>State</th></tr></thead><tbody></tbody></table>
+
+<h2>Live sessions</h2>
+<table id="sessions"><thead><tr><th>User</th><th>Client</th><th>File</th><th>Progress</th><th class="num">Sent</th><th>Started</th></tr></thead><tbody></tbody></table>
+
+<h2>Recent errors</h2>
+<table id="errors"><thead><tr><th>Time</th><th>Type</th><th>Error</th></tr></thead><tbody></tbody></table>
+
+<h2>Files</h2>
+<div id="browser">
+<form id="search"><input type="search" name="q" placeholder="Search films, shows and episodes"><button>Search</button></form>
+<div id="crumbs"></div>
+<table id="files"><thead><tr><th>Name</th><th class="num">Size</th><th>Modified</th></tr></thead><tbody></tbody></table>
+</div>
+
+<script>
+"use strict";
+
+function el(tag, attrs) {
+  var node = document.createElement(tag);
+  for (var key in attrs || {}) {
+    if (key === "text") node.textContent = attrs[key];
+    else node.setAttribute(key, attrs[key]);
+  }
+  for (var i = 2; i < arguments.length; i++) {
+    var child = arguments[i];
+    if (child === null || child === undefined) continue;
+    node.appendChild(typeof child === "object" ? child : document.createTextNode(String(child)));
+  }
+  return node;
+}
+
+function rows(id, items, render, empty) {
+  var body = document.querySelector("#" + id + " tbody");
+  body.textContent = "";
+  if (!items.length) {
+    var cols = document.querySelectorAll("#" + id + " th").length;
+    body.appendChild(el("tr", {}, el("td", {colspan: cols, "class": "muted", text: empty})));
+    return;
+  }
+  items.forEach(function (item) { body.appendChild(render(item)); });
+}
+
+function bytes(n) {
+  var units = ["B", "kB", "MB", "GB", "TB"];
+  var i = 0;
+  while (n >= 1000 && i < units.length - 1) { n /= 1000; i++; }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function ago(t) {
+  if (!t || t.indexOf("0001-") === 0) return "never";
+  var s = Math.round((Date.now() - new Date(t).getTime()) / 1000);
+  if (s < 60) return s + "s ago";
+  if (s < 3600) return Math.round(s / 60) + "m ago";
+  if (s < 86400) return Math.round(s / 3600) + "h ago";
+  return Math.round(s / 86400) + "d ago";
+}
+
+function badge(text, kind) {
+  return el("span", {"class": "badge " + kind, text: text});
+}
+
+function getJSON(url) {
+  return fetch(url, {headers: {Accept: "application/json"}, credentials: "same-origin"}).then(function (res) {
+    if (!res.ok) throw new Error(res.status + " " + res.statusText);
+    return res.json();
+  });
+}
+
+var sessions = {};
+
+function renderSessions() {
+  var list = Object.keys(sessions).map(function (id) { return sessions[id]; });
+  list.sort(function (a, b) { return a.started < b.started ? 1 : -1; });
+  rows("sessions", list, function (s) {
+    var total = s.range_end - s.range_start + 1;
+    var pct = total > 0 ? Math.min(100, Math.round(s.sent / total * 100)) : 0;
+    return el("tr", {},
+      el("td", {text: s.user || "-"}),
+      el("td", {text: s.client}),
+      el("td", {text: s.file}),
+      el("td", {}, el("div", {"class": "bar", title: pct + "%"}, el("div", {style: "width:" + pct + "%"}))),
+      el("td", {"class": "num", text: bytes(s.sent)}),
+      el("td", {text: ago(s.started)}));
+  }, "Nothing is streaming.");
+}
+
+function errorText(e) {
+  var d = e.data || {};
+  if (e.type === "drive.error") return d.operation + (d.file ? " " + d.file : "") + ": " + d.error;
+  if (e.type === "session.ended") return (d.file || "") + ": " + d.error;
+  return d.error || "";
+}
+
+function refresh() {
+  return getJSON("/api/status").then(function (status) {
+    rows("drives", status.drives, function (d) {
+      var state = d.syncing ? badge("syncing", "busy") : d.last_error ? badge("failed", "bad") : badge("idle", "ok");
+      return el("tr", {title: d.last_error || ""},
+        el("td", {}, d.name || d.id, " ", el("span", {"class": "muted", text: d.id})),
+        el("td", {"class": "num", text: d.files}),
+        el("td", {"class": "num", text: d.folders}),
+        el("td", {text: ago(d.last_sync)}),
+        el("td", {}, state));
+    }, "No drives have been synchronised.");
+
+    rows("libraries", status.libraries, function (l) {
+      return el("tr", {},
+        el("td", {}, el("a", {href: "#/" + l.library + "/", text: l.library})),
+        el("td", {"class": "muted", text: l.id}),
+        el("td", {"class": "num", text: l.entries}),
+        el("td", {"class": "num", text: l.version}));
+    }, "No libraries.");
+
+    rows("accounts", status.accounts, function (a) {
+      var state = a.rate_limited ? badge("rate limited", "bad") : badge("ok", "ok");
+      return el("tr", {},
+        el("td", {text: a.email || "service account"}),
+        el("td", {"class": "num", text: a.rate + "/s"}),
+        el("td", {"class": "num", text: a.burst}),
+        el("td", {"class": "num", text: a.requests}),
+        el("td", {"class": "num", title: a.rate_limits ? "last " + ago(a.last_rate_limit) : ""}, a.rate_limits),
+        el("td", {}, state));
+    }, "No service accounts.");
+
+    sessions = {};
+    status.sessions.forEach(function (s) { sessions[s.id] = s; });
+    renderSessions();
+
+    rows("errors", status.errors, function (e) {
+      return el("tr", {},
+        el("td", {text: ago(e.time), title: e.time}),
+        el("td", {text: e.type}),
+        el("td", {text: errorText(e)}));
+    }, "No recent errors.");
+  }).catch(function (err) {
+    document.getElementById("live").className = "badge bad";
+    document.getElementById("live").textContent = err.message;
+  });
+}
+
+var pending = null;
+function refreshSoon() {
+  if (pending) return;
+  pending = setTimeout(function () { pending = null; refresh(); }, 500);
+}
+
+function listen() {
+  var source = new EventSource("/api/events?types=sync,file,session,drive");
+  var live = document.getElementById("live");
+  source.onopen = function () { live.className = "badge ok"; live.textContent = "live"; };
+  source.onerror = function () { live.className = "badge bad"; live.textContent = "reconnecting"; };
+
+  source.addEventListener("session.progress", function (msg) {
+    var p = JSON.parse(msg.data).data;
+    if (sessions[p.id]) { sessions[p.id].sent = p.sent; renderSessions(); }
+  });
+
+  ["sync.started", "sync.finished", "session.started", "session.ended", "drive.error",
+   "file.added", "file.modified", "file.trashed", "file.removed"].forEach(function (type) {
+    source.addEventListener(type, refreshSoon);
+  });
+}
+
+function crumbs(href) {
+  var nav = document.getElementById("crumbs");
+  nav.textContent = "";
+  nav.appendChild(el("a", {href: "#/", text: "/"}));
+  var path = "/";
+  href.split("/").filter(Boolean).forEach(function (part) {
+    path += part + "/";
+    nav.appendChild(el("a", {href: "#" + path, text: decodeURIComponent(part) + "/"}));
+  });
+}
+
+function fileRow(e) {
+  var link = e.folder ? el("a", {href: "#" + e.href, text: e.name + "/"}) : el("a", {href: e.href, text: e.name});
+  return el("tr", {},
+    el("td", {}, link),
+    el("td", {"class": "num", text: e.folder ? "" : bytes(e.size || 0)}),
+    el("td", {text: e.modified ? ago(e.modified) : ""}));
+}
+
+function browse() {
+  var href = location.hash.slice(1) || "/";
+  crumbs(href);
+  getJSON(href).then(function (index) {
+    rows("files", index.entries, fileRow, "This folder is empty.");
+  }).catch(function (err) {
+    rows("files", [], fileRow, err.message);
+  });
+}
+
+document.getElementById("search").addEventListener("submit", function (event) {
+  event.preventDefault();
+  var q = this.q.value.trim();
+  if (!q) { browse(); return; }
+  crumbs("/search/" + encodeURIComponent(q));
+  getJSON("/api/search?q=" + encodeURIComponent(q)).then(function (res) {
+    var shows = res.shows.map(function (s) { s.folder = true; return s; });
+    rows("files", shows.concat(res.files), fileRow, "Nothing matches " + q + ".");
+  });
+});
+
+window.addEventListener("hashchange", browse);
+refresh();
+listen();
+browse();
+setInterval(refresh, 30000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,35 @@
+package stream
+
+import "testing"
+
+// The sync state of a drive is kept while other drives synchronise.
+func TestSyncState(t *testing.T) {
+	bus := NewBus()
+	s := NewStream(Config{Store: newTestStore(t), Events: bus})
+
+	bus.Publish(EventSyncStarted, SyncEvent{Drive: "drive"})
+	if syncing, _ := s.syncState("drive"); !syncing {
+		t.Errorf("drive is not syncing after it started")
+	}
+
+	bus.Publish(EventSyncFinished, SyncEvent{Drive: "drive", Error: "quota exceeded"})
+	bus.Publish(EventSyncStarted, SyncEvent{Drive: "nas"})
+	bus.Publish(EventSyncFinished, SyncEvent{Drive: "nas"})
+
+	if syncing, err := s.syncState("drive"); syncing || err != "quota exceeded" {
+		t.Errorf("syncState(drive) = %v, %q, want the error of its last sync", syncing, err)
+	}
+
+	bus.Publish(EventSyncStarted, SyncEvent{Drive: "drive"})
+	if syncing, err := s.syncState("drive"); !syncing || err != "quota exceeded" {
+		t.Errorf("syncState(drive) = %v, %q, want a running sync and the previous error", syncing, err)
+	}
+
+	if syncing, err := s.syncState("nas"); syncing || err != "" {
+		t.Errorf("syncState(nas) = %v, %q, want a successful sync", syncing, err)
+	}
+
+	if syncing, err := s.syncState("unknown"); syncing || err != "" {
+		t.Errorf("syncState(unknown) = %v, %q, want nothing", syncing, err)
+	}
+}
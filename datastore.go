@@ -2,6 +2,10 @@ package stream
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
 	ds "github.com/m-rots/bernard/datastore"
 	"github.com/m-rots/bernard/datastore/sqlite"
@@ -29,6 +33,54 @@ func NewStore(path string) (store Store, err error) {
 		return
 	}
 
+	if err = store.createSyncTable(); err != nil {
+		return
+	}
+
+	if err = store.createClosureTable(); err != nil {
+		return
+	}
+
+	if err = store.createSearchIndex(); err != nil {
+		return
+	}
+
+	if err = store.createTimeTable(); err != nil {
+		return
+	}
+
+	if err = store.createMediaTable(); err != nil {
+		return
+	}
+
+	if err = store.createAliasTable(); err != nil {
+		return
+	}
+
+	if err = store.createMetadataTable(); err != nil {
+		return
+	}
+
+	if err = store.createDuplicateTable(); err != nil {
+		return
+	}
+
+	if err = store.createShareTable(); err != nil {
+		return
+	}
+
+	if err = store.createSessionTable(); err != nil {
+		return
+	}
+
+	if err = store.createProgressTable(); err != nil {
+		return
+	}
+
+	if err = store.createVersionTable(); err != nil {
+		return
+	}
+
 	return store, nil
 }
 
@@ -64,9 +116,7 @@ func (s Store) GetFile(ctx context.Context, id string) (ds.File, error) {
 
 const sqlRecursiveFiles = `
 WITH cte AS (
-	SELECT id FROM folder WHERE parent = ? AND NOT trashed
-	UNION
-	SELECT folder.id FROM folder, cte WHERE folder.parent = cte.id AND NOT trashed
+	SELECT descendant AS id FROM folder_closure WHERE ancestor = ? AND depth > 0 AND NOT hidden
 )
 SELECT id, name, size, md5 FROM file WHERE file.parent IN cte AND NOT file.trashed
 `
@@ -74,9 +124,19 @@ SELECT id, name, size, md5 FROM file WHERE file.parent IN cte AND NOT file.trash
 // RecursiveFiles retrieves all files recursively from the datastore.
 // Should be used to get all children of a TV show as well as all films.
 func (s Store) RecursiveFiles(ctx context.Context, id string) (files []ds.File, err error) {
+	err = s.EachRecursiveFile(ctx, id, func(f ds.File) bool {
+		files = append(files, f)
+		return true
+	})
+
+	return files, err
+}
+
+// EachRecursiveFile passes the files of RecursiveFiles to fn as they are read, until fn returns false.
+func (s Store) EachRecursiveFile(ctx context.Context, id string, fn func(ds.File) bool) error {
 	rows, err := s.DB.QueryContext(ctx, sqlRecursiveFiles, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	defer rows.Close()
@@ -84,28 +144,285 @@ func (s Store) RecursiveFiles(ctx context.Context, id string) (files []ds.File,
 		f := ds.File{}
 		err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.MD5)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		files = append(files, f)
+		if !fn(f) {
+			break
+		}
 	}
 
-	return files, rows.Err()
+	return rows.Err()
 }
 
 const sqlRecursiveFolders = `
+SELECT folder.id, folder.name FROM folder_closure
+JOIN folder ON folder.id = folder_closure.descendant
+WHERE folder_closure.ancestor = ? AND folder_closure.depth = ? AND NOT folder_closure.hidden
+`
+
+func (s Store) RecursiveFolders(ctx context.Context, id string, depth int) (folders []ds.Folder, err error) {
+	err = s.EachRecursiveFolder(ctx, id, depth, func(f ds.Folder) bool {
+		folders = append(folders, f)
+		return true
+	})
+
+	return folders, err
+}
+
+// EachRecursiveFolder passes the folders of RecursiveFolders to fn as they are read, until fn returns false.
+func (s Store) EachRecursiveFolder(ctx context.Context, id string, depth int, fn func(ds.Folder) bool) error {
+	rows, err := s.DB.QueryContext(ctx, sqlRecursiveFolders, id, depth)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.Folder{}
+		err := rows.Scan(&f.ID, &f.Name)
+		if err != nil {
+			return err
+		}
+
+		if !fn(f) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// Close closes the underlying database.
+func (s Store) Close() error {
+	return s.DB.Close()
+}
+
+const sqlSyncSchema = `
+CREATE TABLE IF NOT EXISTS sync (
+	"drive" text NOT NULL,
+	"time" integer NOT NULL,
+	"full_sync" boolean NOT NULL,
+	PRIMARY KEY(drive)
+)
+`
+
+func (s Store) createSyncTable() error {
+	_, err := s.DB.Exec(sqlSyncSchema)
+	return err
+}
+
+const sqlUpsertSync = `
+INSERT INTO sync (drive, time, full_sync) VALUES (?, ?, ?)
+	ON CONFLICT(drive) DO UPDATE SET
+		time=excluded.time,
+		full_sync=excluded.full_sync
+`
+
+// recordSync saves the time of the last successful sync of the drive.
+func (s Store) recordSync(driveID string, t time.Time, full bool) error {
+	_, err := s.DB.Exec(sqlUpsertSync, driveID, t.Unix(), full)
+	return err
+}
+
+// DriveStatus describes the synchronisation state of a single Shared Drive.
+type DriveStatus struct {
+	ID        string
+	Name      string
+	PageToken string
+	Files     int
+	Folders   int
+	// LastSync is zero when the drive has not been synchronised by Stream.
+	LastSync time.Time
+}
+
+const sqlStatus = `
+SELECT
+	drive.id,
+	COALESCE(root.name, ''),
+	drive.pageToken,
+	(SELECT COUNT(*) FROM file WHERE file.drive = drive.id),
+	(SELECT COUNT(*) FROM folder WHERE folder.drive = drive.id AND folder.parent IS NOT NULL),
+	COALESCE(sync.time, 0)
+FROM drive
+LEFT JOIN folder AS root ON root.id = drive.id AND root.drive = drive.id
+LEFT JOIN sync ON sync.drive = drive.id
+ORDER BY drive.id
+`
+
+// Status retrieves the synchronisation state of all drives in the datastore.
+func (s Store) Status(ctx context.Context) (drives []DriveStatus, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		d := DriveStatus{}
+		var lastSync int64
+
+		err := rows.Scan(&d.ID, &d.Name, &d.PageToken, &d.Files, &d.Folders, &lastSync)
+		if err != nil {
+			return nil, err
+		}
+
+		if lastSync > 0 {
+			d.LastSync = time.Unix(lastSync, 0)
+		}
+
+		drives = append(drives, d)
+	}
+
+	return drives, rows.Err()
+}
+
+// sqlResetDrive removes the files and folders of a drive, together with everything derived from them.
+// Mounts share the ID of the library folder, so the items which remain in another drive are kept in the derived tables.
+// The libraries get a new version on the next Refresh, as their fingerprints are cleared.
+var sqlResetDrive = []string{
+	`CREATE TEMP TABLE IF NOT EXISTS reset_item (id text PRIMARY KEY)`,
+	`DELETE FROM reset_item`,
+	`INSERT OR IGNORE INTO reset_item (id)
+		SELECT id FROM file WHERE drive = ?1
+		UNION SELECT id FROM folder WHERE drive = ?1 AND id NOT IN (SELECT id FROM folder WHERE drive != ?1)`,
+	`DELETE FROM folder_closure WHERE descendant IN (SELECT id FROM reset_item)`,
+	`DELETE FROM search_index WHERE id IN (SELECT id FROM reset_item)`,
+	`DELETE FROM alias WHERE id IN (SELECT id FROM reset_item)`,
+	`DELETE FROM duplicate WHERE id IN (SELECT id FROM reset_item) OR kept IN (SELECT id FROM reset_item)`,
+	`DELETE FROM file WHERE drive = ?1`,
+	`DELETE FROM folder WHERE drive = ?1`,
+	`DELETE FROM drive WHERE id = ?1`,
+	`DELETE FROM sync WHERE drive = ?1`,
+	`DELETE FROM item_time WHERE drive = ?1`,
+	`DELETE FROM media WHERE drive = ?1`,
+	`UPDATE library_version SET fingerprint = ''`,
+	`DELETE FROM reset_item`,
+}
+
+func resetDrive(ctx context.Context, tx *sql.Tx, driveID string) error {
+	for _, statement := range sqlResetDrive {
+		if _, err := tx.ExecContext(ctx, statement, driveID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reset removes the pageToken, files and folders of the drive from the datastore.
+// The next sync of the drive will be a full sync.
+func (s Store) Reset(ctx context.Context, driveID string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := resetDrive(ctx, tx, driveID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const sqlInsertFolder = `
+INSERT INTO folder (id, drive, name, parent, trashed) VALUES (?, ?, ?, NULLIF(?, ''), ?)
+	ON CONFLICT(id, drive) DO UPDATE SET name=excluded.name, parent=excluded.parent, trashed=excluded.trashed
+`
+
+const sqlInsertFile = `
+INSERT INTO file (id, drive, name, md5, parent, size, trashed) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id, drive) DO UPDATE SET name=excluded.name, md5=excluded.md5, parent=excluded.parent, size=excluded.size, trashed=excluded.trashed
+`
+
+// FullSync replaces the files and folders of the drive within a single transaction,
+// so a failed full sync leaves the previous files and folders in place.
+//
+// Bernard saves the full syncs of Shared Drives through FullSync as well.
+func (s Store) FullSync(drive ds.Drive, folders []ds.Folder, files []ds.File) error {
+	ctx := context.Background()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := resetDrive(ctx, tx, drive.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO drive (id, pageToken) VALUES (?, ?)`, drive.ID, drive.PageToken); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	insertFolder, err := tx.PrepareContext(ctx, sqlInsertFolder)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer insertFolder.Close()
+
+	// The drive itself is the root folder.
+	folders = append([]ds.Folder{{ID: drive.ID, Name: drive.Name}}, folders...)
+	for _, f := range folders {
+		if _, err := insertFolder.ExecContext(ctx, f.ID, drive.ID, f.Name, f.Parent, f.Trashed); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v: %w", f.ID, ds.ErrDataAnomaly)
+		}
+	}
+
+	insertFile, err := tx.PrepareContext(ctx, sqlInsertFile)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer insertFile.Close()
+	for _, f := range files {
+		if _, err := insertFile.ExecContext(ctx, f.ID, drive.ID, f.Name, f.MD5, f.Parent, f.Size, f.Trashed); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%v: %w", f.ID, ds.ErrDataAnomaly)
+		}
+	}
+
+	return tx.Commit()
+}
+
+const sqlFileByID = `
+SELECT id, name, parent, trashed, size, md5 FROM file WHERE file.id = ?
+`
+
+// FileByID retrieves a file from the datastore, including trashed files.
+func (s Store) FileByID(ctx context.Context, id string) (ds.File, error) {
+	f := ds.File{}
+
+	row := s.DB.QueryRowContext(ctx, sqlFileByID, id)
+	err := row.Scan(&f.ID, &f.Name, &f.Parent, &f.Trashed, &f.Size, &f.MD5)
+	return f, err
+}
+
+// The mounts of a source share the ID of the library folder they are placed in,
+// so every level keeps the folder with a parent over the mounts.
+const sqlParents = `
 WITH cte AS (
-	SELECT *, 1 AS depth FROM folder WHERE parent = $1 AND NOT trashed
-	UNION
-	SELECT folder.*, (cte.depth + 1) AS depth FROM folder, cte
-	WHERE folder.parent = cte.id AND cte.depth < $2 AND NOT folder.trashed
+	SELECT id, name, parent, trashed, 0 AS level FROM folder WHERE id = ?
+	UNION ALL
+	SELECT folder.id, folder.name, folder.parent, folder.trashed, (cte.level + 1) AS level FROM folder, cte
+	WHERE folder.id = cte.parent
 )
 
-SELECT id, name FROM cte WHERE depth = $2
+SELECT id, name, COALESCE(parent, ''), trashed FROM (
+	SELECT id, name, parent, trashed, level, MAX(parent IS NOT NULL) FROM cte GROUP BY level
+) ORDER BY level
 `
 
-func (s Store) RecursiveFolders(ctx context.Context, id string, depth int) (folders []ds.Folder, err error) {
-	rows, err := s.DB.QueryContext(ctx, sqlRecursiveFolders, id, depth)
+// Parents retrieves the folder and all of its parents, nearest folder first.
+func (s Store) Parents(ctx context.Context, id string) (folders []ds.Folder, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlParents, id)
 	if err != nil {
 		return nil, err
 	}
@@ -113,7 +430,7 @@ func (s Store) RecursiveFolders(ctx context.Context, id string, depth int) (fold
 	defer rows.Close()
 	for rows.Next() {
 		f := ds.Folder{}
-		err := rows.Scan(&f.ID, &f.Name)
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Trashed)
 		if err != nil {
 			return nil, err
 		}
@@ -123,3 +440,62 @@ func (s Store) RecursiveFolders(ctx context.Context, id string, depth int) (fold
 
 	return folders, rows.Err()
 }
+
+const sqlFindFiles = `
+SELECT id, name, parent, size, md5 FROM file
+WHERE name LIKE '%' || ? || '%' ESCAPE '\' AND NOT trashed
+ORDER BY name
+`
+
+const sqlFindFolders = `
+SELECT id, name, parent FROM folder
+WHERE name LIKE '%' || ? || '%' ESCAPE '\' AND NOT trashed AND parent IS NOT NULL
+ORDER BY name
+`
+
+// Find retrieves all files and folders of which the name contains the pattern,
+// except for the roots of the drives and the mounts of the sources.
+// The pattern is matched case-insensitively.
+func (s Store) Find(ctx context.Context, pattern string) (files []ds.File, folders []ds.Folder, err error) {
+	pattern = likeEscaper.Replace(pattern)
+
+	rows, err := s.DB.QueryContext(ctx, sqlFindFiles, pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Size, &f.MD5)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, sqlFindFolders, pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.Folder{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		folders = append(folders, f)
+	}
+
+	return files, folders, rows.Err()
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
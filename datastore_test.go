@@ -0,0 +1,124 @@
+package stream
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// newTestStore opens a Store in a temporary directory, which is removed after the test.
+func newTestStore(t *testing.T) Store {
+	dir, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewStore(filepath.Join(dir, "stream.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newSyncedStore opens a Store with the folders and files of a Shared Drive with the ID `drive`,
+// and updates the tables derived from them like a sync does.
+func newSyncedStore(t *testing.T, folders []ds.Folder, files []ds.File) Store {
+	store := newTestStore(t)
+
+	folders = append([]ds.Folder{{ID: "drive", Name: "Drive"}}, folders...)
+	if err := store.FullSync(ds.Drive{ID: "drive", Name: "Drive"}, folders, files); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, update := range []func(context.Context) error{store.RebuildClosure, store.RebuildSearchIndex, store.UpdateMedia} {
+		if err := update(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return store
+}
+
+func TestFullSyncFailure(t *testing.T) {
+	ctx := context.Background()
+	s, store, src := newLocalStream(t)
+
+	before, err := store.Items(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The directories of the source are gone, so the full sync fails before saving anything.
+	for _, m := range src.mounts {
+		os.RemoveAll(m.Path)
+	}
+
+	if err := NewSyncer(store, s.Refresh).Sync(ctx, src, SyncFull); err == nil {
+		t.Fatal("full sync of a missing directory succeeded")
+	}
+
+	// A full sync which cannot be saved is rolled back.
+	err = store.FullSync(ds.Drive{ID: "nas", Name: "nas"}, nil, []ds.File{{ID: "orphan", Name: "Orphan.mkv", Parent: "unknown"}})
+	if err == nil {
+		t.Fatal("full sync of a file without a parent succeeded")
+	}
+
+	after, err := store.Items(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after.Files) != len(before.Files) || len(after.Folders) != len(before.Folders) {
+		t.Errorf("failed full syncs left %d files and %d folders, want %d and %d",
+			len(after.Files), len(after.Folders), len(before.Files), len(before.Folders))
+	}
+
+	if _, err := store.PageToken("nas"); err != nil {
+		t.Errorf("failed full syncs removed the page token: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ctx := context.Background()
+	s, store, _ := newLocalStream(t)
+
+	film := sourceItemID("nas", "films", "Inception (2010)/Inception (2010).mkv")
+	if err := store.ReplaceDuplicates(ctx, map[string]string{film: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	version := s.snapshot("/films").version
+	if err := store.Reset(ctx, "nas"); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, folders, err := store.Search(ctx, "inception", 0, 0); err != nil || len(files)+len(folders) > 0 {
+		t.Errorf("Search after a reset = %v, %v, %v, want nothing", files, folders, err)
+	}
+
+	if hidden, err := store.HiddenDuplicates(ctx); err != nil || len(hidden) > 0 {
+		t.Errorf("HiddenDuplicates after a reset = %v, %v, want none", hidden, err)
+	}
+
+	// The library folder of the Shared Drive is still found.
+	if _, folders, err := store.Search(ctx, "films", 0, 0); err != nil || len(folders) != 1 {
+		t.Errorf("Search(films) after a reset = %v, %v, want the library folder", folders, err)
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := s.snapshot("/films").version; v != version+1 {
+		t.Errorf("version %d after a reset, want %d", v, version+1)
+	}
+}
@@ -0,0 +1,266 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Dedupe configures which libraries only expose a single copy of byte-identical files.
+type Dedupe struct {
+	Films bool
+	Shows bool
+}
+
+// A DuplicateGroup is a set of files with the same MD5 within a library.
+// The first file is the preferred copy, which is exposed when deduplicating.
+type DuplicateGroup struct {
+	MD5   string  `json:"md5"`
+	Size  int     `json:"size"`
+	Files []Entry `json:"files"`
+	// Wasted is the space taken by all copies but the preferred copy.
+	Wasted int `json:"wasted"`
+}
+
+// A DuplicateReport lists the duplicate groups of a library.
+type DuplicateReport struct {
+	Library string           `json:"library"`
+	Groups  []DuplicateGroup `json:"groups"`
+	Wasted  int              `json:"wasted"`
+}
+
+// Copies are preferred by the time they were added to Google Drive, oldest first,
+// followed by their name and ID so the preference does not change between syncs.
+const sqlDuplicateFiles = `
+WITH cte AS (
+	SELECT descendant AS id FROM folder_closure WHERE ancestor = ? AND depth > 0 AND NOT hidden
+),
+files AS (
+	SELECT file.id, file.name, file.size, file.md5, item_time.created,
+		COUNT(*) OVER (PARTITION BY file.md5) AS copies
+	FROM file
+	LEFT JOIN item_time ON item_time.id = file.id AND item_time.drive = file.drive
+	WHERE file.parent IN cte AND NOT file.trashed AND file.md5 != ''
+)
+SELECT id, name, size, md5 FROM files WHERE copies > 1
+ORDER BY md5, created IS NULL, created, name, id
+`
+
+// DuplicateFiles retrieves all files of the library which share their MD5 with another file,
+// ordered by MD5 and then by preference.
+func (s Store) DuplicateFiles(ctx context.Context, id string) (files []ds.File, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlDuplicateFiles, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.MD5)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// The duplicate table holds the files hidden by deduplication and the copy which is exposed instead.
+const sqlDuplicateSchema = `
+CREATE TABLE IF NOT EXISTS duplicate (
+	"id" text NOT NULL PRIMARY KEY,
+	"kept" text NOT NULL
+);
+`
+
+// duplicateStore keeps the files hidden by deduplication.
+type duplicateStore interface {
+	ReplaceDuplicates(ctx context.Context, hidden map[string]string) error
+	HiddenDuplicates(ctx context.Context) (map[string]bool, error)
+	IsDuplicate(ctx context.Context, id string) (bool, error)
+}
+
+func (s Store) createDuplicateTable() error {
+	_, err := s.DB.Exec(sqlDuplicateSchema)
+	return err
+}
+
+// ReplaceDuplicates replaces all hidden duplicates, mapping each hidden file to the exposed copy.
+func (s Store) ReplaceDuplicates(ctx context.Context, hidden map[string]string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM duplicate`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO duplicate (id, kept) VALUES (?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	for id, kept := range hidden {
+		if _, err := stmt.ExecContext(ctx, id, kept); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HiddenDuplicates retrieves the IDs of all files hidden by deduplication.
+func (s Store) HiddenDuplicates(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id FROM duplicate`)
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := make(map[string]bool)
+
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		hidden[id] = true
+	}
+
+	return hidden, rows.Err()
+}
+
+// IsDuplicate reports whether the file is hidden by deduplication.
+func (s Store) IsDuplicate(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM duplicate WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+// duplicateGroups returns the groups of exposed files with the same MD5 within the library, either `films` or `shows`.
+func (h Stream) duplicateGroups(ctx context.Context, library string) (groups []DuplicateGroup, err error) {
+	o := h.options()
+
+	folderID := o.filmsID
+	if library == "shows" {
+		folderID = o.showsID
+	}
+
+	files, err := h.storage.DuplicateFiles(ctx, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	var group DuplicateGroup
+	flush := func() {
+		if len(group.Files) > 1 {
+			group.Wasted = group.Size * (len(group.Files) - 1)
+			groups = append(groups, group)
+		}
+	}
+
+	for _, f := range files {
+		if !o.exposed(f.Name) {
+			continue
+		}
+
+		if f.MD5 != group.MD5 {
+			flush()
+			group = DuplicateGroup{MD5: f.MD5, Size: f.Size}
+		}
+
+		group.Files = append(group.Files, fileEntry("", f))
+	}
+
+	flush()
+	return groups, nil
+}
+
+// Duplicates reports the groups of exposed files with the same MD5 within the library, either `films` or `shows`.
+// The groups are reported whether or not the library is deduplicated,
+// the href of copies which are hidden by deduplication is empty.
+func (h Stream) Duplicates(ctx context.Context, library string) (DuplicateReport, error) {
+	report := DuplicateReport{Library: library, Groups: []DuplicateGroup{}}
+
+	groups, err := h.duplicateGroups(ctx, library)
+	if err != nil {
+		return report, err
+	}
+
+	for _, g := range groups {
+		for i, e := range g.Files {
+			f, err := h.storage.FileByID(ctx, e.ID)
+			if err != nil {
+				return report, err
+			}
+
+			parents, err := h.storage.Parents(ctx, f.Parent)
+			if err != nil {
+				return report, err
+			}
+
+			g.Files[i].Href, _ = h.Href(ctx, f, parents)
+		}
+
+		report.Groups = append(report.Groups, g)
+		report.Wasted += g.Wasted
+	}
+
+	return report, nil
+}
+
+// rebuildDuplicates hides all but the preferred copy of each duplicate group in the deduplicated libraries.
+func (h Stream) rebuildDuplicates(ctx context.Context) error {
+	o := h.options()
+	hidden := make(map[string]string)
+
+	for library, enabled := range map[string]bool{"films": o.dedupe.Films, "shows": o.dedupe.Shows} {
+		if !enabled {
+			continue
+		}
+
+		groups, err := h.duplicateGroups(ctx, library)
+		if err != nil {
+			return err
+		}
+
+		for _, g := range groups {
+			for _, f := range g.Files[1:] {
+				hidden[f.ID] = g.Files[0].ID
+			}
+		}
+	}
+
+	return h.store.ReplaceDuplicates(ctx, hidden)
+}
+
+// apiDuplicates reports the duplicate groups of both libraries.
+func (h Stream) apiDuplicates(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var reports []DuplicateReport
+
+	for _, library := range []string{"films", "shows"} {
+		report, err := h.Duplicates(r.Context(), library)
+		if err != nil {
+			fmt.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "could not find duplicates")
+			return
+		}
+
+		reports = append(reports, report)
+	}
+
+	writeJSON(w, http.StatusOK, reports)
+}
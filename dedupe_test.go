@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Copies are preferred oldest first, then copies without a known time, each ordered by name and then by ID.
+func TestDuplicatePreference(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	folders := []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "a", Name: "A", Parent: "films"},
+		{ID: "b", Name: "B", Parent: "films"},
+	}
+
+	files := []ds.File{
+		{ID: "d5", Name: "C.mkv", Parent: "b", Size: 10, MD5: "x"},
+		{ID: "d3", Name: "C.mkv", Parent: "a", Size: 10, MD5: "x"},
+		{ID: "d1", Name: "B.mkv", Parent: "a", Size: 10, MD5: "x"},
+		{ID: "d4", Name: "A.mkv", Parent: "b", Size: 10, MD5: "x"},
+		{ID: "d2", Name: "Z.mkv", Parent: "a", Size: 10, MD5: "x"},
+		{ID: "u1", Name: "Unique.mkv", Parent: "a", Size: 10, MD5: "y"},
+	}
+
+	times := []ItemTime{
+		{ID: "d1", Created: created, Modified: created},
+		{ID: "d2", Created: created.Add(-time.Hour), Modified: created},
+	}
+
+	store := newSyncedStore(t, folders, files)
+	if err := store.saveTimes(ctx, "drive", times); err != nil {
+		t.Fatal(err)
+	}
+
+	memory := NewMemoryStorage()
+	memory.Replace(Items{Folders: folders, Files: files, Times: times})
+
+	want := []string{"d2", "d1", "d4", "d3", "d5"}
+	for name, storage := range map[string]Storage{"store": store, "memory": memory} {
+		duplicates, err := storage.DuplicateFiles(ctx, "films")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(duplicates) != len(want) {
+			t.Fatalf("%s: DuplicateFiles = %+v, want %v", name, duplicates, want)
+		}
+
+		for i, f := range duplicates {
+			if f.ID != want[i] {
+				t.Errorf("%s: duplicate %d = %s, want %s", name, i, f.ID, want[i])
+			}
+		}
+	}
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Dedupe: Dedupe{Films: true}})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	hidden, err := store.HiddenDuplicates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hidden) != 4 || hidden["d2"] || hidden["u1"] {
+		t.Errorf("hidden duplicates = %v, want all copies but d2", hidden)
+	}
+
+	report, err := s.Duplicates(ctx, "films")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Wasted != 40 || len(report.Groups) != 1 || report.Groups[0].Files[0].Href == "" || report.Groups[0].Files[1].Href != "" {
+		t.Errorf("report = %+v, want 40 bytes wasted and only d2 exposed", report)
+	}
+}
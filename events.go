@@ -0,0 +1,407 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The types of the events published on the Bus.
+const (
+	EventSyncStarted     = "sync.started"
+	EventSyncFinished    = "sync.finished"
+	EventFileAdded       = "file.added"
+	EventFileModified    = "file.modified"
+	EventFileRemoved     = "file.removed"
+	EventFileTrashed     = "file.trashed"
+	EventSessionStarted  = "session.started"
+	EventSessionProgress = "session.progress"
+	EventSessionEnded    = "session.ended"
+	EventDriveError      = "drive.error"
+)
+
+const (
+	// eventHistory is the number of past events replayed to reconnecting clients.
+	eventHistory = 256
+	// errorHistory is the number of failures kept apart from the other events.
+	errorHistory = 50
+	// eventBuffer is the number of events a subscriber may fall behind before it is dropped.
+	eventBuffer = 64
+	// progressInterval is the time between the progress events of a session.
+	progressInterval = 5 * time.Second
+	// eventHeartbeat keeps idle event streams from being closed by proxies.
+	eventHeartbeat = 30 * time.Second
+)
+
+// An Event is something that happened within Stream, such as a sync or a streaming session.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// SyncEvent is the data of the sync events.
+type SyncEvent struct {
+	Drive string `json:"drive"`
+	Full  bool   `json:"full"`
+	// Duration and Error are only set once the sync has finished.
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// FileEvent is the data of the file events, one for every library containing the file.
+type FileEvent struct {
+	Library string `json:"library"`
+	WebhookItem
+}
+
+// SessionProgress is the data of the session progress events.
+type SessionProgress struct {
+	ID       string `json:"id"`
+	User     string `json:"user,omitempty"`
+	FileID   string `json:"file"`
+	Sent     int64  `json:"sent"`
+	Position int64  `json:"position"`
+	Size     int64  `json:"size"`
+}
+
+// DriveError is the data of the Drive error events.
+type DriveError struct {
+	Operation string `json:"operation"`
+	FileID    string `json:"file,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	RateLimit bool   `json:"rate_limit"`
+	Error     string `json:"error"`
+}
+
+// failure is implemented by the data of events which can report an error.
+type failure interface {
+	failed() bool
+}
+
+func (e SyncEvent) failed() bool {
+	return e.Error != ""
+}
+
+func (ss Session) failed() bool {
+	return ss.Reason == ReasonError
+}
+
+func (e DriveError) failed() bool {
+	return true
+}
+
+// A Bus passes events to its subscribers and keeps the most recent events.
+// Progress events are passed on but not kept, as they are outdated by the next one.
+// Publishing on a nil Bus does nothing.
+type Bus struct {
+	mu      sync.Mutex
+	next    uint64
+	history []Event
+	// errors and latest are kept apart, so they are not pushed out by a burst of other events.
+	errors []Event
+	latest map[string]Event
+	// syncs holds the latest sync events of every drive, so syncs of other drives do not hide them.
+	syncs  map[syncKey]Event
+	subs   map[chan Event]bool
+	closed bool
+}
+
+type syncKey struct {
+	typ   string
+	drive string
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		latest: make(map[string]Event),
+		syncs:  make(map[syncKey]Event),
+		subs:   make(map[chan Event]bool),
+	}
+}
+
+// Publish sends the event to all subscribers.
+// Subscribers which fell too far behind are dropped, so publishing never blocks.
+func (b *Bus) Publish(typ string, data interface{}) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.next++
+	e := Event{ID: b.next, Type: typ, Time: time.Now(), Data: data}
+	b.latest[typ] = e
+
+	if sync, ok := data.(SyncEvent); ok {
+		b.syncs[syncKey{typ, sync.Drive}] = e
+	}
+
+	if typ != EventSessionProgress {
+		b.history = keep(b.history, e, eventHistory)
+	}
+
+	if f, ok := data.(failure); ok && f.failed() {
+		b.errors = keep(b.errors, e, errorHistory)
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the kept events published after the given ID, and a channel receiving all new events.
+// The channel is closed by unsubscribe, when the subscriber falls behind, or when the Bus is closed.
+func (b *Bus) Subscribe(after uint64) (past []Event, events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, eventBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range b.history {
+		if e.ID > after {
+			past = append(past, e)
+		}
+	}
+
+	if b.closed {
+		close(ch)
+		return past, ch, func() {}
+	}
+
+	b.subs[ch] = true
+	return past, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.subs[ch] {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Recent returns the kept events of the given types, oldest first.
+// All kept events are returned when no types are given.
+func (b *Bus) Recent(types ...string) (events []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range b.history {
+		if matchEventType(e.Type, types) {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+// Errors returns the most recent failed syncs, failed sessions and Drive errors, oldest first.
+func (b *Bus) Errors() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]Event(nil), b.errors...)
+}
+
+// Latest returns the most recent event of the type.
+func (b *Bus) Latest(typ string) (Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.latest[typ]
+	return e, ok
+}
+
+// LatestSync returns the most recent sync event of the type for the drive.
+func (b *Bus) LatestSync(typ, drive string) (Event, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.syncs[syncKey{typ, drive}]
+	return e, ok
+}
+
+// keep appends the event, dropping the oldest events beyond the limit.
+func keep(events []Event, e Event, limit int) []Event {
+	events = append(events, e)
+	if len(events) > limit {
+		events = append(events[:0:0], events[len(events)-limit:]...)
+	}
+
+	return events
+}
+
+// Close ends all subscriptions, such as the open event streams when shutting down.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// matchEventType reports whether the type equals or falls within one of the given types,
+// such as `session.ended` within `session`.
+func matchEventType(typ string, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+
+	for _, t := range types {
+		if typ == t || strings.HasPrefix(typ, t+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Events returns the Bus on which Stream publishes its events.
+func (h Stream) Events() *Bus {
+	return h.events
+}
+
+// publishChanges publishes a file event for every changed file in the libraries.
+func (h Stream) publishChanges(libraries []LibraryChanges) {
+	for _, lc := range libraries {
+		for _, item := range lc.Files {
+			typ := EventFileModified
+			switch {
+			case item.Removed:
+				typ = EventFileRemoved
+			case item.Trashed:
+				typ = EventFileTrashed
+			case item.Added:
+				typ = EventFileAdded
+			}
+
+			h.events.Publish(typ, FileEvent{Library: lc.Library, WebhookItem: item})
+		}
+	}
+}
+
+// progressWriter reports the bytes sent at most once per interval while the session is written.
+type progressWriter struct {
+	*countingWriter
+	last     time.Time
+	progress func(sent int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.countingWriter.Write(p)
+
+	if now := time.Now(); now.Sub(pw.last) >= progressInterval {
+		pw.last = now
+		pw.progress(pw.n)
+	}
+
+	return n, err
+}
+
+// sessionProgress updates the live session and publishes its progress.
+func (h Stream) sessionProgress(ss Session, sent int64) {
+	h.live.update(ss.ID, sent)
+	h.events.Publish(EventSessionProgress, SessionProgress{
+		ID:       ss.ID,
+		User:     ss.User,
+		FileID:   ss.FileID,
+		Sent:     sent,
+		Position: int64(ss.RangeStart) + sent,
+		Size:     ss.size,
+	})
+}
+
+// apiEvents streams the events as Server-Sent Events.
+//
+// Query parameters: `types`, a comma-separated list of event types such as `sync,session.ended`.
+// Events missed since the `Last-Event-ID` are replayed, as long as they are still kept.
+func (h Stream) apiEvents(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	var types []string
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+
+	after, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	past, events, unsubscribe := h.events.Subscribe(after)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e Event) error {
+		if !matchEventType(e.Type, types) {
+			return nil
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+
+	for _, e := range past {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if err := write(e); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
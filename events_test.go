@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newEventStream(t *testing.T) (Stream, *Bus) {
+	bus := NewBus()
+	return NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: newSyncedStore(t, nil, nil), Events: bus}), bus
+}
+
+// eventIDs returns the IDs and types of the events within the body of an event stream.
+func eventIDs(t *testing.T, stream string) (ids []string) {
+	for _, block := range strings.Split(stream, "\n\n") {
+		if block == "" {
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[0], "id: ") || !strings.HasPrefix(lines[1], "event: ") {
+			t.Fatalf("malformed event %q", block)
+		}
+
+		var e Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, strings.TrimPrefix(lines[0], "id: ")+" "+e.Type)
+	}
+
+	return ids
+}
+
+// Reconnecting clients receive the kept events after their Last-Event-ID.
+func TestEventReplay(t *testing.T) {
+	s, bus := newEventStream(t)
+	h := s.Handler()
+
+	bus.Publish(EventSyncStarted, SyncEvent{Drive: "drive"})
+	bus.Publish(EventSyncFinished, SyncEvent{Drive: "drive"})
+	bus.Publish(EventSessionStarted, Session{ID: "s1"})
+	bus.Publish(EventSessionProgress, SessionProgress{ID: "s1"})
+	bus.Publish(EventSessionEnded, Session{ID: "s1"})
+
+	// Closing the Bus ends the event streams right after the replay.
+	bus.Close()
+
+	tests := []struct {
+		query, lastID string
+		want          []string
+	}{
+		{"", "2", []string{"3 session.started", "5 session.ended"}},
+		{"", "5", nil},
+		{"", "", []string{"1 sync.started", "2 sync.finished", "3 session.started", "5 session.ended"}},
+		{"", "unknown", []string{"1 sync.started", "2 sync.finished", "3 session.started", "5 session.ended"}},
+		{"?types=sync", "1", []string{"2 sync.finished"}},
+		{"?types=session.ended,sync.started", "", []string{"1 sync.started", "5 session.ended"}},
+	}
+
+	for _, tt := range tests {
+		res := serve(h, "GET", "/api/events"+tt.query, map[string]string{"Last-Event-ID": tt.lastID})
+		if res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("GET /api/events%s: Content-Type %q", tt.query, res.Header.Get("Content-Type"))
+		}
+
+		if got := eventIDs(t, body(t, res)); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /api/events%s after %q = %v, want %v", tt.query, tt.lastID, got, tt.want)
+		}
+	}
+}
+
+// Only the most recent events are kept for the replay.
+func TestEventHistory(t *testing.T) {
+	bus := NewBus()
+	for i := 0; i < eventHistory+50; i++ {
+		bus.Publish(EventSessionEnded, Session{})
+	}
+
+	past, _, unsubscribe := bus.Subscribe(10)
+	defer unsubscribe()
+
+	if len(past) != eventHistory || past[0].ID != 51 || past[len(past)-1].ID != eventHistory+50 {
+		t.Errorf("replayed %d events from %d, want the last %d", len(past), past[0].ID, eventHistory)
+	}
+}
+
+// The replay continues with the events published while connected, without gaps or duplicates.
+func TestEventStream(t *testing.T) {
+	s, bus := newEventStream(t)
+	bus.Publish(EventSyncStarted, SyncEvent{Drive: "drive"})
+	bus.Publish(EventSyncFinished, SyncEvent{Drive: "drive"})
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	r := bufio.NewReader(res.Body)
+
+	next := func() string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("event stream ended: %v", err)
+			}
+
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	if e := next(); !strings.HasPrefix(e, "id: 2\nevent: sync.finished\n") {
+		t.Errorf("replayed event %q, want 2", e)
+	}
+
+	bus.Publish(EventSessionEnded, Session{ID: "s1"})
+	if e := next(); !strings.HasPrefix(e, "id: 3\nevent: session.ended\n") {
+		t.Errorf("published event %q, want 3", e)
+	}
+
+	bus.Close()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("event stream continued after closing the Bus")
+	}
+}
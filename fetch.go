@@ -3,11 +3,14 @@ package stream
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lowe "github.com/m-rots/bernard"
@@ -19,6 +22,16 @@ type fetch struct {
 	baseURL string
 	client  *http.Client
 	limiter *rate.Limiter
+	events  *Bus
+	stats   *fetchStats
+}
+
+// fetchStats counts the requests made to Google Drive, and how many of them were rate limited.
+type fetchStats struct {
+	requests   int64
+	rateLimits int64
+	// lastRateLimit is the time of the last rate limit in nanoseconds since the Unix epoch.
+	lastRateLimit int64
 }
 
 func NewFetch(auth lowe.Authenticator) fetch {
@@ -28,6 +41,7 @@ func NewFetch(auth lowe.Authenticator) fetch {
 		auth:    auth,
 		baseURL: baseURL,
 		limiter: rate.NewLimiter(10, 1),
+		stats:   new(fetchStats),
 		client: &http.Client{
 			Transport: &http.Transport{
 				Proxy: http.ProxyFromEnvironment,
@@ -40,46 +54,92 @@ func NewFetch(auth lowe.Authenticator) fetch {
 	}
 }
 
-func (f fetch) Range(ctx context.Context, rw io.Writer, ID string, start uint64, end uint64) error {
+// withEvents returns a fetch which publishes its errors on the Bus.
+func (f fetch) withEvents(events *Bus) fetch {
+	f.events = events
+	return f
+}
+
+// publishError publishes errors other than cancelled requests as Drive errors.
+func (f fetch) publishError(operation, id string, status int, err error) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if errors.Is(err, ErrRateLimit) {
+		atomic.AddInt64(&f.stats.rateLimits, 1)
+		atomic.StoreInt64(&f.stats.lastRateLimit, time.Now().UnixNano())
+	}
+
+	f.events.Publish(EventDriveError, DriveError{
+		Operation: operation,
+		FileID:    id,
+		Status:    status,
+		RateLimit: errors.Is(err, ErrRateLimit),
+		Error:     err.Error(),
+	})
+}
+
+// Range copies the bytes from start up to and including end of the file to rw,
+// and returns the number of bytes read from Google Drive.
+func (f fetch) Range(ctx context.Context, rw io.Writer, ID string, start uint64, end uint64) (int64, error) {
 	err := f.limiter.Wait(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	token, _, err := f.auth.AccessToken()
 	if err != nil {
-		return err
+		f.publishError("token", ID, 0, err)
+		return 0, err
 	}
 
+	atomic.AddInt64(&f.stats.requests, 1)
 	req, _ := http.NewRequestWithContext(ctx, "GET", f.baseURL+"/files/"+ID+"?alt=media", nil)
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
 	res, err := f.client.Do(req)
 	if err != nil {
-		return err
+		f.publishError("range", ID, 0, err)
+		return 0, err
 	}
 
 	defer res.Body.Close()
 
 	if res.StatusCode != 206 {
-		switch res.StatusCode {
-		case 403:
-			return ErrRateLimit
-		default:
-			return errors.New("weird status code")
+		err = errors.New("weird status code")
+		if res.StatusCode == 403 {
+			err = ErrRateLimit
 		}
+
+		f.publishError("range", ID, res.StatusCode, err)
+		return 0, err
 	}
 
 	buf := streamingBufPool.Get().([]byte)
 	defer streamingBufPool.Put(buf)
 
-	_, err = io.CopyBuffer(rw, res.Body, buf)
-	return err
+	// The bytes read from Google Drive include the bytes which could not be written.
+	body := &countingReader{Reader: res.Body}
+	_, err = io.CopyBuffer(rw, body, buf)
+	return body.n, err
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 var (
 	ErrRateLimit = errors.New("stream: rate limit")
+	ErrNotFound  = errors.New("stream: not found")
 )
 
 var streamingBufPool = sync.Pool{
@@ -87,3 +147,89 @@ var streamingBufPool = sync.Pool{
 		return make([]byte, 32*1024)
 	},
 }
+
+// ItemTime holds the creation and modification times of a file or folder in Google Drive.
+type ItemTime struct {
+	ID       string
+	Created  time.Time `json:"createdTime"`
+	Modified time.Time `json:"modifiedTime"`
+}
+
+// get performs an authenticated GET request to the Google Drive API and decodes the JSON response.
+func (f fetch) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	err := f.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	token, _, err := f.auth.AccessToken()
+	if err != nil {
+		f.publishError("token", "", 0, err)
+		return err
+	}
+
+	atomic.AddInt64(&f.stats.requests, 1)
+	req, _ := http.NewRequestWithContext(ctx, "GET", f.baseURL+path+"?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		f.publishError("metadata", "", 0, err)
+		return err
+	}
+
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return json.NewDecoder(res.Body).Decode(v)
+	case 403, 429:
+		err = ErrRateLimit
+	case 404:
+		return ErrNotFound
+	default:
+		err = fmt.Errorf("stream: status code %d", res.StatusCode)
+	}
+
+	f.publishError("metadata", "", res.StatusCode, err)
+	return err
+}
+
+// Times retrieves the creation and modification times of all items in the Shared Drive.
+func (f fetch) Times(ctx context.Context, driveID string) (times []ItemTime, err error) {
+	query := url.Values{}
+	query.Set("corpora", "drive")
+	query.Set("driveId", driveID)
+	query.Set("includeItemsFromAllDrives", "true")
+	query.Set("supportsAllDrives", "true")
+	query.Set("pageSize", "1000")
+	query.Set("fields", "nextPageToken,files(id,createdTime,modifiedTime)")
+
+	for {
+		page := struct {
+			NextPageToken string
+			Files         []ItemTime
+		}{}
+
+		if err := f.get(ctx, "/files", query, &page); err != nil {
+			return nil, err
+		}
+
+		times = append(times, page.Files...)
+		if page.NextPageToken == "" {
+			return times, nil
+		}
+
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// Time retrieves the creation and modification time of a single item.
+func (f fetch) Time(ctx context.Context, id string) (t ItemTime, err error) {
+	query := url.Values{}
+	query.Set("supportsAllDrives", "true")
+	query.Set("fields", "id,createdTime,modifiedTime")
+
+	err = f.get(ctx, "/files/"+url.PathEscape(id), query, &t)
+	return t, err
+}
@@ -2,7 +2,6 @@ package stream
 
 import (
 	"context"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"mime"
@@ -13,6 +12,7 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
 )
 
 // Handler is the main handler for Stream.
@@ -24,88 +24,180 @@ func (h Stream) Handler() http.Handler {
 		w.Header().Set("MS-Author-Via", "DAV")
 	})
 
-	r.Handle("PROPFIND", "/", h.propRoot)
-	r.Handle("PROPFIND", "/films", h.propFilms)
-	r.Handle("PROPFIND", "/shows", h.propShows)
+	// The libraries are renamed and contain NFO files when enabled.
+	library := func(next httprouter.Handle) httprouter.Handle {
+		return h.serveNFO(h.renamed(next))
+	}
+
+	// Collections are listed by PROPFIND, and as an index for browsers by GET.
+	for _, method := range []string{"PROPFIND", "GET", "HEAD"} {
+		r.Handle(method, "/", h.propRoot)
+		r.Handle(method, "/films", library(h.propFilms))
+		r.Handle(method, "/shows", library(h.propShows))
+		r.Handle(method, "/shows/:folder", library(h.propEpisodes))
+
+		// The folders created by renaming contain one more level.
+		r.Handle(method, "/films/:file/:name", library(notFound))
+		r.Handle(method, "/shows/:folder/:file/:name", library(notFound))
+
+		r.Handle(method, "/search", h.propSearchRoot)
+		r.Handle(method, "/search/:query", h.propSearch)
+
+		for _, order := range []RecentOrder{RecentlyAdded, RecentlyModified} {
+			r.Handle(method, recentRoot(order), h.propRecentRoot(order))
+			r.Handle(method, recentRoot(order)+"/:library", h.propRecent(order))
+		}
+
+		r.Handle(method, continueRoot, h.propContinue)
+	}
+
+	r.Handle("PROPFIND", "/films/:file", library(h.addFile(h.propFile)))
+	r.Handle("GET", "/films/:file", library(addRequestID(h.addFile(h.streamFile))))
+	r.Handle("HEAD", "/films/:file", library(addRequestID(h.addFile(h.streamFile))))
+
+	r.Handle("PROPFIND", "/shows/:folder/:file", library(h.addFile(h.propFile)))
+	r.Handle("GET", "/shows/:folder/:file", library(addRequestID(h.addFile(h.streamFile))))
+	r.Handle("HEAD", "/shows/:folder/:file", library(addRequestID(h.addFile(h.streamFile))))
+
+	r.Handle("PROPFIND", "/search/:query/:file", h.addFile(h.propFile))
+	r.Handle("GET", "/search/:query/:file", addRequestID(h.addFile(h.streamFile)))
+	r.Handle("HEAD", "/search/:query/:file", addRequestID(h.addFile(h.streamFile)))
 
-	r.Handle("PROPFIND", "/films/:file", h.addFile(h.propFile))
-	r.Handle("GET", "/films/:file", addRequestID(h.addFile(h.streamFile)))
-	r.Handle("HEAD", "/films/:file", addRequestID(h.addFile(h.streamFile)))
+	for _, order := range []RecentOrder{RecentlyAdded, RecentlyModified} {
+		root := recentRoot(order)
+		r.Handle("PROPFIND", root+"/:library/:file", h.addFile(h.propFile))
+		r.Handle("GET", root+"/:library/:file", addRequestID(h.addFile(h.streamFile)))
+		r.Handle("HEAD", root+"/:library/:file", addRequestID(h.addFile(h.streamFile)))
+	}
 
-	r.Handle("PROPFIND", "/shows/:folder", h.propEpisodes)
-	r.Handle("PROPFIND", "/shows/:folder/:file", h.addFile(h.propFile))
-	r.Handle("GET", "/shows/:folder/:file", addRequestID(h.addFile(h.streamFile)))
-	r.Handle("HEAD", "/shows/:folder/:file", addRequestID(h.addFile(h.streamFile)))
+	r.Handle("PROPFIND", continueRoot+"/:file", h.addFile(h.propFile))
+	r.Handle("GET", continueRoot+"/:file", addRequestID(h.addFile(h.streamFile)))
+	r.Handle("HEAD", continueRoot+"/:file", addRequestID(h.addFile(h.streamFile)))
+
+	r.Handle("GET", "/s/:token", h.serveShare)
+	r.Handle("HEAD", "/s/:token", h.serveShare)
+
+	r.Handle("GET", "/playlists/:library", h.playlist)
+	r.Handle("GET", "/playlists/:library/:show", h.playlist)
+	r.Handle("GET", "/playlists/:library/:show/:season", h.playlist)
+
+	r.Handle("GET", "/artwork/*filepath", h.serveArtwork)
+	r.Handle("HEAD", "/artwork/*filepath", h.serveArtwork)
+
+	r.Handle("GET", "/api/search", h.apiSearch)
+	r.Handle("GET", "/api/media/:id", h.apiMedia)
+	r.Handle("GET", "/api/duplicates", h.apiDuplicates)
+	r.Handle("GET", "/api/catalogue", h.apiCatalogue)
+	r.Handle("GET", "/api/sessions", h.apiSessions)
+	r.Handle("GET", "/api/events", h.apiEvents)
+	r.Handle("GET", "/api/status", h.apiStatus)
+	r.Handle("GET", "/api/sessions/live", h.apiLiveSessions)
+	r.Handle("GET", "/dashboard", h.dashboard)
+	r.Handle("GET", "/api/progress", h.apiProgress)
+	r.Handle("GET", "/api/progress/:id", h.apiProgress)
+	r.Handle("DELETE", "/api/progress/:id", h.apiDeleteProgress)
+	r.Handle("GET", "/api/shares", h.apiShares)
+	r.Handle("POST", "/api/shares", h.apiCreateShare)
+	r.Handle("DELETE", "/api/shares/:id", h.apiRevokeShare)
+
+	return h.authenticate(compress(r))
+}
 
-	return r
+func notFound(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	http.NotFound(w, r)
 }
 
 func writeXML(w http.ResponseWriter, responses []Response) {
-	res := MultiStatus{
-		Namespace: "DAV:",
-		Responses: responses,
+	ms := newMultistatus(w)
+	for _, res := range responses {
+		ms.write(res)
+	}
+
+	if err := ms.close(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeEntries writes a PROPFIND response of the collection itself followed by its entries.
+// Other requests receive an index of the collection for browsers.
+func (h Stream) writeEntries(w http.ResponseWriter, r *http.Request, collection Response, entries []Entry) {
+	h.writeSource(w, r, collection, sliceSource(entries))
+}
+
+// writeSource is writeEntries for entries which are encoded as they are read.
+//
+// Errors after the response has started leave the multistatus unterminated,
+// so clients do not mistake a partial listing for a complete one.
+func (h Stream) writeSource(w http.ResponseWriter, r *http.Request, collection Response, src entrySource) {
+	if r.Method != "PROPFIND" {
+		entries, err := collect(src)
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+
+		h.writeIndex(w, r, collection, entries)
+		return
 	}
 
-	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-	w.WriteHeader(http.StatusMultiStatus)
+	ms := newMultistatus(w)
+	ms.write(collection)
 
-	w.Write([]byte(xml.Header))
-	xml.NewEncoder(w).Encode(res)
+	err := src(func(e Entry) bool {
+		return ms.write(e.response())
+	})
+
+	if err == nil {
+		err = ms.close()
+	}
+
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 // propRoot creates a PROPFIND response with a `films` and `shows` folder.
 //
 // Does not require any middleware.
 func (h *Stream) propRoot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	responses := []Response{
-		createDavFolder("/", ""),
-		createDavFolder("/films/", "films"),
-		createDavFolder("/shows/", "shows"),
+	entries := []Entry{
+		{Href: "/films/", Name: "films", Folder: true},
+		{Href: "/shows/", Name: "shows", Folder: true},
+		{Href: "/search/", Name: "search", Folder: true},
+		{Href: recentRoot(RecentlyAdded) + "/", Name: recentName(RecentlyAdded), Folder: true},
+		{Href: recentRoot(RecentlyModified) + "/", Name: recentName(RecentlyModified), Folder: true},
+		{Href: continueRoot + "/", Name: continueName, Folder: true},
 	}
 
-	writeXML(w, responses)
+	h.writeEntries(w, r, createDavFolder("/", ""), entries)
 }
 
 // propFilms creates a PROPFIND response with all the films in the datastore.
 //
 // Does not require any middleware.
 func (h Stream) propFilms(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	responses := []Response{createDavFolder("/films/", "films")}
-
-	films, err := h.store.RecursiveFiles(r.Context(), h.filmsID)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(500)
+	if h.collectionNotModified(w, r, "/films") {
 		return
 	}
 
-	for _, f := range films {
-		name := fileWithID(f.Name, f.ID)
-		responses = append(responses, createDavFile("/films/"+url.PathEscape(name), f))
+	films := h.films(r.Context())
+	if h.options().nfo.Enabled {
+		films = h.filmNFOs(r.Context(), films, baseURL(r))
 	}
 
-	writeXML(w, responses)
+	h.writeSource(w, r, createDavFolder("/films/", "films"), films)
 }
 
 // propShows creates a PROPFIND response with all the shows in the datastore.
 //
 // Does not require any middleware.
 func (h Stream) propShows(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	responses := []Response{createDavFolder("/shows/", "shows")}
-
-	shows, err := h.store.RecursiveFolders(r.Context(), h.showsID, h.depth)
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(500)
+	if h.collectionNotModified(w, r, "/shows") {
 		return
 	}
 
-	for _, f := range shows {
-		folderPath := "/shows/" + url.PathEscape(folderWithID(f.Name, f.ID))
-		responses = append(responses, createDavFolder(folderPath, f.Name))
-	}
-
-	writeXML(w, responses)
+	h.writeSource(w, r, createDavFolder("/shows/", "shows"), h.shows(r.Context()))
 }
 
 // propEpisodes creates a PROPFIND response with all episodes of the show.
@@ -118,22 +210,94 @@ func (h Stream) propEpisodes(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
-	responses := []Response{createDavFolder(r.URL.String(), folder)}
+	if h.collectionNotModified(w, r, "/shows") {
+		return
+	}
+
+	show := ds.Folder{ID: id, Name: folder}
+	episodes := h.episodes(r.Context(), show)
+	if h.options().nfo.Enabled {
+		dir := "/shows/" + ps.ByName("folder")
+		episodes = h.folderNFO(r.Context(), dir, showHref(show)+"/", episodes, baseURL(r))
+	}
+
+	h.writeSource(w, r, createDavFolder(r.URL.String(), folder), episodes)
+}
+
+// propSearchRoot creates a PROPFIND response of the empty `search` folder.
+// Searches are performed by opening `/search/<query>/`.
+//
+// Does not require any middleware.
+func (h Stream) propSearchRoot(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.writeEntries(w, r, createDavFolder("/search/", "search"), nil)
+}
+
+// propSearch creates a PROPFIND response with all files matching the query.
+//
+// Does not require any middleware.
+func (h Stream) propSearch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	const limit = 200
+	query := ps.ByName("query")
 
-	episodes, err := h.store.RecursiveFiles(r.Context(), id)
+	files, _, err := h.Search(r.Context(), query, limit)
 	if err != nil {
 		fmt.Println(err)
 		w.WriteHeader(500)
 		return
 	}
 
-	for _, f := range episodes {
-		fileName := fileWithID(f.Name, f.ID)
-		filePath := r.URL.String() + "/" + url.PathEscape(fileName)
-		responses = append(responses, createDavFile(filePath, f))
+	// The files are listed within the search folder, so clients can open them.
+	folderPath := "/search/" + url.PathEscape(query)
+	for i, f := range files {
+		files[i].Href = folderPath + "/" + url.PathEscape(fileWithID(f.Name, f.ID))
+	}
+
+	h.writeEntries(w, r, createDavFolder(folderPath+"/", query), files)
+}
+
+func recentName(order RecentOrder) string {
+	if order == RecentlyModified {
+		return "Recently Modified"
+	}
+
+	return "Recently Added"
+}
+
+// propRecentRoot creates a PROPFIND response with a `films` and `shows` folder
+// of the recently added or modified files.
+//
+// Does not require any middleware.
+func (h Stream) propRecentRoot(order RecentOrder) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		entries := []Entry{
+			{Href: recentHref("films", order), Name: "films", Folder: true},
+			{Href: recentHref("shows", order), Name: "shows", Folder: true},
+		}
+
+		h.writeEntries(w, r, createDavFolder(recentRoot(order)+"/", recentName(order)), entries)
 	}
+}
+
+// propRecent creates a PROPFIND response with the newest files of the library.
+//
+// Does not require any middleware.
+func (h Stream) propRecent(order RecentOrder) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		library := ps.ByName("library")
+		if library != "films" && library != "shows" {
+			http.NotFound(w, r)
+			return
+		}
 
-	writeXML(w, responses)
+		files, err := h.Recent(r.Context(), library, order)
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+
+		h.writeEntries(w, r, createDavFolder(recentHref(library, order), library), files)
+	}
 }
 
 // propFile creates a PROPFIND response for the given File in context.
@@ -142,11 +306,7 @@ func (h Stream) propEpisodes(w http.ResponseWriter, r *http.Request, ps httprout
 func (h Stream) propFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	f := getFile(r.Context())
 
-	responses := []Response{
-		createDavFile(r.URL.String(), f),
-	}
-
-	writeXML(w, responses)
+	writeXML(w, []Response{createDavFile(r.URL.String(), f)})
 }
 
 // streamFile fetches chunks of the file in Google Drive until the request is closed or hits EOF.
@@ -162,6 +322,18 @@ func (h Stream) streamFile(w http.ResponseWriter, r *http.Request, _ httprouter.
 		endPos = uint64(f.Size) - 1
 	}
 
+	if h.checkPreconditions(w, r, f) {
+		return
+	}
+
+	src, err := h.source(r.Context(), f)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	setDownload(w, r, f.Name)
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", startPos, endPos, f.Size))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", endPos-startPos+1))
@@ -174,6 +346,19 @@ func (h Stream) streamFile(w http.ResponseWriter, r *http.Request, _ httprouter.
 
 	fmt.Printf("%s - request: %s\n", requestID, r.Header.Get("Range"))
 
+	session := newSession(r, f, startPos, endPos)
+	h.live.add(session)
+	h.events.Publish(EventSessionStarted, session)
+
+	sent := &countingWriter{Writer: w}
+	out := &progressWriter{countingWriter: sent, last: session.Started, progress: func(n int64) {
+		h.sessionProgress(session, n)
+	}}
+	defer func() {
+		session.Sent = sent.n
+		h.endSession(session)
+	}()
+
 	go func() {
 		<-r.Context().Done()
 
@@ -200,7 +385,8 @@ func (h Stream) streamFile(w http.ResponseWriter, r *http.Request, _ httprouter.
 
 		fmt.Printf("%s - chunk: %d -> %d (%s)\n", requestID, chunkStart, chunkEnd, humanize.Bytes(chunkEnd-chunkStart))
 
-		err = h.fetch.Range(r.Context(), w, f.ID, chunkStart, chunkEnd)
+		n, err := src.Range(r.Context(), out, f.ID, chunkStart, chunkEnd)
+		session.Upstream += n
 		if err == nil {
 			chunkStart = chunkEnd + 1
 			continue
@@ -208,20 +394,24 @@ func (h Stream) streamFile(w http.ResponseWriter, r *http.Request, _ httprouter.
 
 		if errors.Is(err, syscall.EPIPE) {
 			fmt.Printf("%s - stream epipe\n", requestID)
+			session.Reason = ReasonEPIPE
 			break
 		}
 
 		if errors.Is(err, syscall.ECONNRESET) {
 			fmt.Printf("%s - stream connection reset\n", requestID)
+			session.Reason = ReasonReset
 			break
 		}
 
 		if errors.Is(err, context.Canceled) {
 			fmt.Printf("%s - context cancelled\n", requestID)
+			session.Reason = ReasonCancel
 			break
 		}
 
 		fmt.Printf("%s - error: %v\n", requestID, err)
+		session.Reason, session.Error = ReasonError, err.Error()
 		break
 	}
 }
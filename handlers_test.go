@@ -0,0 +1,237 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// memorySource serves the contents of files from memory, by ID.
+type memorySource struct {
+	id    string
+	files map[string][]byte
+}
+
+func (m memorySource) ID() string {
+	return m.id
+}
+
+func (m memorySource) Sync(context.Context, Store, bool) ([]Change, error) {
+	return nil, nil
+}
+
+func (m memorySource) Range(_ context.Context, w io.Writer, id string, start, end uint64) (int64, error) {
+	n, err := w.Write(m.files[id][start : end+1])
+	return int64(n), err
+}
+
+// serve performs a request against the handler and returns the response.
+func serve(h http.Handler, method, target string, header map[string]string) *http.Response {
+	r := httptest.NewRequest(method, target, nil)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func body(t *testing.T, res *http.Response) string {
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// The libraries are served from a MemoryStorage, while the Store only holds the state of Stream.
+func newMemoryStream(t *testing.T) (Stream, memorySource) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	memory := NewMemoryStorage()
+	memory.Replace(Items{
+		Folders: []ds.Folder{
+			{ID: "films", Name: "Films"},
+			{ID: "shows", Name: "Shows"},
+			{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+			{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+			{ID: "dark", Name: "Dark (2017)", Parent: "shows"},
+			{ID: "dark1", Name: "Season 1", Parent: "dark"},
+		},
+		Files: []ds.File{
+			{ID: "f1", Name: "Inception (2010).mkv", Parent: "inception", Size: 10, MD5: "a"},
+			{ID: "f2", Name: "Heat (1995).mkv", Parent: "heat", Size: 4, MD5: "b"},
+			{ID: "e1", Name: "Dark S01E01.mkv", Parent: "dark1", Size: 3, MD5: "c"},
+		},
+		Drives: map[string]string{"f1": "memory", "f2": "memory", "e1": "memory"},
+		Times: []ItemTime{
+			{ID: "f1", Created: created, Modified: created},
+			{ID: "f2", Created: created.Add(time.Hour), Modified: created},
+		},
+	})
+
+	src := memorySource{id: "memory", files: map[string][]byte{
+		"f1": []byte("0123456789"),
+		"f2": []byte("heat"),
+		"e1": []byte("ep1"),
+	}}
+
+	s := NewStream(Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   newTestStore(t),
+		Storage: memory,
+		Sources: []Source{src},
+	})
+
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, src
+}
+
+func TestMemoryStorageListing(t *testing.T) {
+	s, _ := newMemoryStream(t)
+	h := s.Handler()
+
+	res := serve(h, "PROPFIND", "/films", map[string]string{"Depth": "1"})
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND /films: status %d", res.StatusCode)
+	}
+
+	listing := body(t, res)
+	for _, name := range []string{"Inception (2010).f1.mkv", "Heat (1995).f2.mkv"} {
+		if !strings.Contains(listing, "/films/"+url.PathEscape(name)) {
+			t.Errorf("PROPFIND /films does not list %q:\n%s", name, listing)
+		}
+	}
+
+	res = serve(h, "PROPFIND", "/shows", map[string]string{"Depth": "1"})
+	if listing := body(t, res); !strings.Contains(listing, "Dark (2017)") {
+		t.Errorf("PROPFIND /shows does not list the show:\n%s", listing)
+	}
+
+	res = serve(h, "PROPFIND", "/added/films", map[string]string{"Depth": "1"})
+	listing = body(t, res)
+	if heat, inception := strings.Index(listing, "Heat"), strings.Index(listing, "Inception"); heat < 0 || inception < heat {
+		t.Errorf("PROPFIND /added/films does not list the newest film first:\n%s", listing)
+	}
+}
+
+func TestMemoryStorageStream(t *testing.T) {
+	s, _ := newMemoryStream(t)
+	h := s.Handler()
+
+	target := "/films/" + url.PathEscape("Inception (2010).f1.mkv")
+	res := serve(h, "GET", target, map[string]string{"Range": "bytes=2-5"})
+
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("GET %s: status %d", target, res.StatusCode)
+	}
+
+	if got := res.Header.Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 2-5/10")
+	}
+
+	if got := body(t, res); got != "2345" {
+		t.Errorf("body = %q, want %q", got, "2345")
+	}
+
+	res = serve(h, "GET", "/films/"+url.PathEscape("Missing.f9.mkv"), nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of an unknown file: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestMemoryStorageSearch(t *testing.T) {
+	memory := NewMemoryStorage()
+	memory.Replace(Items{
+		Folders: []ds.Folder{{ID: "films", Name: "Films"}},
+		Files: []ds.File{
+			{ID: "a", Name: "Heat (1995).mkv", Parent: "films"},
+			{ID: "b", Name: "Heat (1986).mkv", Parent: "films"},
+		},
+	})
+
+	for _, c := range []struct{ limit, offset, want int }{{-1, 0, 2}, {0, 0, 2}, {1, 0, 1}, {5, 0, 2}, {1, 1, 1}, {0, 1, 1}, {1, 2, 0}, {1, 5, 0}} {
+		files, _, err := memory.Search(context.Background(), "heat", c.limit, c.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != c.want {
+			t.Errorf("Search with limit %d and offset %d: %d files, want %d", c.limit, c.offset, len(files), c.want)
+		}
+	}
+}
+
+// countingStorage counts the queries for the times of items.
+type countingStorage struct {
+	*MemoryStorage
+	itemTimes int64
+}
+
+func (c *countingStorage) ItemTimes(ctx context.Context, ids []string) (map[string]ItemTime, error) {
+	atomic.AddInt64(&c.itemTimes, 1)
+	return c.MemoryStorage.ItemTimes(ctx, ids)
+}
+
+func TestMemoryStoragePreconditions(t *testing.T) {
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	memory := NewMemoryStorage()
+	memory.Replace(Items{
+		Folders: []ds.Folder{
+			{ID: "films", Name: "Films"},
+			{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+		},
+		Files:  []ds.File{{ID: "f1", Name: "Inception (2010).mkv", Parent: "inception", Size: 10, MD5: "a"}},
+		Drives: map[string]string{"f1": "memory"},
+		Times:  []ItemTime{{ID: "f1", Created: modified, Modified: modified}},
+	})
+
+	storage := &countingStorage{MemoryStorage: memory}
+	s := NewStream(Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   newTestStore(t),
+		Storage: storage,
+		Sources: []Source{memorySource{id: "memory", files: map[string][]byte{"f1": []byte("0123456789")}}},
+	})
+
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&storage.itemTimes, 0)
+	h := s.Handler()
+	target := "/films/" + url.PathEscape("Inception (2010).f1.mkv")
+
+	res := serve(h, "GET", target, map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)})
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with If-Modified-Since: status %d, want 304", res.StatusCode)
+	}
+
+	res = serve(h, "GET", target, nil)
+	if got := res.Header.Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", got, modified.Format(http.TimeFormat))
+	}
+
+	if n := atomic.LoadInt64(&storage.itemTimes); n != 0 {
+		t.Errorf("%d queries for the times of files after the Refresh, want none", n)
+	}
+}
@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// An IndexEntry is an entry of a collection as listed for browsers.
+type IndexEntry struct {
+	Entry
+	Modified *time.Time `json:"modified,omitempty"`
+	Download string     `json:"download,omitempty"`
+}
+
+// An Index lists the entries of a collection for browsers.
+type Index struct {
+	Href    string       `json:"href"`
+	Name    string       `json:"name"`
+	Parent  string       `json:"parent,omitempty"`
+	Sort    string       `json:"sort"`
+	Order   string       `json:"order"`
+	Entries []IndexEntry `json:"entries"`
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// downloadHref returns the href which serves the file as an attachment.
+func downloadHref(href string) string {
+	return href + "?download=1"
+}
+
+// setDownload asks the browser to save the file when the request is a download.
+func setDownload(w http.ResponseWriter, r *http.Request, name string) {
+	if r.URL.Query().Get("download") == "" {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(name))
+}
+
+// sortIndex orders the entries by `name`, `size` or `modified`, with folders first.
+func sortIndex(entries []IndexEntry, by string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Folder != b.Folder {
+			return a.Folder
+		}
+
+		if desc {
+			a, b = b, a
+		}
+
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			var at, bt time.Time
+			if a.Modified != nil {
+				at = *a.Modified
+			}
+
+			if b.Modified != nil {
+				bt = *b.Modified
+			}
+
+			if !at.Equal(bt) {
+				return at.Before(bt)
+			}
+		}
+
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// index creates the index of the collection with the modification times of the entries.
+func (h Stream) index(r *http.Request, collection Response, entries []Entry) (Index, error) {
+	q := r.URL.Query()
+	index := Index{
+		Href:    collection.Href,
+		Name:    collection.Propstat.Prop.DisplayName,
+		Sort:    q.Get("sort"),
+		Order:   q.Get("order"),
+		Entries: make([]IndexEntry, 0, len(entries)),
+	}
+
+	if index.Sort != "size" && index.Sort != "modified" {
+		index.Sort = "name"
+	}
+
+	if index.Order != "desc" {
+		index.Order = "asc"
+	}
+
+	if trimmed := strings.TrimSuffix(index.Href, "/"); trimmed != "" {
+		index.Parent = strings.TrimSuffix(path.Dir(trimmed), "/") + "/"
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.ID != "" {
+			ids = append(ids, e.ID)
+		}
+	}
+
+	times, err := h.storage.ItemTimes(r.Context(), ids)
+	if err != nil {
+		return index, err
+	}
+
+	for _, e := range entries {
+		ie := IndexEntry{Entry: e}
+		if t, ok := times[e.ID]; ok {
+			ie.Modified = &t.Modified
+		}
+
+		if e.Folder && !strings.HasSuffix(ie.Href, "/") {
+			ie.Href += "/"
+		}
+
+		if !e.Folder {
+			ie.Download = downloadHref(e.Href)
+		}
+
+		index.Entries = append(index.Entries, ie)
+	}
+
+	sortIndex(index.Entries, index.Sort, index.Order == "desc")
+	return index, nil
+}
+
+// writeIndex writes the collection as an HTML page, or as JSON when requested by the client.
+func (h Stream) writeIndex(w http.ResponseWriter, r *http.Request, collection Response, entries []Entry) {
+	index, err := h.index(r, collection, entries)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, index)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, index); err != nil {
+		fmt.Println(err)
+	}
+}
+
+var indexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"bytes": func(size int) string {
+		return humanize.Bytes(uint64(size))
+	},
+	"ago": humanize.Time,
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+	// sortHref links to the index ordered by the column, reversing the order when already sorted by it.
+	"sortHref": func(index Index, by string) string {
+		order := "asc"
+		if index.Sort == by && index.Order == "asc" {
+			order = "desc"
+		}
+
+		return "?sort=" + by + "&order=" + order
+	},
+}).Parse(indexHTML))
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Name}}{{.Name}}{{else}}Stream{{end}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; margin: 2rem auto; max-width: 60rem; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.4rem; font-weight: 600; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: .4rem .6rem; text-align: left; border-bottom: 1px solid #eee; }
+th a { color: inherit; }
+td.size, td.modified, th.size, th.modified { white-space: nowrap; }
+td.size, th.size { text-align: right; }
+a { color: #0b62d6; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{if .Name}}{{.Name}}{{else}}Stream{{end}}</h1>
+<table>
+<thead>
+<tr>
+<th><a href="{{sortHref . "name"}}">Name</a></th>
+<th class="size"><a href="{{sortHref . "size"}}">Size</a></th>
+<th class="modified"><a href="{{sortHref . "modified"}}">Modified</a></th>
+<th></th>
+</tr>
+</thead>
+<tbody>
+{{- if .Parent}}
+<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr>
+{{- if .Folder}}
+<td><a href="{{.Href}}">{{.Name}}/</a></td>
+<td class="size muted">-</td>
+{{- else}}
+<td><a href="{{.Href}}">{{.Name}}</a></td>
+<td class="size">{{bytes .Size}}</td>
+{{- end}}
+<td class="modified">{{with .Modified}}<span title="{{rfc3339 .}}">{{ago .}}</span>{{else}}<span class="muted">-</span>{{end}}</td>
+<td>{{if not .Folder}}<a href="{{.Href}}">stream</a> · <a href="{{.Download}}">download</a>{{end}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+func newIndexStream(t *testing.T) Stream {
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+		{ID: "alien", Name: "Alien (1979)", Parent: "films"},
+		{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+	}, []ds.File{
+		{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 30},
+		{ID: "f2", Name: "alien (1979).mkv", Parent: "alien", Size: 10},
+		{ID: "f3", Name: "Inception (2010).mkv", Parent: "inception", Size: 20},
+	})
+
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := store.saveTimes(context.Background(), "drive", []ItemTime{
+		{ID: "f1", Created: modified, Modified: modified},
+		{ID: "f2", Created: modified, Modified: modified.AddDate(2, 0, 0)},
+		{ID: "f3", Created: modified, Modified: modified.AddDate(1, 0, 0)},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store})
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestIndexSort(t *testing.T) {
+	h := newIndexStream(t).Handler()
+
+	tests := []struct {
+		query       string
+		want        []string
+		sort, order string
+	}{
+		{"", []string{"f2", "f1", "f3"}, "name", "asc"},
+		{"?sort=name&order=desc", []string{"f3", "f1", "f2"}, "name", "desc"},
+		{"?sort=size", []string{"f2", "f3", "f1"}, "size", "asc"},
+		{"?sort=size&order=desc", []string{"f1", "f3", "f2"}, "size", "desc"},
+		{"?sort=modified", []string{"f1", "f3", "f2"}, "modified", "asc"},
+		{"?sort=modified&order=desc", []string{"f2", "f3", "f1"}, "modified", "desc"},
+		{"?sort=unknown&order=unknown", []string{"f2", "f1", "f3"}, "name", "asc"},
+	}
+
+	for _, tt := range tests {
+		res := serve(h, "GET", "/films"+tt.query, map[string]string{"Accept": "application/json"})
+
+		var index Index
+		if err := json.NewDecoder(res.Body).Decode(&index); err != nil {
+			t.Fatalf("GET /films%s: %v", tt.query, err)
+		}
+
+		if index.Sort != tt.sort || index.Order != tt.order {
+			t.Errorf("GET /films%s: sorted by %s %s, want %s %s", tt.query, index.Sort, index.Order, tt.sort, tt.order)
+		}
+
+		var got []string
+		for _, e := range index.Entries {
+			got = append(got, e.ID)
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /films%s: entries %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// Folders are listed before files, whatever the order.
+func TestIndexFoldersFirst(t *testing.T) {
+	entries := []IndexEntry{
+		{Entry: Entry{Name: "a.mkv", Size: 1}},
+		{Entry: Entry{Name: "z", Folder: true}},
+		{Entry: Entry{Name: "b.mkv", Size: 2}},
+		{Entry: Entry{Name: "y", Folder: true}},
+	}
+
+	sortIndex(entries, "size", true)
+	for i, want := range []string{"z", "y", "b.mkv", "a.mkv"} {
+		if entries[i].Name != want {
+			t.Errorf("entry %d = %s, want %s", i, entries[i].Name, want)
+		}
+	}
+}
+
+func TestIndexNegotiation(t *testing.T) {
+	h := newIndexStream(t).Handler()
+
+	res := serve(h, "GET", "/films", map[string]string{"Accept": "application/json, text/plain"})
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") || res.Header.Get("Vary") != "Accept" {
+		t.Errorf("JSON index: Content-Type %q and Vary %q", ct, res.Header.Get("Vary"))
+	}
+
+	var index Index
+	if err := json.NewDecoder(res.Body).Decode(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	if index.Parent != "/" || index.Entries[0].Modified == nil || index.Entries[0].Download != index.Entries[0].Href+"?download=1" {
+		t.Errorf("JSON index = %+v", index)
+	}
+
+	for _, accept := range []string{"", "text/html,application/xhtml+xml,*/*;q=0.8"} {
+		res := serve(h, "GET", "/films", map[string]string{"Accept": accept})
+		if ct := res.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" || res.Header.Get("Vary") != "Accept" {
+			t.Errorf("index with Accept %q: Content-Type %q and Vary %q", accept, ct, res.Header.Get("Vary"))
+		}
+
+		page := body(t, res)
+		if !strings.Contains(page, `href="?sort=size&amp;order=asc"`) || !strings.Contains(page, "alien (1979).mkv") {
+			t.Errorf("HTML index with Accept %q:\n%s", accept, page)
+		}
+	}
+
+	// The root has no parent, and its folders have no download.
+	var root Index
+	res = serve(h, "GET", "/", map[string]string{"Accept": "application/json"})
+	if err := json.NewDecoder(res.Body).Decode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if root.Parent != "" || len(root.Entries) == 0 {
+		t.Errorf("JSON index of / = %+v", root)
+	}
+
+	for _, e := range root.Entries {
+		if !e.Folder || !strings.HasSuffix(e.Href, "/") || e.Download != "" {
+			t.Errorf("entry of / = %+v, want a folder without a download", e)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	h := newIndexStream(t).Handler()
+
+	res := serve(h, "GET", "/films", map[string]string{"Accept": "application/json"})
+
+	var index Index
+	if err := json.NewDecoder(res.Body).Decode(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, download := range []bool{false, true} {
+		target := index.Entries[0].Href
+		if download {
+			target = index.Entries[0].Download
+		}
+
+		res := serve(h, "HEAD", target, nil)
+		got := res.Header.Get("Content-Disposition")
+		if download != strings.HasPrefix(got, "attachment; filename*=UTF-8''alien%20%281979%29.mkv") {
+			t.Errorf("HEAD %s: status %d, Content-Disposition %q", target, res.StatusCode, got)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package stream
+
+import (
+	"context"
+	"net/url"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// An Entry is a file or folder as exposed by the WebDAV server.
+type Entry struct {
+	Href   string `json:"href"`
+	Name   string `json:"name"`
+	ID     string `json:"id"`
+	Folder bool   `json:"folder"`
+	Size   int    `json:"size,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+func fileEntry(href string, f ds.File) Entry {
+	return Entry{Href: href, Name: f.Name, ID: f.ID, Size: f.Size, MD5: f.MD5}
+}
+
+func folderEntry(href string, f ds.Folder) Entry {
+	return Entry{Href: href, Name: f.Name, ID: f.ID, Folder: true}
+}
+
+func (e Entry) response() Response {
+	if e.Folder {
+		return createDavFolder(e.Href, e.Name)
+	}
+
+	return createDavFile(e.Href, ds.File{ID: e.ID, Name: e.Name, Size: e.Size, MD5: e.MD5})
+}
+
+// An entrySource passes entries to fn until it returns false,
+// so listings can be written while they are read instead of being collected first.
+type entrySource func(fn func(Entry) bool) error
+
+// sliceSource passes the entries of a slice.
+func sliceSource(entries []Entry) entrySource {
+	return func(fn func(Entry) bool) error {
+		for _, e := range entries {
+			if !fn(e) {
+				break
+			}
+		}
+
+		return nil
+	}
+}
+
+// collect reads all entries of the source.
+func collect(src entrySource) (entries []Entry, err error) {
+	err = src(func(e Entry) bool {
+		entries = append(entries, e)
+		return true
+	})
+
+	return entries, err
+}
+
+// Films returns all films exposed in the `/films/` folder.
+func (h Stream) Films(ctx context.Context) ([]Entry, error) {
+	if snap := h.snapshot("/films"); snap != nil {
+		return shared(snap.entries), nil
+	}
+
+	return h.listFilms(ctx)
+}
+
+// listFilms queries the films exposed in the `/films/` folder.
+func (h Stream) listFilms(ctx context.Context) ([]Entry, error) {
+	return collect(h.queryFilms(ctx))
+}
+
+// films lists the films from the snapshot, or from the Store before the first Refresh.
+func (h Stream) films(ctx context.Context) entrySource {
+	if snap := h.snapshot("/films"); snap != nil {
+		return sliceSource(snap.entries)
+	}
+
+	return h.queryFilms(ctx)
+}
+
+func (h Stream) queryFilms(ctx context.Context) entrySource {
+	return func(fn func(Entry) bool) error {
+		o := h.options()
+		if o.aliased() {
+			return h.store.EachAliasChild(ctx, "/films", fn)
+		}
+
+		hidden, err := h.hidden(ctx, o.dedupe.Films)
+		if err != nil {
+			return err
+		}
+
+		return h.storage.EachRecursiveFile(ctx, o.filmsID, func(f ds.File) bool {
+			if !o.exposed(f.Name) || hidden[f.ID] {
+				return true
+			}
+
+			return fn(fileEntry(filmHref(f), f))
+		})
+	}
+}
+
+// Shows returns all TV show folders exposed in the `/shows/` folder.
+func (h Stream) Shows(ctx context.Context) ([]Entry, error) {
+	if snap := h.snapshot("/shows"); snap != nil {
+		return shared(snap.entries), nil
+	}
+
+	return h.listShows(ctx)
+}
+
+// listShows queries the TV show folders exposed in the `/shows/` folder.
+func (h Stream) listShows(ctx context.Context) ([]Entry, error) {
+	return collect(h.queryShows(ctx))
+}
+
+// shows lists the TV shows from the snapshot, or from the Store before the first Refresh.
+func (h Stream) shows(ctx context.Context) entrySource {
+	if snap := h.snapshot("/shows"); snap != nil {
+		return sliceSource(snap.entries)
+	}
+
+	return h.queryShows(ctx)
+}
+
+func (h Stream) queryShows(ctx context.Context) entrySource {
+	return func(fn func(Entry) bool) error {
+		o := h.options()
+		if o.aliased() {
+			return h.store.EachAliasChild(ctx, "/shows", fn)
+		}
+
+		return h.storage.EachRecursiveFolder(ctx, o.showsID, o.depth, func(f ds.Folder) bool {
+			return fn(folderEntry(showHref(f), f))
+		})
+	}
+}
+
+// Episodes returns all episodes exposed in the folder of the TV show.
+//
+// When renaming is enabled, the episodes within the season folders are returned as well.
+func (h Stream) Episodes(ctx context.Context, show ds.Folder) ([]Entry, error) {
+	if snap := h.snapshot("/shows"); snap != nil {
+		return shared(snap.episodes[show.ID]), nil
+	}
+
+	return h.listEpisodes(ctx, show)
+}
+
+// listEpisodes queries the episodes exposed in the folder of the TV show.
+func (h Stream) listEpisodes(ctx context.Context, show ds.Folder) ([]Entry, error) {
+	return collect(h.queryEpisodes(ctx, show))
+}
+
+// episodes lists the episodes from the snapshot, or from the Store before the first Refresh.
+func (h Stream) episodes(ctx context.Context, show ds.Folder) entrySource {
+	if snap := h.snapshot("/shows"); snap != nil {
+		return sliceSource(snap.episodes[show.ID])
+	}
+
+	return h.queryEpisodes(ctx, show)
+}
+
+func (h Stream) queryEpisodes(ctx context.Context, show ds.Folder) entrySource {
+	return func(fn func(Entry) bool) error {
+		o := h.options()
+		if o.aliased() {
+			showPath, err := h.store.AliasPath(ctx, show.ID)
+			if err != nil {
+				return err
+			}
+
+			return h.store.EachAliasFile(ctx, showPath, fn)
+		}
+
+		hidden, err := h.hidden(ctx, o.dedupe.Shows)
+		if err != nil {
+			return err
+		}
+
+		return h.storage.EachRecursiveFile(ctx, show.ID, func(f ds.File) bool {
+			if !o.exposed(f.Name) || hidden[f.ID] {
+				return true
+			}
+
+			return fn(fileEntry(episodeHref(show, f), f))
+		})
+	}
+}
+
+// Href returns the WebDAV path of a file given its parents, nearest parent first.
+//
+// The path is only returned if the file is listed in the `/films/` or `/shows/` folders.
+func (h Stream) Href(ctx context.Context, f ds.File, parents []ds.Folder) (string, bool) {
+	o := h.options()
+	if f.Trashed || !o.exposed(f.Name) {
+		return "", false
+	}
+
+	if o.aliased() {
+		return h.aliasHref(ctx, f.ID)
+	}
+
+	// Aliases are not created for hidden duplicates, so only the original paths are checked.
+	if hidden, err := h.store.IsDuplicate(ctx, f.ID); hidden || err != nil {
+		return "", false
+	}
+
+	for i, folder := range parents {
+		// Only files within subfolders are listed by RecursiveFiles,
+		// so files directly within the library folder are not exposed.
+		if folder.ID == o.filmsID && i > 0 {
+			return filmHref(f), true
+		}
+
+		// The TV show folder is `depth` levels below the shows folder,
+		// and the file must be within a subfolder of the TV show folder.
+		if folder.ID == o.showsID && i-o.depth > 0 {
+			return episodeHref(parents[i-o.depth], f), true
+		}
+
+		if folder.Trashed {
+			return "", false
+		}
+	}
+
+	return "", false
+}
+
+// hidden returns the files hidden by deduplication, or none when the library is not deduplicated.
+func (h Stream) hidden(ctx context.Context, dedupe bool) (map[string]bool, error) {
+	if !dedupe {
+		return nil, nil
+	}
+
+	return h.store.HiddenDuplicates(ctx)
+}
+
+func filmHref(f ds.File) string {
+	return "/films/" + url.PathEscape(fileWithID(f.Name, f.ID))
+}
+
+func showHref(show ds.Folder) string {
+	return "/shows/" + url.PathEscape(folderWithID(show.Name, show.ID))
+}
+
+func episodeHref(show ds.Folder, f ds.File) string {
+	return showHref(show) + "/" + url.PathEscape(fileWithID(f.Name, f.ID))
+}
+
+// FolderHref returns the WebDAV path of a folder given its parents, nearest parent first.
+//
+// The path is only returned if the folder is listed as a TV show in the `/shows/` folder.
+func (h Stream) FolderHref(ctx context.Context, f ds.Folder, parents []ds.Folder) (string, bool) {
+	o := h.options()
+	if f.Trashed || len(parents) < o.depth {
+		return "", false
+	}
+
+	if o.aliased() {
+		return h.aliasHref(ctx, f.ID)
+	}
+
+	for _, folder := range parents[:o.depth-1] {
+		if folder.Trashed {
+			return "", false
+		}
+	}
+
+	if parents[o.depth-1].ID != o.showsID {
+		return "", false
+	}
+
+	return showHref(f), true
+}
+
+func (h Stream) aliasHref(ctx context.Context, id string) (string, bool) {
+	p, err := h.store.AliasPath(ctx, id)
+	if err != nil {
+		return "", false
+	}
+
+	return aliasHref(p), true
+}
@@ -0,0 +1,143 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// A Mount places the contents of a directory within a folder, such as the films or shows folder.
+type Mount struct {
+	// Folder is the ID of the folder the directory is placed in.
+	Folder string
+	// Path is the directory, or the key prefix within a bucket.
+	Path string
+}
+
+// LocalSource serves the files of local directories, such as a NAS mounted on the server.
+//
+// IDs are derived from the paths, so a renamed or moved file is removed and added again.
+// Instead of their MD5 checksum, files get a checksum of their path, size and modification time.
+type LocalSource struct {
+	name   string
+	mounts []Mount
+	files  *locations
+}
+
+func NewLocalSource(name string, mounts ...Mount) LocalSource {
+	return LocalSource{
+		name:   name,
+		mounts: mounts,
+		files:  newLocations(),
+	}
+}
+
+func (l LocalSource) ID() string {
+	return l.name
+}
+
+// scan walks the mounted directories, skipping hidden files and folders.
+// The folder of every mount is included under the ID of the library folder without a parent,
+// so the items within can refer to it as their parent.
+func (l LocalSource) scan() (tree sourceTree, err error) {
+	tree.locations = make(map[string]string)
+
+	for _, m := range l.mounts {
+		root, err := filepath.Abs(m.Path)
+		if err != nil {
+			return tree, err
+		}
+
+		tree.folders = append(tree.folders, ds.Folder{ID: m.Folder, Name: filepath.Base(root)})
+		ids := map[string]string{root: m.Folder}
+
+		err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if p == root {
+				return nil
+			}
+
+			if strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			rel, _ := filepath.Rel(root, p)
+			id := sourceItemID(l.name, m.Folder, filepath.ToSlash(rel))
+			parent := ids[filepath.Dir(p)]
+			tree.times = append(tree.times, ItemTime{ID: id, Created: info.ModTime(), Modified: info.ModTime()})
+
+			if info.IsDir() {
+				ids[p] = id
+				tree.folders = append(tree.folders, ds.Folder{ID: id, Name: info.Name(), Parent: parent})
+				return nil
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			tree.locations[id] = p
+			tree.files = append(tree.files, ds.File{
+				ID:     id,
+				Name:   info.Name(),
+				Parent: parent,
+				Size:   int(info.Size()),
+				MD5:    pseudoChecksum(rel, info.Size(), info.ModTime()),
+			})
+
+			return nil
+		})
+
+		if err != nil {
+			return tree, err
+		}
+	}
+
+	return tree, nil
+}
+
+func (l LocalSource) Sync(ctx context.Context, store Store, full bool) ([]Change, error) {
+	tree, err := l.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	l.files.replace(tree.locations)
+	return store.syncTree(ctx, l.name, tree, full)
+}
+
+func (l LocalSource) Range(ctx context.Context, w io.Writer, id string, start, end uint64) (int64, error) {
+	p, err := l.files.lookup(ctx, id, l.scan)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	buf := streamingBufPool.Get().([]byte)
+	defer streamingBufPool.Put(buf)
+
+	body := &countingReader{Reader: io.NewSectionReader(f, int64(start), int64(end-start+1))}
+	_, err = io.CopyBuffer(w, body, buf)
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return body.n, err
+}
@@ -0,0 +1,208 @@
+package stream
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// newLocalStream mounts a temporary directory in the films and shows folders of a Shared Drive.
+func newLocalStream(t *testing.T) (Stream, Store, LocalSource) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	files := map[string]string{
+		"films/Inception (2010)/Inception (2010).mkv": "0123456789",
+		"films/.partial/Heat (1995).mkv":              "hidden",
+		"shows/Dark (2017)/Season 1/Dark S01E01.mkv":  "ep1",
+	}
+
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := newTestStore(t)
+	err = store.FullSync(ds.Drive{ID: "drive", Name: "Drive"}, []ds.Folder{
+		{ID: "drive", Name: "Drive"},
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+	}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewLocalSource("nas",
+		Mount{Folder: "films", Path: filepath.Join(dir, "films")},
+		Mount{Folder: "shows", Path: filepath.Join(dir, "shows")},
+	)
+
+	s := NewStream(Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   store,
+		Sources: []Source{src},
+	})
+
+	if err := NewSyncer(store, s.Refresh).Sync(context.Background(), src, SyncFull); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, store, src
+}
+
+func TestLocalSourceStream(t *testing.T) {
+	s, _, _ := newLocalStream(t)
+	h := s.Handler()
+
+	res := serve(h, "PROPFIND", "/films", map[string]string{"Depth": "1"})
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("PROPFIND /films: status %d", res.StatusCode)
+	}
+
+	film := ds.File{ID: sourceItemID("nas", "films", "Inception (2010)/Inception (2010).mkv"), Name: "Inception (2010).mkv"}
+	listing := body(t, res)
+	if !strings.Contains(listing, filmHref(film)) {
+		t.Fatalf("PROPFIND /films does not list %s:\n%s", filmHref(film), listing)
+	}
+
+	if strings.Contains(listing, "Heat") {
+		t.Errorf("PROPFIND /films lists a hidden file:\n%s", listing)
+	}
+
+	res = serve(h, "PROPFIND", "/shows", map[string]string{"Depth": "1"})
+	if listing := body(t, res); !strings.Contains(listing, "Dark (2017)") {
+		t.Errorf("PROPFIND /shows does not list the show:\n%s", listing)
+	}
+
+	res = serve(h, "GET", filmHref(film), map[string]string{"Range": "bytes=2-5"})
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("GET %s: status %d", filmHref(film), res.StatusCode)
+	}
+
+	if got := res.Header.Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 2-5/10")
+	}
+
+	if got := body(t, res); got != "2345" {
+		t.Errorf("body = %q, want %q", got, "2345")
+	}
+}
+
+// The mounts share the ID of the library folder, but are never exposed in its place.
+func TestLocalSourceMounts(t *testing.T) {
+	ctx := context.Background()
+	s, store, _ := newLocalStream(t)
+
+	names := func(folders []ds.Folder) (names []string) {
+		for _, f := range folders {
+			names = append(names, f.Name)
+		}
+
+		return names
+	}
+
+	parents, err := store.Parents(ctx, sourceItemID("nas", "films", "Inception (2010)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"Inception (2010)", "Films", "Drive"}; !reflect.DeepEqual(names(parents), want) {
+		t.Errorf("Parents = %v, want %v", names(parents), want)
+	}
+
+	memory := NewMemoryStorage()
+	if err := memory.Load(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+
+	parents, _ = memory.Parents(ctx, "films")
+	if want := []string{"Films", "Drive"}; !reflect.DeepEqual(names(parents), want) {
+		t.Errorf("Parents in memory = %v, want %v", names(parents), want)
+	}
+
+	if _, folders, err := store.Find(ctx, "films"); err != nil || len(folders) != 1 || folders[0].Name != "Films" {
+		t.Errorf("Find(films) = %v, %v, want the library folder once", folders, err)
+	}
+
+	if _, folders, err := store.Search(ctx, "films", 0, 0); err != nil || len(folders) != 1 || folders[0].Name != "Films" {
+		t.Errorf("Search(films) = %v, %v, want the library folder once", folders, err)
+	}
+
+	if _, shows, err := s.Search(ctx, "dark", 0); err != nil || len(shows) != 1 {
+		t.Errorf("Search(dark) = %v, %v, want the show", shows, err)
+	}
+
+	if err := store.Reset(ctx, "nas"); err != nil {
+		t.Fatal(err)
+	}
+
+	ancestors, err := store.Ancestors(ctx, "films")
+	if want := []string{"films", "drive"}; err != nil || !reflect.DeepEqual(ancestors, want) {
+		t.Errorf("Ancestors(films) after a reset = %v, %v, want %v", ancestors, err, want)
+	}
+}
+
+// A partial sync only updates the changed files and folders in the search index.
+func TestLocalSourcePartialSearch(t *testing.T) {
+	ctx := context.Background()
+	s, store, src := newLocalStream(t)
+
+	if _, err := store.DB.Exec(`INSERT INTO search_index (id, kind, name) VALUES ('sentinel', 'file', 'Sentinel')`); err != nil {
+		t.Fatal(err)
+	}
+
+	films := src.mounts[0].Path
+	if err := os.Rename(filepath.Join(films, "Inception (2010)"), filepath.Join(films, "Interstellar (2014)")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(films, "Heat (1995)"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(films, "Heat (1995)", "Heat (1995).mkv"), []byte("heat"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewSyncer(store, s.Refresh).Sync(ctx, src, SyncPartial); err != nil {
+		t.Fatal(err)
+	}
+
+	// The renamed folder gets a new ID, while its film keeps its name.
+	for query, want := range map[string]int{"heat": 2, "interstellar": 1, "inception": 1} {
+		files, folders, err := store.Search(ctx, query, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := len(files) + len(folders); got != want {
+			t.Errorf("Search(%s) = %v, %v, want %d results", query, files, folders, want)
+		}
+	}
+
+	// The sentinel is not an item of the Store, so a rebuild would have removed it.
+	var sentinel int
+	if err := store.DB.QueryRow(`SELECT COUNT(*) FROM search_index WHERE id = 'sentinel'`).Scan(&sentinel); err != nil || sentinel != 1 {
+		t.Errorf("the partial sync rebuilt the search index: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package stream
+
+import (
+	"context"
+
+	"github.com/m-rots/stream/parse"
+)
+
+// The media table holds the metadata parsed from the names of all files and folders.
+// The parsed name and the version of the parser are stored as well,
+// so only new and renamed items, and items parsed by another version, have to be parsed.
+const sqlMediaSchema = `
+CREATE TABLE IF NOT EXISTS media (
+	"id" text NOT NULL,
+	"drive" text NOT NULL,
+	"name" text NOT NULL,
+	"parser" integer NOT NULL,
+	"title" text NOT NULL,
+	"year" integer NOT NULL,
+	"season" integer NOT NULL,
+	"episode" integer NOT NULL,
+	"episode_end" integer NOT NULL,
+	"resolution" text NOT NULL,
+	"source" text NOT NULL,
+	"codec" text NOT NULL,
+	"edition" text NOT NULL,
+	"release_group" text NOT NULL,
+	"extension" text NOT NULL,
+	PRIMARY KEY(id, drive)
+);
+
+CREATE INDEX IF NOT EXISTS media_title ON media(title, year);
+`
+
+func (s Store) createMediaTable() error {
+	if _, err := s.DB.Exec(sqlMediaSchema); err != nil {
+		return err
+	}
+
+	return s.UpdateMedia(context.Background())
+}
+
+const sqlUnparsed = `
+SELECT file.id, file.drive, file.name FROM file
+LEFT JOIN media ON media.id = file.id AND media.drive = file.drive
+WHERE media.name IS NOT file.name OR media.parser IS NOT ?
+UNION ALL
+SELECT folder.id, folder.drive, folder.name FROM folder
+LEFT JOIN media ON media.id = folder.id AND media.drive = folder.drive
+WHERE media.name IS NOT folder.name OR media.parser IS NOT ?
+`
+
+const sqlUpsertMedia = `
+INSERT INTO media (id, drive, name, parser, title, year, season, episode, episode_end, resolution, source, codec, edition, release_group, extension)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id, drive) DO UPDATE SET
+		name=excluded.name,
+		parser=excluded.parser,
+		title=excluded.title,
+		year=excluded.year,
+		season=excluded.season,
+		episode=excluded.episode,
+		episode_end=excluded.episode_end,
+		resolution=excluded.resolution,
+		source=excluded.source,
+		codec=excluded.codec,
+		edition=excluded.edition,
+		release_group=excluded.release_group,
+		extension=excluded.extension
+`
+
+const sqlDeleteOrphanMedia = `
+DELETE FROM media WHERE
+	NOT EXISTS (SELECT 1 FROM file WHERE file.id = media.id AND file.drive = media.drive) AND
+	NOT EXISTS (SELECT 1 FROM folder WHERE folder.id = media.id AND folder.drive = media.drive)
+`
+
+// UpdateMedia parses the names of all new and renamed files and folders, and of those parsed by
+// another version of the parser. The metadata of deleted items is removed.
+func (s Store) UpdateMedia(ctx context.Context) error {
+	type item struct {
+		id, drive, name string
+	}
+
+	rows, err := s.DB.QueryContext(ctx, sqlUnparsed, parse.Version, parse.Version)
+	if err != nil {
+		return err
+	}
+
+	var items []item
+	for rows.Next() {
+		i := item{}
+		if err := rows.Scan(&i.id, &i.drive, &i.name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		items = append(items, i)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	upsert, err := tx.PrepareContext(ctx, sqlUpsertMedia)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer upsert.Close()
+	for _, i := range items {
+		m := parse.Name(i.name)
+
+		_, err := upsert.ExecContext(ctx, i.id, i.drive, i.name, parse.Version, m.Title, m.Year, m.Season, m.Episode, m.EpisodeEnd,
+			m.Resolution, m.Source, m.Codec, m.Edition, m.Group, m.Extension)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlDeleteOrphanMedia); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const sqlGetMedia = `
+SELECT title, year, season, episode, episode_end, resolution, source, codec, edition, release_group, extension
+FROM media WHERE id = ?
+`
+
+// Media retrieves the metadata parsed from the name of a file or folder.
+func (s Store) Media(ctx context.Context, id string) (parse.Media, error) {
+	m := parse.Media{}
+
+	row := s.DB.QueryRowContext(ctx, sqlGetMedia, id)
+	err := row.Scan(&m.Title, &m.Year, &m.Season, &m.Episode, &m.EpisodeEnd,
+		&m.Resolution, &m.Source, &m.Codec, &m.Edition, &m.Group, &m.Extension)
+	return m, err
+}
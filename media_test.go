@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+// Only new and renamed items are parsed, unless they were parsed by another version of the parser.
+func TestUpdateMedia(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncedStore(t, []ds.Folder{{ID: "films", Name: "Films", Parent: "drive"}}, []ds.File{
+		{ID: "f1", Name: "Movie.4K.HDR.mkv", Parent: "films"},
+		{ID: "f2", Name: "Heat (1995).mkv", Parent: "films"},
+	})
+
+	if m, err := store.Media(ctx, "f1"); err != nil || m.Title != "Movie" || m.Resolution != "2160p" {
+		t.Fatalf("Media(f1) = %+v, %v", m, err)
+	}
+
+	// f1 was parsed by an older parser, while f2 is up to date.
+	_, err := store.DB.Exec(`UPDATE media SET title = 'Movie 4K HDR', resolution = '', parser = ? WHERE id = 'f1'`, parse.Version-1)
+	if err == nil {
+		_, err = store.DB.Exec(`UPDATE media SET title = 'Kept' WHERE id = 'f2'`)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateMedia(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := store.Media(ctx, "f1"); err != nil || m.Title != "Movie" || m.Resolution != "2160p" {
+		t.Errorf("Media(f1) after updating the parser = %+v, %v", m, err)
+	}
+
+	if m, err := store.Media(ctx, "f2"); err != nil || m.Title != "Kept" {
+		t.Errorf("Media(f2) = %+v, %v, want it not parsed again", m, err)
+	}
+}
@@ -0,0 +1,257 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrNoMetadata is returned by a MetadataProvider when it does not know the film or TV show.
+var ErrNoMetadata = errors.New("stream: no metadata")
+
+// Metadata describes a film or TV show in more detail than its name.
+type Metadata struct {
+	// Type is either `film` or `show`.
+	Type          string   `json:"type"`
+	Title         string   `json:"title"`
+	Year          int      `json:"year,omitempty"`
+	OriginalTitle string   `json:"original_title,omitempty"`
+	Plot          string   `json:"plot,omitempty"`
+	Tagline       string   `json:"tagline,omitempty"`
+	Genres        []string `json:"genres,omitempty"`
+	Rating        float64  `json:"rating,omitempty"`
+	Runtime       int      `json:"runtime,omitempty"`
+	IMDb          string   `json:"imdb,omitempty"`
+	TMDb          string   `json:"tmdb,omitempty"`
+	TVDb          string   `json:"tvdb,omitempty"`
+
+	// Poster and Fanart are paths within the artwork directory, or absolute URLs.
+	Poster string `json:"poster,omitempty"`
+	Fanart string `json:"fanart,omitempty"`
+}
+
+// A MetadataProvider looks up the metadata of films and TV shows by their parsed title and year.
+// The year is zero when unknown.
+type MetadataProvider interface {
+	FilmMetadata(ctx context.Context, title string, year int) (Metadata, error)
+	ShowMetadata(ctx context.Context, title string, year int) (Metadata, error)
+}
+
+// titleKey reduces a title to its lowercase letters and digits,
+// so `Some.Film` and `Some Film!` are the same film.
+func titleKey(title string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+
+		return -1
+	}, title)
+}
+
+// ReadDataset reads the metadata of a dataset in the `json` or `csv` format.
+//
+// A JSON dataset is an array of objects with the fields of Metadata.
+// A CSV dataset starts with a header of the same field names, with the genres separated by `|`.
+func ReadDataset(r io.Reader, format string) ([]Metadata, error) {
+	var items []Metadata
+
+	switch strings.ToLower(format) {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&items); err != nil {
+			return nil, err
+		}
+	case "csv":
+		var err error
+		if items, err = readCSVDataset(r); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("stream: unknown dataset format %q", format)
+	}
+
+	for i, m := range items {
+		if m.Type != "film" && m.Type != "show" {
+			return nil, fmt.Errorf("stream: item %d: type must be `film` or `show`, got %q", i+1, m.Type)
+		}
+
+		if titleKey(m.Title) == "" {
+			return nil, fmt.Errorf("stream: item %d: missing title", i+1)
+		}
+	}
+
+	return items, nil
+}
+
+func readCSVDataset(r io.Reader) (items []Metadata, err error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	for line, record := range records[1:] {
+		m := Metadata{}
+
+		for i, field := range header {
+			value := strings.TrimSpace(record[i])
+			if value == "" {
+				continue
+			}
+
+			switch strings.TrimSpace(field) {
+			case "type":
+				m.Type = value
+			case "title":
+				m.Title = value
+			case "year":
+				m.Year, err = strconv.Atoi(value)
+			case "original_title":
+				m.OriginalTitle = value
+			case "plot":
+				m.Plot = value
+			case "tagline":
+				m.Tagline = value
+			case "genres":
+				m.Genres = strings.Split(value, "|")
+			case "rating":
+				m.Rating, err = strconv.ParseFloat(value, 64)
+			case "runtime":
+				m.Runtime, err = strconv.Atoi(value)
+			case "imdb":
+				m.IMDb = value
+			case "tmdb":
+				m.TMDb = value
+			case "tvdb":
+				m.TVDb = value
+			case "poster":
+				m.Poster = value
+			case "fanart":
+				m.Fanart = value
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("stream: line %d: invalid %s: %w", line+2, field, err)
+			}
+		}
+
+		items = append(items, m)
+	}
+
+	return items, nil
+}
+
+// The metadata table holds the imported dataset, which is used as the offline MetadataProvider.
+const sqlMetadataSchema = `
+CREATE TABLE IF NOT EXISTS metadata (
+	"type" text NOT NULL,
+	"title_key" text NOT NULL,
+	"year" integer NOT NULL,
+	"title" text NOT NULL,
+	"original_title" text NOT NULL,
+	"plot" text NOT NULL,
+	"tagline" text NOT NULL,
+	"genres" text NOT NULL,
+	"rating" real NOT NULL,
+	"runtime" integer NOT NULL,
+	"imdb" text NOT NULL,
+	"tmdb" text NOT NULL,
+	"tvdb" text NOT NULL,
+	"poster" text NOT NULL,
+	"fanart" text NOT NULL,
+	PRIMARY KEY(type, title_key, year)
+);
+`
+
+func (s Store) createMetadataTable() error {
+	_, err := s.DB.Exec(sqlMetadataSchema)
+	return err
+}
+
+const sqlUpsertMetadata = `
+INSERT OR REPLACE INTO metadata (type, title_key, year, title, original_title, plot, tagline, genres, rating, runtime, imdb, tmdb, tvdb, poster, fanart)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// ImportMetadata adds the items of a dataset to the database, replacing items with the same type, title and year.
+// With replace, all previously imported items are removed first.
+func (s Store) ImportMetadata(ctx context.Context, items []Metadata, replace bool) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM metadata`); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, sqlUpsertMetadata)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer stmt.Close()
+
+	for _, m := range items {
+		_, err := stmt.ExecContext(ctx, m.Type, titleKey(m.Title), m.Year, m.Title, m.OriginalTitle,
+			m.Plot, m.Tagline, strings.Join(m.Genres, "|"), m.Rating, m.Runtime,
+			m.IMDb, m.TMDb, m.TVDb, m.Poster, m.Fanart)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// An exact year is preferred, but items without a year match any year and the other way around.
+const sqlGetMetadata = `
+SELECT type, year, title, original_title, plot, tagline, genres, rating, runtime, imdb, tmdb, tvdb, poster, fanart
+FROM metadata
+WHERE type = ? AND title_key = ? AND (year = ? OR year = 0 OR ? = 0)
+ORDER BY year = ? DESC, year DESC
+LIMIT 1
+`
+
+func (s Store) metadata(ctx context.Context, kind, title string, year int) (m Metadata, err error) {
+	var genres string
+
+	row := s.DB.QueryRowContext(ctx, sqlGetMetadata, kind, titleKey(title), year, year, year)
+	err = row.Scan(&m.Type, &m.Year, &m.Title, &m.OriginalTitle, &m.Plot, &m.Tagline, &genres,
+		&m.Rating, &m.Runtime, &m.IMDb, &m.TMDb, &m.TVDb, &m.Poster, &m.Fanart)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrNoMetadata
+	}
+
+	if genres != "" {
+		m.Genres = strings.Split(genres, "|")
+	}
+
+	return m, err
+}
+
+// FilmMetadata looks up the film in the imported dataset.
+func (s Store) FilmMetadata(ctx context.Context, title string, year int) (Metadata, error) {
+	return s.metadata(ctx, "film", title, year)
+}
+
+// ShowMetadata looks up the TV show in the imported dataset.
+func (s Store) ShowMetadata(ctx context.Context, title string, year int) (Metadata, error) {
+	return s.metadata(ctx, "show", title, year)
+}
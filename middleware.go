@@ -2,10 +2,12 @@ package stream
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	ds "github.com/m-rots/bernard/datastore"
@@ -17,6 +19,7 @@ type ctxKey int
 const (
 	requestIDKey = ctxKey(0)
 	fileKey      = ctxKey(1)
+	userKey      = ctxKey(2)
 )
 
 func withRequestID(ctx context.Context, id string) context.Context {
@@ -52,8 +55,9 @@ func (h Stream) addFile(next httprouter.Handle) httprouter.Handle {
 			return
 		}
 
-		f, err := h.store.GetFile(r.Context(), id)
-		if errors.Is(sql.ErrNoRows, err) {
+		// Files outside the extension filter are not served either.
+		f, err := h.storage.GetFile(r.Context(), id)
+		if errors.Is(sql.ErrNoRows, err) || (err == nil && !h.options().exposed(f.Name)) {
 			http.NotFound(w, r)
 			return
 		}
@@ -69,3 +73,35 @@ func (h Stream) addFile(next httprouter.Handle) httprouter.Handle {
 		next(w, r.WithContext(ctx), ps)
 	}
 }
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// getUser returns the authenticated user, or an empty string when authentication is disabled.
+func getUser(ctx context.Context) string {
+	user, _ := ctx.Value(userKey).(string)
+	return user
+}
+
+// authenticate requires HTTP Basic authentication when users are configured.
+// Share links are signed instead, so they do not require authentication.
+func (h Stream) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users := h.options().users
+		if len(users) == 0 || strings.HasPrefix(r.URL.Path, "/s/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		expected, exists := users[user]
+		if !ok || !exists || subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Stream"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+	})
+}
@@ -0,0 +1,565 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+// NFO configures the virtual `movie.nfo` and `tvshow.nfo` files,
+// which let Kodi skip scraping the libraries over WebDAV.
+type NFO struct {
+	Enabled bool
+	// Artwork is the local directory served at `/artwork/`,
+	// from which the poster and fanart paths of the metadata are served.
+	Artwork string
+	// Provider adds metadata to the parsed names,
+	// defaults to the dataset imported into the Store.
+	Provider MetadataProvider
+}
+
+type nfoUniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr,omitempty"`
+	ID      string `xml:",chardata"`
+}
+
+type nfoThumb struct {
+	Aspect string `xml:"aspect,attr,omitempty"`
+	URL    string `xml:",chardata"`
+}
+
+type nfoFanart struct {
+	Thumbs []nfoThumb `xml:"thumb"`
+}
+
+// nfoDocument is the root element of both `movie.nfo` and `tvshow.nfo` files.
+type nfoDocument struct {
+	XMLName       xml.Name
+	Title         string        `xml:"title"`
+	OriginalTitle string        `xml:"originaltitle,omitempty"`
+	Year          int           `xml:"year,omitempty"`
+	Plot          string        `xml:"plot,omitempty"`
+	Tagline       string        `xml:"tagline,omitempty"`
+	Runtime       int           `xml:"runtime,omitempty"`
+	Rating        float64       `xml:"rating,omitempty"`
+	Genres        []string      `xml:"genre"`
+	UniqueIDs     []nfoUniqueID `xml:"uniqueid"`
+	Thumbs        []nfoThumb    `xml:"thumb"`
+	Fanart        *nfoFanart    `xml:"fanart"`
+}
+
+// artworkURL returns the URL of a poster or fanart path within the artwork directory.
+func (o options) artworkURL(base, p string) string {
+	if p == "" || strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://") {
+		return p
+	}
+
+	if o.nfo.Artwork == "" {
+		return ""
+	}
+
+	u := url.URL{Path: "/artwork/" + strings.TrimPrefix(p, "/")}
+	return base + u.EscapedPath()
+}
+
+// nfo creates the NFO file of the parsed media and its metadata, if known.
+func (h Stream) nfo(ctx context.Context, root string, m parse.Media, base string) ([]byte, error) {
+	doc, err := h.nfoDocument(ctx, root, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeNFO(doc, base)
+}
+
+// nfoDocument creates the NFO document of the parsed media and its metadata, if known.
+// The artwork URLs are left relative to the base URL of the request.
+func (h Stream) nfoDocument(ctx context.Context, root string, m parse.Media) (nfoDocument, error) {
+	o := h.options()
+	doc := nfoDocument{XMLName: xml.Name{Local: root}, Title: m.Title, Year: m.Year}
+
+	var meta Metadata
+	var err error
+	if root == "movie" {
+		meta, err = o.nfo.Provider.FilmMetadata(ctx, m.Title, m.Year)
+	} else {
+		meta, err = o.nfo.Provider.ShowMetadata(ctx, m.Title, m.Year)
+	}
+
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return doc, err
+	}
+
+	if err == nil {
+		doc.Title = meta.Title
+		if meta.Year != 0 {
+			doc.Year = meta.Year
+		}
+
+		doc.OriginalTitle = meta.OriginalTitle
+		doc.Plot = meta.Plot
+		doc.Tagline = meta.Tagline
+		doc.Runtime = meta.Runtime
+		doc.Rating = meta.Rating
+		doc.Genres = meta.Genres
+
+		for _, id := range []nfoUniqueID{{Type: "imdb", ID: meta.IMDb}, {Type: "tmdb", ID: meta.TMDb}, {Type: "tvdb", ID: meta.TVDb}} {
+			if id.ID != "" {
+				id.Default = len(doc.UniqueIDs) == 0
+				doc.UniqueIDs = append(doc.UniqueIDs, id)
+			}
+		}
+
+		if poster := o.artworkURL("", meta.Poster); poster != "" {
+			doc.Thumbs = append(doc.Thumbs, nfoThumb{Aspect: "poster", URL: poster})
+		}
+
+		if fanart := o.artworkURL("", meta.Fanart); fanart != "" {
+			doc.Fanart = &nfoFanart{Thumbs: []nfoThumb{{URL: fanart}}}
+		}
+	}
+
+	return doc, nil
+}
+
+// encodeNFO encodes the NFO document, with its relative artwork URLs completed by the base URL.
+func encodeNFO(doc nfoDocument, base string) ([]byte, error) {
+	doc.Thumbs = withBase(doc.Thumbs, base)
+	if doc.Fanart != nil {
+		doc.Fanart = &nfoFanart{Thumbs: withBase(doc.Fanart.Thumbs, base)}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// withBase copies the thumbs, adding the base URL to the relative URLs.
+func withBase(thumbs []nfoThumb, base string) []nfoThumb {
+	copied := make([]nfoThumb, len(thumbs))
+	for i, t := range thumbs {
+		if strings.HasPrefix(t.URL, "/") {
+			t.URL = base + t.URL
+		}
+
+		copied[i] = t
+	}
+
+	return copied
+}
+
+// relativeThumbs counts the artwork URLs of the NFO document which start with the base URL.
+func (doc nfoDocument) relativeThumbs() (n int) {
+	thumbs := [][]nfoThumb{doc.Thumbs}
+	if doc.Fanart != nil {
+		thumbs = append(thumbs, doc.Fanart.Thumbs)
+	}
+
+	for _, list := range thumbs {
+		for _, t := range list {
+			if strings.HasPrefix(t.URL, "/") {
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// A preparedNFO is the NFO of a film or TV show as of the last Refresh,
+// so listing the libraries does not query the metadata of every item.
+type preparedNFO struct {
+	doc nfoDocument
+	// size and hash exclude the base URL, which precedes each of the relative artwork URLs.
+	size     int
+	hash     string
+	relative int
+}
+
+// sizeAt returns the size of the NFO file served with the base URL.
+func (n preparedNFO) sizeAt(base string) int {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(base))
+	return n.size + n.relative*b.Len()
+}
+
+// prepareNFOs prepares the `movie.nfo` of every film with a title in `/films`,
+// or the `tvshow.nfo` of every TV show in `/shows`.
+func (h Stream) prepareNFOs(ctx context.Context, root string, entries []Entry) (map[string]preparedNFO, error) {
+	films := root == "/films"
+	nfos := make(map[string]preparedNFO, len(entries))
+
+	for _, e := range entries {
+		if e.Folder == films {
+			continue
+		}
+
+		m, err := h.media(ctx, e.ID, e.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Like ShowNFO, TV shows without a parsed title are named after their folder.
+		kind := "movie"
+		if !films {
+			kind = "tvshow"
+			if m.Title == "" {
+				m.Title = e.Name
+			}
+		}
+
+		if m.Title == "" {
+			continue
+		}
+
+		doc, err := h.nfoDocument(ctx, kind, m)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := encodeNFO(doc, "")
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha1.Sum(b)
+		nfos[e.ID] = preparedNFO{doc: doc, size: len(b), hash: hex.EncodeToString(sum[:]), relative: doc.relativeThumbs()}
+	}
+
+	return nfos, nil
+}
+
+// media returns the parsed name of the file or folder,
+// parsing the name directly when the item has not been synced yet.
+func (h Stream) media(ctx context.Context, id, name string) (parse.Media, error) {
+	m, err := h.storage.Media(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return parse.Name(name), nil
+	}
+
+	return m, err
+}
+
+// FilmNFO returns the `movie.nfo` of the film, or false when no title can be parsed from its name.
+// Films within the snapshot of the films are served from their prepared NFO.
+func (h Stream) FilmNFO(ctx context.Context, f ds.File, base string) ([]byte, bool, error) {
+	if snap := h.snapshot("/films"); snap != nil && snap.nfos != nil {
+		if n, ok := snap.nfos[f.ID]; ok {
+			b, err := encodeNFO(n.doc, base)
+			return b, err == nil, err
+		}
+	}
+
+	m, err := h.media(ctx, f.ID, f.Name)
+	if err != nil || m.Title == "" {
+		return nil, false, err
+	}
+
+	b, err := h.nfo(ctx, "movie", m, base)
+	return b, err == nil, err
+}
+
+// ShowNFO returns the `tvshow.nfo` of the TV show, from its prepared NFO when within the snapshot of the shows.
+// The name of the folder is used as the title when no title can be parsed from it.
+func (h Stream) ShowNFO(ctx context.Context, show ds.Folder, base string) ([]byte, error) {
+	if snap := h.snapshot("/shows"); snap != nil && snap.nfos != nil {
+		if n, ok := snap.nfos[show.ID]; ok {
+			return encodeNFO(n.doc, base)
+		}
+	}
+
+	m, err := h.media(ctx, show.ID, show.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Title == "" {
+		m.Title = show.Name
+	}
+
+	return h.nfo(ctx, "tvshow", m, base)
+}
+
+// nfoAt returns the NFO file at the WebDAV path, or false when the path is not an NFO file.
+//
+// Films are given a `movie.nfo` when they are within their own folder,
+// otherwise the NFO has the same name as the film. TV shows are given a `tvshow.nfo`.
+func (h Stream) nfoAt(ctx context.Context, p, base string) ([]byte, bool, error) {
+	o := h.options()
+	dir, name := path.Split(strings.TrimSuffix(p, "/"))
+	dir = strings.TrimSuffix(dir, "/")
+
+	if name == "tvshow.nfo" {
+		show, ok, err := h.showAt(ctx, dir)
+		if !ok || err != nil {
+			return nil, false, err
+		}
+
+		b, err := h.ShowNFO(ctx, show, base)
+		return b, err == nil, err
+	}
+
+	if !o.aliased() {
+		if dir != "/films" {
+			return nil, false, nil
+		}
+
+		id, err := fileIDFromName(name)
+		if err != nil {
+			return nil, false, nil
+		}
+
+		f, err := h.storage.FileByID(ctx, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		parents, err := h.storage.Parents(ctx, f.Parent)
+		if err != nil {
+			return nil, false, err
+		}
+
+		href, ok := h.Href(ctx, f, parents)
+		if href, err = url.PathUnescape(href); !ok || err != nil || sidecarNFO(href) != p {
+			return nil, false, nil
+		}
+
+		return h.FilmNFO(ctx, f, base)
+	}
+
+	if dir != "/films" && (path.Dir(dir) != "/films" || name != "movie.nfo") {
+		return nil, false, nil
+	}
+
+	var film *Entry
+	err := h.aliasChildren(ctx, dir)(func(e Entry) bool {
+		if e.Folder || (name != "movie.nfo" && sidecarNFO(e.Name) != name) {
+			return true
+		}
+
+		film = &e
+		return false
+	})
+
+	if err != nil || film == nil {
+		return nil, false, err
+	}
+
+	return h.FilmNFO(ctx, ds.File{ID: film.ID, Name: film.Name}, base)
+}
+
+// showAt returns the TV show of the WebDAV folder, or false when the folder is not a TV show.
+func (h Stream) showAt(ctx context.Context, dir string) (ds.Folder, bool, error) {
+	if path.Dir(dir) != "/shows" {
+		return ds.Folder{}, false, nil
+	}
+
+	if h.options().aliased() {
+		a, err := h.alias(ctx, dir)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && (!a.Folder || a.ID == "")) {
+			return ds.Folder{}, false, nil
+		}
+
+		return ds.Folder{ID: a.ID, Name: a.Name}, err == nil, err
+	}
+
+	name, id, err := folderIDFromName(path.Base(dir))
+	if err != nil {
+		return ds.Folder{}, false, nil
+	}
+
+	// Parents starts with the folder itself.
+	parents, err := h.storage.Parents(ctx, id)
+	if err != nil || len(parents) == 0 || parents[0].Name != name {
+		return ds.Folder{}, false, err
+	}
+
+	href, ok := h.FolderHref(ctx, parents[0], parents[1:])
+	if href, err = url.PathUnescape(href); !ok || err != nil || href != dir {
+		return ds.Folder{}, false, nil
+	}
+
+	return parents[0], true, nil
+}
+
+// sidecarNFO replaces the extension of a film with `.nfo`.
+func sidecarNFO(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".nfo"
+}
+
+func nfoEntry(href string, size int) Entry {
+	return Entry{Href: href, Name: path.Base(href), Size: size}
+}
+
+// filmNFOs adds an NFO next to each film within the `/films/` folder,
+// with the sizes of the NFOs prepared on Refresh.
+func (h Stream) filmNFOs(ctx context.Context, src entrySource, base string) entrySource {
+	snap := h.snapshot("/films")
+
+	return func(fn func(Entry) bool) error {
+		var err error
+		srcErr := src(func(e Entry) bool {
+			if !fn(e) {
+				return false
+			}
+
+			if e.Folder {
+				return true
+			}
+
+			if snap != nil && snap.nfos != nil {
+				n, ok := snap.nfos[e.ID]
+				return !ok || fn(nfoEntry(sidecarNFO(e.Href), n.sizeAt(base)))
+			}
+
+			var b []byte
+			var ok bool
+			if b, ok, err = h.FilmNFO(ctx, ds.File{ID: e.ID, Name: e.Name}, base); err != nil {
+				return false
+			}
+
+			return !ok || fn(nfoEntry(sidecarNFO(e.Href), len(b)))
+		})
+
+		if srcErr != nil {
+			return srcErr
+		}
+
+		return err
+	}
+}
+
+// folderNFO adds the `movie.nfo` or `tvshow.nfo` to the contents of a folder within the libraries.
+func (h Stream) folderNFO(ctx context.Context, dir, href string, src entrySource, base string) entrySource {
+	return func(fn func(Entry) bool) error {
+		// The NFO of a film folder describes its first film.
+		var film *Entry
+		stopped := false
+
+		err := src(func(e Entry) bool {
+			if film == nil && !e.Folder {
+				film = &Entry{ID: e.ID, Name: e.Name}
+			}
+
+			stopped = !fn(e)
+			return !stopped
+		})
+
+		if err != nil || stopped {
+			return err
+		}
+
+		switch path.Dir(dir) {
+		case "/films":
+			if film == nil {
+				return nil
+			}
+
+			b, ok, err := h.FilmNFO(ctx, ds.File{ID: film.ID, Name: film.Name}, base)
+			if ok && err == nil {
+				fn(nfoEntry(href+"movie.nfo", len(b)))
+			}
+
+			return err
+		case "/shows":
+			show, ok, err := h.showAt(ctx, dir)
+			if !ok || err != nil {
+				return err
+			}
+
+			b, err := h.ShowNFO(ctx, show, base)
+			if err != nil {
+				return err
+			}
+
+			fn(nfoEntry(href+"tvshow.nfo", len(b)))
+		}
+
+		return nil
+	}
+}
+
+// serveNFO serves the virtual NFO files when enabled.
+// Otherwise, the request is passed to the next handler.
+func (h Stream) serveNFO(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !h.options().nfo.Enabled || path.Ext(r.URL.Path) != ".nfo" {
+			next(w, r, ps)
+			return
+		}
+
+		b, ok, err := h.nfoAt(r.Context(), r.URL.Path, baseURL(r))
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == "PROPFIND" {
+			writeXML(w, []Response{nfoEntry(r.URL.EscapedPath(), len(b)).response()})
+			return
+		}
+
+		setDownload(w, r, path.Base(r.URL.Path))
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, bytes.NewReader(b))
+	}
+}
+
+// serveArtwork serves the files within the artwork directory.
+//
+// Does not require any middleware.
+func (h Stream) serveArtwork(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	dir := h.options().nfo.Artwork
+	if dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// http.Dir does not allow paths outside of the directory.
+	f, err := http.Dir(dir).Open(ps.ByName("filepath"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), f)
+}
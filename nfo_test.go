@@ -0,0 +1,154 @@
+package stream
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// countingProvider gives every film a poster and fanart, and counts the lookups.
+type countingProvider struct {
+	lookups *int64
+}
+
+func (p countingProvider) FilmMetadata(_ context.Context, title string, year int) (Metadata, error) {
+	atomic.AddInt64(p.lookups, 1)
+	return Metadata{Type: "film", Title: title, Year: year, Poster: "films/poster & co.jpg", Fanart: "https://example.org/fanart.jpg"}, nil
+}
+
+func (p countingProvider) ShowMetadata(context.Context, string, int) (Metadata, error) {
+	atomic.AddInt64(p.lookups, 1)
+	return Metadata{}, ErrNoMetadata
+}
+
+func TestFilmNFOs(t *testing.T) {
+	memory := NewMemoryStorage()
+	memory.Replace(Items{
+		Folders: []ds.Folder{
+			{ID: "films", Name: "Films"},
+			{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+			{ID: "unknown", Name: "Unknown", Parent: "films"},
+		},
+		Files: []ds.File{
+			{ID: "f1", Name: "Inception (2010).mkv", Parent: "inception", Size: 10, MD5: "a"},
+			{ID: "f2", Name: "S01E01.mkv", Parent: "unknown", Size: 4, MD5: "b"},
+		},
+	})
+
+	var lookups int64
+	s := NewStream(Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   newTestStore(t),
+		Storage: memory,
+		NFO:     NFO{Enabled: true, Artwork: "artwork", Provider: countingProvider{&lookups}},
+	})
+
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt64(&lookups, 0)
+	h := s.Handler()
+
+	for _, host := range []string{"example.com", "stream.example.com:8080"} {
+		r := serve(h, "PROPFIND", "http://"+host+"/films", map[string]string{"Depth": "1"})
+
+		var listing struct {
+			Responses []struct {
+				Href   string `xml:"href"`
+				Length int    `xml:"propstat>prop>getcontentlength"`
+			} `xml:"response"`
+		}
+
+		if err := xml.Unmarshal([]byte(body(t, r)), &listing); err != nil {
+			t.Fatal(err)
+		}
+
+		nfos := 0
+		for _, res := range listing.Responses {
+			if !strings.HasSuffix(res.Href, ".nfo") {
+				continue
+			}
+
+			nfos++
+			p, _ := url.PathUnescape(res.Href)
+			nfo := serve(h, "GET", "http://"+host+res.Href, nil)
+			if nfo.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: status %d", p, nfo.StatusCode)
+			}
+
+			b := body(t, nfo)
+			if len(b) != res.Length {
+				t.Errorf("%s on %s: listed %d bytes, served %d", p, host, res.Length, len(b))
+			}
+
+			poster := "http://" + host + "/artwork/films/poster%20&amp;%20co.jpg"
+			if !strings.Contains(b, poster) || !strings.Contains(b, "https://example.org/fanart.jpg") {
+				t.Errorf("%s on %s does not contain the artwork:\n%s", p, host, b)
+			}
+		}
+
+		// The film without a title has no NFO.
+		if nfos != 1 {
+			t.Errorf("PROPFIND /films on %s lists %d NFOs, want 1", host, nfos)
+		}
+	}
+
+	if n := atomic.LoadInt64(&lookups); n != 0 {
+		t.Errorf("%d metadata lookups after the Refresh, want none", n)
+	}
+}
+
+// The version of a library changes with the NFO files, even when the files are the same.
+func TestNFOFingerprint(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	memory := NewMemoryStorage()
+	memory.Replace(Items{
+		Folders: []ds.Folder{
+			{ID: "films", Name: "Films"},
+			{ID: "inception", Name: "Inception (2010)", Parent: "films"},
+		},
+		Files: []ds.File{{ID: "f1", Name: "Inception (2010).mkv", Parent: "inception", Size: 10, MD5: "a"}},
+	})
+
+	s := NewStream(Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Store:   store,
+		Storage: memory,
+		NFO:     NFO{Enabled: true},
+	})
+
+	version := func() int64 {
+		if err := s.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		return s.snapshot("/films").version
+	}
+
+	first := version()
+	if v := version(); v != first {
+		t.Errorf("version %d after refreshing the same library, want %d", v, first)
+	}
+
+	err := store.ImportMetadata(ctx, []Metadata{{Type: "film", Title: "Inception", Year: 2010, Plot: "A dream."}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := version(); v != first+1 {
+		t.Errorf("version %d after importing metadata, want %d", v, first+1)
+	}
+}
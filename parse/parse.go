@@ -0,0 +1,422 @@
+// Package parse extracts structured metadata from the names of media files and folders.
+//
+// Names are expected to follow the common release naming conventions, such as
+// `Some.Film.2019.1080p.BluRay.x264-GRP.mkv` or `Some Show (2019)/Season 1/Some Show S01E02.mkv`.
+// Anything which cannot be recognised is left empty.
+package parse
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media holds the metadata found in a file or folder name.
+type Media struct {
+	Title string `json:"title"`
+	Year  int    `json:"year,omitempty"`
+
+	Season  int `json:"season,omitempty"`
+	Episode int `json:"episode,omitempty"`
+	// EpisodeEnd is the last episode of a multi-episode file such as `S01E01-E03`.
+	// It equals Episode for single episodes.
+	EpisodeEnd int `json:"episodeEnd,omitempty"`
+
+	Resolution string `json:"resolution,omitempty"`
+	Source     string `json:"source,omitempty"`
+	Codec      string `json:"codec,omitempty"`
+	Edition    string `json:"edition,omitempty"`
+	Group      string `json:"group,omitempty"`
+
+	// Extension is the lowercased file extension including the dot, such as `.mkv`.
+	Extension string `json:"extension,omitempty"`
+}
+
+// Version is increased whenever Name parses names differently,
+// so names parsed by an earlier version can be parsed again.
+const Version = 2
+
+// IsEpisode reports whether an episode number was found.
+func (m Media) IsEpisode() bool {
+	return m.Episode > 0
+}
+
+// extensions are stripped before parsing the name.
+var extensions = map[string]bool{
+	".mkv": true, ".mp4": true, ".m4v": true, ".avi": true, ".mov": true, ".wmv": true,
+	".ts": true, ".m2ts": true, ".mpg": true, ".mpeg": true, ".webm": true, ".flv": true,
+	".srt": true, ".ass": true, ".ssa": true, ".sub": true, ".idx": true, ".vtt": true,
+	".nfo": true, ".jpg": true, ".png": true,
+}
+
+// artwork are the suffixes of the artwork files of Kodi.
+var artwork = map[string]bool{
+	"poster": true, "fanart": true, "thumb": true, "landscape": true, "banner": true, "clearlogo": true, "clearart": true, "discart": true,
+}
+
+var (
+	// Multi-episode ranges are matched as well, such as S01E01E02, S01E01-E02 and S01E01-02.
+	reEpisode     = regexp.MustCompile(`(?i)\bS(\d{1,4}) ?E(\d{1,4})(?:(?: ?-? ?E|-)(\d{1,4}))*\b`)
+	reCross       = regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{2,3})(?:-(?:\d{1,2}x)?(\d{2,3}))?\b`)
+	reSeasonWord  = regexp.MustCompile(`(?i)\bSeason ?(\d{1,3})\b`)
+	reSeasonShort = regexp.MustCompile(`(?i)\bS(\d{1,3})\b`)
+	reEpisodeWord = regexp.MustCompile(`(?i)\bEpisode ?(\d{1,4})\b`)
+	reAbsolute    = regexp.MustCompile(`\s-\s(\d{1,4})(?:v\d)?(?:\s|$)`)
+	reYear        = regexp.MustCompile(`\b(19[0-9]{2}|20[0-9]{2})\b`)
+	reResolution  = regexp.MustCompile(`(?i)\b(2160p|1080p|1080i|720p|576p|480p|4k|uhd)\b`)
+	reSource      = regexp.MustCompile(`(?i)\b(remux|blu-?ray|bdrip|brrip|bdremux|web-?dl|webrip|web|hdtv|pdtv|dvdrip|dvd|hdrip|hdcam|cam|telesync)\b`)
+	reCodec       = regexp.MustCompile(`(?i)\b(x ?264|h ?264|avc|x ?265|h ?265|hevc|av1|xvid|divx|vc-?1|mpeg-?2)\b`)
+	reEdition     = regexp.MustCompile(`(?i)\b(extended(?: (?:cut|edition))?|director'?s(?: cut)?|unrated|uncut|theatrical(?: cut)?|remastered|imax|special edition|criterion|final cut)\b`)
+	// Other tags are not stored, but end the title just like the tags above.
+	reOther       = regexp.MustCompile(`(?i)\b(hdr(?:10)?|dv|dovi|dolby ?vision|10 ?bit|repack|proper|amzn|dsnp|atmos|truehd|dts(?:-hd)?|ddp?(?:[257]\.[01])?|e?ac3|aac(?:[257]\.[01])?)\b`)
+	reGroupSuffix = regexp.MustCompile(`-([A-Za-z0-9]+)(?:\[[^\]]*\])?$`)
+	reGroupPrefix = regexp.MustCompile(`^\[([^\]]+)\]`)
+	reBrackets    = regexp.MustCompile(`[\[(]`)
+	reSpaces      = regexp.MustCompile(`\s+`)
+)
+
+// maxYear is the latest year a release can be from.
+var maxYear = time.Now().Year() + 1
+
+// Name parses the name of a file or folder.
+func Name(name string) (m Media) {
+	name = strings.TrimSpace(name)
+
+	if ext := strings.ToLower(path.Ext(name)); extensions[ext] {
+		m.Extension = ext
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	// The release group is usually at the end, but sometimes at the start between brackets.
+	if match := reGroupPrefix.FindStringSubmatch(name); match != nil {
+		m.Group = match[1]
+		name = strings.TrimSpace(name[len(match[0]):])
+	}
+
+	if match := reGroupSuffix.FindStringSubmatchIndex(name); match != nil {
+		group := name[match[2]:match[3]]
+		before := name[:match[0]]
+
+		// Separated titles such as `Spider-Man` or `Some Film - Part 2` are no groups,
+		// and neither is the end of an episode range such as `S01E01-E03`.
+		// The artwork of Kodi such as `Some Film (2019)-poster.jpg` has no group either.
+		if artwork[strings.ToLower(group)] {
+			name = before
+		} else if !isKeyword(group) && hasMarker(normalise(before)) && !strings.HasSuffix(before, " ") && !inEpisode(name, match[0]) {
+			if m.Group == "" {
+				m.Group = group
+			}
+			name = before
+		}
+	}
+
+	name = normalise(name)
+
+	// end holds the index at which the title ends.
+	end := len(name)
+	mark := func(index int) {
+		if index >= 0 && index < end {
+			end = index
+		}
+	}
+
+	if match := reEpisode.FindStringSubmatchIndex(name); match != nil {
+		m.Season = atoi(name, match[2], match[3])
+		m.Episode = atoi(name, match[4], match[5])
+		m.EpisodeEnd = atoi(name, match[6], match[7])
+		mark(match[0])
+	} else if match := reCross.FindStringSubmatchIndex(name); match != nil {
+		m.Season = atoi(name, match[2], match[3])
+		m.Episode = atoi(name, match[4], match[5])
+		m.EpisodeEnd = atoi(name, match[6], match[7])
+		mark(match[0])
+	} else {
+		if match := reSeasonWord.FindStringSubmatchIndex(name); match != nil {
+			m.Season = atoi(name, match[2], match[3])
+			mark(match[0])
+		} else if match := reSeasonShort.FindStringSubmatchIndex(name); match != nil && (match[0] > 0 || match[1] == len(name)) {
+			m.Season = atoi(name, match[2], match[3])
+			mark(match[0])
+		}
+
+		if match := reEpisodeWord.FindStringSubmatchIndex(name); match != nil {
+			m.Episode = atoi(name, match[2], match[3])
+			mark(match[0])
+		} else if match := reAbsolute.FindStringSubmatchIndex(name); match != nil && !reYear.MatchString(name[match[2]:match[3]]) {
+			// Absolute episode numbers are common for anime, such as `Some Anime - 01`.
+			m.Episode = atoi(name, match[2], match[3])
+			mark(match[0])
+		}
+	}
+
+	if m.EpisodeEnd < m.Episode {
+		m.EpisodeEnd = m.Episode
+	}
+
+	// The last year which leaves a title is used, as titles may contain years as well,
+	// such as `Blade Runner 2049 (2017)`. Years in the future are never release years,
+	// and a year at the very start is only a year when nothing else could be the title.
+	var year []int
+	for _, match := range reYear.FindAllStringSubmatchIndex(name, -1) {
+		if match[0] >= end {
+			break
+		}
+
+		if atoi(name, match[2], match[3]) > maxYear {
+			continue
+		}
+
+		if match[0] == 0 && len(strings.TrimSpace(name[match[1]:end])) > 0 {
+			continue
+		}
+
+		year = match
+	}
+
+	if year != nil {
+		m.Year = atoi(name, year[2], year[3])
+		if year[0] > 0 {
+			mark(year[0])
+		}
+	}
+
+	// tag returns the first tag following the title. Tags within the title are skipped,
+	// so a tag must follow the episode, the year or another tag, or be the last word,
+	// which keeps titles such as `The Dvd Club` intact.
+	tag := func(re *regexp.Regexp) []int {
+		for _, match := range re.FindAllStringSubmatchIndex(name, -1) {
+			if match[0] == 0 {
+				continue
+			}
+
+			rest := strings.TrimLeft(name[match[1]:], " -")
+			if match[0] >= end || rest == "" || startsWithTag(rest) {
+				return match
+			}
+		}
+
+		return nil
+	}
+
+	if match := tag(reResolution); match != nil {
+		m.Resolution = resolution(name[match[2]:match[3]])
+		mark(match[0])
+	}
+
+	if match := tag(reSource); match != nil {
+		m.Source = source(name[match[2]:match[3]])
+		mark(match[0])
+	}
+
+	if match := tag(reCodec); match != nil {
+		m.Codec = codec(name[match[2]:match[3]])
+		mark(match[0])
+	}
+
+	if match := tag(reOther); match != nil {
+		mark(match[0])
+	}
+
+	if match := reEdition.FindStringSubmatchIndex(name); match != nil && match[0] > 0 {
+		m.Edition = edition(name[match[2]:match[3]])
+		mark(match[0])
+	}
+
+	if loc := reBrackets.FindStringIndex(name); loc != nil && loc[0] > 0 {
+		mark(loc[0])
+	}
+
+	m.Title = cleanTitle(name[:end])
+	return m
+}
+
+// normalise replaces the separators of release names with spaces.
+// Dots are kept in numbers, such as in `5.1` and `H.264`, and acronyms such as `S.H.I.E.L.D.`.
+func normalise(name string) string {
+	var b strings.Builder
+	b.Grow(len(name))
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' {
+			b.WriteByte(' ')
+			continue
+		}
+
+		if c != '.' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if isChannelDot(name, i) {
+			b.WriteByte('.')
+			continue
+		}
+
+		if isAcronymDot(name, i) {
+			b.WriteByte('.')
+			continue
+		}
+
+		b.WriteByte(' ')
+	}
+
+	return reSpaces.ReplaceAllString(strings.TrimSpace(b.String()), " ")
+}
+
+// isChannelDot reports whether the dot at i separates two single digits, such as the audio channels in `DD5.1`.
+func isChannelDot(name string, i int) bool {
+	digit := func(j int) bool {
+		return j >= 0 && j < len(name) && isDigit(name[j])
+	}
+
+	return digit(i-1) && !digit(i-2) && digit(i+1) && !digit(i+2)
+}
+
+// isAcronymDot reports whether the dot at i is part of an acronym of single letters such as `S.H.I.E.L.D.`.
+func isAcronymDot(name string, i int) bool {
+	single := func(j int) bool {
+		if j < 0 || j >= len(name) || !isLetter(name[j]) {
+			return false
+		}
+
+		return (j == 0 || name[j-1] == '.' || name[j-1] == ' ') && (j+1 == len(name) || name[j+1] == '.')
+	}
+
+	return single(i-1) && (single(i+1) || (i >= 3 && single(i-3)))
+}
+
+// inEpisode reports whether the index is within the episode or episode range of the name.
+func inEpisode(name string, i int) bool {
+	for _, re := range []*regexp.Regexp{reEpisode, reCross} {
+		if loc := re.FindStringIndex(name); loc != nil && loc[0] <= i && i < loc[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startsWithTag reports whether the name starts with a resolution, source, codec or other tag.
+func startsWithTag(name string) bool {
+	for _, re := range []*regexp.Regexp{reResolution, reSource, reCodec, reOther} {
+		if loc := re.FindStringIndex(name); loc != nil && loc[0] == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasMarker(name string) bool {
+	for _, re := range []*regexp.Regexp{reEpisode, reCross, reYear, reResolution, reSource, reCodec} {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isKeyword reports whether a word following a hyphen is part of a source or codec such as `WEB-DL`.
+func isKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "dl", "rip", "ray", "1", "2":
+		return true
+	}
+
+	return false
+}
+
+func cleanTitle(title string) string {
+	title = strings.Trim(title, " -[](){}")
+	return reSpaces.ReplaceAllString(title, " ")
+}
+
+func resolution(s string) string {
+	switch strings.ToLower(s) {
+	case "4k", "uhd":
+		return "2160p"
+	}
+
+	return strings.ToLower(s)
+}
+
+func source(s string) string {
+	switch strings.ToLower(strings.Replace(s, "-", "", 1)) {
+	case "remux", "bdremux":
+		return "Remux"
+	case "bluray", "bdrip", "brrip":
+		return "BluRay"
+	case "webdl", "web":
+		return "WEB-DL"
+	case "webrip":
+		return "WEBRip"
+	case "hdtv", "pdtv":
+		return "HDTV"
+	case "dvdrip", "dvd":
+		return "DVD"
+	case "hdrip":
+		return "HDRip"
+	}
+
+	return "CAM"
+}
+
+func codec(s string) string {
+	switch strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(s)) {
+	case "x264", "h264", "avc":
+		return "H.264"
+	case "x265", "h265", "hevc":
+		return "H.265"
+	case "av1":
+		return "AV1"
+	case "xvid":
+		return "XviD"
+	case "divx":
+		return "DivX"
+	case "vc1":
+		return "VC-1"
+	}
+
+	return "MPEG-2"
+}
+
+func edition(s string) string {
+	s = strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, "extended"):
+		return "Extended"
+	case strings.HasPrefix(s, "director"):
+		return "Director's Cut"
+	case strings.HasPrefix(s, "theatrical"):
+		return "Theatrical"
+	case s == "imax":
+		return "IMAX"
+	case s == "special edition":
+		return "Special Edition"
+	case s == "final cut":
+		return "Final Cut"
+	}
+
+	return strings.Title(s)
+}
+
+func atoi(s string, start, end int) int {
+	if start < 0 {
+		return 0
+	}
+
+	i, _ := strconv.Atoi(s[start:end])
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
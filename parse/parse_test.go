@@ -0,0 +1,165 @@
+package parse
+
+import "testing"
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name string
+		want Media
+	}{
+		// Films
+		{"Inception.2010.1080p.BluRay.x264-SPARKS.mkv", Media{Title: "Inception", Year: 2010, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "SPARKS", Extension: ".mkv"}},
+		{"Inception (2010).mkv", Media{Title: "Inception", Year: 2010, Extension: ".mkv"}},
+		{"Blade Runner 2049 (2017).mkv", Media{Title: "Blade Runner 2049", Year: 2017, Extension: ".mkv"}},
+		{"Blade.Runner.2049.2017.2160p.UHD.BluRay.REMUX.HDR.HEVC-FGT.mkv", Media{Title: "Blade Runner 2049", Year: 2017, Resolution: "2160p", Source: "BluRay", Codec: "H.265", Group: "FGT", Extension: ".mkv"}},
+		{"Blade Runner 2049.mkv", Media{Title: "Blade Runner 2049", Extension: ".mkv"}},
+		{"2001.A.Space.Odyssey.1968.720p.BluRay.x264-AMIABLE.mkv", Media{Title: "2001 A Space Odyssey", Year: 1968, Resolution: "720p", Source: "BluRay", Codec: "H.264", Group: "AMIABLE", Extension: ".mkv"}},
+		{"1917 (2019).mkv", Media{Title: "1917", Year: 2019, Extension: ".mkv"}},
+		{"2012.mkv", Media{Title: "2012", Year: 2012, Extension: ".mkv"}},
+		{"The.Dvd.Club.mkv", Media{Title: "The Dvd Club", Extension: ".mkv"}},
+		{"The.Dvd.Club.2019.DVDRip.XviD-GRP.avi", Media{Title: "The Dvd Club", Year: 2019, Source: "DVD", Codec: "XviD", Group: "GRP", Extension: ".avi"}},
+		{"Web (2013).mp4", Media{Title: "Web", Year: 2013, Extension: ".mp4"}},
+		{"Cam.2018.WEBRip.x264-ION10.mp4", Media{Title: "Cam", Year: 2018, Source: "WEBRip", Codec: "H.264", Group: "ION10", Extension: ".mp4"}},
+		{"Some Film BluRay 1080p.mkv", Media{Title: "Some Film", Resolution: "1080p", Source: "BluRay", Extension: ".mkv"}},
+		{"Spider-Man.Into.the.Spider-Verse.2018.1080p.WEB-DL.DD5.1.H264-FGT.mkv", Media{Title: "Spider-Man Into the Spider-Verse", Year: 2018, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Group: "FGT", Extension: ".mkv"}},
+		{"Spider-Man (2002).mkv", Media{Title: "Spider-Man", Year: 2002, Extension: ".mkv"}},
+		{"Aliens.1986.Special.Edition.1080p.BluRay.x264-GRP.mkv", Media{Title: "Aliens", Year: 1986, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Edition: "Special Edition", Group: "GRP", Extension: ".mkv"}},
+		{"Blade Runner (1982) Final Cut.mkv", Media{Title: "Blade Runner", Year: 1982, Edition: "Final Cut", Extension: ".mkv"}},
+		{"The Lord of the Rings The Fellowship of the Ring (2001) Extended Edition 2160p Remux.mkv", Media{Title: "The Lord of the Rings The Fellowship of the Ring", Year: 2001, Resolution: "2160p", Source: "Remux", Edition: "Extended", Extension: ".mkv"}},
+		{"Agents.of.S.H.I.E.L.D.S01E01.720p.HDTV.x264-KILLERS.mkv", Media{Title: "Agents of S.H.I.E.L.D.", Season: 1, Episode: 1, EpisodeEnd: 1, Resolution: "720p", Source: "HDTV", Codec: "H.264", Group: "KILLERS", Extension: ".mkv"}},
+		{"Movie.4K.HDR.mkv", Media{Title: "Movie", Resolution: "2160p", Extension: ".mkv"}},
+		{"Movie.HDR.1080p.mkv", Media{Title: "Movie", Resolution: "1080p", Extension: ".mkv"}},
+		{"Movie 4K.mkv", Media{Title: "Movie", Resolution: "2160p", Extension: ".mkv"}},
+		{"Movie.1080p.mkv", Media{Title: "Movie", Resolution: "1080p", Extension: ".mkv"}},
+		{"Movie (2020) [2160p HDR].mkv", Media{Title: "Movie", Year: 2020, Resolution: "2160p", Extension: ".mkv"}},
+		{"Movie.Name.2019.REPACK.1080p.BluRay.x264-GRP.mkv", Media{Title: "Movie Name", Year: 2019, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"Movie.Name.PROPER.720p.HDTV.mkv", Media{Title: "Movie Name", Resolution: "720p", Source: "HDTV", Extension: ".mkv"}},
+		{"Movie.2019.2160p.WEB-DL.DDP5.1.Atmos.HDR.HEVC-GRP.mkv", Media{Title: "Movie", Year: 2019, Resolution: "2160p", Source: "WEB-DL", Codec: "H.265", Group: "GRP", Extension: ".mkv"}},
+		{"Dune.2021.2160p.UHD.BluRay.x265.10bit.HDR.TrueHD.7.1.Atmos-RARBG.mkv", Media{Title: "Dune", Year: 2021, Resolution: "2160p", Source: "BluRay", Codec: "H.265", Group: "RARBG", Extension: ".mkv"}},
+		{"Movie.Title.2020.1080p.BluRay.REMUX.AVC.DTS-HD.MA.5.1-GRP.mkv", Media{Title: "Movie Title", Year: 2020, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"Movie Title 2020 1080p WEBRip x265 10bit AAC5.1-GRP.mkv", Media{Title: "Movie Title", Year: 2020, Resolution: "1080p", Source: "WEBRip", Codec: "H.265", Group: "GRP", Extension: ".mkv"}},
+		{"Movie.Name.2019.1080p.NF.WEB-DL.DDP5.1.x264-NTG.mkv", Media{Title: "Movie Name", Year: 2019, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Group: "NTG", Extension: ".mkv"}},
+		{"Movie.Name.2020.PROPER.720p.WEBRip.x264.AAC-YTS.mp4", Media{Title: "Movie Name", Year: 2020, Resolution: "720p", Source: "WEBRip", Codec: "H.264", Group: "YTS", Extension: ".mp4"}},
+		{"Movie.Dolby.Vision.2160p.mkv", Media{Title: "Movie", Resolution: "2160p", Extension: ".mkv"}},
+		{"The.Matrix.1999.REPACK.1080p.BluRay.x264-GRP.mkv", Media{Title: "The Matrix", Year: 1999, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"The Matrix (1999) 1080i HDTV.ts", Media{Title: "The Matrix", Year: 1999, Resolution: "1080i", Source: "HDTV", Extension: ".ts"}},
+		{"Parasite (2019) [1080p] [BluRay].mkv", Media{Title: "Parasite", Year: 2019, Resolution: "1080p", Source: "BluRay", Extension: ".mkv"}},
+		{"Amelie.2001.FRENCH.1080p.BluRay.x264-GRP.mkv", Media{Title: "Amelie", Year: 2001, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"Se7en (1995).mkv", Media{Title: "Se7en", Year: 1995, Extension: ".mkv"}},
+		{"WALL-E (2008).mkv", Media{Title: "WALL-E", Year: 2008, Extension: ".mkv"}},
+		{"WALL-E.2008.720p.BluRay.x264-GRP.mkv", Media{Title: "WALL-E", Year: 2008, Resolution: "720p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"Mission Impossible - Ghost Protocol (2011).mkv", Media{Title: "Mission Impossible - Ghost Protocol", Year: 2011, Extension: ".mkv"}},
+		{"Star Wars Episode IV - A New Hope (1977).mkv", Media{Title: "Star Wars Episode IV - A New Hope", Year: 1977, Extension: ".mkv"}},
+		{"Fantastic.Four.2015.mkv", Media{Title: "Fantastic Four", Year: 2015, Extension: ".mkv"}},
+		{"10 Cloverfield Lane (2016).mkv", Media{Title: "10 Cloverfield Lane", Year: 2016, Extension: ".mkv"}},
+		{"300.2006.1080p.BluRay.x264-GRP.mkv", Media{Title: "300", Year: 2006, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"2012 (2009).mkv", Media{Title: "2012", Year: 2009, Extension: ".mkv"}},
+		{"Space.Odyssey.2099.mkv", Media{Title: "Space Odyssey 2099", Extension: ".mkv"}},
+		{"Heat 1995 DVDRip.avi", Media{Title: "Heat", Year: 1995, Source: "DVD", Extension: ".avi"}},
+		{"heat.1995.720p.bluray.x264.mkv", Media{Title: "heat", Year: 1995, Resolution: "720p", Source: "BluRay", Codec: "H.264", Extension: ".mkv"}},
+		{"Heat_1995_720p.mkv", Media{Title: "Heat", Year: 1995, Resolution: "720p", Extension: ".mkv"}},
+		{"Heat.1995.480p.DVD.MPEG-2.mpg", Media{Title: "Heat", Year: 1995, Resolution: "480p", Source: "DVD", Codec: "MPEG-2", Extension: ".mpg"}},
+		{"Heat.1995.576p.BDRip.DivX.avi", Media{Title: "Heat", Year: 1995, Resolution: "576p", Source: "BluRay", Codec: "DivX", Extension: ".avi"}},
+		{"Heat.1995.1080p.BluRay.VC-1.mkv", Media{Title: "Heat", Year: 1995, Resolution: "1080p", Source: "BluRay", Codec: "VC-1", Extension: ".mkv"}},
+		{"Heat.1995.1080p.WEB.AV1.mkv", Media{Title: "Heat", Year: 1995, Resolution: "1080p", Source: "WEB-DL", Codec: "AV1", Extension: ".mkv"}},
+		{"Heat.1995.BRRip.XviD.avi", Media{Title: "Heat", Year: 1995, Source: "BluRay", Codec: "XviD", Extension: ".avi"}},
+		{"Heat.1995.HDRip.x264.mp4", Media{Title: "Heat", Year: 1995, Source: "HDRip", Codec: "H.264", Extension: ".mp4"}},
+		{"Heat.1995.CAM.x264.mp4", Media{Title: "Heat", Year: 1995, Source: "CAM", Codec: "H.264", Extension: ".mp4"}},
+		{"Heat.1995.TELESYNC.mp4", Media{Title: "Heat", Year: 1995, Source: "CAM", Extension: ".mp4"}},
+		{"Heat.1995.BDREMUX.mkv", Media{Title: "Heat", Year: 1995, Source: "Remux", Extension: ".mkv"}},
+		{"Heat.1995.WEBDL.H 265.mkv", Media{Title: "Heat", Year: 1995, Source: "WEB-DL", Codec: "H.265", Extension: ".mkv"}},
+		{"Heat.1995.m2ts", Media{Title: "Heat", Year: 1995, Extension: ".m2ts"}},
+		{"Heat.1995.m4v", Media{Title: "Heat", Year: 1995, Extension: ".m4v"}},
+		{"Heat.1995.MOV", Media{Title: "Heat", Year: 1995, Extension: ".mov"}},
+		{"Heat.1995.webm", Media{Title: "Heat", Year: 1995, Extension: ".webm"}},
+		{"Heat.1995.iso", Media{Title: "Heat", Year: 1995}},
+
+		// Editions
+		{"Avatar.2009.EXTENDED.1080p.BluRay.x264-GRP.mkv", Media{Title: "Avatar", Year: 2009, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Edition: "Extended", Group: "GRP", Extension: ".mkv"}},
+		{"Avatar (2009) Extended Cut.mkv", Media{Title: "Avatar", Year: 2009, Edition: "Extended", Extension: ".mkv"}},
+		{"Apocalypse.Now.1979.Final.Cut.2160p.UHD.BluRay.x265-GRP.mkv", Media{Title: "Apocalypse Now", Year: 1979, Resolution: "2160p", Source: "BluRay", Codec: "H.265", Edition: "Final Cut", Group: "GRP", Extension: ".mkv"}},
+		{"Monty Python and the Holy Grail (1975) Directors Cut.mkv", Media{Title: "Monty Python and the Holy Grail", Year: 1975, Edition: "Director's Cut", Extension: ".mkv"}},
+		{"Kingdom.of.Heaven.2005.Director's.Cut.1080p.mkv", Media{Title: "Kingdom of Heaven", Year: 2005, Resolution: "1080p", Edition: "Director's Cut", Extension: ".mkv"}},
+		{"Alien.1979.Theatrical.Cut.mkv", Media{Title: "Alien", Year: 1979, Edition: "Theatrical", Extension: ".mkv"}},
+		{"Dunkirk.2017.IMAX.2160p.mkv", Media{Title: "Dunkirk", Year: 2017, Resolution: "2160p", Edition: "IMAX", Extension: ".mkv"}},
+		{"Watchmen.2009.UNRATED.720p.mkv", Media{Title: "Watchmen", Year: 2009, Resolution: "720p", Edition: "Unrated", Extension: ".mkv"}},
+		{"Amadeus.1984.Uncut.mkv", Media{Title: "Amadeus", Year: 1984, Edition: "Uncut", Extension: ".mkv"}},
+		{"Seven.Samurai.1954.Criterion.1080p.BluRay.mkv", Media{Title: "Seven Samurai", Year: 1954, Resolution: "1080p", Source: "BluRay", Edition: "Criterion", Extension: ".mkv"}},
+		{"Star.Wars.1977.Remastered.mkv", Media{Title: "Star Wars", Year: 1977, Edition: "Remastered", Extension: ".mkv"}},
+
+		// Episodes
+		{"The.Boys.S02E03.1080p.AMZN.WEB-DL.DDP5.1.H.264-NTb.mkv", Media{Title: "The Boys", Season: 2, Episode: 3, EpisodeEnd: 3, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Group: "NTb", Extension: ".mkv"}},
+		{"Dark S01E01-E03.mkv", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 3, Extension: ".mkv"}},
+		{"Dark.S01E01E02.mkv", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 2, Extension: ".mkv"}},
+		{"Doctor.Who.2005.S12E01.720p.HDTV.x264-ORGANiC.mkv", Media{Title: "Doctor Who", Year: 2005, Season: 12, Episode: 1, EpisodeEnd: 1, Resolution: "720p", Source: "HDTV", Codec: "H.264", Group: "ORGANiC", Extension: ".mkv"}},
+		{"Friends 1x01.avi", Media{Title: "Friends", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".avi"}},
+		{"[SubsPlease] Jujutsu Kaisen - 24 (1080p).mkv", Media{Title: "Jujutsu Kaisen", Episode: 24, EpisodeEnd: 24, Resolution: "1080p", Group: "SubsPlease", Extension: ".mkv"}},
+		{"Season 1", Media{Season: 1}},
+		{"The Boys (2019)", Media{Title: "The Boys", Year: 2019}},
+		{"The.Office.US.S05E14.720p.WEB-DL.mkv", Media{Title: "The Office US", Season: 5, Episode: 14, EpisodeEnd: 14, Resolution: "720p", Source: "WEB-DL", Extension: ".mkv"}},
+		{"the.expanse.s03e05.1080p.web.h264-memento.mkv", Media{Title: "the expanse", Season: 3, Episode: 5, EpisodeEnd: 5, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Group: "memento", Extension: ".mkv"}},
+		{"Game of Thrones - S08E06 - The Iron Throne.mkv", Media{Title: "Game of Thrones", Season: 8, Episode: 6, EpisodeEnd: 6, Extension: ".mkv"}},
+		{"Breaking Bad S05E16 Felina 1080p.mkv", Media{Title: "Breaking Bad", Season: 5, Episode: 16, EpisodeEnd: 16, Resolution: "1080p", Extension: ".mkv"}},
+		{"Breaking Bad s5e16.mkv", Media{Title: "Breaking Bad", Season: 5, Episode: 16, EpisodeEnd: 16, Extension: ".mkv"}},
+		{"Breaking Bad S05 E16.mkv", Media{Title: "Breaking Bad", Season: 5, Episode: 16, EpisodeEnd: 16, Extension: ".mkv"}},
+		{"Planet.Earth.II.S01E01.2160p.UHD.BluRay.x265-GRP.mkv", Media{Title: "Planet Earth II", Season: 1, Episode: 1, EpisodeEnd: 1, Resolution: "2160p", Source: "BluRay", Codec: "H.265", Group: "GRP", Extension: ".mkv"}},
+		{"Friends.S01E01.The.One.Where.Monica.Gets.a.Roommate.DVDRip.XviD-GRP.avi", Media{Title: "Friends", Season: 1, Episode: 1, EpisodeEnd: 1, Source: "DVD", Codec: "XviD", Group: "GRP", Extension: ".avi"}},
+		{"The.Mandalorian.S02E08.Chapter.16.2160p.DSNP.WEB-DL.DDP5.1.Atmos.HDR.DV.H.265-GRP.mkv", Media{Title: "The Mandalorian", Season: 2, Episode: 8, EpisodeEnd: 8, Resolution: "2160p", Source: "WEB-DL", Codec: "H.265", Group: "GRP", Extension: ".mkv"}},
+		{"Sherlock.3x02.The.Sign.of.Three.720p.HDTV.x264-FoV.mkv", Media{Title: "Sherlock", Season: 3, Episode: 2, EpisodeEnd: 2, Resolution: "720p", Source: "HDTV", Codec: "H.264", Group: "FoV", Extension: ".mkv"}},
+		{"Doctor Who (2005) - S01E01 - Rose.mkv", Media{Title: "Doctor Who", Year: 2005, Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".mkv"}},
+		{"Top.Gear.S22E01.mp4", Media{Title: "Top Gear", Season: 22, Episode: 1, EpisodeEnd: 1, Extension: ".mp4"}},
+		{"24.S01E01.mkv", Media{Title: "24", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".mkv"}},
+		{"The.100.S01E01.mkv", Media{Title: "The 100", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".mkv"}},
+		{"Show S01E01E02E03.mkv", Media{Title: "Show", Season: 1, Episode: 1, EpisodeEnd: 3, Extension: ".mkv"}},
+		{"Show S01E01-02.mkv", Media{Title: "Show", Season: 1, Episode: 1, EpisodeEnd: 2, Extension: ".mkv"}},
+		{"Show - 1x01-1x02 - Title.mkv", Media{Title: "Show", Season: 1, Episode: 1, EpisodeEnd: 2, Extension: ".mkv"}},
+		{"Show 1x01-02.mkv", Media{Title: "Show", Season: 1, Episode: 1, EpisodeEnd: 2, Extension: ".mkv"}},
+		{"The.Daily.Show.S2021E05.mkv", Media{Title: "The Daily Show", Season: 2021, Episode: 5, EpisodeEnd: 5, Extension: ".mkv"}},
+		{"One.Piece.S01E1000.mkv", Media{Title: "One Piece", Season: 1, Episode: 1000, EpisodeEnd: 1000, Extension: ".mkv"}},
+		{"Show Season 2 Episode 5.mkv", Media{Title: "Show", Season: 2, Episode: 5, EpisodeEnd: 5, Extension: ".mkv"}},
+		{"Episode 5.mkv", Media{Episode: 5, EpisodeEnd: 5, Extension: ".mkv"}},
+		{"Show.Name.S01.1080p.BluRay.x264-GRP", Media{Title: "Show Name", Season: 1, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP"}},
+		{"Show Name S02", Media{Title: "Show Name", Season: 2}},
+		{"Dark.S01E01.Secrets.GERMAN.1080p.NF.WEB-DL.DD5.1.x264-GRP.mkv", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 1, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Group: "GRP", Extension: ".mkv"}},
+		{"Dark S01E01.en.srt", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".srt"}},
+		{"Dark S01E01.ass", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".ass"}},
+		{"Dark S01E01-thumb.jpg", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".jpg"}},
+		{"Heat (1995)-poster.jpg", Media{Title: "Heat", Year: 1995, Extension: ".jpg"}},
+		{"Heat.1995.1080p-fanart.jpg", Media{Title: "Heat", Year: 1995, Resolution: "1080p", Extension: ".jpg"}},
+		{"Dark S01E01.nfo", Media{Title: "Dark", Season: 1, Episode: 1, EpisodeEnd: 1, Extension: ".nfo"}},
+
+		// Anime
+		{"[SubsPlease] One Piece - 1000 (1080p) [ABCD1234].mkv", Media{Title: "One Piece", Episode: 1000, EpisodeEnd: 1000, Resolution: "1080p", Group: "SubsPlease", Extension: ".mkv"}},
+		{"[HorribleSubs] One Piece - 1000 [1080p].mkv", Media{Title: "One Piece", Episode: 1000, EpisodeEnd: 1000, Resolution: "1080p", Group: "HorribleSubs", Extension: ".mkv"}},
+		{"Naruto Shippuden - 500 [720p].mkv", Media{Title: "Naruto Shippuden", Episode: 500, EpisodeEnd: 500, Resolution: "720p", Extension: ".mkv"}},
+		{"[Erai-raws] Spy x Family - 12v2 [1080p].mkv", Media{Title: "Spy x Family", Episode: 12, EpisodeEnd: 12, Resolution: "1080p", Group: "Erai-raws", Extension: ".mkv"}},
+		{"Cowboy Bebop - 05.mkv", Media{Title: "Cowboy Bebop", Episode: 5, EpisodeEnd: 5, Extension: ".mkv"}},
+
+		// Folders
+		{"Season 01", Media{Season: 1}},
+		{"Season 10", Media{Season: 10}},
+		{"season.2", Media{Season: 2}},
+		{"S03", Media{Season: 3}},
+		{"Specials", Media{Title: "Specials"}},
+		{"Films", Media{Title: "Films"}},
+		{"Dark (2017)", Media{Title: "Dark", Year: 2017}},
+		{"Heat (1995) [1080p]", Media{Title: "Heat", Year: 1995, Resolution: "1080p"}},
+		{"Heat.1995.1080p.BluRay.x264-GRP", Media{Title: "Heat", Year: 1995, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP"}},
+
+		// Other files
+		{"poster.jpg", Media{Title: "poster", Extension: ".jpg"}},
+		{"fanart.png", Media{Title: "fanart", Extension: ".png"}},
+		{"movie.nfo", Media{Title: "movie", Extension: ".nfo"}},
+		{"Heat (1995).nfo", Media{Title: "Heat", Year: 1995, Extension: ".nfo"}},
+		{"Heat (1995).en.forced.srt", Media{Title: "Heat", Year: 1995, Extension: ".srt"}},
+		{"Heat (1995).vtt", Media{Title: "Heat", Year: 1995, Extension: ".vtt"}},
+		{"  Heat (1995).mkv  ", Media{Title: "Heat", Year: 1995, Extension: ".mkv"}},
+		{"", Media{}},
+	}
+
+	for _, tt := range tests {
+		if got := Name(tt.name); got != tt.want {
+			t.Errorf("Name(%q)\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
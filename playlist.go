@@ -0,0 +1,325 @@
+package stream
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+// A CatalogueItem is an exposed file with its streaming URL and parsed metadata.
+type CatalogueItem struct {
+	Entry
+	URL   string      `json:"url"`
+	Media parse.Media `json:"media"`
+}
+
+// A CatalogueShow is an exposed TV show with all of its episodes.
+type CatalogueShow struct {
+	Entry
+	Media    parse.Media     `json:"media"`
+	Episodes []CatalogueItem `json:"episodes"`
+}
+
+// A Catalogue lists the contents of both libraries.
+type Catalogue struct {
+	Films []CatalogueItem `json:"films"`
+	Shows []CatalogueShow `json:"shows"`
+}
+
+// FilmFiles returns all exposed films, including the films within renamed folders.
+func (h Stream) FilmFiles(ctx context.Context) ([]Entry, error) {
+	if !h.options().aliased() {
+		return h.Films(ctx)
+	}
+
+	if snap := h.snapshot("/films"); snap != nil && snap.aliases != nil {
+		return shared(snap.files), nil
+	}
+
+	return h.store.AliasFiles(ctx, "/films")
+}
+
+// playlistExpiry is how long the streaming URLs of playlists work when users are configured.
+const playlistExpiry = 7 * 24 * time.Hour
+
+// streamURL returns the streaming URL of the file.
+// Most players cannot ask for credentials, so the files are linked by tokens
+// of the signed-in user instead of their paths when users are configured.
+func (h Stream) streamURL(ctx context.Context, e Entry, base string) (string, error) {
+	user := getUser(ctx)
+	if user == "" {
+		return base + e.Href, nil
+	}
+
+	token, err := h.userToken(ctx, e.ID, user, playlistExpiry)
+	if err != nil {
+		return "", err
+	}
+
+	return ShareURL(base, token), nil
+}
+
+// catalogueItems adds the URL and parsed metadata to the files,
+// ordered by season and episode when sorting.
+func (h Stream) catalogueItems(ctx context.Context, entries []Entry, base string, sortEpisodes bool) ([]CatalogueItem, error) {
+	items := make([]CatalogueItem, 0, len(entries))
+
+	for _, e := range entries {
+		if e.Folder {
+			continue
+		}
+
+		m, err := h.media(ctx, e.ID, e.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := h.streamURL(ctx, e, base)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, CatalogueItem{Entry: e, URL: u, Media: m})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if sortEpisodes && a.Media.Season != b.Media.Season {
+			return a.Media.Season < b.Media.Season
+		}
+
+		if sortEpisodes && a.Media.Episode != b.Media.Episode {
+			return a.Media.Episode < b.Media.Episode
+		}
+
+		return a.Name < b.Name
+	})
+
+	return items, nil
+}
+
+// Catalogue lists all exposed films and TV shows with absolute streaming URLs starting with base.
+func (h Stream) Catalogue(ctx context.Context, base string) (c Catalogue, err error) {
+	films, err := h.FilmFiles(ctx)
+	if err != nil {
+		return c, err
+	}
+
+	if c.Films, err = h.catalogueItems(ctx, films, base, false); err != nil {
+		return c, err
+	}
+
+	shows, err := h.Shows(ctx)
+	if err != nil {
+		return c, err
+	}
+
+	c.Shows = make([]CatalogueShow, 0, len(shows))
+	for _, s := range shows {
+		show, err := h.catalogueShow(ctx, s, base)
+		if err != nil {
+			return c, err
+		}
+
+		c.Shows = append(c.Shows, show)
+	}
+
+	return c, nil
+}
+
+func (h Stream) catalogueShow(ctx context.Context, s Entry, base string) (CatalogueShow, error) {
+	show := CatalogueShow{Entry: s}
+
+	m, err := h.media(ctx, s.ID, s.Name)
+	if err != nil {
+		return show, err
+	}
+
+	episodes, err := h.Episodes(ctx, ds.Folder{ID: s.ID, Name: s.Name})
+	if err != nil {
+		return show, err
+	}
+
+	show.Media = m
+	show.Episodes, err = h.catalogueItems(ctx, episodes, base, true)
+	return show, err
+}
+
+// apiCatalogue returns the catalogue of both libraries.
+func (h Stream) apiCatalogue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	c, err := h.Catalogue(r.Context(), baseURL(r))
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not create the catalogue")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+// A playlist is the title and files of a library, TV show or season.
+type playlist struct {
+	title string
+	items []CatalogueItem
+}
+
+// playlistOf returns the files of a library, TV show or season, or false when it does not exist.
+// The show is the ID of the TV show folder and the season is ignored when negative.
+func (h Stream) playlistOf(ctx context.Context, library, showID string, season int, base string) (p playlist, ok bool, err error) {
+	p.title = library
+
+	if library == "films" {
+		if showID != "" {
+			return p, false, nil
+		}
+
+		films, err := h.FilmFiles(ctx)
+		if err != nil {
+			return p, false, err
+		}
+
+		p.items, err = h.catalogueItems(ctx, films, base, false)
+		return p, err == nil, err
+	}
+
+	if library != "shows" {
+		return p, false, nil
+	}
+
+	shows, err := h.Shows(ctx)
+	if err != nil {
+		return p, false, err
+	}
+
+	for _, s := range shows {
+		if showID != "" && s.ID != showID {
+			continue
+		}
+
+		show, err := h.catalogueShow(ctx, s, base)
+		if err != nil {
+			return p, false, err
+		}
+
+		if showID != "" {
+			p.title = show.Name
+			if season >= 0 {
+				p.title += fmt.Sprintf(" - Season %d", season)
+			}
+		}
+
+		ok = true
+		for _, e := range show.Episodes {
+			if season < 0 || e.Media.Season == season {
+				p.items = append(p.items, e)
+			}
+		}
+	}
+
+	return p, ok || showID == "", nil
+}
+
+// playlistTitle returns the name of the file without its extension.
+func playlistTitle(item CatalogueItem) string {
+	return strings.TrimSuffix(item.Name, path.Ext(item.Name))
+}
+
+func writeM3U(w http.ResponseWriter, items []CatalogueItem) {
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, item := range items {
+		fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", playlistTitle(item), item.URL)
+	}
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func writeXSPF(w http.ResponseWriter, title string, items []CatalogueItem) {
+	playlist := xspfPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: title}
+	for _, item := range items {
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{Location: item.URL, Title: playlistTitle(item)})
+	}
+
+	w.Header().Set("Content-Type", "application/xspf+xml")
+	w.Write([]byte(xml.Header))
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(playlist)
+}
+
+// playlist renders a library, TV show or season as an M3U8 or XSPF playlist:
+// `/playlists/films.m3u8`, `/playlists/shows/<show-id>.xspf` or `/playlists/shows/<show-id>/<season>.m3u8`.
+//
+// Does not require any middleware.
+func (h Stream) playlist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	segments := []string{ps.ByName("library")}
+	for _, name := range []string{"show", "season"} {
+		if s := ps.ByName(name); s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	last := len(segments) - 1
+	format := path.Ext(segments[last])
+	segments[last] = strings.TrimSuffix(segments[last], format)
+
+	if format != ".m3u8" && format != ".m3u" && format != ".xspf" {
+		http.NotFound(w, r)
+		return
+	}
+
+	library, showID, season := segments[0], "", -1
+	if len(segments) > 1 {
+		showID = segments[1]
+	}
+
+	if len(segments) > 2 {
+		var err error
+		if season, err = strconv.Atoi(segments[2]); err != nil || season < 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	p, ok, err := h.playlistOf(r.Context(), library, showID, season, baseURL(r))
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if format == ".xspf" {
+		writeXSPF(w, p.title, p.items)
+		return
+	}
+
+	writeM3U(w, p.items)
+}
@@ -0,0 +1,62 @@
+package stream
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Playlists link the files by tokens of the user, as players cannot ask for credentials.
+func TestPlaylistCredentials(t *testing.T) {
+	s, src := newMemoryStream(t)
+
+	config := Config{
+		Depth:   1,
+		FilmsID: "films",
+		ShowsID: "shows",
+		Users:   map[string]string{"kodi": "secret"},
+		Sources: []Source{src},
+	}
+
+	s.Reload(config)
+	h := s.Handler()
+
+	r := serve(h, "GET", "http://example.com/playlists/films.m3u8", map[string]string{"Authorization": "Basic a29kaTpzZWNyZXQ="})
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("GET /playlists/films.m3u8: status %d", r.StatusCode)
+	}
+
+	playlist := body(t, r)
+	if strings.Contains(playlist, "secret") || strings.Contains(playlist, "kodi") {
+		t.Fatalf("the playlist contains the credentials:\n%s", playlist)
+	}
+
+	var links []string
+	for _, line := range strings.Split(playlist, "\n") {
+		if strings.HasPrefix(line, "http") {
+			links = append(links, line)
+		}
+	}
+
+	if len(links) != 2 {
+		t.Fatalf("the playlist contains %d links, want 2:\n%s", len(links), playlist)
+	}
+
+	u, err := url.Parse(links[0])
+	if err != nil || !strings.HasPrefix(u.Path, "/s/") {
+		t.Fatalf("link %s is not a token: %v", links[0], err)
+	}
+
+	if r := serve(h, "GET", links[0], nil); r.StatusCode >= 300 {
+		t.Errorf("GET %s without credentials: status %d", links[0], r.StatusCode)
+	}
+
+	// The tokens stop working once the user is removed.
+	config.Users = map[string]string{"other": "secret"}
+	s.Reload(config)
+
+	if r := serve(h, "GET", links[0], nil); r.StatusCode != http.StatusForbidden {
+		t.Errorf("GET %s of a removed user: status %d, want %d", links[0], r.StatusCode, http.StatusForbidden)
+	}
+}
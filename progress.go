@@ -0,0 +1,236 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+const (
+	// Players probe files with small requests, which do not tell how far someone got.
+	minProgressBytes = 1 << 20
+	// Files are finished once the credits are reached.
+	finishedPercent = 95
+	// Files are only partially watched when more than the opening was watched.
+	startedPercent = 2
+)
+
+// Progress is how far a user got into a file, estimated from the bytes streamed.
+type Progress struct {
+	User     string    `json:"user"`
+	FileID   string    `json:"file"`
+	Position int64     `json:"position"`
+	Size     int64     `json:"size"`
+	Percent  float64   `json:"percent"`
+	Finished bool      `json:"finished"`
+	Updated  time.Time `json:"updated"`
+}
+
+func newProgress(user, fileID string, position, size int64, updated time.Time) Progress {
+	p := Progress{User: user, FileID: fileID, Position: position, Size: size, Updated: updated}
+	if size > 0 {
+		p.Percent = float64(position) * 100 / float64(size)
+	}
+
+	p.Finished = p.Percent >= finishedPercent
+	return p
+}
+
+const sqlProgressSchema = `
+CREATE TABLE IF NOT EXISTS progress (
+	"user" text NOT NULL,
+	"file" text NOT NULL,
+	"position" integer NOT NULL,
+	"size" integer NOT NULL,
+	"updated" integer NOT NULL,
+	PRIMARY KEY(user, file)
+);
+
+CREATE INDEX IF NOT EXISTS progress_updated ON progress(user, updated);
+`
+
+// progressStore keeps the playback progress of every user.
+type progressStore interface {
+	SaveProgress(ctx context.Context, p Progress) error
+	DeleteProgress(ctx context.Context, user, fileID string) error
+	UserProgress(ctx context.Context, user, fileID string, fn func(Progress, ds.File) bool) error
+}
+
+func (s Store) createProgressTable() error {
+	_, err := s.DB.Exec(sqlProgressSchema)
+	return err
+}
+
+const sqlUpsertProgress = `
+INSERT INTO progress (user, file, position, size, updated) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(user, file) DO UPDATE SET
+		position=excluded.position,
+		size=excluded.size,
+		updated=excluded.updated
+`
+
+// SaveProgress stores the progress of the user in the file.
+func (s Store) SaveProgress(ctx context.Context, p Progress) error {
+	_, err := s.DB.ExecContext(ctx, sqlUpsertProgress, p.User, p.FileID, p.Position, p.Size, p.Updated.Unix())
+	return err
+}
+
+// DeleteProgress forgets the progress of the user in the file, returning sql.ErrNoRows when there is none.
+func (s Store) DeleteProgress(ctx context.Context, user, fileID string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM progress WHERE user = ? AND file = ?`, user, fileID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+const sqlUserProgress = `
+SELECT progress.file, progress.position, progress.size, progress.updated, file.name, file.size, file.md5
+FROM progress
+JOIN file ON file.id = progress.file
+WHERE progress.user = ? AND NOT file.trashed AND (? = '' OR progress.file = ?)
+ORDER BY progress.updated DESC
+`
+
+// UserProgress retrieves the progress of the user in all files which still exist, most recent first.
+// Only the progress in the file is retrieved when fileID is given.
+//
+// Progress is passed to fn until it returns false.
+func (s Store) UserProgress(ctx context.Context, user, fileID string, fn func(Progress, ds.File) bool) error {
+	rows, err := s.DB.QueryContext(ctx, sqlUserProgress, user, fileID, fileID)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var position, size, updated int64
+		f := ds.File{}
+
+		err := rows.Scan(&id, &position, &size, &updated, &f.Name, &f.Size, &f.MD5)
+		if err != nil {
+			return err
+		}
+
+		f.ID = id
+		if !fn(newProgress(user, id, position, size, time.Unix(updated, 0)), f) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// updateProgress estimates the progress of the user from a finished session.
+// The position is where the session stopped reading, as the user may have skipped back.
+func (h Stream) updateProgress(ss Session) {
+	if ss.Sent < minProgressBytes || strings.HasPrefix(ss.User, "share:") {
+		return
+	}
+
+	p := newProgress(ss.User, ss.FileID, int64(ss.RangeStart)+ss.Sent, ss.size, ss.Ended)
+
+	// The request has ended, so its context can no longer be used.
+	if err := h.store.SaveProgress(context.Background(), p); err != nil {
+		fmt.Printf("%s - could not save progress: %v\n", ss.ID, err)
+	}
+}
+
+// ContinueWatching returns the partially watched files of the user, most recent first.
+func (h Stream) ContinueWatching(ctx context.Context, user string) (entries []Entry, err error) {
+	o := h.options()
+
+	err = h.store.UserProgress(ctx, user, "", func(p Progress, f ds.File) bool {
+		if o.exposed(f.Name) && !p.Finished && p.Percent > startedPercent {
+			entries = append(entries, fileEntry(continueRoot+"/"+url.PathEscape(fileWithID(f.Name, f.ID)), f))
+		}
+
+		return len(entries) < o.continues
+	})
+
+	return entries, err
+}
+
+const (
+	continueRoot = "/continue"
+	continueName = "Continue Watching"
+)
+
+// propContinue creates a PROPFIND response with the partially watched files of the user.
+//
+// Does not require any middleware.
+func (h Stream) propContinue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	entries, err := h.ContinueWatching(r.Context(), getUser(r.Context()))
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	h.writeEntries(w, r, createDavFolder(continueRoot+"/", continueName), entries)
+}
+
+type progressResponse struct {
+	Progress
+	Name string `json:"name"`
+}
+
+// apiProgress returns the progress of the user in all files, or in the file given by the `:id` parameter.
+func (h Stream) apiProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	res := []progressResponse{}
+
+	err := h.store.UserProgress(r.Context(), getUser(r.Context()), id, func(p Progress, f ds.File) bool {
+		res = append(res, progressResponse{Progress: p, Name: f.Name})
+		return true
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not retrieve the progress")
+		return
+	}
+
+	if id == "" {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if len(res) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no progress in this file")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res[0])
+}
+
+// apiDeleteProgress forgets the progress of the user in a file, removing it from Continue Watching.
+func (h Stream) apiDeleteProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := h.store.DeleteProgress(r.Context(), getUser(r.Context()), ps.ByName("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "no progress in this file")
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not remove the progress")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
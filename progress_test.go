@@ -0,0 +1,165 @@
+package stream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Continue Watching is limited by its own setting, not by the one of the recent folders.
+func TestContinueWatchingLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	err := store.FullSync(ds.Drive{ID: "drive", Name: "Drive"}, []ds.Folder{
+		{ID: "drive", Name: "Drive"},
+		{ID: "films", Name: "Films", Parent: "drive"},
+	}, []ds.File{
+		{ID: "f1", Name: "Inception (2010).mkv", Parent: "films", Size: 100},
+		{ID: "f2", Name: "Heat (1995).mkv", Parent: "films", Size: 100},
+		{ID: "f3", Name: "Ronin (1998).mkv", Parent: "films", Size: 100},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStream(Config{
+		Depth:    1,
+		FilmsID:  "films",
+		ShowsID:  "shows",
+		Store:    store,
+		Recent:   1,
+		Continue: 2,
+	})
+
+	now := time.Now()
+	for i, id := range []string{"f1", "f2", "f3"} {
+		if err := store.SaveProgress(ctx, newProgress("kodi", id, 50, 100, now.Add(time.Duration(i)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := s.ContinueWatching(ctx, "kodi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Name != "Ronin (1998).mkv" {
+		t.Errorf("ContinueWatching = %v, want the two most recent files", entries)
+	}
+}
+
+// Sessions resume from where they stopped reading, small requests of players probing the file are ignored.
+func TestUpdateProgress(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+	}, []ds.File{
+		{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 100 << 20},
+	})
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Users: map[string]string{"kodi": "change-me"}})
+	h := s.Handler()
+	auth := map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("kodi:change-me"))}
+
+	position := func() (p Progress, found bool) {
+		err := store.UserProgress(ctx, "kodi", "f1", func(progress Progress, _ ds.File) bool {
+			p, found = progress, true
+			return false
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return p, found
+	}
+
+	session := func(user string, start uint64, sent int64) Session {
+		return Session{ID: "s", User: user, FileID: "f1", RangeStart: start, Sent: sent, size: 100 << 20, Ended: time.Now()}
+	}
+
+	s.updateProgress(session("kodi", 50<<20, minProgressBytes-1))
+	s.updateProgress(session("share:sh", 0, 60<<20))
+	if p, found := position(); found {
+		t.Fatalf("progress after probing and sharing = %+v, want none", p)
+	}
+
+	tests := []struct {
+		start    uint64
+		sent     int64
+		position int64
+		finished bool
+	}{
+		{10 << 20, minProgressBytes, 11 << 20, false},
+		{0, 40 << 20, 40 << 20, false},
+		{60 << 20, 36 << 20, 96 << 20, true},
+		{20 << 20, 5 << 20, 25 << 20, false},
+	}
+
+	for i, tt := range tests {
+		s.updateProgress(session("kodi", tt.start, tt.sent))
+
+		p, found := position()
+		if !found || p.Position != tt.position || p.Finished != tt.finished || p.Percent != float64(tt.position)*100/(100<<20) {
+			t.Errorf("progress after session %d = %+v, want position %d and finished %t", i, p, tt.position, tt.finished)
+		}
+	}
+
+	res := serve(h, "GET", "/api/progress/f1", auth)
+
+	var p progressResponse
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Position != 25<<20 || p.Name != "Heat (1995).mkv" {
+		t.Errorf("GET /api/progress/f1 = %+v", p)
+	}
+
+	if entries, err := s.ContinueWatching(ctx, "kodi"); err != nil || len(entries) != 1 {
+		t.Errorf("ContinueWatching = %v, %v, want the film", entries, err)
+	}
+
+	if res := serve(h, "DELETE", "/api/progress/f1", auth); res.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE /api/progress/f1: status %d", res.StatusCode)
+	}
+
+	if res := serve(h, "GET", "/api/progress/f1", auth); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /api/progress/f1 after removing it: status %d, want 404", res.StatusCode)
+	}
+}
+
+// Only files past the opening and before the credits are partially watched.
+func TestContinueWatchingPartial(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "a", Name: "A", Parent: "films"},
+	}, []ds.File{
+		{ID: "f1", Name: "Opening.mkv", Parent: "a", Size: 100},
+		{ID: "f2", Name: "Middle.mkv", Parent: "a", Size: 100},
+		{ID: "f3", Name: "Credits.mkv", Parent: "a", Size: 100},
+		{ID: "f4", Name: "Subtitles.srt", Parent: "a", Size: 100},
+	})
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Extensions: []string{"mkv"}})
+
+	for id, position := range map[string]int64{"f1": 2, "f2": 50, "f3": 95, "f4": 50} {
+		if err := store.SaveProgress(ctx, newProgress("kodi", id, position, 100, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := s.ContinueWatching(ctx, "kodi")
+	if err != nil || len(entries) != 1 || entries[0].Name != "Middle.mkv" {
+		t.Errorf("ContinueWatching = %v, %v, want only Middle.mkv", entries, err)
+	}
+}
@@ -0,0 +1,240 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Bernard does not store when files were created or modified,
+// so Stream retrieves these times from Google Drive after every sync.
+const sqlTimeSchema = `
+CREATE TABLE IF NOT EXISTS item_time (
+	"id" text NOT NULL,
+	"drive" text NOT NULL,
+	"created" integer NOT NULL,
+	"modified" integer NOT NULL,
+	PRIMARY KEY(id, drive)
+);
+
+CREATE INDEX IF NOT EXISTS item_time_created ON item_time(created);
+CREATE INDEX IF NOT EXISTS item_time_modified ON item_time(modified);
+`
+
+func (s Store) createTimeTable() error {
+	_, err := s.DB.Exec(sqlTimeSchema)
+	return err
+}
+
+const sqlUpsertTime = `
+INSERT INTO item_time (id, drive, created, modified) VALUES (?, ?, ?, ?)
+	ON CONFLICT(id, drive) DO UPDATE SET
+		created=excluded.created,
+		modified=excluded.modified
+`
+
+// saveTimes stores the creation and modification times of the items in the drive.
+func (s Store) saveTimes(ctx context.Context, driveID string, times []ItemTime) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	upsert, err := tx.PrepareContext(ctx, sqlUpsertTime)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer upsert.Close()
+	for _, t := range times {
+		_, err := upsert.ExecContext(ctx, t.ID, driveID, t.Created.Unix(), t.Modified.Unix())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RecentOrder determines by which time recent files are ordered.
+type RecentOrder int
+
+const (
+	// RecentlyAdded orders files by their creation time in Google Drive.
+	RecentlyAdded RecentOrder = iota
+	// RecentlyModified orders files by their modification time in Google Drive.
+	RecentlyModified
+)
+
+const sqlRecentlyAdded = `
+WITH cte AS (
+	SELECT descendant AS id FROM folder_closure WHERE ancestor = ? AND depth > 0 AND NOT hidden
+)
+SELECT file.id, file.name, file.size, file.md5 FROM file
+JOIN item_time ON item_time.id = file.id AND item_time.drive = file.drive
+WHERE file.parent IN cte AND NOT file.trashed
+ORDER BY item_time.created DESC
+`
+
+const sqlRecentlyModified = `
+WITH cte AS (
+	SELECT descendant AS id FROM folder_closure WHERE ancestor = ? AND depth > 0 AND NOT hidden
+)
+SELECT file.id, file.name, file.size, file.md5 FROM file
+JOIN item_time ON item_time.id = file.id AND item_time.drive = file.drive
+WHERE file.parent IN cte AND NOT file.trashed
+ORDER BY item_time.modified DESC
+`
+
+// RecentFiles retrieves the files within the folder and its subfolders, newest first.
+//
+// Files are passed to fn until it returns false.
+func (s Store) RecentFiles(ctx context.Context, id string, order RecentOrder, fn func(ds.File) bool) error {
+	query := sqlRecentlyAdded
+	if order == RecentlyModified {
+		query = sqlRecentlyModified
+	}
+
+	rows, err := s.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.MD5)
+		if err != nil {
+			return err
+		}
+
+		if !fn(f) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// Recent returns the newest files of the library, either `films` or `shows`.
+func (h Stream) Recent(ctx context.Context, library string, order RecentOrder) (entries []Entry, err error) {
+	o := h.options()
+
+	folderID, dedupe := o.filmsID, o.dedupe.Films
+	if library == "shows" {
+		folderID, dedupe = o.showsID, o.dedupe.Shows
+	}
+
+	hidden, err := h.hidden(ctx, dedupe)
+	if err != nil {
+		return nil, err
+	}
+
+	base := recentHref(library, order)
+	err = h.storage.RecentFiles(ctx, folderID, order, func(f ds.File) bool {
+		if o.exposed(f.Name) && !hidden[f.ID] {
+			entries = append(entries, fileEntry(base+url.PathEscape(fileWithID(f.Name, f.ID)), f))
+		}
+
+		return len(entries) < o.recent
+	})
+
+	return entries, err
+}
+
+// recentRoot returns the path of the folder containing the recent files of each library.
+func recentRoot(order RecentOrder) string {
+	if order == RecentlyModified {
+		return "/modified"
+	}
+
+	return "/added"
+}
+
+func recentHref(library string, order RecentOrder) string {
+	return recentRoot(order) + "/" + library + "/"
+}
+
+// syncTimes retrieves the times of the changed items, or of all items when ids is nil.
+func (d driveSource) syncTimes(ctx context.Context, store Store, ids []string) error {
+	// Retrieving all times at once is cheaper than a request per item.
+	const maxRequests = 100
+
+	var times []ItemTime
+	var err error
+
+	if ids == nil || len(ids) > maxRequests {
+		times, err = d.fetch.Times(ctx, d.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if times == nil {
+		for _, id := range ids {
+			t, err := d.fetch.Time(ctx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			times = append(times, t)
+		}
+	}
+
+	return store.saveTimes(ctx, d.id, times)
+}
+
+// ItemTimes retrieves the creation and modification times of the items, by ID.
+// Items of which the times are unknown are omitted.
+func (s Store) ItemTimes(ctx context.Context, ids []string) (map[string]ItemTime, error) {
+	// SQLite limits the number of parameters of a query.
+	const chunk = 500
+
+	times := make(map[string]ItemTime, len(ids))
+	for start := 0; start < len(ids); start += chunk {
+		end := start + chunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+
+		query := `SELECT id, created, modified FROM item_time WHERE id IN (?` + strings.Repeat(", ?", len(args)-1) + `)`
+		rows, err := s.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var t ItemTime
+			var created, modified int64
+			if err := rows.Scan(&t.ID, &created, &modified); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			t.Created, t.Modified = time.Unix(created, 0), time.Unix(modified, 0)
+			times[t.ID] = t
+		}
+
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return times, nil
+}
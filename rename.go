@@ -0,0 +1,622 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/julienschmidt/httprouter"
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+// Rename configures the renaming of films and episodes to the naming conventions of Kodi and Plex.
+//
+// The templates are Go templates which receive the parsed metadata of the file.
+// A `/` in the output of a template creates a folder.
+type Rename struct {
+	Enabled bool
+	// Film is the path of a film within the `films` folder, without the extension.
+	Film string
+	// Episode is the path of an episode within the folder of its TV show, without the extension.
+	Episode string
+}
+
+const (
+	DefaultFilmTemplate    = `{{.Title}}{{with .Year}} ({{.}}){{end}}/{{.Title}}{{with .Year}} ({{.}}){{end}}`
+	DefaultEpisodeTemplate = `Season {{.Season}}/{{.Show}} - {{.EpisodeCode}}`
+)
+
+// nameData is passed to the rename templates.
+type nameData struct {
+	parse.Media
+	// Show is the title of the TV show, or empty for films.
+	Show string
+	// ShowYear is the year of the TV show, or zero for films and shows without a year.
+	ShowYear int
+}
+
+// EpisodeCode formats the season and episodes, such as `S01E02` or `S01E02-E04`.
+func (d nameData) EpisodeCode() string {
+	code := fmt.Sprintf("S%02dE%02d", d.Season, d.Episode)
+	if d.EpisodeEnd > d.Episode {
+		code += fmt.Sprintf("-E%02d", d.EpisodeEnd)
+	}
+
+	return code
+}
+
+// templates parses the film and episode templates, using the defaults when empty.
+func (r Rename) templates() (film *template.Template, episode *template.Template, err error) {
+	if r.Film == "" {
+		r.Film = DefaultFilmTemplate
+	}
+
+	if r.Episode == "" {
+		r.Episode = DefaultEpisodeTemplate
+	}
+
+	film, err = template.New("film").Option("missingkey=error").Parse(r.Film)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	episode, err = template.New("episode").Option("missingkey=error").Parse(r.Episode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return film, episode, nil
+}
+
+// Validate checks whether the templates can be parsed and render a path of at most two parts.
+func (r Rename) Validate() error {
+	film, episode, err := r.templates()
+	if err != nil {
+		return err
+	}
+
+	example := nameData{
+		Media:    parse.Media{Title: "Title", Year: 2020, Season: 1, Episode: 2, EpisodeEnd: 2},
+		Show:     "Show",
+		ShowYear: 2019,
+	}
+
+	for _, t := range []*template.Template{film, episode} {
+		name, err := render(t, example)
+		if err != nil {
+			return err
+		}
+
+		if strings.Count(name, "/") > 1 {
+			return fmt.Errorf("template %s: %q contains more than one folder", t.Name(), name)
+		}
+	}
+
+	return nil
+}
+
+// render executes the template and cleans every part of the resulting path.
+func render(t *template.Template, data nameData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(buf.String(), "/")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r < ' ' || r == '\\' {
+				return -1
+			}
+
+			return r
+		}, part))
+
+		if parts[i] == "" || parts[i] == "." || parts[i] == ".." {
+			return "", fmt.Errorf("template %s: empty path in %q", t.Name(), buf.String())
+		}
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// An Alias maps a renamed path to a Google Drive file or folder.
+type Alias struct {
+	Path   string
+	Parent string
+	Name   string
+	// ID holds the ID of the file, the ID of the TV show folder,
+	// or is empty for the folders created by the templates.
+	ID     string
+	Folder bool
+}
+
+const sqlAliasSchema = `
+CREATE TABLE IF NOT EXISTS alias (
+	"path" text NOT NULL,
+	"parent" text NOT NULL,
+	"name" text NOT NULL,
+	"id" text NOT NULL,
+	"folder" boolean NOT NULL,
+	PRIMARY KEY(path)
+);
+
+CREATE INDEX IF NOT EXISTS alias_parent ON alias(parent);
+CREATE INDEX IF NOT EXISTS alias_id ON alias(id);
+`
+
+// aliasStore keeps the renamed paths of the libraries.
+type aliasStore interface {
+	ReplaceAliases(ctx context.Context, aliases []Alias) error
+	GetAlias(ctx context.Context, p string) (Alias, error)
+	AliasPath(ctx context.Context, id string) (string, error)
+	EachAliasChild(ctx context.Context, parent string, fn func(Entry) bool) error
+	AliasFiles(ctx context.Context, parent string) ([]Entry, error)
+	EachAliasFile(ctx context.Context, parent string, fn func(Entry) bool) error
+	AliasTree(ctx context.Context, root string, fn func(Alias, Entry)) error
+}
+
+func (s Store) createAliasTable() error {
+	_, err := s.DB.Exec(sqlAliasSchema)
+	return err
+}
+
+// ReplaceAliases replaces all aliases in a single transaction.
+func (s Store) ReplaceAliases(ctx context.Context, aliases []Alias) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM alias`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT INTO alias (path, parent, name, id, folder) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer insert.Close()
+	for _, a := range aliases {
+		if _, err := insert.ExecContext(ctx, a.Path, a.Parent, a.Name, a.ID, a.Folder); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAlias retrieves the alias of the path.
+func (s Store) GetAlias(ctx context.Context, p string) (a Alias, err error) {
+	row := s.DB.QueryRowContext(ctx, `SELECT path, parent, name, id, folder FROM alias WHERE path = ?`, p)
+	err = row.Scan(&a.Path, &a.Parent, &a.Name, &a.ID, &a.Folder)
+	return a, err
+}
+
+// AliasPath retrieves the renamed path of a file or TV show folder.
+func (s Store) AliasPath(ctx context.Context, id string) (p string, err error) {
+	row := s.DB.QueryRowContext(ctx, `SELECT path FROM alias WHERE id = ? LIMIT 1`, id)
+	err = row.Scan(&p)
+	return p, err
+}
+
+const sqlAliasChildren = `
+SELECT alias.path, alias.name, alias.id, alias.folder, COALESCE(file.size, 0), COALESCE(file.md5, '')
+FROM alias LEFT JOIN file ON NOT alias.folder AND file.id = alias.id
+WHERE alias.parent = ?
+ORDER BY alias.name
+`
+
+const sqlAliasDescendants = `
+SELECT alias.path, alias.name, alias.id, alias.folder, file.size, file.md5
+FROM alias JOIN file ON file.id = alias.id
+WHERE alias.path LIKE ? || '/%' ESCAPE '\' AND NOT alias.folder
+ORDER BY alias.path
+`
+
+// AliasChildren retrieves the entries within the renamed folder.
+func (s Store) AliasChildren(ctx context.Context, parent string) ([]Entry, error) {
+	return collect(func(fn func(Entry) bool) error {
+		return s.EachAliasChild(ctx, parent, fn)
+	})
+}
+
+// EachAliasChild passes the entries of AliasChildren to fn as they are read, until fn returns false.
+func (s Store) EachAliasChild(ctx context.Context, parent string, fn func(Entry) bool) error {
+	return s.eachAlias(ctx, sqlAliasChildren, parent, fn)
+}
+
+// AliasFiles retrieves all files within the renamed folder and its subfolders.
+func (s Store) AliasFiles(ctx context.Context, parent string) ([]Entry, error) {
+	return collect(func(fn func(Entry) bool) error {
+		return s.EachAliasFile(ctx, parent, fn)
+	})
+}
+
+// EachAliasFile passes the entries of AliasFiles to fn as they are read, until fn returns false.
+func (s Store) EachAliasFile(ctx context.Context, parent string, fn func(Entry) bool) error {
+	return s.eachAlias(ctx, sqlAliasDescendants, likeEscaper.Replace(parent), fn)
+}
+
+const sqlAliasTree = `
+SELECT alias.path, alias.parent, alias.name, alias.id, alias.folder, COALESCE(file.size, 0), COALESCE(file.md5, '')
+FROM alias LEFT JOIN file ON NOT alias.folder AND file.id = alias.id
+WHERE alias.path LIKE ? || '/%' ESCAPE '\'
+ORDER BY alias.name
+`
+
+// AliasTree passes every alias within the renamed folder and its subfolders to fn, ordered by name.
+func (s Store) AliasTree(ctx context.Context, root string, fn func(Alias, Entry)) error {
+	rows, err := s.DB.QueryContext(ctx, sqlAliasTree, likeEscaper.Replace(root))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		a, e := Alias{}, Entry{}
+
+		err := rows.Scan(&a.Path, &a.Parent, &a.Name, &a.ID, &a.Folder, &e.Size, &e.MD5)
+		if err != nil {
+			return err
+		}
+
+		e.Href, e.Name, e.ID, e.Folder = aliasHref(a.Path), a.Name, a.ID, a.Folder
+		fn(a, e)
+	}
+
+	return rows.Err()
+}
+
+func (s Store) eachAlias(ctx context.Context, query string, arg string, fn func(Entry) bool) error {
+	rows, err := s.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		e := Entry{}
+
+		err := rows.Scan(&p, &e.Name, &e.ID, &e.Folder, &e.Size, &e.MD5)
+		if err != nil {
+			return err
+		}
+
+		e.Href = aliasHref(p)
+		if !fn(e) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
+
+// aliasHref escapes every part of the path.
+func aliasHref(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// A MediaFile is a file together with the metadata parsed from its name.
+type MediaFile struct {
+	ds.File
+	Media parse.Media
+}
+
+const sqlRecursiveMedia = `
+WITH cte AS (
+	SELECT descendant AS id FROM folder_closure WHERE ancestor = ? AND depth > 0 AND NOT hidden
+)
+SELECT file.id, file.name, file.size, file.md5,
+	COALESCE(media.title, ''), COALESCE(media.year, 0), COALESCE(media.season, 0),
+	COALESCE(media.episode, 0), COALESCE(media.episode_end, 0), COALESCE(media.resolution, ''),
+	COALESCE(media.source, ''), COALESCE(media.codec, ''), COALESCE(media.edition, ''),
+	COALESCE(media.release_group, ''), COALESCE(media.extension, '')
+FROM file LEFT JOIN media ON media.id = file.id AND media.drive = file.drive
+WHERE file.parent IN cte AND NOT file.trashed
+`
+
+// RecursiveMedia retrieves the same files as RecursiveFiles together with their parsed metadata.
+func (s Store) RecursiveMedia(ctx context.Context, id string) (files []MediaFile, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlRecursiveMedia, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := MediaFile{}
+		m := &f.Media
+
+		err := rows.Scan(&f.ID, &f.Name, &f.Size, &f.MD5,
+			&m.Title, &m.Year, &m.Season, &m.Episode, &m.EpisodeEnd, &m.Resolution,
+			&m.Source, &m.Codec, &m.Edition, &m.Group, &m.Extension)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// aliasBuilder collects aliases and resolves conflicting paths.
+type aliasBuilder struct {
+	aliases []Alias
+	paths   map[string]bool
+}
+
+func newAliasBuilder() *aliasBuilder {
+	b := &aliasBuilder{paths: make(map[string]bool)}
+	b.folder("/films", "")
+	b.folder("/shows", "")
+	return b
+}
+
+// folder adds the folder and all of its parents.
+func (b *aliasBuilder) folder(p string, id string) {
+	if b.paths[p] || p == "" {
+		return
+	}
+
+	i := strings.LastIndex(p, "/")
+	b.folder(p[:i], "")
+
+	b.paths[p] = true
+	b.aliases = append(b.aliases, Alias{Path: p, Parent: p[:i], Name: p[i+1:], ID: id, Folder: true})
+}
+
+// file adds the file at the path, or with its ID in the name when the path is taken.
+func (b *aliasBuilder) file(p string, f ds.File) {
+	i := strings.LastIndex(p, "/")
+	if b.paths[p] {
+		p = p[:i] + "/" + fileWithID(p[i+1:], f.ID)
+	}
+
+	b.folder(p[:i], "")
+
+	b.paths[p] = true
+	b.aliases = append(b.aliases, Alias{Path: p, Parent: p[:i], Name: p[i+1:], ID: f.ID})
+}
+
+func extension(f MediaFile) string {
+	if f.Media.Extension != "" {
+		return f.Media.Extension
+	}
+
+	return strings.ToLower(path.Ext(f.Name))
+}
+
+// rebuildAliases renames all exposed films and episodes with the templates,
+// and groups the copies of each film when enabled.
+// Files of which no title could be parsed keep their original name.
+func (h Stream) rebuildAliases(ctx context.Context) error {
+	o := h.options()
+	if !o.aliased() {
+		return h.store.ReplaceAliases(ctx, nil)
+	}
+
+	filmTemplate, episodeTemplate, err := o.rename.templates()
+	if err != nil {
+		return err
+	}
+
+	b := newAliasBuilder()
+
+	// Only the duplicates of deduplicated libraries are hidden.
+	hidden, err := h.store.HiddenDuplicates(ctx)
+	if err != nil {
+		return err
+	}
+
+	films, err := h.storage.RecursiveMedia(ctx, o.filmsID)
+	if err != nil {
+		return err
+	}
+
+	// When paths collide, the first file keeps the path, so the files are sorted to always pick the same one.
+	sortMediaFiles(films)
+
+	var titled []MediaFile
+	for _, f := range films {
+		if !o.exposed(f.Name) || hidden[f.ID] {
+			continue
+		}
+
+		if f.Media.Title == "" {
+			b.file("/films/"+fileWithID(f.Name, f.ID), f.File)
+			continue
+		}
+
+		titled = append(titled, f)
+	}
+
+	for _, copies := range groupFilms(titled) {
+		if !o.versions.Group && !o.versions.Best {
+			for _, f := range copies {
+				h.addFilm(b, filmTemplate, f, "")
+			}
+
+			continue
+		}
+
+		if o.versions.Best {
+			copies = []MediaFile{o.versions.best(copies)}
+		}
+
+		if len(copies) == 1 {
+			h.addFilm(b, filmTemplate, copies[0], "")
+			continue
+		}
+
+		for i, label := range versionLabels(copies) {
+			h.addFilm(b, filmTemplate, copies[i], label)
+		}
+	}
+
+	shows, err := h.storage.RecursiveFolders(ctx, o.showsID, o.depth)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(shows, func(i, j int) bool {
+		return shows[i].Name < shows[j].Name || (shows[i].Name == shows[j].Name && shows[i].ID < shows[j].ID)
+	})
+
+	for _, show := range shows {
+		m, err := h.storage.Media(ctx, show.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		m = cleanMedia(m)
+		showName := m.Title
+		if m.Year > 0 {
+			showName += fmt.Sprintf(" (%d)", m.Year)
+		}
+
+		showPath := "/shows/" + showName
+		if !o.rename.Enabled || m.Title == "" || b.paths[showPath] {
+			showPath = "/shows/" + folderWithID(show.Name, show.ID)
+		}
+
+		b.folder(showPath, show.ID)
+
+		episodes, err := h.storage.RecursiveMedia(ctx, show.ID)
+		if err != nil {
+			return err
+		}
+
+		sortMediaFiles(episodes)
+
+		for _, f := range episodes {
+			if !o.exposed(f.Name) || hidden[f.ID] {
+				continue
+			}
+
+			data := nameData{Media: cleanMedia(f.Media), Show: m.Title, ShowYear: m.Year}
+			if data.Show == "" {
+				data.Show = show.Name
+			}
+
+			name, err := render(episodeTemplate, data)
+			if !o.rename.Enabled || !f.Media.IsEpisode() || err != nil {
+				b.file(showPath+"/"+fileWithID(f.Name, f.ID), f.File)
+				continue
+			}
+
+			b.file(showPath+"/"+name+extension(f), f.File)
+		}
+	}
+
+	return h.store.ReplaceAliases(ctx, b.aliases)
+}
+
+// sortMediaFiles sorts the files by name, and by ID when the names are equal.
+func sortMediaFiles(files []MediaFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name || (files[i].Name == files[j].Name && files[i].ID < files[j].ID)
+	})
+}
+
+// addFilm adds the film with the name of the film template and the version, if any.
+func (h Stream) addFilm(b *aliasBuilder, t *template.Template, f MediaFile, version string) {
+	name, err := render(t, nameData{Media: cleanMedia(f.Media)})
+	if err != nil {
+		b.file("/films/"+fileWithID(f.Name, f.ID), f.File)
+		return
+	}
+
+	if version != "" {
+		name += " - " + strings.Replace(version, "/", "-", -1)
+	}
+
+	b.file("/films/"+name+extension(f), f.File)
+}
+
+// cleanMedia removes slashes from the metadata, as slashes in the templates create folders.
+func cleanMedia(m parse.Media) parse.Media {
+	m.Title = strings.Replace(m.Title, "/", "-", -1)
+	m.Edition = strings.Replace(m.Edition, "/", "-", -1)
+	m.Group = strings.Replace(m.Group, "/", "-", -1)
+	return m
+}
+
+// renamed serves the request from the aliases when renaming is enabled.
+// Otherwise, the request is passed to the next handler.
+func (h Stream) renamed(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !h.options().aliased() {
+			next(w, r, ps)
+			return
+		}
+
+		a, err := h.alias(r.Context(), strings.TrimSuffix(r.URL.Path, "/"))
+		if errors.Is(err, sql.ErrNoRows) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+
+		if a.Folder {
+			h.propAlias(w, r, a)
+			return
+		}
+
+		f, err := h.storage.GetFile(r.Context(), a.ID)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The renamed file keeps its extension, so the content type remains the same.
+		f.Name = a.Name
+		ctx := withFile(r.Context(), f)
+
+		if r.Method == "PROPFIND" {
+			h.propFile(w, r.WithContext(ctx), ps)
+			return
+		}
+
+		addRequestID(h.streamFile)(w, r.WithContext(ctx), ps)
+	}
+}
+
+// propAlias creates a PROPFIND response with the contents of the renamed folder.
+func (h Stream) propAlias(w http.ResponseWriter, r *http.Request, a Alias) {
+	if h.collectionNotModified(w, r, libraryRoot(a.Path)) {
+		return
+	}
+
+	entries := h.aliasChildren(r.Context(), a.Path)
+	if h.options().nfo.Enabled {
+		entries = h.folderNFO(r.Context(), a.Path, aliasHref(a.Path)+"/", entries, baseURL(r))
+	}
+
+	h.writeSource(w, r, createDavFolder(aliasHref(a.Path)+"/", a.Name), entries)
+}
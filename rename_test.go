@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+func TestRender(t *testing.T) {
+	film, episode, err := Rename{}.templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  func() (string, error)
+		want string
+	}{
+		{"film", func() (string, error) {
+			return render(film, nameData{Media: parse.Media{Title: "Heat", Year: 1995}})
+		}, "Heat (1995)/Heat (1995)"},
+		{"film without a year", func() (string, error) {
+			return render(film, nameData{Media: parse.Media{Title: "Heat"}})
+		}, "Heat/Heat"},
+		{"episode", func() (string, error) {
+			return render(episode, nameData{Media: parse.Media{Season: 1, Episode: 2, EpisodeEnd: 2}, Show: "Dark"})
+		}, "Season 1/Dark - S01E02"},
+		{"episode range", func() (string, error) {
+			return render(episode, nameData{Media: parse.Media{Season: 1, Episode: 2, EpisodeEnd: 4}, Show: "Dark"})
+		}, "Season 1/Dark - S01E02-E04"},
+		{"slash in the title", func() (string, error) {
+			return render(film, nameData{Media: cleanMedia(parse.Media{Title: "AC/DC Live", Year: 1992})})
+		}, "AC-DC Live (1992)/AC-DC Live (1992)"},
+		{"control characters and backslashes", func() (string, error) {
+			return render(film, nameData{Media: parse.Media{Title: " Heat\\\t", Year: 1995}})
+		}, "Heat (1995)/Heat (1995)"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.got()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: render = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+
+	// A template which renders an empty folder name is not used.
+	edition, _, err := Rename{Film: "{{.Edition}}/{{.Title}}"}.templates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := render(edition, nameData{Media: parse.Media{Title: "Heat"}}); err == nil {
+		t.Errorf("render with an empty folder = %q, want an error", got)
+	}
+}
+
+func TestRenameValidate(t *testing.T) {
+	for _, r := range []Rename{{}, {Film: "{{.Title}}", Episode: "{{.Show}} {{.EpisodeCode}}"}} {
+		if err := r.Validate(); err != nil {
+			t.Errorf("Validate(%+v) = %v", r, err)
+		}
+	}
+
+	for _, r := range []Rename{
+		{Film: "{{.Title}"},
+		{Film: "{{.Unknown}}"},
+		{Film: "{{.Title}}/{{.Year}}/{{.Title}}"},
+		{Episode: "Season {{.Season}}/../{{.Show}}"},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", r)
+		}
+	}
+}
+
+// Colliding names are resolved with the ID of the file or folder, always for the same file or folder.
+func TestRenameCollisions(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "a", Name: "A", Parent: "films"},
+		{ID: "b", Name: "B", Parent: "films"},
+		{ID: "dark1", Name: "Dark.2017", Parent: "shows"},
+		{ID: "dark2", Name: "Dark (2017)", Parent: "shows"},
+		{ID: "season1", Name: "Season 1", Parent: "dark1"},
+		{ID: "season2", Name: "Season 1", Parent: "dark2"},
+	}, []ds.File{
+		{ID: "h1", Name: "Heat.1995.1080p.mkv", Parent: "a"},
+		{ID: "h2", Name: "Heat (1995).mkv", Parent: "b"},
+		{ID: "e1", Name: "Dark.S01E01.720p.mkv", Parent: "season2"},
+		{ID: "e2", Name: "Dark S01E01.mkv", Parent: "season2"},
+		{ID: "e3", Name: "Trailer.mkv", Parent: "season2"},
+		{ID: "e4", Name: "Dark S01E02.mkv", Parent: "season1"},
+	})
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Rename: Rename{Enabled: true}})
+
+	want := map[string]string{
+		"h2":    "/films/Heat (1995)/Heat (1995).mkv",
+		"h1":    "/films/Heat (1995)/Heat (1995).h1.mkv",
+		"dark2": "/shows/Dark (2017)",
+		"dark1": "/shows/Dark.2017 [dark1]",
+		"e2":    "/shows/Dark (2017)/Season 1/Dark - S01E01.mkv",
+		"e1":    "/shows/Dark (2017)/Season 1/Dark - S01E01.e1.mkv",
+		"e3":    "/shows/Dark (2017)/Trailer.e3.mkv",
+		"e4":    "/shows/Dark.2017 [dark1]/Season 1/Dark - S01E02.mkv",
+	}
+
+	// Every refresh resolves the collisions the same way.
+	for i := 0; i < 3; i++ {
+		if err := s.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for id, p := range want {
+			if got, err := store.AliasPath(ctx, id); err != nil || got != p {
+				t.Errorf("refresh %d: AliasPath(%s) = %q, %v, want %q", i, id, got, err, p)
+			}
+		}
+	}
+}
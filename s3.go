@@ -0,0 +1,422 @@
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// emptySHA256 is the hash of an empty payload, as sent with every request without a body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config locates a bucket of an S3-compatible service, such as MinIO, Backblaze B2 or Wasabi.
+type S3Config struct {
+	// Endpoint is the URL of the service, such as `https://s3.us-west-002.backblazeb2.com`.
+	Endpoint string
+	// Region defaults to `us-east-1`.
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// VirtualHost places the bucket in the host name instead of the path of the URL.
+	VirtualHost bool
+}
+
+// S3Source serves the objects of a bucket, where every prefix within a mount is a folder.
+//
+// Like a local source, IDs are derived from the keys. Objects uploaded in a single part have their
+// ETag as MD5 checksum, other objects a checksum of their key, size and modification time.
+type S3Source struct {
+	name   string
+	conf   S3Config
+	mounts []Mount
+	files  *locations
+	client *http.Client
+}
+
+func NewS3Source(name string, conf S3Config, mounts ...Mount) S3Source {
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+
+	conf.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+
+	return S3Source{
+		name:   name,
+		conf:   conf,
+		mounts: mounts,
+		files:  newLocations(),
+		client: &http.Client{
+			// The timeout only covers the response headers, as ranges are streamed for hours.
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: time.Minute,
+			},
+		},
+	}
+}
+
+func (s S3Source) ID() string {
+	return s.name
+}
+
+func (s S3Source) Sync(ctx context.Context, store Store, full bool) ([]Change, error) {
+	tree, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.files.replace(tree.locations)
+	return store.syncTree(ctx, s.name, tree, full)
+}
+
+func (s S3Source) Range(ctx context.Context, w io.Writer, id string, start, end uint64) (int64, error) {
+	key, err := s.files.lookup(ctx, id, func() (sourceTree, error) {
+		return s.list(ctx)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := s.request(ctx, key, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	s.sign(req, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	// Services may ignore a range covering the whole object, in which case the object is sent as is.
+	var content io.Reader = res.Body
+	switch {
+	case res.StatusCode == http.StatusOK && start == 0:
+		content = io.LimitReader(res.Body, int64(end+1))
+	case res.StatusCode != http.StatusPartialContent:
+		return 0, s3Error(res)
+	}
+
+	buf := streamingBufPool.Get().([]byte)
+	defer streamingBufPool.Put(buf)
+
+	body := &countingReader{Reader: content}
+	_, err = io.CopyBuffer(w, body, buf)
+	return body.n, err
+}
+
+// s3Object is an object in the listing of a bucket.
+type s3Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+type s3Listing struct {
+	Contents              []s3Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list lists the objects within the mounted prefixes, skipping hidden files and folders.
+// Every prefix becomes a folder, and keys ending with a slash only create their folder.
+func (s S3Source) list(ctx context.Context) (tree sourceTree, err error) {
+	tree.locations = make(map[string]string)
+
+	for _, m := range s.mounts {
+		prefix := strings.TrimPrefix(m.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+
+		name := path.Base(strings.TrimSuffix(prefix, "/"))
+		if prefix == "" {
+			name = s.conf.Bucket
+		}
+
+		tree.folders = append(tree.folders, ds.Folder{ID: m.Folder, Name: name})
+		folders := map[string]string{"": m.Folder}
+
+		// folder returns the ID of the folder, adding it and its parents when they were not seen yet.
+		var folder func(rel string, modified time.Time) string
+		folder = func(rel string, modified time.Time) string {
+			if id, ok := folders[rel]; ok {
+				return id
+			}
+
+			parent := folder(parentKey(rel), modified)
+			id := sourceItemID(s.name, m.Folder, rel)
+			folders[rel] = id
+
+			tree.folders = append(tree.folders, ds.Folder{ID: id, Name: path.Base(rel), Parent: parent})
+			tree.times = append(tree.times, ItemTime{ID: id, Created: modified, Modified: modified})
+			return id
+		}
+
+		err = s.listObjects(ctx, prefix, func(obj s3Object) {
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			if rel == "" || hiddenKey(rel) {
+				return
+			}
+
+			if strings.HasSuffix(rel, "/") {
+				folder(strings.TrimSuffix(rel, "/"), obj.LastModified)
+				return
+			}
+
+			id := sourceItemID(s.name, m.Folder, rel)
+			checksum := strings.Trim(obj.ETag, `"`)
+			if len(checksum) != 32 {
+				checksum = pseudoChecksum(rel, obj.Size, obj.LastModified)
+			}
+
+			tree.locations[id] = obj.Key
+			tree.times = append(tree.times, ItemTime{ID: id, Created: obj.LastModified, Modified: obj.LastModified})
+			tree.files = append(tree.files, ds.File{
+				ID:     id,
+				Name:   path.Base(rel),
+				Parent: folder(parentKey(rel), obj.LastModified),
+				Size:   int(obj.Size),
+				MD5:    checksum,
+			})
+		})
+
+		if err != nil {
+			return tree, err
+		}
+	}
+
+	return tree, nil
+}
+
+// parentKey returns the key of the folder containing the key, or an empty string at the top.
+func parentKey(rel string) string {
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i]
+	}
+
+	return ""
+}
+
+// hiddenKey reports whether the key or one of its folders starts with a dot.
+func hiddenKey(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listObjects calls fn with every object starting with the prefix, following the continuation tokens.
+func (s S3Source) listObjects(ctx context.Context, prefix string, fn func(s3Object)) error {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+
+	for {
+		req, err := s.request(ctx, "", query)
+		if err != nil {
+			return err
+		}
+
+		s.sign(req, time.Now())
+
+		res, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			err = s3Error(res)
+			res.Body.Close()
+			return err
+		}
+
+		var page s3Listing
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range page.Contents {
+			fn(obj)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// request creates an unsigned GET request of the key, or of the bucket when the key is empty.
+func (s S3Source) request(ctx context.Context, key string, query url.Values) (*http.Request, error) {
+	u, err := url.Parse(s.conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	p := "/" + s.conf.Bucket + "/" + key
+	if s.conf.VirtualHost {
+		u.Host = s.conf.Bucket + "." + u.Host
+		p = "/" + key
+	}
+
+	// The escaped path is set as well, so it is sent exactly as it is signed.
+	u.Path, u.RawPath = p, awsEscape(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+}
+
+// sign adds an AWS Signature Version 4 to the request, signing the host, the range and all `x-amz` headers.
+func (s S3Source) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+
+	scope := date + "/" + s.conf.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := []byte("AWS4" + s.conf.SecretKey)
+	for _, part := range []string{date, s.conf.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.conf.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery encodes the query sorted by key, with the escaping of AWS.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and slashes unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Error converts an error response into an error, such as ErrRateLimit when the service slows down.
+func s3Error(res *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+
+	xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&body)
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusTooManyRequests || body.Code == "SlowDown":
+		return ErrRateLimit
+	case body.Code != "":
+		return fmt.Errorf("stream: s3: %s: %s", body.Code, body.Message)
+	}
+
+	return fmt.Errorf("stream: s3: status code %d", res.StatusCode)
+}
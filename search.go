@@ -0,0 +1,260 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// The search index is a full-text index over the names of all files and folders.
+//
+// FTS5 requires the `sqlite_fts5` build tag of go-sqlite3,
+// so FTS4 is used instead when Stream is built without it.
+const (
+	sqlSearchIndexFTS5 = `
+CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(
+	id UNINDEXED, kind UNINDEXED, name, tokenize = 'unicode61 remove_diacritics 1'
+)
+`
+
+	sqlSearchIndexFTS4 = `
+CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts4(
+	id, kind, name, notindexed=id, notindexed=kind, tokenize=unicode61
+)
+`
+)
+
+func (s Store) createSearchIndex() error {
+	if _, err := s.DB.Exec(sqlSearchIndexFTS5); err != nil {
+		if !strings.Contains(err.Error(), "no such module") {
+			return err
+		}
+
+		if _, err := s.DB.Exec(sqlSearchIndexFTS4); err != nil {
+			return err
+		}
+
+		fmt.Println("SQLite lacks FTS5, so the search index uses FTS4 instead. Build Stream with `-tags sqlite_fts5` to use FTS5.")
+	}
+
+	// Databases created before the search index existed are indexed right away.
+	var indexed int
+	if err := s.DB.QueryRow(`SELECT COUNT(*) FROM search_index`).Scan(&indexed); err != nil {
+		return err
+	}
+
+	if indexed > 0 {
+		return nil
+	}
+
+	return s.RebuildSearchIndex(context.Background())
+}
+
+const sqlRebuildSearchIndex = `
+DELETE FROM search_index;
+INSERT INTO search_index (id, kind, name) SELECT id, 'file', name FROM file WHERE NOT trashed;
+INSERT INTO search_index (id, kind, name) SELECT id, 'folder', name FROM folder WHERE NOT trashed AND parent IS NOT NULL;
+`
+
+// RebuildSearchIndex replaces the search index with the current files and folders.
+func (s Store) RebuildSearchIndex(ctx context.Context) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlRebuildSearchIndex); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateSearchIndex updates the search index after the given files and folders were changed or removed.
+func (s Store) UpdateSearchIndex(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Temporary tables belong to the connection of the transaction.
+	setup := []string{
+		`CREATE TEMP TABLE IF NOT EXISTS search_changed (id text PRIMARY KEY)`,
+		`DELETE FROM search_changed`,
+	}
+
+	for _, statement := range setup {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	insert, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO search_changed (id) VALUES (?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	defer insert.Close()
+	for _, id := range ids {
+		if _, err := insert.ExecContext(ctx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	statements := []string{
+		`DELETE FROM search_index WHERE id IN (SELECT id FROM search_changed)`,
+		`INSERT INTO search_index (id, kind, name)
+			SELECT id, 'file', name FROM file WHERE NOT trashed AND id IN (SELECT id FROM search_changed)`,
+		`INSERT INTO search_index (id, kind, name)
+			SELECT id, 'folder', name FROM folder WHERE NOT trashed AND parent IS NOT NULL AND id IN (SELECT id FROM search_changed)`,
+		`DELETE FROM search_changed`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const sqlSearchFiles = `
+SELECT file.id, file.name, file.parent, file.size, file.md5
+FROM search_index JOIN file ON file.id = search_index.id
+WHERE search_index MATCH ? AND search_index.kind = 'file' AND NOT file.trashed
+ORDER BY file.name, file.id
+LIMIT ? OFFSET ?
+`
+
+const sqlSearchFolders = `
+SELECT folder.id, folder.name, folder.parent
+FROM search_index JOIN folder ON folder.id = search_index.id
+WHERE search_index MATCH ? AND search_index.kind = 'folder' AND NOT folder.trashed AND folder.parent IS NOT NULL
+ORDER BY folder.name, folder.id
+LIMIT ? OFFSET ?
+`
+
+// Search retrieves up to limit files and folders of which the name contains all words of the query,
+// or all of them when limit is not positive. The first offset files and folders are skipped.
+// The last word of the query is matched as a prefix.
+func (s Store) Search(ctx context.Context, query string, limit, offset int) (files []ds.File, folders []ds.Folder, err error) {
+	match := matchQuery(query)
+	if match == "" {
+		return nil, nil, nil
+	}
+
+	// A negative limit has no limit in SQLite.
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.DB.QueryContext(ctx, sqlSearchFiles, match, limit, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Size, &f.MD5)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, sqlSearchFolders, match, limit, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.Folder{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		folders = append(folders, f)
+	}
+
+	return files, folders, rows.Err()
+}
+
+// matchQuery converts user input into a full-text query which is compatible with both FTS4 and FTS5.
+// Only letters and digits are kept, and words are lowercased so they are never interpreted as operators.
+func matchQuery(query string) string {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return ""
+	}
+
+	words[len(words)-1] += "*"
+	return strings.Join(words, " ")
+}
+
+// Search returns up to limit exposed files and TV shows matching the query, or all of them when limit is not positive.
+// Matches outside the libraries are skipped, so the matches are retrieved a page at a time until enough are exposed.
+func (h Stream) Search(ctx context.Context, query string, limit int) (files []Entry, shows []Entry, err error) {
+	for offset := 0; ; offset += limit {
+		matchedFiles, matchedFolders, err := h.storage.Search(ctx, query, limit, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, f := range matchedFiles {
+			if limit > 0 && len(files) == limit {
+				break
+			}
+
+			parents, err := h.storage.Parents(ctx, f.Parent)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if href, ok := h.Href(ctx, f, parents); ok {
+				files = append(files, fileEntry(href, f))
+			}
+		}
+
+		for _, f := range matchedFolders {
+			if limit > 0 && len(shows) == limit {
+				break
+			}
+
+			parents, err := h.storage.Parents(ctx, f.Parent)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if href, ok := h.FolderHref(ctx, f, parents); ok {
+				shows = append(shows, folderEntry(href, f))
+			}
+		}
+
+		// A kind is done once it has enough entries, or once a page holds fewer matches than requested.
+		filesDone := len(files) == limit || len(matchedFiles) < limit
+		showsDone := len(shows) == limit || len(matchedFolders) < limit
+		if limit <= 0 || (filesDone && showsDone) {
+			return files, shows, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Matches outside the libraries do not count towards the limit.
+func TestSearchLimit(t *testing.T) {
+	ctx := context.Background()
+
+	folders := []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "extras", Name: "Extras", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+	}
+
+	// The trailers are sorted before the films, so they fill the first pages.
+	var files []ds.File
+	for i := 0; i < 5; i++ {
+		files = append(files, ds.File{ID: fmt.Sprintf("t%d", i), Name: fmt.Sprintf("Heat & Ronin Trailer %d.mkv", i), Parent: "extras", Size: 1})
+	}
+
+	files = append(files,
+		ds.File{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 1},
+		ds.File{ID: "f2", Name: "Heat (1995) Extended.mkv", Parent: "heat", Size: 1},
+		ds.File{ID: "f3", Name: "Heat (1995) Remastered.mkv", Parent: "heat", Size: 1},
+	)
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: newSyncedStore(t, folders, files)})
+
+	for limit, want := range map[int]int{0: 3, 1: 1, 2: 2, 3: 3, 10: 3} {
+		found, _, err := s.Search(ctx, "heat", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(found) != want {
+			t.Errorf("Search with limit %d: %d files, want %d: %+v", limit, len(found), want, found)
+		}
+
+		for _, e := range found {
+			if e.ID[0] != 'f' {
+				t.Errorf("Search with limit %d returned %s outside the libraries", limit, e.Name)
+			}
+		}
+	}
+}
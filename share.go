@@ -0,0 +1,532 @@
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/rs/xid"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrInvalidShare is returned for share tokens which are malformed, expired, revoked or used up.
+	ErrInvalidShare = errors.New("stream: invalid share link")
+)
+
+// A Share grants access to a single file without credentials until it expires.
+type Share struct {
+	ID      string    `json:"id"`
+	FileID  string    `json:"file"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// Rate limits the bandwidth of each stream in bytes per second, unlimited when zero.
+	Rate int `json:"rate,omitempty"`
+	// MaxUses limits the number of times the file can be opened, unlimited when zero.
+	MaxUses int  `json:"max_uses,omitempty"`
+	Uses    int  `json:"uses"`
+	Revoked bool `json:"revoked"`
+}
+
+// shareClaims are signed into the token, so links can be validated before reaching the database.
+// Links of playlists have no ID, but stream as the user who requested the playlist.
+type shareClaims struct {
+	ID      string `json:"id,omitempty"`
+	FileID  string `json:"f"`
+	Expires int64  `json:"e"`
+	Rate    int    `json:"r,omitempty"`
+	User    string `json:"u,omitempty"`
+}
+
+const sqlShareSchema = `
+CREATE TABLE IF NOT EXISTS share (
+	"id" text NOT NULL PRIMARY KEY,
+	"file" text NOT NULL,
+	"created" integer NOT NULL,
+	"expires" integer NOT NULL,
+	"rate" integer NOT NULL,
+	"max_uses" integer NOT NULL,
+	"uses" integer NOT NULL DEFAULT 0,
+	"revoked" boolean NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS share_client (
+	"share" text NOT NULL,
+	"client" text NOT NULL,
+	"first" integer NOT NULL,
+	PRIMARY KEY(share, client)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS secret (
+	"name" text NOT NULL PRIMARY KEY,
+	"value" blob NOT NULL
+);
+`
+
+// shareStore keeps the share links and the secret they are signed with.
+type shareStore interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+	CreateShare(ctx context.Context, sh Share) error
+	Shares(ctx context.Context) ([]Share, error)
+	RevokeShare(ctx context.Context, id string) error
+	UseShare(ctx context.Context, id, client string, count bool) error
+}
+
+func (s Store) createShareTable() error {
+	_, err := s.DB.Exec(sqlShareSchema)
+	return err
+}
+
+// Secret returns the named secret, creating a random secret on first use.
+func (s Store) Secret(ctx context.Context, name string) ([]byte, error) {
+	var value []byte
+	err := s.DB.QueryRowContext(ctx, `SELECT value FROM secret WHERE name = ?`, name).Scan(&value)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return value, err
+	}
+
+	value = make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return nil, err
+	}
+
+	// Another process may have created the secret in the meantime, so it is read again.
+	_, err = s.DB.ExecContext(ctx, `INSERT OR IGNORE INTO secret (name, value) VALUES (?, ?)`, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.QueryRowContext(ctx, `SELECT value FROM secret WHERE name = ?`, name).Scan(&value)
+	return value, err
+}
+
+// secretCache loads a secret from the Store once.
+type secretCache struct {
+	mu    sync.Mutex
+	value []byte
+}
+
+func (c *secretCache) get(ctx context.Context, store shareStore, name string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.value != nil {
+		return c.value, nil
+	}
+
+	value, err := store.Secret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.value = value
+	return value, nil
+}
+
+// CreateShare stores a new share link.
+func (s Store) CreateShare(ctx context.Context, sh Share) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO share (id, file, created, expires, rate, max_uses) VALUES (?, ?, ?, ?, ?, ?)`,
+		sh.ID, sh.FileID, sh.Created.Unix(), sh.Expires.Unix(), sh.Rate, sh.MaxUses)
+	return err
+}
+
+const sqlShares = `
+SELECT id, file, created, expires, rate, max_uses, uses, revoked FROM share
+ORDER BY created DESC
+`
+
+// Shares retrieves all share links, newest first.
+func (s Store) Shares(ctx context.Context) (shares []Share, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlShares)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		sh := Share{}
+		var created, expires int64
+
+		err := rows.Scan(&sh.ID, &sh.FileID, &created, &expires, &sh.Rate, &sh.MaxUses, &sh.Uses, &sh.Revoked)
+		if err != nil {
+			return nil, err
+		}
+
+		sh.Created, sh.Expires = time.Unix(created, 0), time.Unix(expires, 0)
+		shares = append(shares, sh)
+	}
+
+	return shares, rows.Err()
+}
+
+// RevokeShare revokes the share link, returning sql.ErrNoRows when it does not exist.
+func (s Store) RevokeShare(ctx context.Context, id string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE share SET revoked = 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UseShare counts a use of the share link by the client, returning ErrInvalidShare when it is revoked or used up.
+//
+// Every client counts as a single use, so the many requests of a player continue its use
+// and can still be served once the other uses are taken. Without count, the request is
+// only checked, such as for HEAD requests.
+func (s Store) UseShare(ctx context.Context, id, client string, count bool) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var maxUses, uses int
+	var revoked bool
+
+	err = tx.QueryRowContext(ctx, `SELECT max_uses, uses, revoked FROM share WHERE id = ?`, id).Scan(&maxUses, &uses, &revoked)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && revoked) {
+		tx.Rollback()
+		return ErrInvalidShare
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var known int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM share_client WHERE share = ? AND client = ?`, id, client).Scan(&known)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if known > 0 {
+		return tx.Commit()
+	}
+
+	if maxUses > 0 && uses >= maxUses {
+		tx.Rollback()
+		return ErrInvalidShare
+	}
+
+	if !count {
+		return tx.Commit()
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE share SET uses = uses + 1 WHERE id = ?`, []interface{}{id}},
+		{`INSERT INTO share_client (share, client, first) VALUES (?, ?, ?)`, []interface{}{id, client, time.Now().Unix()}},
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement.query, statement.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// shareClient identifies the client of a share link by its address and user agent.
+// Without trusted proxies, all clients behind a reverse proxy share its address.
+func (o options) shareClient(r *http.Request) string {
+	sum := sha256.Sum256([]byte(o.clientAddress(r) + "\n" + r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+func signShare(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return tokenEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewShare creates a share link of the file which expires after ttl, and returns its token.
+func (h Stream) NewShare(ctx context.Context, fileID string, ttl time.Duration, rate, maxUses int) (Share, string, error) {
+	if ttl <= 0 || rate < 0 || maxUses < 0 {
+		return Share{}, "", errors.New("stream: the expiry must be positive, the rate and uses cannot be negative")
+	}
+
+	if _, err := h.storage.GetFile(ctx, fileID); err != nil {
+		return Share{}, "", err
+	}
+
+	now := time.Now()
+	sh := Share{
+		ID:      xid.New().String(),
+		FileID:  fileID,
+		Created: now,
+		Expires: now.Add(ttl),
+		Rate:    rate,
+		MaxUses: maxUses,
+	}
+
+	token, err := h.signClaims(ctx, shareClaims{ID: sh.ID, FileID: sh.FileID, Expires: sh.Expires.Unix(), Rate: sh.Rate})
+	if err != nil {
+		return sh, "", err
+	}
+
+	if err := h.store.CreateShare(ctx, sh); err != nil {
+		return sh, "", err
+	}
+
+	return sh, token, nil
+}
+
+// userToken returns a token streaming the file as the user until it expires after ttl.
+// These tokens are not stored, so they cannot be revoked, but stop working once the user is removed.
+func (h Stream) userToken(ctx context.Context, fileID, user string, ttl time.Duration) (string, error) {
+	return h.signClaims(ctx, shareClaims{FileID: fileID, Expires: time.Now().Add(ttl).Unix(), User: user})
+}
+
+// signClaims returns the token of the claims.
+func (h Stream) signClaims(ctx context.Context, claims shareClaims) (string, error) {
+	secret, err := h.shareSecret.get(ctx, h.store, "share")
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	payload := tokenEncoding.EncodeToString(b)
+	return payload + "." + signShare(secret, payload), nil
+}
+
+// verifyShare validates the signature and expiry of the token.
+func (h Stream) verifyShare(ctx context.Context, token string) (shareClaims, error) {
+	claims := shareClaims{}
+
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return claims, ErrInvalidShare
+	}
+
+	secret, err := h.shareSecret.get(ctx, h.store, "share")
+	if err != nil {
+		return claims, err
+	}
+
+	payload, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signShare(secret, payload))) {
+		return claims, ErrInvalidShare
+	}
+
+	b, err := tokenEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return claims, ErrInvalidShare
+	}
+
+	if time.Now().Unix() >= claims.Expires {
+		return claims, ErrInvalidShare
+	}
+
+	return claims, nil
+}
+
+// ShareURL returns the URL of a share link.
+func ShareURL(base, token string) string {
+	return strings.TrimSuffix(base, "/") + "/s/" + token
+}
+
+// throttledWriter limits the bandwidth of a response.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func newThrottledWriter(w http.ResponseWriter, ctx context.Context, bytesPerSecond int) throttledWriter {
+	burst := 32 * 1024
+	if bytesPerSecond < burst {
+		burst = bytesPerSecond
+	}
+
+	return throttledWriter{w, ctx, rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (t throttledWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if size > t.limiter.Burst() {
+			size = t.limiter.Burst()
+		}
+
+		if err := t.limiter.WaitN(t.ctx, size); err != nil {
+			return n, err
+		}
+
+		written, err := t.ResponseWriter.Write(p[:size])
+		n += written
+		if err != nil {
+			return n, err
+		}
+
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+// serveShare streams the file of a share link.
+// The first GET of every client counts as a use, whatever range it requests,
+// as players continue with many requests for other ranges.
+//
+// Does not require any middleware.
+func (h Stream) serveShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	claims, err := h.verifyShare(ctx, ps.ByName("token"))
+	if errors.Is(err, ErrInvalidShare) {
+		http.Error(w, "This link is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	f, err := h.storage.GetFile(ctx, claims.FileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	user := claims.User
+	if claims.ID != "" {
+		user = "share:" + claims.ID
+		err = h.store.UseShare(ctx, claims.ID, h.options().shareClient(r), r.Method == "GET")
+	} else if _, ok := h.options().users[user]; !ok {
+		err = ErrInvalidShare
+	}
+
+	if errors.Is(err, ErrInvalidShare) {
+		http.Error(w, "This link is invalid or has expired.", http.StatusForbidden)
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+
+	// The token does not contain the name of the file.
+	w.Header().Set("Content-Disposition", "inline; filename*=UTF-8''"+url.PathEscape(f.Name))
+
+	if claims.Rate > 0 {
+		w = newThrottledWriter(w, ctx, claims.Rate)
+	}
+
+	// Sessions of share links are recorded under the ID of the link.
+	ctx = withUser(withFile(ctx, f), user)
+	addRequestID(h.streamFile)(w, r.WithContext(ctx), ps)
+}
+
+type shareRequest struct {
+	FileID string `json:"file"`
+	// Expires is a duration such as `24h`, defaults to a day.
+	Expires string `json:"expires"`
+	Rate    int    `json:"rate"`
+	MaxUses int    `json:"max_uses"`
+}
+
+type shareResponse struct {
+	Share
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// apiCreateShare creates a share link from a JSON shareRequest.
+func (h Stream) apiCreateShare(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	req := shareRequest{Expires: "24h"}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.Expires)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "`expires` must be a duration such as `24h`")
+		return
+	}
+
+	sh, token, err := h.NewShare(r.Context(), req.FileID, ttl, req.Rate, req.MaxUses)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "no file with this ID")
+		return
+	}
+
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, shareResponse{Share: sh, Token: token, URL: ShareURL(baseURL(r), token)})
+}
+
+// apiShares lists all share links.
+func (h Stream) apiShares(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	shares, err := h.store.Shares(r.Context())
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not retrieve the share links")
+		return
+	}
+
+	if shares == nil {
+		shares = []Share{}
+	}
+
+	writeJSON(w, http.StatusOK, shares)
+}
+
+// apiRevokeShare revokes a share link.
+func (h Stream) apiRevokeShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := h.store.RevokeShare(r.Context(), ps.ByName("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "no share link with this ID")
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		writeJSONError(w, http.StatusInternalServerError, "could not revoke the share link")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
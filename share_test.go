@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+func newShareStream(t *testing.T) (Stream, Store) {
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+	}, []ds.File{
+		{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat", Size: 10},
+	})
+
+	s := NewStream(Config{
+		Depth:          1,
+		FilmsID:        "films",
+		ShowsID:        "shows",
+		Store:          store,
+		Users:          map[string]string{"kodi": "change-me"},
+		TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+	})
+
+	return s, store
+}
+
+func TestShareToken(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newShareStream(t)
+
+	sh, token, err := s.NewShare(ctx, "f1", time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := s.verifyShare(ctx, token)
+	if err != nil || claims.ID != sh.ID || claims.FileID != "f1" {
+		t.Fatalf("verifyShare = %+v, %v", claims, err)
+	}
+
+	if _, _, err := s.NewShare(ctx, "missing", time.Hour, 0, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("NewShare of a missing file = %v, want sql.ErrNoRows", err)
+	}
+
+	// Another file signed with the signature of the link.
+	i := strings.LastIndex(token, ".")
+	other, err := s.signClaims(ctx, shareClaims{ID: sh.ID, FileID: "f2", Expires: claims.Expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := s.signClaims(ctx, shareClaims{ID: sh.ID, FileID: "f1", Expires: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream signs with its own secret.
+	stranger, _ := newShareStream(t)
+	foreign, err := stranger.signClaims(ctx, shareClaims{FileID: "f1", Expires: claims.Expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"tampered payload":   other[:strings.LastIndex(other, ".")] + token[i:],
+		"tampered signature": token[:i] + "." + strings.Repeat("A", len(token)-i-1),
+		"without signature":  token[:i],
+		"expired":            expired,
+		"foreign":            foreign,
+	}
+
+	for name, token := range tests {
+		if _, err := s.verifyShare(ctx, token); !errors.Is(err, ErrInvalidShare) {
+			t.Errorf("%s: verifyShare = %v, want ErrInvalidShare", name, err)
+		}
+	}
+}
+
+// Every client counts as a single use, HEAD requests never count.
+func TestShareUses(t *testing.T) {
+	ctx := context.Background()
+	_, store := newShareStream(t)
+
+	now := time.Now()
+	if err := store.CreateShare(ctx, Share{ID: "sh", FileID: "f1", Created: now, Expires: now.Add(time.Hour), MaxUses: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	uses := []struct {
+		client string
+		count  bool
+		valid  bool
+	}{
+		{"a", true, true},
+		{"a", true, true},
+		{"b", false, true},
+		{"b", true, true},
+		{"c", false, false},
+		{"c", true, false},
+		{"a", true, true},
+		{"b", false, true},
+	}
+
+	for i, use := range uses {
+		err := store.UseShare(ctx, "sh", use.client, use.count)
+		if use.valid && err != nil || !use.valid && !errors.Is(err, ErrInvalidShare) {
+			t.Errorf("use %d by %s = %v, want valid %t", i, use.client, err, use.valid)
+		}
+	}
+
+	shares, err := store.Shares(ctx)
+	if err != nil || len(shares) != 1 || shares[0].Uses != 2 {
+		t.Fatalf("Shares = %+v, %v, want 2 uses", shares, err)
+	}
+
+	if err := store.RevokeShare(ctx, "sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UseShare(ctx, "sh", "a", true); !errors.Is(err, ErrInvalidShare) {
+		t.Errorf("use of a revoked link = %v, want ErrInvalidShare", err)
+	}
+
+	if err := store.RevokeShare(ctx, "missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("RevokeShare of a missing link = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := store.UseShare(ctx, "missing", "a", false); !errors.Is(err, ErrInvalidShare) {
+		t.Errorf("use of a missing link = %v, want ErrInvalidShare", err)
+	}
+}
+
+func TestServeShareForbidden(t *testing.T) {
+	ctx := context.Background()
+	s, store := newShareStream(t)
+	h := s.Handler()
+
+	sh, token, err := s.NewShare(ctx, "f1", time.Hour, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RevokeShare(ctx, sh.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.userToken(ctx, "f1", "removed", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{
+		"revoked":      ShareURL("", token),
+		"tampered":     ShareURL("", token+"A"),
+		"removed user": ShareURL("", removed),
+	} {
+		if res := serve(h, "HEAD", target, nil); res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, res.StatusCode)
+		}
+	}
+}
+
+// Behind trusted proxies, the client is the last untrusted address of X-Forwarded-For.
+func TestShareClient(t *testing.T) {
+	s, _ := newShareStream(t)
+	o := s.options()
+
+	tests := []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"203.0.113.5:1234", nil, "203.0.113.5"},
+		{"203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.7, 192.168.1.1"}, "198.51.100.7"},
+		{"10.0.0.1:1234", []string{"1.1.1.1", "198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.1:1234", []string{"192.168.1.1"}, "192.168.1.1"},
+		{"10.0.0.2:1234", []string{"198.51.100.7"}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/s/token", nil)
+		r.RemoteAddr = tt.remote
+		for _, value := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+
+		if got := o.clientAddress(r); got != tt.want {
+			t.Errorf("clientAddress of %s forwarding %q = %s, want %s", tt.remote, tt.forwarded, got, tt.want)
+		}
+	}
+
+	// Viewers behind the proxy are different clients, unless they forward the same address.
+	client := func(forwarded, agent string) string {
+		r := httptest.NewRequest("GET", "/s/token", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", forwarded)
+		r.Header.Set("User-Agent", agent)
+		return o.shareClient(r)
+	}
+
+	if client("198.51.100.7", "Kodi") == client("198.51.100.8", "Kodi") {
+		t.Error("viewers with different addresses behind the proxy are the same client")
+	}
+
+	if client("198.51.100.7", "Kodi") != client("198.51.100.7", "Kodi") || client("198.51.100.7", "Kodi") == client("198.51.100.7", "VLC") {
+		t.Error("clients are not identified by their address and user agent")
+	}
+
+	if _, err := ParseProxies([]string{"10.0.0.1", "::1", "192.168.0.0/16"}); err != nil {
+		t.Errorf("ParseProxies = %v", err)
+	}
+
+	for _, proxy := range []string{"proxy", "10.0.0.0/33", ""} {
+		if _, err := ParseProxies([]string{proxy}); err == nil {
+			t.Errorf("ParseProxies(%q) succeeded", proxy)
+		}
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 3000)
+
+	// The first 20000 bytes are written at once, the other 10000 take half a second.
+	w := httptest.NewRecorder()
+	start := time.Now()
+	if n, err := newThrottledWriter(w, context.Background(), 20000).Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("30000 bytes at 20000 bytes per second took %v", elapsed)
+	}
+
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("throttled body differs from the data")
+	}
+
+	// Writes stop once the request is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w = httptest.NewRecorder()
+	if n, err := newThrottledWriter(w, ctx, 1000).Write(data); err == nil || n > 0 {
+		t.Errorf("Write after cancelling = %d, %v, want an error", n, err)
+	}
+}
@@ -0,0 +1,240 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// A snapshot is the listing of a library as of the last Refresh.
+// Snapshots are never modified, so listings are served from memory without locking.
+type snapshot struct {
+	// entries are the films or TV shows in the library folder.
+	entries []Entry
+	// episodes holds the files of every TV show by the ID of its folder.
+	episodes map[string][]Entry
+	// files holds all renamed files within the library, ordered by path.
+	files []Entry
+	// aliases and children hold every renamed path and the entries within renamed folders.
+	aliases  map[string]Alias
+	children map[string][]Entry
+
+	// nfos holds the NFO of every film with a title or every TV show by ID, when NFO files are enabled.
+	nfos map[string]preparedNFO
+	// modified holds the modification time of every file within the library by ID, zero when unknown.
+	modified map[string]time.Time
+
+	// version is the change counter of the library, used in the ETags of its collections.
+	version int64
+}
+
+// snapshots holds the latest snapshot of each library, which is replaced atomically by Refresh.
+type snapshots struct {
+	films atomic.Value
+	shows atomic.Value
+}
+
+func (s *snapshots) library(root string) *atomic.Value {
+	if root == "/shows" {
+		return &s.shows
+	}
+
+	return &s.films
+}
+
+// snapshot returns the snapshot of the library in `/films` or `/shows`,
+// or nil when the libraries have not been refreshed yet.
+func (h Stream) snapshot(root string) *snapshot {
+	snap, _ := h.snapshots.library(root).Load().(*snapshot)
+	return snap
+}
+
+// rebuildSnapshots lists both libraries and swaps them with their previous snapshots.
+func (h Stream) rebuildSnapshots(ctx context.Context) error {
+	o := h.options()
+
+	for _, root := range []string{"/films", "/shows"} {
+		var snap *snapshot
+		var err error
+
+		if o.aliased() {
+			snap, err = h.aliasSnapshot(ctx, root)
+		} else {
+			snap, err = h.flatSnapshot(ctx, root)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if o.nfo.Enabled {
+			entries := snap.entries
+			if root == "/films" && o.aliased() {
+				entries = snap.files
+			}
+
+			if snap.nfos, err = h.prepareNFOs(ctx, root, entries); err != nil {
+				return err
+			}
+		}
+
+		if snap.modified, err = h.modifiedTimes(ctx, snap); err != nil {
+			return err
+		}
+
+		snap.version, err = h.store.LibraryVersion(ctx, root, snap.fingerprint(o))
+		if err != nil {
+			return err
+		}
+
+		h.snapshots.library(root).Store(snap)
+	}
+
+	return nil
+}
+
+// modifiedTimes retrieves the modification times of the files within the snapshot.
+func (h Stream) modifiedTimes(ctx context.Context, snap *snapshot) (map[string]time.Time, error) {
+	modified := make(map[string]time.Time)
+	add := func(entries []Entry) {
+		for _, e := range entries {
+			if !e.Folder {
+				modified[e.ID] = time.Time{}
+			}
+		}
+	}
+
+	add(snap.entries)
+	add(snap.files)
+	for _, episodes := range snap.episodes {
+		add(episodes)
+	}
+
+	ids := make([]string, 0, len(modified))
+	for id := range modified {
+		ids = append(ids, id)
+	}
+
+	times, err := h.storage.ItemTimes(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for id, t := range times {
+		modified[id] = t.Modified
+	}
+
+	return modified, nil
+}
+
+func (h Stream) flatSnapshot(ctx context.Context, root string) (*snapshot, error) {
+	if root == "/films" {
+		films, err := h.listFilms(ctx)
+		return &snapshot{entries: films}, err
+	}
+
+	shows, err := h.listShows(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{entries: shows, episodes: make(map[string][]Entry, len(shows))}
+	for _, show := range shows {
+		episodes, err := h.listEpisodes(ctx, ds.Folder{ID: show.ID, Name: show.Name})
+		if err != nil {
+			return nil, err
+		}
+
+		snap.episodes[show.ID] = episodes
+	}
+
+	return snap, nil
+}
+
+func (h Stream) aliasSnapshot(ctx context.Context, root string) (*snapshot, error) {
+	snap := &snapshot{
+		episodes: make(map[string][]Entry),
+		aliases:  map[string]Alias{root: {Path: root, Name: root[1:], Folder: true}},
+		children: make(map[string][]Entry),
+	}
+
+	paths := make(map[string]string)
+	err := h.store.AliasTree(ctx, root, func(a Alias, e Entry) {
+		snap.aliases[a.Path] = a
+		snap.children[a.Parent] = append(snap.children[a.Parent], e)
+
+		if !a.Folder {
+			paths[e.Href] = a.Path
+			snap.files = append(snap.files, e)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	snap.entries = snap.children[root]
+	sort.Slice(snap.files, func(i, j int) bool {
+		return paths[snap.files[i].Href] < paths[snap.files[j].Href]
+	})
+
+	if root == "/shows" {
+		for _, e := range snap.files {
+			// The folder of the TV show is the first folder within the library.
+			p := strings.TrimPrefix(paths[e.Href], root+"/")
+			show := snap.aliases[root+"/"+p[:strings.Index(p+"/", "/")]]
+
+			if show.Folder {
+				snap.episodes[show.ID] = append(snap.episodes[show.ID], e)
+			}
+		}
+	}
+
+	return snap, nil
+}
+
+// alias retrieves the renamed path from the snapshot of its library, or from the Store before the first Refresh.
+func (h Stream) alias(ctx context.Context, p string) (Alias, error) {
+	if snap := h.snapshot(libraryRoot(p)); snap != nil && snap.aliases != nil {
+		a, ok := snap.aliases[p]
+		if !ok {
+			return a, sql.ErrNoRows
+		}
+
+		return a, nil
+	}
+
+	return h.store.GetAlias(ctx, p)
+}
+
+// aliasChildren lists the entries within the renamed folder from the snapshot of its library,
+// or from the Store before the first Refresh.
+func (h Stream) aliasChildren(ctx context.Context, p string) entrySource {
+	if snap := h.snapshot(libraryRoot(p)); snap != nil && snap.children != nil {
+		return sliceSource(snap.children[p])
+	}
+
+	return func(fn func(Entry) bool) error {
+		return h.store.EachAliasChild(ctx, p, fn)
+	}
+}
+
+// libraryRoot returns `/films` or `/shows` for a path within the libraries.
+func libraryRoot(p string) string {
+	if p == "/shows" || strings.HasPrefix(p, "/shows/") {
+		return "/shows"
+	}
+
+	return "/films"
+}
+
+// shared limits the capacity of a slice from a snapshot,
+// so appending to it copies the entries instead of modifying the snapshot.
+func shared(entries []Entry) []Entry {
+	return entries[:len(entries):len(entries)]
+}
@@ -0,0 +1,112 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+func newSnapshotStore(t *testing.T) Store {
+	return newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+		{ID: "dark", Name: "Dark (2017)", Parent: "shows"},
+		{ID: "season1", Name: "Season 1", Parent: "dark"},
+	}, []ds.File{
+		{ID: "f1", Name: "Heat.1995.1080p.mkv", Parent: "heat"},
+		{ID: "e2", Name: "Dark.S01E02.mkv", Parent: "season1"},
+		{ID: "e1", Name: "Dark.S01E01.mkv", Parent: "season1"},
+	})
+}
+
+// Listings are served from the snapshot of the last Refresh, and from the Store before the first.
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	store := newSnapshotStore(t)
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store})
+
+	added := []ds.File{{ID: "f2", Name: "Heat.1995.2160p.mkv", Parent: "heat"}}
+	if err := store.PartialSync(ds.Drive{ID: "drive", Name: "Drive"}, nil, added, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if films, err := s.Films(ctx); err != nil || len(films) != 2 || s.snapshot("/films") != nil {
+		t.Fatalf("Films before the first Refresh = %v, %v, want both files from the Store", films, err)
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := []string{"f2"}
+	if err := store.PartialSync(ds.Drive{ID: "drive", Name: "Drive"}, nil, nil, removed); err != nil {
+		t.Fatal(err)
+	}
+
+	films, err := s.Films(ctx)
+	if err != nil || len(films) != 2 {
+		t.Fatalf("Films before refreshing = %v, %v, want the snapshot of both files", films, err)
+	}
+
+	// Appending to a listing copies it, so the snapshot is never changed.
+	extended := append(films, Entry{ID: "appended"})
+	extended[0].ID = "changed"
+	if films, _ := s.Films(ctx); films[0].ID == "changed" {
+		t.Error("appending to the films shares the snapshot")
+	}
+
+	episodes, err := s.Episodes(ctx, ds.Folder{ID: "dark", Name: "Dark (2017)"})
+	if err != nil || len(episodes) != 2 {
+		t.Errorf("Episodes = %v, %v, want both episodes", episodes, err)
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if films, err := s.Films(ctx); err != nil || len(films) != 1 || films[0].ID != "f1" {
+		t.Errorf("Films after refreshing = %v, %v, want f1", films, err)
+	}
+}
+
+// Renamed paths are resolved from the snapshot, which groups the episodes by TV show.
+func TestAliasSnapshot(t *testing.T) {
+	ctx := context.Background()
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: newSnapshotStore(t), Rename: Rename{Enabled: true}})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := s.snapshot("/shows")
+	if snap == nil || snap.aliases == nil {
+		t.Fatal("no snapshot of the renamed TV shows")
+	}
+
+	a, err := s.alias(ctx, "/shows/Dark (2017)")
+	if err != nil || !a.Folder || a.ID != "dark" {
+		t.Errorf("alias of the TV show = %+v, %v", a, err)
+	}
+
+	if _, err := s.alias(ctx, "/shows/Dark (2017)/Season 2"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("alias of a missing season = %v, want sql.ErrNoRows", err)
+	}
+
+	children, err := collect(s.aliasChildren(ctx, "/shows/Dark (2017)/Season 1"))
+	if err != nil || len(children) != 2 {
+		t.Errorf("children of the season = %v, %v", children, err)
+	}
+
+	// Files are ordered by their renamed path.
+	episodes := snap.episodes["dark"]
+	if len(episodes) != 2 || episodes[0].ID != "e1" || episodes[1].ID != "e2" {
+		t.Errorf("episodes of the snapshot = %v, want e1 and e2", episodes)
+	}
+
+	if films := s.snapshot("/films"); len(films.entries) != 1 || !films.entries[0].Folder || len(films.files) != 1 {
+		t.Errorf("films of the snapshot = %+v, want a single folder with the film", films)
+	}
+}
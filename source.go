@@ -0,0 +1,444 @@
+package stream
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	lowe "github.com/m-rots/bernard"
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// A Source provides files and folders to the libraries, such as a Shared Drive or a local directory.
+//
+// Every source keeps its files and folders in the Store under its own ID, like a Shared Drive,
+// so the libraries can contain the files of multiple sources.
+type Source interface {
+	// ID identifies the files and folders of the source in the Store.
+	ID() string
+	// Sync saves the files and folders of the source in the Store.
+	// A full sync saves everything to an empty drive, a partial sync returns the changes since the previous sync.
+	Sync(ctx context.Context, store Store, full bool) ([]Change, error)
+	// Range copies the bytes from start up to and including end of the file to w,
+	// and returns the number of bytes read from the source.
+	Range(ctx context.Context, w io.Writer, id string, start, end uint64) (int64, error)
+}
+
+// driveSource synchronises a Shared Drive with Bernard and streams its files from Google Drive.
+type driveSource struct {
+	id    string
+	fetch fetch
+}
+
+// DriveSource returns the Source of the Shared Drive, which shares the rate limits of Stream.
+func (h Stream) DriveSource(driveID string) Source {
+	return driveSource{id: driveID, fetch: h.fetch}
+}
+
+func (d driveSource) ID() string {
+	return d.id
+}
+
+func (d driveSource) Range(ctx context.Context, w io.Writer, id string, start, end uint64) (int64, error) {
+	return d.fetch.Range(ctx, w, id, start, end)
+}
+
+// Sync runs Bernard, which cannot be cancelled. Once the context is cancelled,
+// the sync is abandoned unless Bernard is committing or has committed the changes.
+func (d driveSource) Sync(ctx context.Context, store Store, full bool) ([]Change, error) {
+	type result struct {
+		changes []Change
+		err     error
+	}
+
+	gate := &commitGate{ctx: ctx}
+	done := make(chan result, 1)
+
+	go func() {
+		changes, err := d.sync(ctx, store, gatedStore{store, gate}, full)
+		done <- result{changes, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.changes, r.err
+	case <-ctx.Done():
+	}
+
+	if gate.abandon() {
+		r := <-done
+		return r.changes, r.err
+	}
+
+	return nil, ctx.Err()
+}
+
+func (d driveSource) sync(ctx context.Context, store Store, gated gatedStore, full bool) ([]Change, error) {
+	bernard := lowe.New(d.fetch.auth, gated, lowe.WithSafeSleep(0*time.Minute))
+
+	if full {
+		fmt.Printf("%s - performing full sync...\n", d.id)
+		if err := bernard.FullSync(d.id); err != nil {
+			return nil, err
+		}
+
+		// The sync itself succeeded, so Recently Added is merely outdated until the next sync.
+		if err := d.syncTimes(ctx, store, nil); err != nil {
+			fmt.Printf("%s - could not retrieve creation and modification times: %v\n", d.id, err)
+		}
+
+		return nil, nil
+	}
+
+	changed := []string{}
+	var changes []Change
+
+	hook := func(drive ds.Drive, files []ds.File, folders []ds.Folder, removed []string) error {
+		for _, f := range files {
+			_, err := store.FileByID(ctx, f.ID)
+			changed = append(changed, f.ID)
+			changes = append(changes, Change{ID: f.ID, Name: f.Name, Trashed: f.Trashed, Added: errors.Is(err, sql.ErrNoRows), parent: f.Parent})
+		}
+
+		for _, f := range folders {
+			changed = append(changed, f.ID)
+			changes = append(changes, Change{ID: f.ID, Name: f.Name, Folder: true, Trashed: f.Trashed, parent: f.Parent})
+		}
+
+		// The hook runs before the changes are saved, so removed items can still be looked up.
+		for _, id := range removed {
+			changes = append(changes, store.removedChange(ctx, id))
+		}
+
+		return nil
+	}
+
+	fmt.Printf("%s - performing partial sync...\n", d.id)
+	if err := bernard.PartialSync(d.id, hook); err != nil {
+		return nil, err
+	}
+
+	if err := d.syncTimes(ctx, store, changed); err != nil {
+		fmt.Printf("%s - could not retrieve creation and modification times: %v\n", d.id, err)
+	}
+
+	return changes, nil
+}
+
+// errAbandoned is returned to Bernard when it commits a sync which was abandoned.
+var errAbandoned = errors.New("stream: sync abandoned before committing")
+
+// commitGate abandons a sync before it commits its changes, but never while it commits them.
+type commitGate struct {
+	ctx       context.Context
+	mu        sync.Mutex
+	abandoned bool
+	committed bool
+}
+
+// commit runs fn unless the sync was abandoned or its context was cancelled.
+func (g *commitGate) commit(fn func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.abandoned || g.ctx.Err() != nil {
+		return errAbandoned
+	}
+
+	g.committed = true
+	return fn()
+}
+
+// abandon prevents the commit, and reports whether it already started.
+// A running commit is waited for.
+func (g *commitGate) abandon() (committed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.abandoned = true
+	return g.committed
+}
+
+// gatedStore commits the syncs of Bernard through the gate.
+type gatedStore struct {
+	Store
+	gate *commitGate
+}
+
+func (s gatedStore) FullSync(drive ds.Drive, folders []ds.Folder, files []ds.File) error {
+	return s.gate.commit(func() error {
+		return s.Store.FullSync(drive, folders, files)
+	})
+}
+
+func (s gatedStore) PartialSync(drive ds.Drive, folders []ds.Folder, files []ds.File, removed []string) error {
+	return s.gate.commit(func() error {
+		return s.Store.PartialSync(drive, folders, files, removed)
+	})
+}
+
+// source returns the Source of the file, which is the Shared Drive unless another source contains it.
+func (h Stream) source(ctx context.Context, f ds.File) (Source, error) {
+	drive, err := h.storage.FileDrive(ctx, f.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range h.sources {
+		if src.ID() == drive {
+			return src, nil
+		}
+	}
+
+	return h.DriveSource(drive), nil
+}
+
+// Sources returns the Shared Drive, if configured, followed by the other sources.
+func (h Stream) Sources() []Source {
+	var sources []Source
+	if h.driveID != "" {
+		sources = append(sources, h.DriveSource(h.driveID))
+	}
+
+	return append(sources, h.sources...)
+}
+
+// FileDrive retrieves the ID of the drive or source containing the file.
+func (s Store) FileDrive(ctx context.Context, id string) (drive string, err error) {
+	err = s.DB.QueryRowContext(ctx, `SELECT drive FROM file WHERE id = ?`, id).Scan(&drive)
+	return drive, err
+}
+
+// driveItems retrieves all files and folders of the drive, except for its root folder.
+func (s Store) driveItems(ctx context.Context, driveID string) (folders []ds.Folder, files []ds.File, err error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, name, COALESCE(parent, ''), trashed FROM folder WHERE drive = ? AND id != ?`, driveID, driveID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for rows.Next() {
+		f := ds.Folder{}
+		if err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Trashed); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+
+		folders = append(folders, f)
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, `SELECT id, name, parent, trashed, size, md5 FROM file WHERE drive = ?`, driveID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		if err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Trashed, &f.Size, &f.MD5); err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return folders, files, rows.Err()
+}
+
+// sourceTree holds the files and folders listed by a source, and the location of every file by ID.
+type sourceTree struct {
+	folders   []ds.Folder
+	files     []ds.File
+	times     []ItemTime
+	locations map[string]string
+}
+
+// sourceItemID derives the ID of an item from its path within the folder it is mounted in.
+func sourceItemID(source, folder, rel string) string {
+	sum := sha1.Sum([]byte(source + "\x00" + folder + "\x00" + rel))
+	return "l" + hex.EncodeToString(sum[:16])
+}
+
+// pseudoChecksum stands in for the MD5 checksum of a file which is unknown,
+// and changes whenever the file is replaced.
+func pseudoChecksum(rel string, size int64, modified time.Time) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s\x00%d\x00%d", rel, size, modified.UnixNano())))
+	return hex.EncodeToString(sum[:])
+}
+
+// syncTree saves the listed files and folders of a source.
+// A partial sync compares them with the stored files and folders and only saves the differences.
+func (s Store) syncTree(ctx context.Context, name string, tree sourceTree, full bool) ([]Change, error) {
+	drive := ds.Drive{ID: name, Name: name, PageToken: time.Now().UTC().Format(time.RFC3339)}
+
+	if full {
+		fmt.Printf("%s - performing full sync...\n", name)
+		if err := s.FullSync(drive, tree.folders, tree.files); err != nil {
+			return nil, err
+		}
+
+		return nil, s.saveTimes(ctx, name, tree.times)
+	}
+
+	fmt.Printf("%s - performing partial sync...\n", name)
+
+	folders, files, err := s.driveItems(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	previousFolders := make(map[string]ds.Folder, len(folders))
+	for _, f := range folders {
+		previousFolders[f.ID] = f
+	}
+
+	previousFiles := make(map[string]ds.File, len(files))
+	for _, f := range files {
+		previousFiles[f.ID] = f
+	}
+
+	var changes []Change
+	var changedFolders []ds.Folder
+	var changedFiles []ds.File
+	changed := make(map[string]bool)
+
+	for _, f := range tree.folders {
+		previous, exists := previousFolders[f.ID]
+		delete(previousFolders, f.ID)
+
+		if exists && previous == f {
+			continue
+		}
+
+		changed[f.ID] = true
+		changedFolders = append(changedFolders, f)
+		changes = append(changes, Change{ID: f.ID, Name: f.Name, Folder: true, parent: f.Parent})
+	}
+
+	for _, f := range tree.files {
+		previous, exists := previousFiles[f.ID]
+		delete(previousFiles, f.ID)
+
+		if exists && previous == f {
+			continue
+		}
+
+		changed[f.ID] = true
+		changedFiles = append(changedFiles, f)
+		changes = append(changes, Change{ID: f.ID, Name: f.Name, Added: !exists, parent: f.Parent})
+	}
+
+	// The removed items are described before they are deleted.
+	var removed []string
+	for id := range previousFiles {
+		removed = append(removed, id)
+		changes = append(changes, s.removedChange(ctx, id))
+	}
+
+	for id := range previousFolders {
+		removed = append(removed, id)
+		changes = append(changes, s.removedChange(ctx, id))
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	if err := s.PartialSync(drive, changedFolders, changedFiles, removed); err != nil {
+		return nil, err
+	}
+
+	var times []ItemTime
+	for _, t := range tree.times {
+		if changed[t.ID] {
+			times = append(times, t)
+		}
+	}
+
+	return changes, s.saveTimes(ctx, name, times)
+}
+
+// relistAfter is how long a listing is trusted to contain every file of a source.
+const relistAfter = time.Minute
+
+// locations maps the IDs of the files of a source to their location, such as a path or key.
+type locations struct {
+	mu   sync.Mutex
+	byID map[string]string
+	// listed is the time of the last listing, and listing is closed once the running listing has finished.
+	listed  time.Time
+	listing chan struct{}
+}
+
+func newLocations() *locations {
+	return &locations{byID: make(map[string]string)}
+}
+
+func (l *locations) replace(byID map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.byID, l.listed = byID, time.Now()
+}
+
+// lookup returns the location of the file, listing the source again when the file is unknown,
+// such as when the server started without synchronising.
+//
+// Files which are still unknown within relistAfter of the last listing return ErrNotFound right away,
+// and lookups during a listing wait for it instead of listing the source again.
+func (l *locations) lookup(ctx context.Context, id string, list func() (sourceTree, error)) (string, error) {
+	for {
+		l.mu.Lock()
+		if location, ok := l.byID[id]; ok {
+			l.mu.Unlock()
+			return location, nil
+		}
+
+		if listing := l.listing; listing != nil {
+			l.mu.Unlock()
+
+			select {
+			case <-listing:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+
+		if !l.listed.IsZero() && time.Since(l.listed) < relistAfter {
+			l.mu.Unlock()
+			return "", ErrNotFound
+		}
+
+		listing := make(chan struct{})
+		l.listing = listing
+		l.mu.Unlock()
+
+		tree, err := list()
+
+		// Failed listings are not retried right away either.
+		l.mu.Lock()
+		if err == nil {
+			l.byID = tree.locations
+		}
+
+		l.listed, l.listing = time.Now(), nil
+		l.mu.Unlock()
+		close(listing)
+
+		if err != nil {
+			return "", err
+		}
+	}
+}
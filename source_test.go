@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Bernard cannot be cancelled, so its sync is abandoned before it commits, but never while it commits.
+func TestCommitGate(t *testing.T) {
+	store := newTestStore(t)
+	drive := ds.Drive{ID: "drive", Name: "Drive"}
+	folders := []ds.Folder{{ID: "drive", Name: "Drive"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gate := &commitGate{ctx: ctx}
+
+	if gate.abandon() {
+		t.Error("abandon reports a commit before any commit")
+	}
+
+	if err := (gatedStore{store, gate}).FullSync(drive, folders, nil); !errors.Is(err, errAbandoned) {
+		t.Errorf("FullSync after abandoning = %v, want %v", err, errAbandoned)
+	}
+
+	if _, err := store.PageToken("drive"); !errors.Is(err, ds.ErrFullSync) {
+		t.Errorf("the abandoned sync was saved: %v", err)
+	}
+
+	// A commit which started is finished, and abandoning waits for it.
+	gate = &commitGate{ctx: ctx}
+	committing := make(chan struct{})
+	release := make(chan struct{})
+
+	go gate.commit(func() error {
+		close(committing)
+		<-release
+		return nil
+	})
+
+	<-committing
+	abandoned := make(chan bool)
+	go func() { abandoned <- gate.abandon() }()
+
+	select {
+	case <-abandoned:
+		t.Fatal("abandon did not wait for the running commit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if committed := <-abandoned; !committed {
+		t.Error("abandon does not report the running commit")
+	}
+
+	// A cancelled sync is never committed, even before it is abandoned.
+	cancel()
+	gate = &commitGate{ctx: ctx}
+	if err := (gatedStore{store, gate}).PartialSync(drive, folders, nil, nil); !errors.Is(err, errAbandoned) {
+		t.Errorf("PartialSync after cancelling = %v, want %v", err, errAbandoned)
+	}
+}
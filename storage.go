@@ -0,0 +1,635 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+// Storage holds the files and folders of the Shared Drives which the libraries are built from.
+//
+// Files and folders which do not exist return sql.ErrNoRows.
+type Storage interface {
+	// GetFile retrieves a file which is not trashed.
+	GetFile(ctx context.Context, id string) (ds.File, error)
+	// FileByID retrieves a file, including trashed files.
+	FileByID(ctx context.Context, id string) (ds.File, error)
+	// RecursiveFiles retrieves all files within the subfolders of the folder.
+	RecursiveFiles(ctx context.Context, id string) ([]ds.File, error)
+	// EachRecursiveFile passes the files of RecursiveFiles to fn until it returns false.
+	EachRecursiveFile(ctx context.Context, id string, fn func(ds.File) bool) error
+	// RecursiveFolders retrieves all folders exactly depth levels below the folder.
+	RecursiveFolders(ctx context.Context, id string, depth int) ([]ds.Folder, error)
+	// EachRecursiveFolder passes the folders of RecursiveFolders to fn until it returns false.
+	EachRecursiveFolder(ctx context.Context, id string, depth int, fn func(ds.Folder) bool) error
+	// Children retrieves the files and folders directly within the folder, sorted by name.
+	Children(ctx context.Context, id string) ([]ds.File, []ds.Folder, error)
+	// Parents retrieves the folder and all of its parents, nearest folder first.
+	Parents(ctx context.Context, id string) ([]ds.Folder, error)
+	// Search retrieves up to limit files and folders of which the name contains all words of the query,
+	// or all of them when limit is not positive. The first offset files and folders are skipped.
+	Search(ctx context.Context, query string, limit, offset int) ([]ds.File, []ds.Folder, error)
+
+	// FileDrive retrieves the ID of the drive or source containing the file.
+	FileDrive(ctx context.Context, id string) (string, error)
+	// ItemTimes retrieves the creation and modification times of the items, by ID.
+	ItemTimes(ctx context.Context, ids []string) (map[string]ItemTime, error)
+	// RecentFiles passes the files within the subfolders of the folder to fn, newest first, until it returns false.
+	RecentFiles(ctx context.Context, id string, order RecentOrder, fn func(ds.File) bool) error
+	// Media retrieves the metadata parsed from the name of a file or folder.
+	Media(ctx context.Context, id string) (parse.Media, error)
+	// RecursiveMedia retrieves the files of RecursiveFiles together with their parsed metadata.
+	RecursiveMedia(ctx context.Context, id string) ([]MediaFile, error)
+	// DuplicateFiles retrieves the files of RecursiveFiles which share their MD5 with another file,
+	// ordered by MD5 and then by preference.
+	DuplicateFiles(ctx context.Context, id string) ([]ds.File, error)
+}
+
+// Database holds the state Stream keeps next to the files and folders,
+// such as the aliases, share links, sessions and progress.
+type Database interface {
+	aliasStore
+	duplicateStore
+	versionStore
+	shareStore
+	sessionStore
+	progressStore
+	MetadataProvider
+
+	// Status retrieves the synchronisation state of all drives.
+	Status(ctx context.Context) ([]DriveStatus, error)
+}
+
+var (
+	_ Storage  = Store{}
+	_ Storage  = (*MemoryStorage)(nil)
+	_ Database = Store{}
+)
+
+const sqlChildFiles = `
+SELECT id, name, parent, size, md5 FROM file WHERE parent = ? AND NOT trashed ORDER BY name
+`
+
+const sqlChildFolders = `
+SELECT id, name, parent FROM folder WHERE parent = ? AND NOT trashed ORDER BY name
+`
+
+// Children retrieves the files and folders directly within the folder, sorted by name.
+func (s Store) Children(ctx context.Context, id string) (files []ds.File, folders []ds.Folder, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlChildFiles, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.File{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Size, &f.MD5)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, sqlChildFolders, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.Folder{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		folders = append(folders, f)
+	}
+
+	return files, folders, rows.Err()
+}
+
+// Items holds all files and folders, including trashed ones,
+// together with the drive of every file and the times of every item.
+type Items struct {
+	Files   []ds.File
+	Folders []ds.Folder
+	// Drives holds the ID of the drive or source of every file, by file ID.
+	Drives map[string]string
+	Times  []ItemTime
+}
+
+const sqlAllFiles = `
+SELECT id, name, parent, size, md5, trashed, drive FROM file
+`
+
+const sqlAllFolders = `
+SELECT id, name, COALESCE(parent, ''), trashed FROM folder
+`
+
+const sqlAllTimes = `
+SELECT id, created, modified FROM item_time
+`
+
+// Items retrieves all files and folders.
+func (s Store) Items(ctx context.Context) (items Items, err error) {
+	rows, err := s.DB.QueryContext(ctx, sqlAllFiles)
+	if err != nil {
+		return items, err
+	}
+
+	defer rows.Close()
+	items.Drives = make(map[string]string)
+	for rows.Next() {
+		f := ds.File{}
+		var drive string
+
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Size, &f.MD5, &f.Trashed, &drive)
+		if err != nil {
+			return items, err
+		}
+
+		items.Files = append(items.Files, f)
+		items.Drives[f.ID] = drive
+	}
+
+	if err = rows.Err(); err != nil {
+		return items, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, sqlAllFolders)
+	if err != nil {
+		return items, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		f := ds.Folder{}
+		err := rows.Scan(&f.ID, &f.Name, &f.Parent, &f.Trashed)
+		if err != nil {
+			return items, err
+		}
+
+		items.Folders = append(items.Folders, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return items, err
+	}
+
+	rows, err = s.DB.QueryContext(ctx, sqlAllTimes)
+	if err != nil {
+		return items, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		t := ItemTime{}
+		var created, modified int64
+
+		err := rows.Scan(&t.ID, &created, &modified)
+		if err != nil {
+			return items, err
+		}
+
+		t.Created, t.Modified = time.Unix(created, 0), time.Unix(modified, 0)
+		items.Times = append(items.Times, t)
+	}
+
+	return items, rows.Err()
+}
+
+// MemoryStorage keeps all files and folders in memory.
+//
+// It is meant for tests and small deployments, in which case it is loaded from the Store after every sync.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	files   map[string]ds.File
+	folders map[string]ds.Folder
+	drives  map[string]string
+	times   map[string]ItemTime
+	media   map[string]parse.Media
+
+	// childFiles and childFolders index the items by their parent.
+	childFiles   map[string][]ds.File
+	childFolders map[string][]ds.Folder
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	m := &MemoryStorage{}
+	m.Replace(Items{})
+	return m
+}
+
+// Load replaces the contents with all files and folders of the Store.
+func (m *MemoryStorage) Load(ctx context.Context, store Store) error {
+	items, err := store.Items(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.Replace(items)
+	return nil
+}
+
+// Replace replaces the contents with the items. Their names are parsed right away.
+func (m *MemoryStorage) Replace(items Items) {
+	media := make(map[string]parse.Media, len(items.Files)+len(items.Folders))
+
+	byID := make(map[string]ds.File, len(items.Files))
+	childFiles := make(map[string][]ds.File)
+	for _, f := range items.Files {
+		byID[f.ID] = f
+		childFiles[f.Parent] = append(childFiles[f.Parent], f)
+		media[f.ID] = parse.Name(f.Name)
+	}
+
+	foldersByID := make(map[string]ds.Folder, len(items.Folders))
+	childFolders := make(map[string][]ds.Folder)
+	for _, f := range items.Folders {
+		// The mounts of a source share the ID of the library folder, which is kept instead.
+		if existing, ok := foldersByID[f.ID]; ok && (f.Parent == "" || existing.Parent != "") {
+			continue
+		}
+
+		foldersByID[f.ID] = f
+		childFolders[f.Parent] = append(childFolders[f.Parent], f)
+		media[f.ID] = parse.Name(f.Name)
+	}
+
+	for _, c := range childFiles {
+		sort.Slice(c, func(i, j int) bool { return c[i].Name < c[j].Name })
+	}
+
+	for _, c := range childFolders {
+		sort.Slice(c, func(i, j int) bool { return c[i].Name < c[j].Name })
+	}
+
+	times := make(map[string]ItemTime, len(items.Times))
+	for _, t := range items.Times {
+		times[t.ID] = t
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files, m.folders, m.drives, m.times, m.media = byID, foldersByID, items.Drives, times, media
+	m.childFiles, m.childFolders = childFiles, childFolders
+}
+
+func (m *MemoryStorage) GetFile(_ context.Context, id string) (ds.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[id]
+	if !ok || f.Trashed {
+		return ds.File{}, sql.ErrNoRows
+	}
+
+	return f, nil
+}
+
+func (m *MemoryStorage) FileByID(_ context.Context, id string) (ds.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[id]
+	if !ok {
+		return ds.File{}, sql.ErrNoRows
+	}
+
+	return f, nil
+}
+
+func (m *MemoryStorage) RecursiveFiles(_ context.Context, id string) (files []ds.File, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Like the Store, only the files within subfolders are included.
+	m.walk(id, -1, func(folder ds.Folder, _ int) {
+		for _, f := range m.childFiles[folder.ID] {
+			if !f.Trashed {
+				files = append(files, f)
+			}
+		}
+	})
+
+	return files, nil
+}
+
+// EachRecursiveFile passes the files of RecursiveFiles to fn, after the lock is released.
+func (m *MemoryStorage) EachRecursiveFile(ctx context.Context, id string, fn func(ds.File) bool) error {
+	files, _ := m.RecursiveFiles(ctx, id)
+	for _, f := range files {
+		if !fn(f) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) RecursiveFolders(_ context.Context, id string, depth int) (folders []ds.Folder, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	m.walk(id, depth, func(folder ds.Folder, level int) {
+		if level == depth {
+			folders = append(folders, folder)
+		}
+	})
+
+	return folders, nil
+}
+
+// EachRecursiveFolder passes the folders of RecursiveFolders to fn, after the lock is released.
+func (m *MemoryStorage) EachRecursiveFolder(ctx context.Context, id string, depth int, fn func(ds.Folder) bool) error {
+	folders, _ := m.RecursiveFolders(ctx, id, depth)
+	for _, f := range folders {
+		if !fn(f) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// walk calls fn for every folder which is not trashed below the folder, up to depth levels deep.
+// Trashed folders are not descended into. A negative depth has no limit.
+func (m *MemoryStorage) walk(id string, depth int, fn func(folder ds.Folder, level int)) {
+	var visit func(id string, level int)
+	visit = func(id string, level int) {
+		for _, folder := range m.childFolders[id] {
+			if folder.Trashed {
+				continue
+			}
+
+			fn(folder, level)
+			if depth < 0 || level < depth {
+				visit(folder.ID, level+1)
+			}
+		}
+	}
+
+	visit(id, 1)
+}
+
+func (m *MemoryStorage) Children(_ context.Context, id string) (files []ds.File, folders []ds.Folder, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, f := range m.childFiles[id] {
+		if !f.Trashed {
+			files = append(files, f)
+		}
+	}
+
+	for _, f := range m.childFolders[id] {
+		if !f.Trashed {
+			folders = append(folders, f)
+		}
+	}
+
+	return files, folders, nil
+}
+
+func (m *MemoryStorage) Parents(_ context.Context, id string) (folders []ds.Folder, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for id != "" {
+		f, ok := m.folders[id]
+		if !ok {
+			break
+		}
+
+		folders = append(folders, f)
+		id = f.Parent
+	}
+
+	return folders, nil
+}
+
+// Search matches the words of the query like the search index of the Store does.
+func (m *MemoryStorage) Search(_ context.Context, query string, limit, offset int) (files []ds.File, folders []ds.Folder, err error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, f := range m.files {
+		if !f.Trashed && matchWords(words, f.Name) {
+			files = append(files, f)
+		}
+	}
+
+	// Shared Drives themselves are not indexed.
+	for _, f := range m.folders {
+		if !f.Trashed && f.Parent != "" && matchWords(words, f.Name) {
+			folders = append(folders, f)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name || (files[i].Name == files[j].Name && files[i].ID < files[j].ID)
+	})
+
+	sort.Slice(folders, func(i, j int) bool {
+		return folders[i].Name < folders[j].Name || (folders[i].Name == folders[j].Name && folders[i].ID < folders[j].ID)
+	})
+
+	start, end := page(len(files), limit, offset)
+	files = files[start:end]
+
+	start, end = page(len(folders), limit, offset)
+	return files, folders[start:end], nil
+}
+
+// page returns the bounds of the page of limit items after offset items, or of all items after offset when limit is not positive.
+func page(n, limit, offset int) (start, end int) {
+	start, end = offset, n
+	if start > n {
+		start = n
+	}
+
+	if limit > 0 && start+limit < n {
+		end = start + limit
+	}
+
+	return start, end
+}
+
+func (m *MemoryStorage) FileDrive(_ context.Context, id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	drive, ok := m.drives[id]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+
+	return drive, nil
+}
+
+func (m *MemoryStorage) ItemTimes(_ context.Context, ids []string) (map[string]ItemTime, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	times := make(map[string]ItemTime, len(ids))
+	for _, id := range ids {
+		if t, ok := m.times[id]; ok {
+			times[id] = t
+		}
+	}
+
+	return times, nil
+}
+
+// RecentFiles passes the files of RecursiveFiles of which the times are known to fn, after the lock is released.
+func (m *MemoryStorage) RecentFiles(ctx context.Context, id string, order RecentOrder, fn func(ds.File) bool) error {
+	files, _ := m.RecursiveFiles(ctx, id)
+
+	m.mu.RLock()
+	recent := make([]ds.File, 0, len(files))
+	key := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		t, ok := m.times[f.ID]
+		if !ok {
+			continue
+		}
+
+		key[f.ID] = t.Created
+		if order == RecentlyModified {
+			key[f.ID] = t.Modified
+		}
+
+		recent = append(recent, f)
+	}
+	m.mu.RUnlock()
+
+	sort.SliceStable(recent, func(i, j int) bool { return key[recent[i].ID].After(key[recent[j].ID]) })
+	for _, f := range recent {
+		if !fn(f) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) Media(_ context.Context, id string) (parse.Media, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	media, ok := m.media[id]
+	if !ok {
+		return parse.Media{}, sql.ErrNoRows
+	}
+
+	return media, nil
+}
+
+func (m *MemoryStorage) RecursiveMedia(ctx context.Context, id string) ([]MediaFile, error) {
+	files, _ := m.RecursiveFiles(ctx, id)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	media := make([]MediaFile, 0, len(files))
+	for _, f := range files {
+		media = append(media, MediaFile{File: f, Media: m.media[f.ID]})
+	}
+
+	return media, nil
+}
+
+// DuplicateFiles prefers the oldest copy like the Store does, followed by copies of which the time is unknown.
+func (m *MemoryStorage) DuplicateFiles(ctx context.Context, id string) ([]ds.File, error) {
+	files, _ := m.RecursiveFiles(ctx, id)
+
+	copies := make(map[string]int)
+	for _, f := range files {
+		if f.MD5 != "" {
+			copies[f.MD5]++
+		}
+	}
+
+	var duplicates []ds.File
+	for _, f := range files {
+		if copies[f.MD5] > 1 {
+			duplicates = append(duplicates, f)
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		a, b := duplicates[i], duplicates[j]
+		if a.MD5 != b.MD5 {
+			return a.MD5 < b.MD5
+		}
+
+		ta, knownA := m.times[a.ID]
+		tb, knownB := m.times[b.ID]
+		switch {
+		case knownA != knownB:
+			return knownA
+		case knownA && !ta.Created.Equal(tb.Created):
+			return ta.Created.Before(tb.Created)
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		}
+
+		return a.ID < b.ID
+	})
+
+	return duplicates, nil
+}
+
+// searchWords splits text into lowercase words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchWords reports whether the name contains all words, the last word as a prefix.
+func matchWords(words []string, name string) bool {
+	tokens := searchWords(name)
+
+	for i, w := range words {
+		last := i == len(words)-1
+		found := false
+
+		for _, t := range tokens {
+			if t == w || last && strings.HasPrefix(t, w) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,7 +1,16 @@
 package stream
 
 import (
+	"context"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	lowe "github.com/m-rots/bernard"
+	"golang.org/x/time/rate"
 )
 
 type Config struct {
@@ -9,29 +18,233 @@ type Config struct {
 	FilmsID string
 	ShowsID string
 
+	// Extensions limits the exposed files to the given file extensions.
+	// All files are exposed when no extensions are given.
+	Extensions []string
+
+	// Users maps usernames to passwords for HTTP Basic authentication.
+	// Authentication is disabled when no users are given.
+	Users map[string]string
+
+	Limits Limits
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies,
+	// whose `X-Forwarded-For` header identifies the clients of share links.
+	TrustedProxies []string
+
+	Rename   Rename
+	Versions Versions
+	NFO      NFO
+	Dedupe   Dedupe
+	Audit    Audit
+
+	// Webhooks are called after every partial sync which changed their libraries.
+	Webhooks []Webhook
+
+	// Recent is the number of files listed in the Recently Added
+	// and Recently Modified folders, defaults to 50.
+	Recent int
+
+	// Continue is the number of files listed in the Continue Watching folder, defaults to 50.
+	Continue int
+
+	// DriveID is the Shared Drive synchronised with Bernard, if any.
+	DriveID string
+	// Sources provide files and folders next to the Shared Drive.
+	Sources []Source
+
 	Auth  lowe.Authenticator
 	Store Store
+	// Storage serves the files and folders of the libraries, defaults to the Store.
+	Storage Storage
+	// Events receives the events of Stream, defaults to a new Bus.
+	Events *Bus
+	// Account is the email address of the service account, shown on the dashboard.
+	Account string
+}
+
+// Limits configures the rate at which requests are made to Google Drive.
+type Limits struct {
+	// Rate is the number of requests per second, defaults to 10.
+	Rate float64
+	// Burst is the maximum number of requests at once, defaults to 1.
+	Burst int
 }
 
 type Stream struct {
+	fetch     fetch
+	store     Database
+	storage   Storage
+	snapshots *snapshots
+	events    *Bus
+	live      *liveSessions
+	account   string
+	driveID   string
+	sources   []Source
+
+	shareSecret *secretCache
+	deliveries  *webhookQueue
+
+	// refreshing serialises Refresh, as concurrent runs would rewrite the same tables.
+	refreshing *sync.Mutex
+
+	opts *atomic.Value
+}
+
+// options holds all settings of Stream which can be changed at runtime.
+type options struct {
 	depth   int
 	filmsID string
 	showsID string
 
-	fetch fetch
-	store Store
+	extensions map[string]bool
+	users      map[string]string
+	proxies    []*net.IPNet
+	recent     int
+	continues  int
+	rename     Rename
+	versions   Versions
+	nfo        NFO
+	dedupe     Dedupe
+	audit      Audit
+	webhooks   []Webhook
 }
 
 func NewStream(c Config) Stream {
+	if c.Storage == nil {
+		c.Storage = c.Store
+	}
+
+	if c.Events == nil {
+		c.Events = NewBus()
+	}
+
+	s := Stream{
+		store:       c.Store,
+		storage:     c.Storage,
+		snapshots:   new(snapshots),
+		events:      c.Events,
+		live:        newLiveSessions(),
+		account:     c.Account,
+		driveID:     c.DriveID,
+		sources:     c.Sources,
+		shareSecret: new(secretCache),
+		deliveries:  newWebhookQueue(),
+		refreshing:  new(sync.Mutex),
+		fetch:       NewFetch(c.Auth).withEvents(c.Events),
+		opts:        new(atomic.Value),
+	}
+
+	s.Reload(c)
+	return s
+}
+
+// Reload applies the libraries, filters, users and limits of the given Config.
+//
+// Active streams are not interrupted, the new settings only apply to new requests.
+func (h Stream) Reload(c Config) {
 	if c.Depth < 1 {
 		c.Depth = 1
 	}
 
-	return Stream{
-		depth:   c.Depth,
-		filmsID: c.FilmsID,
-		showsID: c.ShowsID,
-		store:   c.Store,
-		fetch:   NewFetch(c.Auth),
+	if c.Limits.Rate <= 0 {
+		c.Limits.Rate = 10
+	}
+
+	if c.Limits.Burst < 1 {
+		c.Limits.Burst = 1
+	}
+
+	if c.Recent < 1 {
+		c.Recent = 50
+	}
+
+	if c.Continue < 1 {
+		c.Continue = 50
 	}
+
+	if c.Audit.Retention <= 0 {
+		c.Audit.Retention = 90 * 24 * time.Hour
+	}
+
+	if c.NFO.Provider == nil {
+		c.NFO.Provider = h.store
+	}
+
+	o := options{
+		depth:     c.Depth,
+		filmsID:   c.FilmsID,
+		showsID:   c.ShowsID,
+		users:     make(map[string]string, len(c.Users)),
+		recent:    c.Recent,
+		continues: c.Continue,
+		rename:    c.Rename,
+		versions:  c.Versions,
+		nfo:       c.NFO,
+		dedupe:    c.Dedupe,
+		audit:     c.Audit,
+		webhooks:  c.Webhooks,
+	}
+
+	if len(c.Extensions) > 0 {
+		o.extensions = make(map[string]bool, len(c.Extensions))
+		for _, ext := range c.Extensions {
+			o.extensions[normaliseExtension(ext)] = true
+		}
+	}
+
+	for user, pass := range c.Users {
+		o.users[user] = pass
+	}
+
+	// Invalid proxies are reported by ParseProxies, but never trusted.
+	for _, proxy := range c.TrustedProxies {
+		if network, err := parseProxy(proxy); err == nil {
+			o.proxies = append(o.proxies, network)
+		}
+	}
+
+	h.opts.Store(o)
+	h.fetch.limiter.SetLimit(rate.Limit(c.Limits.Rate))
+	h.fetch.limiter.SetBurst(c.Limits.Burst)
+}
+
+// Refresh rebuilds the state derived from the Store and the current settings.
+// Refresh must be called after every sync and after Reload.
+// Concurrent calls run one after another, so the last call always sees the latest state.
+func (h Stream) Refresh(ctx context.Context) error {
+	h.refreshing.Lock()
+	defer h.refreshing.Unlock()
+
+	if err := h.rebuildDuplicates(ctx); err != nil {
+		return err
+	}
+
+	if err := h.rebuildAliases(ctx); err != nil {
+		return err
+	}
+
+	return h.rebuildSnapshots(ctx)
+}
+
+func (h Stream) options() options {
+	return h.opts.Load().(options)
+}
+
+// aliased reports whether the libraries are exposed through the aliases of rebuildAliases.
+func (o options) aliased() bool {
+	return o.rename.Enabled || o.versions.Group || o.versions.Best
+}
+
+// exposed reports whether the file name passes the configured extension filter.
+func (o options) exposed(name string) bool {
+	if o.extensions == nil {
+		return true
+	}
+
+	return o.extensions[normaliseExtension(path.Ext(name))]
+}
+
+func normaliseExtension(ext string) string {
+	return "." + strings.ToLower(strings.TrimPrefix(ext, "."))
 }
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// The last Reload is served once the libraries are refreshed, even when refreshes overlap.
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	s, src := newMemoryStream(t)
+	h := s.Handler()
+
+	config := Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Sources: []Source{src}}
+	if listing := body(t, serve(h, "PROPFIND", "/shows", map[string]string{"Depth": "1"})); !strings.Contains(listing, "Dark (2017)") {
+		t.Fatalf("PROPFIND /shows does not list the show:\n%s", listing)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Refresh(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	config.Depth = 2
+	s.Reload(config)
+	wg.Wait()
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	listing := body(t, serve(h, "PROPFIND", "/shows", map[string]string{"Depth": "1"}))
+	if !strings.Contains(listing, "Season 1") || strings.Contains(listing, "Dark (2017)") {
+		t.Errorf("PROPFIND /shows after reloading depth 2 does not list the seasons:\n%s", listing)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	s, src := newMemoryStream(t)
+	s.Reload(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Sources: []Source{src}, Extensions: []string{"MP4", ".avi"}})
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.Handler()
+	if listing := body(t, serve(h, "PROPFIND", "/films", map[string]string{"Depth": "1"})); strings.Contains(listing, ".mkv") {
+		t.Errorf("PROPFIND /films lists files outside the extensions:\n%s", listing)
+	}
+
+	if res := serve(h, "GET", filmHref(ds.File{ID: "f2", Name: "Heat (1995).mkv"}), nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a file outside the extensions: status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	for ext, want := range map[string]bool{"Film.mp4": true, "Film.AVI": true, "Film.mkv": false, "Film": false} {
+		if got := s.options().exposed(ext); got != want {
+			t.Errorf("exposed(%s) = %v, want %v", ext, got, want)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s, src := newMemoryStream(t)
+	s.Reload(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Sources: []Source{src}, Users: map[string]string{"kodi": "secret"}})
+	h := s.Handler()
+
+	for _, auth := range []string{"", "Basic a29kaTp3cm9uZw==", "Basic b3RoZXI6c2VjcmV0"} {
+		res := serve(h, "PROPFIND", "/films", map[string]string{"Authorization": auth})
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("PROPFIND /films with %q: status %d, want a challenge", auth, res.StatusCode)
+		}
+	}
+
+	if res := serve(h, "PROPFIND", "/films", map[string]string{"Authorization": "Basic a29kaTpzZWNyZXQ="}); res.StatusCode != http.StatusMultiStatus {
+		t.Errorf("PROPFIND /films with valid credentials: status %d", res.StatusCode)
+	}
+
+	// Users are removed by a reload.
+	s.Reload(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Sources: []Source{src}})
+	if res := serve(h, "PROPFIND", "/films", nil); res.StatusCode != http.StatusMultiStatus {
+		t.Errorf("PROPFIND /films without users: status %d", res.StatusCode)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s, _ := newMemoryStream(t)
+	if limit, burst := s.fetch.limiter.Limit(), s.fetch.limiter.Burst(); limit != 10 || burst != 1 {
+		t.Errorf("default limits %v and %d, want 10 and 1", limit, burst)
+	}
+
+	s.Reload(Config{Limits: Limits{Rate: 2.5, Burst: 4}})
+	if limit, burst := s.fetch.limiter.Limit(), s.fetch.limiter.Burst(); limit != 2.5 || burst != 4 {
+		t.Errorf("reloaded limits %v and %d, want 2.5 and 4", limit, burst)
+	}
+}
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Syncer synchronises Sources, such as Shared Drives, to the Store.
+type Syncer struct {
+	store  Store
+	after  []func(context.Context) error
+	notify []func(context.Context, string, []Change)
+	events *Bus
+}
+
+// A Change is a file or folder which was added, modified or removed by a partial sync.
+type Change struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Folder  bool   `json:"folder"`
+	Trashed bool   `json:"trashed"`
+	Removed bool   `json:"removed"`
+	// Added is set for files which were not in the Store before.
+	Added bool `json:"added"`
+	// Ancestors holds the IDs of all folders containing the item, nearest first,
+	// as they were before the item was removed.
+	Ancestors []string `json:"-"`
+
+	parent string
+}
+
+// NewSyncer creates a Syncer which calls the after functions after every successful sync,
+// such as Stream.Refresh.
+func NewSyncer(store Store, after ...func(context.Context) error) Syncer {
+	return Syncer{
+		store: store,
+		after: after,
+	}
+}
+
+// WithNotify returns a Syncer which passes the changes of every successful partial sync to fn,
+// after the after functions were called.
+func (s Syncer) WithNotify(fn func(ctx context.Context, driveID string, changes []Change)) Syncer {
+	s.notify = append(s.notify[:len(s.notify):len(s.notify)], fn)
+	return s
+}
+
+// WithEvents returns a Syncer which publishes the start and end of every sync on the Bus.
+func (s Syncer) WithEvents(events *Bus) Syncer {
+	s.events = events
+	return s
+}
+
+// SyncMode determines whether a full or a partial sync is performed.
+type SyncMode int
+
+const (
+	// SyncAuto performs a full sync when the drive has not been synchronised yet,
+	// otherwise a partial sync is performed.
+	SyncAuto SyncMode = iota
+	// SyncFull replaces the drive with a full sync.
+	SyncFull
+	// SyncPartial only performs a partial sync.
+	SyncPartial
+)
+
+// Sync synchronises the source to the Store.
+func (s Syncer) Sync(ctx context.Context, src Source, mode SyncMode) error {
+	full := mode == SyncFull
+	started := time.Now()
+	driveID := src.ID()
+
+	if mode == SyncAuto {
+		_, err := s.store.PageToken(driveID)
+		if err != nil && !errors.Is(err, ds.ErrFullSync) {
+			return err
+		}
+
+		full = errors.Is(err, ds.ErrFullSync)
+	}
+
+	s.events.Publish(EventSyncStarted, SyncEvent{Drive: driveID, Full: full})
+	err := s.sync(ctx, src, full)
+
+	finished := SyncEvent{Drive: driveID, Full: full, Duration: time.Since(started)}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+
+	s.events.Publish(EventSyncFinished, finished)
+	return err
+}
+
+// SyncAll synchronises the sources one after another, and stops at the first error.
+func (s Syncer) SyncAll(ctx context.Context, mode SyncMode, sources ...Source) error {
+	for _, src := range sources {
+		if err := s.Sync(ctx, src, mode); err != nil {
+			return fmt.Errorf("%s: %w", src.ID(), err)
+		}
+	}
+
+	return nil
+}
+
+// sync performs a full or partial sync, and notifies of the changes after a partial sync.
+func (s Syncer) sync(ctx context.Context, src Source, full bool) error {
+	driveID := src.ID()
+
+	// A full sync replaces the drive in the same transaction in which it saves the new files and folders.
+	changes, err := src.Sync(ctx, s.store, full)
+	if err != nil {
+		return err
+	}
+
+	// The source has committed its changes, which are not reported again by the next sync,
+	// so the tables derived from them are always updated, even when shutting down.
+	update := detached{ctx}
+
+	if full {
+		err = s.store.RebuildClosure(update)
+		if err == nil {
+			err = s.store.RebuildSearchIndex(update)
+		}
+	} else {
+		// Removed items may be folders too, so their descendants are determined again.
+		var moved, changed []string
+		for _, c := range changes {
+			changed = append(changed, c.ID)
+			if c.Folder || c.Removed {
+				moved = append(moved, c.ID)
+			}
+		}
+
+		err = s.store.UpdateClosure(update, moved)
+		if err == nil {
+			err = s.store.UpdateSearchIndex(update, changed)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = s.store.UpdateMedia(update); err != nil {
+		return err
+	}
+
+	if err = s.store.recordSync(driveID, time.Now(), full); err != nil {
+		return err
+	}
+
+	for _, fn := range s.after {
+		if err = fn(ctx); err != nil {
+			return err
+		}
+	}
+
+	if full || len(changes) == 0 {
+		return nil
+	}
+
+	for i, c := range changes {
+		if c.Removed {
+			continue
+		}
+
+		if changes[i].Ancestors, err = s.store.Ancestors(update, c.parent); err != nil {
+			return err
+		}
+	}
+
+	for _, fn := range s.notify {
+		fn(ctx, driveID, changes)
+	}
+
+	return nil
+}
+
+// Run performs a partial sync of the sources at every interval until the context is cancelled.
+//
+// Cancelling the context stops a source before it has committed its changes, after which
+// the sync is finished regardless. Run only returns once the running sync has finished.
+func (s Syncer) Run(ctx context.Context, interval time.Duration, sources ...Source) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, src := range sources {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err := s.Sync(ctx, src, SyncPartial); err != nil {
+				fmt.Printf("%s - sync error: %v\n", src.ID(), err)
+			}
+		}
+	}
+}
+
+// detached keeps the values of its context, but is never cancelled.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -2,6 +2,9 @@ package stream
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"path"
 	"strconv"
 	"strings"
@@ -109,3 +112,98 @@ func parseRange(header string, contentLength uint64) (uint64, uint64, error) {
 
 	return startPos, endPos, nil
 }
+
+// baseURL returns the scheme and host the client used to reach Stream,
+// respecting the `X-Forwarded-Proto` header of reverse proxies.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// clientAddress returns the address of the client which made the request.
+// Behind trusted proxies, the client is the last address of `X-Forwarded-For`
+// which is not a trusted proxy itself.
+func (o options) clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !o.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+
+		if !o.trusted(addr) {
+			return addr
+		}
+
+		host = addr
+	}
+
+	return host
+}
+
+// trusted reports whether the address belongs to a trusted proxy.
+func (o options) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range o.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseProxies parses the trusted proxies, which are IP addresses or CIDR ranges.
+func ParseProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		network, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseProxy parses an IP address as a range of a single address, or a CIDR range.
+func parseProxy(proxy string) (*net.IPNet, error) {
+	if ip := net.ParseIP(proxy); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("stream: %q is neither an IP address nor a CIDR range", proxy)
+	}
+
+	return network, nil
+}
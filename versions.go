@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"sort"
+	"strings"
+)
+
+// Versions configures how multiple copies of the same film are exposed.
+type Versions struct {
+	// Group places all copies of a film with the same title and year in a single folder,
+	// with the version added to the name such as `Some Film (2019) - 1080p.mkv`.
+	// Films are named with the film template of Rename when grouped.
+	Group bool
+	// Best only exposes the best copy of each film. Implies Group.
+	Best bool
+
+	// Resolutions lists the preferred resolutions, best first.
+	// Defaults to 2160p, 1080p, 720p, 576p and 480p.
+	Resolutions []string
+	// Codecs lists the preferred codecs, best first.
+	// Defaults to H.265, AV1 and H.264.
+	Codecs []string
+	// Smallest prefers the smallest copy instead of the largest when the resolution and codec are equal.
+	Smallest bool
+}
+
+var (
+	defaultResolutions = []string{"2160p", "1080p", "720p", "576p", "480p"}
+	defaultCodecs      = []string{"H.265", "AV1", "H.264"}
+)
+
+// rank returns the position of value in the preferences, or the number of preferences when absent.
+func rank(preferences []string, value string) int {
+	for i, p := range preferences {
+		if strings.EqualFold(p, value) {
+			return i
+		}
+	}
+
+	return len(preferences)
+}
+
+// best returns the preferred copy of a film.
+func (v Versions) best(copies []MediaFile) MediaFile {
+	resolutions, codecs := v.Resolutions, v.Codecs
+	if len(resolutions) == 0 {
+		resolutions = defaultResolutions
+	}
+
+	if len(codecs) == 0 {
+		codecs = defaultCodecs
+	}
+
+	sorted := append([]MediaFile(nil), copies...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+
+		if ra, rb := rank(resolutions, a.Media.Resolution), rank(resolutions, b.Media.Resolution); ra != rb {
+			return ra < rb
+		}
+
+		if ca, cb := rank(codecs, a.Media.Codec), rank(codecs, b.Media.Codec); ca != cb {
+			return ca < cb
+		}
+
+		if a.Size != b.Size {
+			return (a.Size < b.Size) == v.Smallest
+		}
+
+		// The ID makes the choice deterministic for identical copies.
+		return a.ID < b.ID
+	})
+
+	return sorted[0]
+}
+
+// filmKey identifies a film by its title and year.
+type filmKey struct {
+	title string
+	year  int
+}
+
+func newFilmKey(f MediaFile) filmKey {
+	return filmKey{title: titleKey(f.Media.Title), year: f.Media.Year}
+}
+
+// groupFilms groups the copies of each film, keeping the order in which the films first appear.
+func groupFilms(films []MediaFile) (groups [][]MediaFile) {
+	index := make(map[filmKey]int)
+
+	for _, f := range films {
+		key := newFilmKey(f)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+
+		groups[i] = append(groups[i], f)
+	}
+
+	return groups
+}
+
+// versionLabels returns the version suffix of each copy, such as `1080p`.
+// More details are added until the labels are unique or no details remain.
+func versionLabels(copies []MediaFile) []string {
+	details := []func(MediaFile) string{
+		func(f MediaFile) string { return f.Media.Edition },
+		func(f MediaFile) string { return f.Media.Resolution },
+		func(f MediaFile) string { return f.Media.Codec },
+		func(f MediaFile) string { return f.Media.Source },
+	}
+
+	labels := make([]string, len(copies))
+	for n := 2; n <= len(details); n++ {
+		seen := make(map[string]bool)
+		unique := true
+
+		for i, f := range copies {
+			var parts []string
+			for _, detail := range details[:n] {
+				if d := detail(f); d != "" {
+					parts = append(parts, d)
+				}
+			}
+
+			labels[i] = strings.Join(parts, " ")
+			if seen[labels[i]] {
+				unique = false
+			}
+
+			seen[labels[i]] = true
+		}
+
+		if unique {
+			break
+		}
+	}
+
+	for i := range labels {
+		if labels[i] == "" {
+			labels[i] = "Version"
+		}
+	}
+
+	return labels
+}
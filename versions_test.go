@@ -0,0 +1,125 @@
+package stream
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/m-rots/bernard/datastore"
+	"github.com/m-rots/stream/parse"
+)
+
+func copyOf(id, resolution, codec string, size int) MediaFile {
+	return MediaFile{
+		File:  ds.File{ID: id, Size: size},
+		Media: parse.Media{Title: "Heat", Year: 1995, Resolution: resolution, Codec: codec},
+	}
+}
+
+// The resolution is preferred over the codec, the codec over the size and the size over the ID.
+func TestBestVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions Versions
+		copies   []MediaFile
+		want     string
+	}{
+		{"resolution", Versions{}, []MediaFile{
+			copyOf("a", "720p", "H.265", 9), copyOf("b", "2160p", "H.264", 1), copyOf("c", "1080p", "H.265", 5),
+		}, "b"},
+		{"unknown resolutions last", Versions{}, []MediaFile{
+			copyOf("a", "", "H.265", 9), copyOf("b", "480p", "", 1),
+		}, "b"},
+		{"codec", Versions{}, []MediaFile{
+			copyOf("a", "1080p", "H.264", 9), copyOf("b", "1080p", "AV1", 1), copyOf("c", "1080p", "H.265", 1),
+		}, "c"},
+		{"largest", Versions{}, []MediaFile{
+			copyOf("a", "1080p", "H.265", 5), copyOf("b", "1080p", "H.265", 9), copyOf("c", "1080p", "H.265", 7),
+		}, "b"},
+		{"smallest", Versions{Smallest: true}, []MediaFile{
+			copyOf("a", "1080p", "H.265", 5), copyOf("b", "1080p", "H.265", 9), copyOf("c", "1080p", "H.265", 3),
+		}, "c"},
+		{"identical copies", Versions{}, []MediaFile{
+			copyOf("c", "1080p", "H.265", 5), copyOf("a", "1080p", "H.265", 5), copyOf("b", "1080p", "H.265", 5),
+		}, "a"},
+		{"custom resolutions", Versions{Resolutions: []string{"1080P", "2160p"}}, []MediaFile{
+			copyOf("a", "2160p", "H.265", 9), copyOf("b", "1080p", "H.264", 1),
+		}, "b"},
+		{"custom codecs", Versions{Codecs: []string{"h.264"}}, []MediaFile{
+			copyOf("a", "1080p", "H.265", 9), copyOf("b", "1080p", "H.264", 1),
+		}, "b"},
+	}
+
+	for _, tt := range tests {
+		// The order of the copies never changes the choice.
+		for i := range tt.copies {
+			rotated := append(append([]MediaFile(nil), tt.copies[i:]...), tt.copies[:i]...)
+			if got := tt.versions.best(rotated); got.ID != tt.want {
+				t.Errorf("%s: best of rotation %d = %s, want %s", tt.name, i, got.ID, tt.want)
+			}
+		}
+	}
+}
+
+func TestVersionLabels(t *testing.T) {
+	copies := []MediaFile{
+		{Media: parse.Media{Resolution: "1080p", Codec: "H.264", Source: "BluRay"}},
+		{Media: parse.Media{Resolution: "1080p", Codec: "H.265"}},
+		{Media: parse.Media{Resolution: "2160p", Codec: "H.265", Edition: "Extended"}},
+	}
+
+	want := []string{"1080p H.264", "1080p H.265", "Extended 2160p H.265"}
+	for i, label := range versionLabels(copies) {
+		if label != want[i] {
+			t.Errorf("label %d = %q, want %q", i, label, want[i])
+		}
+	}
+
+	if labels := versionLabels([]MediaFile{{}, {}}); labels[0] != "Version" || labels[1] != "Version" {
+		t.Errorf("labels without details = %q, want Version", labels)
+	}
+}
+
+func TestVersionsGroup(t *testing.T) {
+	ctx := context.Background()
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "a", Name: "A", Parent: "films"},
+	}, []ds.File{
+		{ID: "h1", Name: "Heat.1995.1080p.BluRay.x264.mkv", Parent: "a", Size: 8},
+		{ID: "h2", Name: "Heat.1995.2160p.WEB-DL.x265.mkv", Parent: "a", Size: 20},
+		{ID: "h3", Name: "Heat.1995.720p.HDTV.x264.mkv", Parent: "a", Size: 4},
+	})
+
+	s := NewStream(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Store: store, Versions: Versions{Group: true}})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"h1": "/films/Heat (1995)/Heat (1995) - 1080p.mkv",
+		"h2": "/films/Heat (1995)/Heat (1995) - 2160p.mkv",
+		"h3": "/films/Heat (1995)/Heat (1995) - 720p.mkv",
+	}
+
+	for id, p := range want {
+		if got, err := store.AliasPath(ctx, id); err != nil || got != p {
+			t.Errorf("grouped AliasPath(%s) = %q, %v, want %q", id, got, err, p)
+		}
+	}
+
+	// Only the best copy remains, without a version in its name.
+	s.Reload(Config{Depth: 1, FilmsID: "films", ShowsID: "shows", Versions: Versions{Best: true}})
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := store.AliasPath(ctx, "h2"); err != nil || got != "/films/Heat (1995)/Heat (1995).mkv" {
+		t.Errorf("best AliasPath(h2) = %q, %v", got, err)
+	}
+
+	for _, id := range []string{"h1", "h3"} {
+		if got, err := store.AliasPath(ctx, id); err == nil {
+			t.Errorf("AliasPath(%s) = %q, want only the best copy", id, got)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package stream
 
 import (
 	"encoding/xml"
+	"io"
 	"mime"
+	"net/http"
 	"path"
 
 	ds "github.com/m-rots/bernard/datastore"
@@ -65,8 +67,58 @@ func createDavFile(href string, f ds.File) Response {
 				ContentLength: uint64(f.Size),
 				ContentType:   mime.TypeByExtension(path.Ext(f.Name)),
 				DisplayName:   f.Name,
-				Etag:          f.MD5,
+				Etag:          fileETag(f),
 			},
 		},
 	}
 }
+
+var (
+	multistatusStart = xml.StartElement{
+		Name: xml.Name{Local: "D:multistatus"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:D"}, Value: "DAV:"}},
+	}
+
+	responseStart = xml.StartElement{Name: xml.Name{Local: "D:response"}}
+)
+
+// multistatus encodes the responses of a PROPFIND request one at a time,
+// so large listings are written while they are read.
+type multistatus struct {
+	enc *xml.Encoder
+	err error
+}
+
+func newMultistatus(w http.ResponseWriter) *multistatus {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	ms := &multistatus{enc: xml.NewEncoder(w)}
+	if _, ms.err = io.WriteString(w, xml.Header); ms.err == nil {
+		ms.err = ms.enc.EncodeToken(multistatusStart)
+	}
+
+	return ms
+}
+
+// write encodes the response, returning false once writing failed.
+func (ms *multistatus) write(res Response) bool {
+	if ms.err == nil {
+		ms.err = ms.enc.EncodeElement(res, responseStart)
+	}
+
+	return ms.err == nil
+}
+
+// close ends the multistatus and returns the first error encountered.
+func (ms *multistatus) close() error {
+	if ms.err == nil {
+		ms.err = ms.enc.EncodeToken(multistatusStart.End())
+	}
+
+	if ms.err == nil {
+		ms.err = ms.enc.Flush()
+	}
+
+	return ms.err
+}
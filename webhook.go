@@ -0,0 +1,471 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+// Webhook presets format the request for a media server instead of posting the changes.
+const (
+	PresetKodi = "kodi"
+	PresetPlex = "plex"
+)
+
+// A Webhook is called after every partial sync which changed its libraries.
+type Webhook struct {
+	URL string
+	// Libraries limits the webhook to changes within `films` or `shows`, all libraries when empty.
+	Libraries []string
+	// Secret signs the body with HMAC-SHA256 in the `X-Stream-Signature` header when set.
+	Secret string
+	// Preset is empty to post the changes as JSON, `kodi` to start a Kodi library scan
+	// or `plex` to start a partial scan of a Plex library section.
+	Preset string
+	// Path is where Kodi or Plex find the root of the WebDAV server, such as `dav://stream:3000` or `/mnt/stream`.
+	// The whole library is scanned when empty.
+	Path string
+	// Retries is the number of times a failed request is retried.
+	Retries int
+}
+
+// WebhookItem is a changed file or folder together with its WebDAV path, if it is exposed.
+type WebhookItem struct {
+	Change
+	Href string `json:"href,omitempty"`
+}
+
+// LibraryChanges holds the changed files and folders within a library.
+type LibraryChanges struct {
+	Library string        `json:"library"`
+	Files   []WebhookItem `json:"files"`
+	Folders []WebhookItem `json:"folders"`
+}
+
+// WebhookPayload is the body posted to webhooks without a preset.
+type WebhookPayload struct {
+	Event     string           `json:"event"`
+	Drive     string           `json:"drive"`
+	Time      time.Time        `json:"time"`
+	Libraries []LibraryChanges `json:"libraries"`
+}
+
+// includes reports whether the webhook is called for changes within the library.
+func (wh Webhook) includes(library string) bool {
+	if len(wh.Libraries) == 0 {
+		return true
+	}
+
+	for _, l := range wh.Libraries {
+		if l == library {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notify publishes the changes of a partial sync as file events and queues the webhooks, grouped by library.
+// Webhooks are delivered in the background, so Notify returns right away.
+func (h Stream) Notify(ctx context.Context, driveID string, changes []Change) {
+	o := h.options()
+	libraries, err := h.libraryChanges(ctx, o, changes)
+	if err != nil {
+		fmt.Printf("%s - could not determine the changed libraries: %v\n", driveID, err)
+		return
+	}
+
+	h.publishChanges(libraries)
+
+	for _, wh := range o.webhooks {
+		var selected []LibraryChanges
+		for _, lc := range libraries {
+			if wh.includes(lc.Library) {
+				selected = append(selected, lc)
+			}
+		}
+
+		if len(selected) == 0 {
+			continue
+		}
+
+		requests, err := wh.requests(driveID, selected)
+		if err != nil {
+			fmt.Printf("webhook %s - %v\n", redactURL(wh.URL), err)
+			continue
+		}
+
+		if !h.deliveries.enqueue(webhookDelivery{webhook: wh, requests: requests}) {
+			fmt.Printf("webhook %s - too many queued deliveries, skipping the changes of %s\n", redactURL(wh.URL), driveID)
+		}
+	}
+}
+
+// FlushWebhooks waits until the queued webhooks are delivered, and must only be called once the syncs have stopped.
+// Once ctx is done, the remaining deliveries are cancelled and no more webhooks are delivered.
+func (h Stream) FlushWebhooks(ctx context.Context) error {
+	return h.deliveries.flush(ctx)
+}
+
+const (
+	// webhookWorkers is the number of webhooks delivered at once.
+	webhookWorkers = 4
+	// webhookQueueSize limits the deliveries waiting for a worker, further deliveries are skipped.
+	webhookQueueSize = 64
+)
+
+type webhookDelivery struct {
+	webhook  Webhook
+	requests []webhookRequest
+}
+
+// webhookQueue delivers webhooks in the background, so syncs never wait for slow or unreachable servers.
+type webhookQueue struct {
+	deliveries chan webhookDelivery
+	pending    sync.WaitGroup
+	start      sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhookQueue() *webhookQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookQueue{
+		deliveries: make(chan webhookDelivery, webhookQueueSize),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// enqueue queues the delivery, returning false when the queue is full.
+// The workers are started on the first delivery.
+func (q *webhookQueue) enqueue(d webhookDelivery) bool {
+	q.start.Do(func() {
+		for i := 0; i < webhookWorkers; i++ {
+			go q.work()
+		}
+	})
+
+	q.pending.Add(1)
+	select {
+	case q.deliveries <- d:
+		return true
+	default:
+		q.pending.Done()
+		return false
+	}
+}
+
+func (q *webhookQueue) work() {
+	for d := range q.deliveries {
+		for _, req := range d.requests {
+			if err := d.webhook.deliver(q.ctx, req); err != nil {
+				fmt.Printf("webhook %s - %v\n", redactURL(d.webhook.URL), err)
+			}
+		}
+
+		q.pending.Done()
+	}
+}
+
+// flush waits for the queued deliveries, and cancels them once ctx is done.
+func (q *webhookQueue) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// libraryChanges groups the changes by the library they are in.
+// Files which are not exposed by the extension filter are left out.
+func (h Stream) libraryChanges(ctx context.Context, o options, changes []Change) ([]LibraryChanges, error) {
+	libraries := []LibraryChanges{
+		{Library: "films", Files: []WebhookItem{}, Folders: []WebhookItem{}},
+		{Library: "shows", Files: []WebhookItem{}, Folders: []WebhookItem{}},
+	}
+	ids := []string{o.filmsID, o.showsID}
+
+	for _, c := range changes {
+		if !c.Folder && c.Name != "" && !o.exposed(c.Name) {
+			continue
+		}
+
+		for i, id := range ids {
+			if !contains(c.Ancestors, id) {
+				continue
+			}
+
+			item, err := h.webhookItem(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+
+			if c.Folder {
+				libraries[i].Folders = append(libraries[i].Folders, item)
+			} else {
+				libraries[i].Files = append(libraries[i].Files, item)
+			}
+		}
+	}
+
+	var changed []LibraryChanges
+	for _, lc := range libraries {
+		if len(lc.Files) > 0 || len(lc.Folders) > 0 {
+			changed = append(changed, lc)
+		}
+	}
+
+	return changed, nil
+}
+
+// webhookItem adds the WebDAV path of the changed item, unless it was removed.
+func (h Stream) webhookItem(ctx context.Context, c Change) (WebhookItem, error) {
+	item := WebhookItem{Change: c}
+	if c.Removed || c.Trashed || len(c.Ancestors) == 0 {
+		return item, nil
+	}
+
+	parent := c.Ancestors[0]
+	parents, err := h.storage.Parents(ctx, parent)
+	if err != nil {
+		return item, err
+	}
+
+	if c.Folder {
+		item.Href, _ = h.FolderHref(ctx, ds.Folder{ID: c.ID, Name: c.Name, Parent: parent}, parents)
+		return item, nil
+	}
+
+	f, err := h.storage.GetFile(ctx, c.ID)
+	if err != nil {
+		return item, nil
+	}
+
+	item.Href, _ = h.Href(ctx, f, parents)
+	return item, nil
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+type webhookRequest struct {
+	method string
+	url    string
+	body   []byte
+}
+
+// requests formats the requests of the webhook for the changed libraries.
+func (wh Webhook) requests(driveID string, libraries []LibraryChanges) ([]webhookRequest, error) {
+	switch wh.Preset {
+	case PresetKodi:
+		return wh.kodiRequests(libraries)
+	case PresetPlex:
+		return wh.plexRequests(libraries)
+	}
+
+	body, err := json.Marshal(WebhookPayload{
+		Event:     "sync",
+		Drive:     driveID,
+		Time:      time.Now(),
+		Libraries: libraries,
+	})
+
+	return []webhookRequest{{method: "POST", url: wh.URL, body: body}}, err
+}
+
+type kodiRequest struct {
+	JSONRPC string     `json:"jsonrpc"`
+	Method  string     `json:"method"`
+	Params  kodiParams `json:"params"`
+	ID      string     `json:"id"`
+}
+
+type kodiParams struct {
+	Directory   string `json:"directory,omitempty"`
+	ShowDialogs bool   `json:"showdialogs"`
+}
+
+// kodiRequests scans the folders of the changed libraries, or the whole video library without a path.
+func (wh Webhook) kodiRequests(libraries []LibraryChanges) (requests []webhookRequest, err error) {
+	directories := []string{""}
+	if wh.Path != "" {
+		directories = nil
+		for _, lc := range libraries {
+			directories = append(directories, strings.TrimSuffix(wh.Path, "/")+"/"+lc.Library+"/")
+		}
+	}
+
+	for _, dir := range directories {
+		body, err := json.Marshal(kodiRequest{
+			JSONRPC: "2.0",
+			Method:  "VideoLibrary.Scan",
+			Params:  kodiParams{Directory: dir},
+			ID:      "stream",
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		requests = append(requests, webhookRequest{method: "POST", url: wh.URL, body: body})
+	}
+
+	return requests, nil
+}
+
+// plexRequests scans the folders of the changed files, or the whole library section without a path.
+// Libraries with removed or hidden items are scanned as a whole, as their folders are unknown.
+func (wh Webhook) plexRequests(libraries []LibraryChanges) (requests []webhookRequest, err error) {
+	if wh.Path == "" {
+		return []webhookRequest{{method: "GET", url: wh.URL}}, nil
+	}
+
+	root := strings.TrimSuffix(wh.Path, "/")
+	seen := make(map[string]bool)
+	var dirs []string
+
+	for _, lc := range libraries {
+		libraryDirs := []string{}
+
+		for _, item := range append(lc.Files, lc.Folders...) {
+			if item.Href == "" {
+				libraryDirs = []string{"/" + lc.Library}
+				break
+			}
+
+			p, err := url.PathUnescape(item.Href)
+			if err != nil {
+				return nil, err
+			}
+
+			if !item.Folder {
+				p = path.Dir(p)
+			}
+
+			libraryDirs = append(libraryDirs, p)
+		}
+
+		for _, dir := range libraryDirs {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		u, err := url.Parse(wh.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		query := u.Query()
+		query.Set("path", root+dir)
+		u.RawQuery = query.Encode()
+
+		requests = append(requests, webhookRequest{method: "GET", url: u.String()})
+	}
+
+	return requests, nil
+}
+
+var (
+	webhookClient = &http.Client{Timeout: 30 * time.Second}
+	// webhookBackoff is the delay before the first retry, which doubles with every retry.
+	webhookBackoff = time.Second
+)
+
+// deliver sends the request, retrying server errors and network errors with an exponential backoff.
+func (wh Webhook) deliver(ctx context.Context, req webhookRequest) error {
+	backoff := webhookBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := wh.send(ctx, req)
+		if err == nil || !retry || attempt >= wh.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// send performs the request once, and reports whether a failure is worth retrying.
+func (wh Webhook) send(ctx context.Context, req webhookRequest) (bool, error) {
+	r, err := http.NewRequestWithContext(ctx, req.method, req.url, bytes.NewReader(req.body))
+	if err != nil {
+		return false, err
+	}
+
+	r.Header.Set("User-Agent", "stream")
+	r.Header.Set("X-Stream-Event", "sync")
+	if req.body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(req.body)
+		r.Header.Set("X-Stream-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := webhookClient.Do(r)
+	if err != nil {
+		return true, err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors other than timeouts and rate limits will not succeed when retried.
+	retry := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %s", res.Status)
+}
+
+// redactURL leaves out the credentials and query of the URL, which may contain tokens.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+
+	return u.Scheme + "://" + u.Host + u.Path
+}
@@ -0,0 +1,312 @@
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/m-rots/bernard/datastore"
+)
+
+func webhookLibraries() []LibraryChanges {
+	return []LibraryChanges{
+		{Library: "films", Folders: []WebhookItem{}, Files: []WebhookItem{
+			{Change: Change{ID: "f1", Name: "Heat.mkv", Added: true}, Href: "/films/Heat%20%281995%29/Heat.mkv"},
+			{Change: Change{ID: "f2", Name: "Heat.srt"}, Href: "/films/Heat%20%281995%29/Heat.srt"},
+		}},
+		{Library: "shows", Folders: []WebhookItem{}, Files: []WebhookItem{
+			{Change: Change{ID: "e1", Name: "Dark.S01E01.mkv"}, Href: "/shows/Dark/Season%201/Dark.S01E01.mkv"},
+			{Change: Change{ID: "e2", Name: "Dark.S01E02.mkv", Removed: true}},
+		}},
+	}
+}
+
+func TestWebhookPayload(t *testing.T) {
+	requests, err := Webhook{URL: "https://example.com/hook"}.requests("drive", webhookLibraries())
+	if err != nil || len(requests) != 1 || requests[0].method != "POST" || requests[0].url != "https://example.com/hook" {
+		t.Fatalf("requests = %+v, %v", requests, err)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Event != "sync" || payload.Drive != "drive" || len(payload.Libraries) != 2 || payload.Time.IsZero() {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	films := payload.Libraries[0]
+	if films.Library != "films" || len(films.Files) != 2 || !films.Files[0].Added || films.Files[0].Href != "/films/Heat%20%281995%29/Heat.mkv" {
+		t.Errorf("films of the payload = %+v", films)
+	}
+
+	// The ancestors are internal to Stream.
+	if strings.Contains(string(requests[0].body), "ncestors") {
+		t.Errorf("payload contains the ancestors: %s", requests[0].body)
+	}
+}
+
+func TestWebhookPresets(t *testing.T) {
+	libraries := webhookLibraries()
+
+	kodi := func(wh Webhook) (directories []string) {
+		requests, err := wh.requests("drive", libraries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, req := range requests {
+			var body kodiRequest
+			if err := json.Unmarshal(req.body, &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if req.method != "POST" || body.Method != "VideoLibrary.Scan" || body.JSONRPC != "2.0" {
+				t.Errorf("Kodi request = %+v, %+v", req, body)
+			}
+
+			directories = append(directories, body.Params.Directory)
+		}
+
+		return directories
+	}
+
+	if got := kodi(Webhook{URL: "http://kodi:8080/jsonrpc", Preset: PresetKodi}); len(got) != 1 || got[0] != "" {
+		t.Errorf("Kodi directories without a path = %q, want a single scan of the whole library", got)
+	}
+
+	got := kodi(Webhook{URL: "http://kodi:8080/jsonrpc", Preset: PresetKodi, Path: "dav://stream:3000/"})
+	if strings.Join(got, " ") != "dav://stream:3000/films/ dav://stream:3000/shows/" {
+		t.Errorf("Kodi directories = %q", got)
+	}
+
+	plex := func(wh Webhook) (paths []string) {
+		requests, err := wh.requests("drive", libraries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, req := range requests {
+			u, err := url.Parse(req.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.method != "GET" || req.body != nil || u.Query().Get("X-Plex-Token") != "token" {
+				t.Errorf("Plex request = %+v", req)
+			}
+
+			paths = append(paths, u.Query().Get("path"))
+		}
+
+		return paths
+	}
+
+	plexURL := "http://plex:32400/library/sections/1/refresh?X-Plex-Token=token"
+	if got := plex(Webhook{URL: plexURL, Preset: PresetPlex}); len(got) != 1 || got[0] != "" {
+		t.Errorf("Plex paths without a path = %q, want a scan of the whole section", got)
+	}
+
+	// The folders of both films are scanned once, the TV shows as a whole as an episode was removed.
+	got = plex(Webhook{URL: plexURL, Preset: PresetPlex, Path: "/mnt/stream/"})
+	if strings.Join(got, "|") != "/mnt/stream/films/Heat (1995)|/mnt/stream/shows" {
+		t.Errorf("Plex paths = %q", got)
+	}
+}
+
+// Server errors, timeouts and rate limits are retried, other client errors are not.
+func TestWebhookDeliver(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("change-me"))
+		mac.Write(b)
+		if r.Header.Get("X-Stream-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request with signature %q and Content-Type %q", r.Header.Get("X-Stream-Signature"), r.Header.Get("Content-Type"))
+		}
+
+		mu.Lock()
+		attempts[r.URL.Path]++
+		attempt := attempts[r.URL.Path]
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/flaky":
+			if attempt == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/ok":
+		default:
+			status := map[string]int{"/500": 500, "/408": 408, "/429": 429, "/400": 400, "/404": 404}[r.URL.Path]
+			w.WriteHeader(status)
+		}
+	}))
+
+	defer srv.Close()
+
+	tests := []struct {
+		path     string
+		attempts int
+		failed   bool
+	}{
+		{"/ok", 1, false},
+		{"/flaky", 2, false},
+		{"/500", 3, true},
+		{"/408", 3, true},
+		{"/429", 3, true},
+		{"/400", 1, true},
+		{"/404", 1, true},
+	}
+
+	for _, tt := range tests {
+		wh := Webhook{URL: srv.URL + tt.path, Secret: "change-me", Retries: 2}
+		err := wh.deliver(context.Background(), webhookRequest{method: "POST", url: wh.URL, body: []byte(`{"event":"sync"}`)})
+
+		if (err != nil) != tt.failed || attempts[tt.path] != tt.attempts {
+			t.Errorf("%s: %d attempts, error %v, want %d attempts", tt.path, attempts[tt.path], err, tt.attempts)
+		}
+	}
+
+	// Unreachable servers are retried as well.
+	srv.Close()
+	if retry, err := (Webhook{}).send(context.Background(), webhookRequest{method: "GET", url: srv.URL}); err == nil || !retry {
+		t.Errorf("send to a closed server = %t, %v, want a retry", retry, err)
+	}
+}
+
+// Notify queues the webhooks of the changed libraries without waiting for them.
+func TestNotify(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies[r.URL.Path] = b
+		mu.Unlock()
+
+		<-release
+	}))
+
+	defer srv.Close()
+
+	store := newSyncedStore(t, []ds.Folder{
+		{ID: "films", Name: "Films", Parent: "drive"},
+		{ID: "shows", Name: "Shows", Parent: "drive"},
+		{ID: "heat", Name: "Heat (1995)", Parent: "films"},
+	}, []ds.File{
+		{ID: "f1", Name: "Heat (1995).mkv", Parent: "heat"},
+		{ID: "f2", Name: "Heat (1995).srt", Parent: "heat"},
+	})
+
+	s := NewStream(Config{
+		Depth:      1,
+		FilmsID:    "films",
+		ShowsID:    "shows",
+		Store:      store,
+		Extensions: []string{"mkv"},
+		Webhooks: []Webhook{
+			{URL: srv.URL + "/films", Libraries: []string{"films"}},
+			{URL: srv.URL + "/shows", Libraries: []string{"shows"}},
+			{URL: srv.URL + "/all"},
+		},
+	})
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan struct{})
+	go func() {
+		defer close(notified)
+		s.Notify(ctx, "drive", []Change{
+			{ID: "f1", Name: "Heat (1995).mkv", Added: true, Ancestors: []string{"heat", "films", "drive"}},
+			{ID: "f2", Name: "Heat (1995).srt", Added: true, Ancestors: []string{"heat", "films", "drive"}},
+		})
+	}()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify waited for the webhooks")
+	}
+
+	close(release)
+	if err := s.FlushWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if bodies["/shows"] != nil || bodies["/films"] == nil || bodies["/all"] == nil {
+		t.Fatalf("webhooks called: %v, want /films and /all", bodies)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(bodies["/films"], &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Libraries) != 1 || len(payload.Libraries[0].Files) != 1 || payload.Libraries[0].Files[0].Href == "" {
+		t.Errorf("payload = %+v, want the film without its subtitles", payload)
+	}
+}
+
+// The queue holds a limited number of deliveries, and cancels them once flushing times out.
+func TestWebhookQueue(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	defer srv.Close()
+	defer close(release)
+
+	q := newWebhookQueue()
+	d := webhookDelivery{
+		webhook:  Webhook{URL: srv.URL, Retries: 5},
+		requests: []webhookRequest{{method: "GET", url: srv.URL}},
+	}
+
+	queued := 0
+	for q.enqueue(d) {
+		queued++
+		if queued > webhookQueueSize+webhookWorkers {
+			t.Fatal("the queue is unbounded")
+		}
+	}
+
+	if queued < webhookQueueSize {
+		t.Errorf("queued %d deliveries, want at least %d", queued, webhookQueueSize)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := q.flush(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("flush = %v, want the deadline to pass", err)
+	}
+}